@@ -0,0 +1,42 @@
+use std::process::Command;
+use std::{env, fs};
+
+// the build script passes the build info returned by the `version` rpc
+fn main() {
+    // TODA_GIT_SHA can be set when the repository isn't there, as in the
+    // docker build, and it's read by `option_env!` as it is
+    println!("cargo:rerun-if-env-changed=TODA_GIT_SHA");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs/heads");
+    if env::var("TODA_GIT_SHA").is_err() {
+        if let Some(sha) = git_sha() {
+            println!("cargo:rustc-env=TODA_GIT_SHA={}", sha);
+        }
+    }
+
+    println!("cargo:rerun-if-changed=Cargo.lock");
+    let fuser = fuser_version().unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=TODA_FUSER_VERSION={}", fuser);
+}
+
+fn git_sha() -> Option<String> {
+    let output = Command::new("git")
+        .args(&["rev-parse", "HEAD"])
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let sha = String::from_utf8(output.stdout).ok()?;
+    Some(sha.trim().to_string())
+}
+
+// fuser_version reads the version of fuser resolved in Cargo.lock, which
+// cargo writes before running the build script
+fn fuser_version() -> Option<String> {
+    let lock = fs::read_to_string("Cargo.lock").ok()?;
+    let mut lines = lock.lines();
+    lines.find(|line| *line == "name = \"fuser\"")?;
+    let version = lines.next()?.strip_prefix("version = \"")?;
+    Some(version.trim_end_matches('"').to_string())
+}
@@ -0,0 +1,401 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client drives the JSON-RPC API of toda, which is served on the
+// stdin and stdout of the toda process, one request or response per line.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// statusWithStats is the `inst` of get_status which returns the Status
+// rather than only the status string
+const statusWithStats = "stats"
+
+// ErrClosed is returned by the calls after the responses of toda end, as
+// toda has exited or its stdout has been closed
+var ErrClosed = errors.New("toda: connection closed")
+
+// Error is the error of the JSON-RPC call returned by toda, like the one of
+// an invalid config
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("toda: %s (code %d)", e.Message, e.Code)
+}
+
+// StatusError is returned by the calls which toda answers with a status
+// other than "ok", like when the injection failed to start
+type StatusError struct {
+	Method string
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("toda: %s: %s", e.Method, e.Status)
+}
+
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      uint64        `json:"id"`
+}
+
+type response struct {
+	ID     *uint64         `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Client calls the methods of toda. It's safe to use from multiple
+// goroutines, and the calls may be in flight at the same time.
+type Client struct {
+	writeLock sync.Mutex
+	w         io.Writer
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan response
+	// err is set once the responses end, and fails all the later calls
+	err error
+}
+
+// New returns the client writing the requests to `w` and reading the
+// responses from `r`, which are the stdin and stdout of toda
+func New(r io.Reader, w io.Writer) *Client {
+	c := &Client{
+		w:       w,
+		pending: make(map[uint64]chan response),
+	}
+	go c.read(r)
+	return c
+}
+
+// Start starts `cmd`, which runs toda, and returns the client connected to
+// its stdin and stdout. The stdin is closed by Close, and the process is left
+// to the caller to wait for.
+func Start(cmd *exec.Cmd) (*Client, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return New(stdout, stdin), nil
+}
+
+// Close closes the writer of the requests if it's an io.Closer. The calls in
+// flight fail once the responses end.
+func (c *Client) Close() error {
+	if closer, ok := c.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *Client) read(r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var resp response
+			// the lines which are not responses are ignored, as the ids of
+			// the calls waiting for them are unknown
+			if json.Unmarshal(line, &resp) == nil && resp.ID != nil {
+				c.dispatch(*resp.ID, resp)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			c.close(err)
+			return
+		}
+	}
+}
+
+func (c *Client) dispatch(id uint64, resp response) {
+	c.lock.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+
+	// the call may have been cancelled by its context
+	if ok {
+		ch <- resp
+	}
+}
+
+func (c *Client) close(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// call sends the request of `method` and decodes the result into `result`,
+// unless it's nil. It returns when the response arrives or `ctx` is done,
+// but a write blocked by toda not reading its stdin can't be interrupted.
+func (c *Client) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return err
+	}
+	c.nextID++
+	id := c.nextID
+	// the channel is buffered so that the reader never waits for a call
+	// which has given up
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	data, err := json.Marshal(request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      id,
+	})
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+	data = append(data, '\n')
+
+	c.writeLock.Lock()
+	_, err = c.w.Write(data)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			return c.err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	}
+}
+
+func (c *Client) forget(id uint64) {
+	c.lock.Lock()
+	delete(c.pending, id)
+	c.lock.Unlock()
+}
+
+// callOk calls the methods which return "ok", or the error as the result
+func (c *Client) callOk(ctx context.Context, method string, params ...interface{}) error {
+	var status string
+	if err := c.call(ctx, method, &status, params...); err != nil {
+		return err
+	}
+	if status != "ok" {
+		return &StatusError{Method: method, Status: status}
+	}
+	return nil
+}
+
+// mountParam is the optional `mount` of the methods, which is all the mounts
+// if it's empty
+func mountParam(mount string) interface{} {
+	if mount == "" {
+		return nil
+	}
+	return mount
+}
+
+// Ping returns the status of the injection, which is nil if it's started.
+// toda exits after it returns the error.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.callOk(ctx, "get_status", "")
+}
+
+// GetStatus returns the status with the stats of all the mounts
+func (c *Client) GetStatus(ctx context.Context) (*Status, error) {
+	return c.GetMountStatus(ctx, "")
+}
+
+// GetMountStatus returns the status with the stats of the mount, or all the
+// mounts if it's empty
+func (c *Client) GetMountStatus(ctx context.Context, mount string) (*Status, error) {
+	var status Status
+	if err := c.call(ctx, "get_status", &status, statusWithStats, mountParam(mount)); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// UpdateOptions are the optional params of UpdateWith
+type UpdateOptions struct {
+	// Mount is the mount point to update, or all of them if it's empty
+	Mount string
+	// Generation is the generation of the config, which is bumped by toda if
+	// it's nil
+	Generation *uint64
+}
+
+// Update replaces the injectors of all the mounts with `config`
+func (c *Client) Update(ctx context.Context, config []InjectorConfig) error {
+	return c.UpdateWith(ctx, config, UpdateOptions{})
+}
+
+// UpdateWith replaces the injectors with `config` as `opts` tells
+func (c *Client) UpdateWith(ctx context.Context, config []InjectorConfig, opts UpdateOptions) error {
+	if config == nil {
+		config = []InjectorConfig{}
+	}
+	var generation interface{}
+	if opts.Generation != nil {
+		generation = *opts.Generation
+	}
+	return c.callOk(ctx, "update", config, mountParam(opts.Mount), generation)
+}
+
+// UpdateInjector replaces the injector of the same name, or adds it if there
+// isn't, and leaves the others as they are
+func (c *Client) UpdateInjector(ctx context.Context, config InjectorConfig, mount string) error {
+	return c.callOk(ctx, "update_injector", config, mountParam(mount))
+}
+
+// RemoveInjector removes the injector of the name
+func (c *Client) RemoveInjector(ctx context.Context, name, mount string) error {
+	return c.callOk(ctx, "remove_injector", name, mountParam(mount))
+}
+
+// EnableInjector switches on the injector of the name
+func (c *Client) EnableInjector(ctx context.Context, name, mount string) error {
+	return c.callOk(ctx, "enable_injector", name, mountParam(mount))
+}
+
+// DisableInjector switches off the injector of the name, which keeps its
+// counters until it's enabled again
+func (c *Client) DisableInjector(ctx context.Context, name, mount string) error {
+	return c.callOk(ctx, "disable_injector", name, mountParam(mount))
+}
+
+// SetReadonly makes the changes of the mount fail with EROFS, or lets them
+// through again
+func (c *Client) SetReadonly(ctx context.Context, readonly bool, mount string) error {
+	return c.callOk(ctx, "set_readonly", readonly, mountParam(mount))
+}
+
+// Pause stops all the injection until Resume
+func (c *Client) Pause(ctx context.Context) error {
+	return c.callOk(ctx, "pause")
+}
+
+// Resume starts the injection stopped by Pause again
+func (c *Client) Resume(ctx context.Context) error {
+	return c.callOk(ctx, "resume")
+}
+
+// ListInjectors returns the status of the injectors of all the mounts
+func (c *Client) ListInjectors(ctx context.Context) ([]InjectorStatus, error) {
+	var injectors []InjectorStatus
+	if err := c.call(ctx, "list_injectors", &injectors); err != nil {
+		return nil, err
+	}
+	return injectors, nil
+}
+
+// ResetQuota clears the bytes counted by the quota injectors
+func (c *Client) ResetQuota(ctx context.Context) error {
+	return c.callOk(ctx, "reset_quota")
+}
+
+// ResetStats clears the counters of the mount, and returns the status before
+func (c *Client) ResetStats(ctx context.Context, mount string) (*Status, error) {
+	var status Status
+	if err := c.call(ctx, "reset_stats", &status, mountParam(mount)); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SimulateCrash loses the writes since the last fsync which are kept by the
+// volatileWrites injectors of the mount
+func (c *Client) SimulateCrash(ctx context.Context, mount string) error {
+	return c.callOk(ctx, "simulate_crash", mountParam(mount))
+}
+
+// DebugInfo returns the mounts and the processes toda has hijacked
+func (c *Client) DebugInfo(ctx context.Context) (*DebugInfo, error) {
+	var info DebugInfo
+	if err := c.call(ctx, "debug_info", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Version returns the build of toda and the FUSE protocol of every mount
+func (c *Client) Version(ctx context.Context) (*VersionInfo, error) {
+	var info VersionInfo
+	if err := c.call(ctx, "version", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Validate checks `config` as Update does without applying it, and returns
+// the errors, which are empty if the config can be applied
+func (c *Client) Validate(ctx context.Context, config []InjectorConfig, mount string) ([]string, error) {
+	if config == nil {
+		config = []InjectorConfig{}
+	}
+	var errs []string
+	if err := c.call(ctx, "validate", &errs, config, mountParam(mount)); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type fakeRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     uint64            `json:"id"`
+}
+
+// fakeToda serves the requests with `handle`, which returns the result, or
+// nothing to leave the request unanswered
+func fakeToda(t *testing.T, handle func(req fakeRequest) interface{}) *Client {
+	requests, requestWriter := io.Pipe()
+	responseReader, responses := io.Pipe()
+
+	go func() {
+		defer responses.Close()
+		scanner := bufio.NewScanner(requests)
+		for scanner.Scan() {
+			var req fakeRequest
+			if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+				t.Errorf("invalid request %s: %v", scanner.Text(), err)
+				return
+			}
+			result := handle(req)
+			if result == nil {
+				continue
+			}
+			var resp []byte
+			if rpcErr, ok := result.(*Error); ok {
+				resp, _ = json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "error": rpcErr, "id": req.ID})
+			} else {
+				resp, _ = json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "result": result, "id": req.ID})
+			}
+			if _, err := responses.Write(append(resp, '\n')); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := New(responseReader, requestWriter)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestUpdateParams(t *testing.T) {
+	var got fakeRequest
+	c := fakeToda(t, func(req fakeRequest) interface{} {
+		got = req
+		return "ok"
+	})
+
+	generation := uint64(3)
+	config := []InjectorConfig{{&Latency{
+		Filter:  Filter{Name: "slow", Methods: []string{"read"}, Percent: 100},
+		Latency: Duration(1500 * time.Millisecond),
+	}}}
+	err := c.UpdateWith(context.Background(), config, UpdateOptions{Mount: "/mnt", Generation: &generation})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Method != "update" || len(got.Params) != 3 {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	var injectors []map[string]interface{}
+	if err := json.Unmarshal(got.Params[0], &injectors); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"type":    "latency",
+		"name":    "slow",
+		"methods": []interface{}{"read"},
+		"percent": float64(100),
+		"latency": "1500ms",
+	}
+	if len(injectors) != 1 || len(injectors[0]) != len(want) {
+		t.Fatalf("unexpected config %s", got.Params[0])
+	}
+	for key, value := range want {
+		if encoded, _ := json.Marshal(injectors[0][key]); string(encoded) != mustMarshal(t, value) {
+			t.Errorf("%s: got %s, want %v", key, encoded, value)
+		}
+	}
+	if string(got.Params[1]) != `"/mnt"` || string(got.Params[2]) != "3" {
+		t.Errorf("unexpected params %s %s", got.Params[1], got.Params[2])
+	}
+
+	// the optional params are null when they are not set
+	if err := c.Update(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Params[0]) != "[]" || string(got.Params[1]) != "null" || string(got.Params[2]) != "null" {
+		t.Errorf("unexpected params %s", got.Params)
+	}
+}
+
+func mustMarshal(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStatusError(t *testing.T) {
+	c := fakeToda(t, func(req fakeRequest) interface{} {
+		switch req.Method {
+		case "remove_injector":
+			return "no injector named slow"
+		case "get_status":
+			return "failed to mount"
+		}
+		return &Error{Code: -32601, Message: "Method not found"}
+	})
+
+	var statusErr *StatusError
+	err := c.RemoveInjector(context.Background(), "slow", "")
+	if !errors.As(err, &statusErr) || statusErr.Status != "no injector named slow" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := c.Ping(context.Background()); !errors.As(err, &statusErr) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	var rpcErr *Error
+	if err := c.Pause(context.Background()); !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	c := fakeToda(t, func(req fakeRequest) interface{} {
+		if string(req.Params[0]) != `"stats"` {
+			t.Errorf("unexpected inst %s", req.Params[0])
+		}
+		return json.RawMessage(`{
+			"status": "ok",
+			"generation": 2,
+			"mounts": [{
+				"path": "/mnt",
+				"operations": 10,
+				"injected": 4,
+				"lastInjection": "2020-06-01T12:00:00.5Z",
+				"injectors": [
+					{"type": "fault", "name": "eio", "percent": 50, "faults": [{"errno": 5, "weight": 1}],
+					 "enabled": true, "matched": 4, "burst": {"active": true, "bursts": 1}},
+					{"type": "futureInjector", "percent": 1, "enabled": false, "matched": 0}
+				],
+				"readonly": false,
+				"breaker": {"threshold": 5, "cooldown": "10s", "open": false, "consecutiveErrors": 0, "trips": 0}
+			}]
+		}`)
+	})
+
+	status, err := c.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Generation != 2 || len(status.Mounts) != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	mount := status.Mounts[0]
+	if mount.LastInjection == nil || mount.LastInjection.Nanosecond() != 500000000 {
+		t.Errorf("unexpected last injection %v", mount.LastInjection)
+	}
+	if mount.Breaker == nil || time.Duration(mount.Breaker.Cooldown) != 10*time.Second {
+		t.Errorf("unexpected breaker %+v", mount.Breaker)
+	}
+	if len(mount.Injectors) != 2 {
+		t.Fatalf("unexpected injectors %+v", mount.Injectors)
+	}
+
+	fault, ok := mount.Injectors[0].Config.Injector.(*Fault)
+	if !ok || fault.Name != "eio" || len(fault.Faults) != 1 || fault.Faults[0].Errno != 5 {
+		t.Fatalf("unexpected fault %+v", mount.Injectors[0].Config.Injector)
+	}
+	if !mount.Injectors[0].Enabled || mount.Injectors[0].Matched != 4 {
+		t.Errorf("unexpected counters %+v", mount.Injectors[0])
+	}
+
+	// the types unknown by the client are kept as they are
+	raw, ok := mount.Injectors[1].Config.Injector.(*Raw)
+	if !ok || raw.Type() != "futureInjector" {
+		t.Fatalf("unexpected injector %+v", mount.Injectors[1].Config.Injector)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	c := fakeToda(t, func(req fakeRequest) interface{} {
+		if req.Method == "pause" {
+			return nil
+		}
+		return "ok"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Pause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// the client is still usable after a call gives up
+	if err := c.Resume(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	requests, requestWriter := io.Pipe()
+	responseReader, responses := io.Pipe()
+	c := New(responseReader, requestWriter)
+	go func() {
+		// toda exits after reading the request
+		bufio.NewReader(requests).ReadBytes('\n')
+		responses.Close()
+	}()
+
+	if err := c.Pause(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := c.Resume(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
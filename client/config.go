@@ -0,0 +1,608 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Injector is the config of one type of the injectors, like *Latency or
+// *Fault
+type Injector interface {
+	// Type is the "type" of the config, like "latency"
+	Type() string
+}
+
+// InjectorConfig is the config of an injector, which is tagged by its type in
+// JSON
+type InjectorConfig struct {
+	Injector
+}
+
+// injectors returns the empty configs of the types known by the client
+var injectors = map[string]func() Injector{
+	"latency":        func() Injector { return &Latency{} },
+	"fault":          func() Injector { return &Fault{} },
+	"attrOverride":   func() Injector { return &AttrOverride{} },
+	"mistake":        func() Injector { return &Mistake{} },
+	"throttle":       func() Injector { return &Throttle{} },
+	"shortIo":        func() Injector { return &ShortIo{} },
+	"quota":          func() Injector { return &Quota{} },
+	"delayFault":     func() Injector { return &DelayFault{} },
+	"timeout":        func() Injector { return &Timeout{} },
+	"staleRead":      func() Injector { return &StaleRead{} },
+	"statfsOverride": func() Injector { return &StatfsOverride{} },
+	"phases":         func() Injector { return &Phases{} },
+	"shuffleDir":     func() Injector { return &ShuffleDir{} },
+	"hideEntries":    func() Injector { return &HideEntries{} },
+	"volatileWrites": func() Injector { return &VolatileWrites{} },
+	"sequence":       func() Injector { return &Sequence{} },
+	"readlink":       func() Injector { return &Readlink{} },
+}
+
+// MarshalJSON encodes the injector with its "type"
+func (c InjectorConfig) MarshalJSON() ([]byte, error) {
+	if c.Injector == nil {
+		return nil, fmt.Errorf("toda: injector config without injector")
+	}
+	if raw, ok := c.Injector.(*Raw); ok {
+		return raw.MarshalJSON()
+	}
+
+	data, err := json.Marshal(c.Injector)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["type"], err = json.Marshal(c.Injector.Type())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON decodes the injector by its "type". The types unknown by the
+// client are kept as *Raw, so that they are sent back as they are.
+func (c *InjectorConfig) UnmarshalJSON(data []byte) error {
+	var tagged struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &tagged); err != nil {
+		return err
+	}
+
+	newInjector, ok := injectors[tagged.Type]
+	if !ok {
+		c.Injector = &Raw{TypeName: tagged.Type, Data: append(json.RawMessage(nil), data...)}
+		return nil
+	}
+	injector := newInjector()
+	if err := json.Unmarshal(data, injector); err != nil {
+		return fmt.Errorf("toda: %s injector: %w", tagged.Type, err)
+	}
+	c.Injector = injector
+	return nil
+}
+
+// Raw is the config of an injector of the type unknown by the client, with
+// "type" in its data
+type Raw struct {
+	TypeName string
+	Data     json.RawMessage
+}
+
+func (r *Raw) Type() string { return r.TypeName }
+
+func (r *Raw) MarshalJSON() ([]byte, error) { return r.Data, nil }
+
+// Filter decides the operations matched by an injector. It's embedded in the
+// configs of the injectors, and its fields are flattened into them in JSON.
+type Filter struct {
+	// Name identifies the injector in UpdateInjector, RemoveInjector and the
+	// status
+	Name string `json:"name,omitempty"`
+	// Enabled is true if it's nil
+	Enabled *bool `json:"enabled,omitempty"`
+
+	Path    string   `json:"path,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	Percent int32    `json:"percent"`
+
+	PathPattern string `json:"pathPattern,omitempty"`
+	PathRegex   string `json:"pathRegex,omitempty"`
+
+	DelayStart  *Duration `json:"delayStart,omitempty"`
+	StartOffset *Duration `json:"startOffset,omitempty"`
+	Duration    *Duration `json:"duration,omitempty"`
+	Period      *Duration `json:"period,omitempty"`
+
+	UID   *IDFilter `json:"uid,omitempty"`
+	GID   *IDFilter `json:"gid,omitempty"`
+	Comm  []string  `json:"comm,omitempty"`
+	MntNs []string  `json:"mntNs,omitempty"`
+
+	OpenFlags *OpenFlags `json:"openFlags,omitempty"`
+	// OpenMode is one of "read", "write" and "readwrite"
+	OpenMode string `json:"openMode,omitempty"`
+
+	MinSize   *uint64   `json:"minSize,omitempty"`
+	MaxSize   *uint64   `json:"maxSize,omitempty"`
+	MinAge    *Duration `json:"minAge,omitempty"`
+	MaxAge    *Duration `json:"maxAge,omitempty"`
+	OffsetMin *uint64   `json:"offsetMin,omitempty"`
+	OffsetMax *uint64   `json:"offsetMax,omitempty"`
+
+	Mmap *bool `json:"mmap,omitempty"`
+
+	MinDepth    *uint64 `json:"minDepth,omitempty"`
+	MaxDepth    *uint64 `json:"maxDepth,omitempty"`
+	OnlyRoot    bool    `json:"onlyRoot,omitempty"`
+	ExcludeRoot bool    `json:"excludeRoot,omitempty"`
+
+	IoctlCommands []uint32 `json:"ioctlCommands,omitempty"`
+	Ino           []uint64 `json:"ino,omitempty"`
+	InoPaths      []string `json:"inoPaths,omitempty"`
+	IsSymlink     *bool    `json:"isSymlink,omitempty"`
+	// ModeMask and ModeValue match the files whose permission bits masked by
+	// ModeMask are ModeValue, like 04000 for both to match the setuid files
+	ModeMask  *Mode `json:"modeMask,omitempty"`
+	ModeValue *Mode `json:"modeValue,omitempty"`
+
+	DryRun            bool     `json:"dryRun,omitempty"`
+	RatePerSec        *float64 `json:"ratePerSec,omitempty"`
+	Deterministic     bool     `json:"deterministic,omitempty"`
+	FirstOnly         bool     `json:"firstOnly,omitempty"`
+	FirstOnlyCapacity *uint64  `json:"firstOnlyCapacity,omitempty"`
+	// Retries is "always" or "never"
+	Retries       string  `json:"retries,omitempty"`
+	MaxInjections *uint64 `json:"maxInjections,omitempty"`
+
+	// Expr has to match in addition to the fields above
+	Expr *FilterExpr `json:"expr,omitempty"`
+}
+
+// FilterExpr is one of And, Or, Not and a sub-filter, which matches when all
+// the conditions present in it match. A sub-filter can't have the fields
+// deciding whether and how often to inject, like Percent or Duration, and its
+// Percent is encoded as 100.
+type FilterExpr struct {
+	And    []FilterExpr
+	Or     []FilterExpr
+	Not    *FilterExpr
+	Filter *Filter
+}
+
+func (e FilterExpr) MarshalJSON() ([]byte, error) {
+	switch {
+	case e.And != nil:
+		return json.Marshal(struct {
+			And []FilterExpr `json:"and"`
+		}{e.And})
+	case e.Or != nil:
+		return json.Marshal(struct {
+			Or []FilterExpr `json:"or"`
+		}{e.Or})
+	case e.Not != nil:
+		return json.Marshal(struct {
+			Not *FilterExpr `json:"not"`
+		}{e.Not})
+	case e.Filter != nil:
+		filter := *e.Filter
+		filter.Percent = 100
+		return json.Marshal(filter)
+	}
+	return nil, fmt.Errorf("toda: empty filter expression")
+}
+
+func (e *FilterExpr) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	*e = FilterExpr{}
+	if and, ok := fields["and"]; ok {
+		e.And = []FilterExpr{}
+		return json.Unmarshal(and, &e.And)
+	}
+	if or, ok := fields["or"]; ok {
+		e.Or = []FilterExpr{}
+		return json.Unmarshal(or, &e.Or)
+	}
+	if not, ok := fields["not"]; ok {
+		e.Not = &FilterExpr{}
+		return json.Unmarshal(not, e.Not)
+	}
+	e.Filter = &Filter{}
+	return json.Unmarshal(data, e.Filter)
+}
+
+// IDFilter matches the ids in IDs, or the ones out of them if Not is set
+type IDFilter struct {
+	IDs []uint32
+	Not bool
+}
+
+func (f IDFilter) MarshalJSON() ([]byte, error) {
+	ids := f.IDs
+	if ids == nil {
+		ids = []uint32{}
+	}
+	if f.Not {
+		return json.Marshal(struct {
+			Not []uint32 `json:"not"`
+		}{ids})
+	}
+	return json.Marshal(ids)
+}
+
+// UnmarshalJSON decodes one id, a list of ids, or `{"not": [ids]}`
+func (f *IDFilter) UnmarshalJSON(data []byte) error {
+	var id uint32
+	if json.Unmarshal(data, &id) == nil {
+		*f = IDFilter{IDs: []uint32{id}}
+		return nil
+	}
+	var ids []uint32
+	if json.Unmarshal(data, &ids) == nil {
+		*f = IDFilter{IDs: ids}
+		return nil
+	}
+	var not struct {
+		Not []uint32 `json:"not"`
+	}
+	if err := json.Unmarshal(data, &not); err != nil {
+		return err
+	}
+	*f = IDFilter{IDs: not.Not, Not: true}
+	return nil
+}
+
+// Mode is the permission bits, which are encoded as the octal string
+type Mode uint32
+
+func (m Mode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(m), 8))
+}
+
+// UnmarshalJSON decodes a number, or an octal string like "4000" or "0o4000"
+func (m *Mode) UnmarshalJSON(data []byte) error {
+	var bits uint32
+	if json.Unmarshal(data, &bits) == nil {
+		*m = Mode(bits)
+		return nil
+	}
+	var octal string
+	if err := json.Unmarshal(data, &octal); err != nil {
+		return err
+	}
+	parsed, err := strconv.ParseUint(strings.TrimPrefix(octal, "0o"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("toda: invalid mode %q", octal)
+	}
+	*m = Mode(parsed)
+	return nil
+}
+
+// OpenFlags matches the files opened with any of the Flags, like "O_DIRECT",
+// or with none of them if Not is set
+type OpenFlags struct {
+	Flags []string
+	Not   bool
+}
+
+func (f OpenFlags) MarshalJSON() ([]byte, error) {
+	flags := f.Flags
+	if flags == nil {
+		flags = []string{}
+	}
+	if f.Not {
+		return json.Marshal(struct {
+			Not []string `json:"not"`
+		}{flags})
+	}
+	return json.Marshal(flags)
+}
+
+func (f *OpenFlags) UnmarshalJSON(data []byte) error {
+	var flags []string
+	if json.Unmarshal(data, &flags) == nil {
+		*f = OpenFlags{Flags: flags}
+		return nil
+	}
+	var not struct {
+		Not []string `json:"not"`
+	}
+	if err := json.Unmarshal(data, &not); err != nil {
+		return err
+	}
+	*f = OpenFlags{Flags: not.Not, Not: true}
+	return nil
+}
+
+// Latency delays the matched operations
+type Latency struct {
+	Filter
+	Latency Duration  `json:"latency"`
+	PerByte *Duration `json:"perByte,omitempty"`
+	// Distribution is one of "fixed", "uniform", "normal", "exponential" and
+	// "ramp"
+	Distribution string    `json:"distribution,omitempty"`
+	Jitter       *Duration `json:"jitter,omitempty"`
+	Stddev       *Duration `json:"stddev,omitempty"`
+	// the ramp goes from Start to End linearly in RampDuration since the
+	// config is applied, and then holds at End
+	Start        *Duration `json:"start,omitempty"`
+	End          *Duration `json:"end,omitempty"`
+	RampDuration *Duration `json:"rampDuration,omitempty"`
+}
+
+func (*Latency) Type() string { return "latency" }
+
+// Fault fails the matched operations with the errnos picked from Faults, or
+// the ones of the first matching Rules
+type Fault struct {
+	Filter
+	Faults      []FaultErrno `json:"faults,omitempty"`
+	Rules       []FaultRule  `json:"rules,omitempty"`
+	FailOnce    bool         `json:"failOnce,omitempty"`
+	RetryWindow *Duration    `json:"retryWindow,omitempty"`
+	Seed        *uint64      `json:"seed,omitempty"`
+	Burst       *Burst       `json:"burst,omitempty"`
+}
+
+func (*Fault) Type() string { return "fault" }
+
+// MarshalJSON encodes the unset Percent of a Fault with Rules as 100, so that
+// the rules are rolled only by their own percents
+func (f Fault) MarshalJSON() ([]byte, error) {
+	type fault Fault
+	if len(f.Rules) > 0 && f.Percent == 0 {
+		f.Percent = 100
+	}
+	return json.Marshal(fault(f))
+}
+
+// FaultErrno is an errno picked by its weight
+type FaultErrno struct {
+	Errno  int32 `json:"errno"`
+	Weight int32 `json:"weight"`
+}
+
+type FaultRule struct {
+	Methods []string `json:"methods,omitempty"`
+	Errno   int32    `json:"errno"`
+	Percent int32    `json:"percent"`
+}
+
+// Burst clusters the faults into bursts of Duration, with QuietDuration after
+// every burst
+type Burst struct {
+	Duration      Duration `json:"duration"`
+	QuietDuration Duration `json:"quietDuration"`
+	Probability   *float64 `json:"probability,omitempty"`
+}
+
+// AttrOverride overrides the attributes of the file at Path
+type AttrOverride struct {
+	Name    string `json:"name,omitempty"`
+	Enabled *bool  `json:"enabled,omitempty"`
+	Path    string `json:"path"`
+	Percent int32  `json:"percent"`
+	DryRun  bool   `json:"dryRun,omitempty"`
+
+	Ino    *uint64     `json:"ino,omitempty"`
+	Size   *uint64     `json:"size,omitempty"`
+	Blocks *uint64     `json:"blocks,omitempty"`
+	Atime  *SystemTime `json:"atime,omitempty"`
+	Mtime  *SystemTime `json:"mtime,omitempty"`
+	Ctime  *SystemTime `json:"ctime,omitempty"`
+	// Kind is one of "namedPipe", "charDevice", "blockDevice", "directory",
+	// "regularFile", "symlink" and "socket"
+	Kind    string  `json:"kind,omitempty"`
+	Perm    *uint16 `json:"perm,omitempty"`
+	Nlink   *uint32 `json:"nlink,omitempty"`
+	UID     *uint32 `json:"uid,omitempty"`
+	GID     *uint32 `json:"gid,omitempty"`
+	Rdev    *uint32 `json:"rdev,omitempty"`
+	Blksize *uint32 `json:"blksize,omitempty"`
+}
+
+func (*AttrOverride) Type() string { return "attrOverride" }
+
+// SystemTime is a time as toda encodes it, in the seconds and nanoseconds
+// since the Unix epoch
+type SystemTime struct {
+	SecsSinceEpoch  uint64 `json:"secs_since_epoch"`
+	NanosSinceEpoch uint32 `json:"nanos_since_epoch"`
+}
+
+// NewSystemTime returns the SystemTime of `t`, which should not be before
+// the epoch
+func NewSystemTime(t time.Time) *SystemTime {
+	nanos := t.UnixNano()
+	return &SystemTime{
+		SecsSinceEpoch:  uint64(nanos / int64(time.Second)),
+		NanosSinceEpoch: uint32(nanos % int64(time.Second)),
+	}
+}
+
+func (t SystemTime) Time() time.Time {
+	return time.Unix(int64(t.SecsSinceEpoch), int64(t.NanosSinceEpoch))
+}
+
+// Mistake corrupts the data of the matched reads and writes
+type Mistake struct {
+	Filter
+	Mistake MistakeSpec `json:"mistake"`
+}
+
+func (*Mistake) Type() string { return "mistake" }
+
+type MistakeSpec struct {
+	// Mode is one of "fill", "zero", "random" and "bitflip"
+	Mode string `json:"mode,omitempty"`
+	// Filling is "zero", "random", or a byte pattern in hex with the "0x"
+	// prefix or in base64, used by the "fill" mode
+	Filling        string  `json:"filling,omitempty"`
+	MaxLength      uint64  `json:"maxLength"`
+	MaxOccurrences uint64  `json:"maxOccurrences"`
+	Offset         *uint64 `json:"offset,omitempty"`
+	Bits           *uint64 `json:"bits,omitempty"`
+	Seed           *uint64 `json:"seed,omitempty"`
+	TrackRegions   *uint64 `json:"trackRegions,omitempty"`
+}
+
+// Throttle limits the bytes per second of the matched reads and writes
+type Throttle struct {
+	Filter
+	Rate  uint64 `json:"rate"`
+	Burst uint64 `json:"burst,omitempty"`
+}
+
+func (*Throttle) Type() string { return "throttle" }
+
+// ShortIo shortens the matched reads and writes
+type ShortIo struct {
+	Filter
+	Ratio     *float64 `json:"ratio,omitempty"`
+	MaxLength *uint64  `json:"maxLength,omitempty"`
+}
+
+func (*ShortIo) Type() string { return "shortIo" }
+
+// Quota fails the writes beyond the quota with ENOSPC, or beyond the quota of
+// the user with EDQUOT
+type Quota struct {
+	Filter
+	Quota     *uint64 `json:"quota,omitempty"`
+	UserQuota *uint64 `json:"userQuota,omitempty"`
+}
+
+func (*Quota) Type() string { return "quota" }
+
+// DelayFault delays the matched operations, and then fails them with Errno
+type DelayFault struct {
+	Filter
+	Latency Duration `json:"latency"`
+	Errno   int32    `json:"errno"`
+}
+
+func (*DelayFault) Type() string { return "delayFault" }
+
+// Timeout fails the matched operations with ETIMEDOUT after Timeout
+type Timeout struct {
+	Filter
+	Timeout Duration `json:"timeout"`
+}
+
+func (*Timeout) Type() string { return "timeout" }
+
+// StaleRead replies to the reads with the data read before it changed
+type StaleRead struct {
+	Filter
+	MaxRegions *uint64 `json:"maxRegions,omitempty"`
+	MaxBytes   *uint64 `json:"maxBytes,omitempty"`
+}
+
+func (*StaleRead) Type() string { return "staleRead" }
+
+// StatfsOverride overrides the counts replied to statfs
+type StatfsOverride struct {
+	Filter
+	FreeBlocks      *uint64 `json:"freeBlocks,omitempty"`
+	AvailableBlocks *uint64 `json:"availableBlocks,omitempty"`
+	FreeInodes      *uint64 `json:"freeInodes,omitempty"`
+}
+
+func (*StatfsOverride) Type() string { return "statfsOverride" }
+
+// Phases runs the injectors of one phase at a time
+type Phases struct {
+	Name    string  `json:"name,omitempty"`
+	Enabled *bool   `json:"enabled,omitempty"`
+	Phases  []Phase `json:"phases"`
+	Loop    bool    `json:"loop,omitempty"`
+}
+
+func (*Phases) Type() string { return "phases" }
+
+type Phase struct {
+	Duration  Duration         `json:"duration"`
+	Injectors []InjectorConfig `json:"injectors"`
+}
+
+// ShuffleDir shuffles the entries of the matched directories
+type ShuffleDir struct {
+	Filter
+	Seed *uint64 `json:"seed,omitempty"`
+}
+
+func (*ShuffleDir) Type() string { return "shuffleDir" }
+
+// HideEntries hides the entries of the matched directories whose names match
+// Pattern, or Ratio of them
+type HideEntries struct {
+	Filter
+	Pattern string   `json:"pattern,omitempty"`
+	Ratio   *float64 `json:"ratio,omitempty"`
+	Seed    *uint64  `json:"seed,omitempty"`
+}
+
+func (*HideEntries) Type() string { return "hideEntries" }
+
+// VolatileWrites keeps the writes since the last fsync, which are lost by
+// SimulateCrash
+type VolatileWrites struct {
+	Filter
+	MaxBytes *uint64 `json:"maxBytes,omitempty"`
+}
+
+func (*VolatileWrites) Type() string { return "volatileWrites" }
+
+// Sequence applies the Steps to the matched operations on every file by
+// their positions, like delaying only the 3rd write
+type Sequence struct {
+	Filter
+	Steps []SequenceStep `json:"steps"`
+}
+
+func (*Sequence) Type() string { return "sequence" }
+
+// SequenceStep delays the Index-th operation, counted from 1, for Latency,
+// and then fails it with Errno
+type SequenceStep struct {
+	Index   uint64    `json:"index"`
+	Latency *Duration `json:"latency,omitempty"`
+	Errno   *int32    `json:"errno,omitempty"`
+}
+
+// Readlink replaces the targets of the matched links replied to readlink
+// with Target. With Dangling, a random suffix is appended to the target,
+// which is the real one if Target is empty, so that the link points to
+// nothing.
+type Readlink struct {
+	Filter
+	Target   string `json:"target,omitempty"`
+	Dangling bool   `json:"dangling,omitempty"`
+}
+
+func (*Readlink) Type() string { return "readlink" }
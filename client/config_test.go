@@ -0,0 +1,178 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	for _, c := range []struct {
+		duration time.Duration
+		encoded  string
+	}{
+		{0, "0s"},
+		{2 * time.Hour, "2h"},
+		{90 * time.Second, "90s"},
+		{1500 * time.Millisecond, "1500ms"},
+		{time.Microsecond + time.Nanosecond, "1001ns"},
+	} {
+		if got := Duration(c.duration).String(); got != c.encoded {
+			t.Errorf("%v: got %s, want %s", c.duration, got, c.encoded)
+		}
+		parsed, err := ParseDuration(c.encoded)
+		if err != nil || time.Duration(parsed) != c.duration {
+			t.Errorf("%s: got %v (%v), want %v", c.encoded, parsed, err, c.duration)
+		}
+	}
+
+	// the durations formatted by toda
+	for encoded, duration := range map[string]time.Duration{
+		"1m 30s":     90 * time.Second,
+		"2days 3h":   51 * time.Hour,
+		"1s 5ms 7us": time.Second + 5*time.Millisecond + 7*time.Microsecond,
+		"100ns":      100 * time.Nanosecond,
+		"1min5sec":   65 * time.Second,
+	} {
+		parsed, err := ParseDuration(encoded)
+		if err != nil || time.Duration(parsed) != duration {
+			t.Errorf("%s: got %v (%v), want %v", encoded, parsed, err, duration)
+		}
+	}
+
+	for _, invalid := range []string{"", "10", "s", "1.5s", "3 parsecs"} {
+		if _, err := ParseDuration(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	enabled := false
+	config := []InjectorConfig{
+		{&Fault{
+			Filter: Filter{
+				Name:      "eio",
+				Enabled:   &enabled,
+				Percent:   50,
+				UID:       &IDFilter{IDs: []uint32{0}, Not: true},
+				OpenFlags: &OpenFlags{Flags: []string{"O_DIRECT"}},
+				Duration:  NewDuration(time.Minute),
+			},
+			Faults: []FaultErrno{{Errno: 5, Weight: 1}},
+			Burst:  &Burst{Duration: Duration(time.Second), QuietDuration: Duration(10 * time.Second)},
+		}},
+		{&Latency{
+			Filter: Filter{
+				Percent: 10,
+				Expr: &FilterExpr{Or: []FilterExpr{
+					{Filter: &Filter{Path: "/a/*", Percent: 100}},
+					{Not: &FilterExpr{Filter: &Filter{Path: "/b/*", Percent: 100}}},
+				}},
+			},
+			Latency: Duration(time.Second),
+		}},
+		{&AttrOverride{
+			Path:    "/mnt/file",
+			Percent: 100,
+			Mtime:   NewSystemTime(time.Unix(1591012800, 5)),
+		}},
+		{&Phases{
+			Name: "outage",
+			Phases: []Phase{{
+				Duration:  Duration(30 * time.Second),
+				Injectors: []InjectorConfig{{&Throttle{Filter: Filter{Percent: 100}, Rate: 1024}}},
+			}},
+			Loop: true,
+		}},
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []InjectorConfig
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, config) {
+		t.Errorf("got %s after the round trip", data)
+	}
+
+	var fields []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"type":      `"fault"`,
+		"enabled":   "false",
+		"uid":       `{"not":[0]}`,
+		"openFlags": `["O_DIRECT"]`,
+		"duration":  `"1m"`,
+		"burst":     `{"duration":"1s","quietDuration":"10s"}`,
+	} {
+		if got := string(fields[0][key]); got != want {
+			t.Errorf("%s: got %s, want %s", key, got, want)
+		}
+	}
+	if got := string(fields[1]["expr"]); got != `{"or":[{"path":"/a/*","percent":100},{"not":{"path":"/b/*","percent":100}}]}` {
+		t.Errorf("unexpected expr %s", got)
+	}
+	if got := string(fields[2]["mtime"]); got != `{"secs_since_epoch":1591012800,"nanos_since_epoch":5}` {
+		t.Errorf("unexpected mtime %s", got)
+	}
+}
+
+func TestMode(t *testing.T) {
+	for encoded, want := range map[string]Mode{
+		"2048":     04000,
+		`"4000"`:   04000,
+		`"0o4000"`: 04000,
+	} {
+		var got Mode
+		if err := json.Unmarshal([]byte(encoded), &got); err != nil || got != want {
+			t.Errorf("%s: got %o (%v), want %o", encoded, got, err, want)
+		}
+	}
+	if got := mustMarshal(t, Mode(02)); got != `"2"` {
+		t.Errorf("unexpected mode %s", got)
+	}
+}
+
+func TestFaultRules(t *testing.T) {
+	fault := &Fault{Rules: []FaultRule{{Methods: []string{"getxattr"}, Errno: 61, Percent: 50}}}
+	if got := mustMarshal(t, fault); got != `{"percent":100,"rules":[{"methods":["getxattr"],"errno":61,"percent":50}]}` {
+		t.Errorf("unexpected fault %s", got)
+	}
+	fault.Percent = 10
+	if got := mustMarshal(t, fault); got != `{"percent":10,"rules":[{"methods":["getxattr"],"errno":61,"percent":50}]}` {
+		t.Errorf("unexpected fault %s", got)
+	}
+}
+
+func TestIDFilter(t *testing.T) {
+	for encoded, want := range map[string]IDFilter{
+		"1000":               {IDs: []uint32{1000}},
+		"[1, 2]":             {IDs: []uint32{1, 2}},
+		`{"not": [0, 1000]}`: {IDs: []uint32{0, 1000}, Not: true},
+	} {
+		var got IDFilter
+		if err := json.Unmarshal([]byte(encoded), &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v (%v), want %+v", encoded, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration encoded as toda does, like "1m 30s". toda
+// doesn't accept the fractions of a unit in the configs, so it's encoded in
+// the largest unit which divides it, like "1500ms".
+type Duration time.Duration
+
+// humantimeUnits are the units of humantime, which toda parses and formats
+// the durations with. A month is 30.44 days and a year is 365.25 days.
+var humantimeUnits = map[string]time.Duration{
+	"nsec": time.Nanosecond, "ns": time.Nanosecond,
+	"usec": time.Microsecond, "us": time.Microsecond,
+	"msec": time.Millisecond, "ms": time.Millisecond,
+	"seconds": time.Second, "second": time.Second, "sec": time.Second, "s": time.Second,
+	"minutes": time.Minute, "minute": time.Minute, "min": time.Minute, "m": time.Minute,
+	"hours": time.Hour, "hour": time.Hour, "hr": time.Hour, "h": time.Hour,
+	"days": 24 * time.Hour, "day": 24 * time.Hour, "d": 24 * time.Hour,
+	"weeks": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "w": 7 * 24 * time.Hour,
+	"months": 2630016 * time.Second, "month": 2630016 * time.Second, "M": 2630016 * time.Second,
+	"years": 31557600 * time.Second, "year": 31557600 * time.Second, "y": 31557600 * time.Second,
+}
+
+func (d Duration) String() string {
+	duration := time.Duration(d)
+	if duration == 0 {
+		return "0s"
+	}
+	for _, unit := range []struct {
+		name   string
+		length time.Duration
+	}{
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+		{"us", time.Microsecond},
+	} {
+		if duration%unit.length == 0 {
+			return fmt.Sprintf("%d%s", duration/unit.length, unit.name)
+		}
+	}
+	return fmt.Sprintf("%dns", duration)
+}
+
+// ParseDuration parses the durations formatted by toda, which are the
+// numbers with the units separated by the spaces or not, like "1m 30s" or
+// "2days3h"
+func ParseDuration(s string) (Duration, error) {
+	var duration time.Duration
+	rest := strings.TrimSpace(s)
+	if rest == "" {
+		return 0, fmt.Errorf("toda: empty duration")
+	}
+	for rest != "" {
+		digits := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		if digits == 0 {
+			return 0, fmt.Errorf("toda: invalid duration %q", s)
+		}
+		if digits < 0 {
+			return 0, fmt.Errorf("toda: missing unit in duration %q", s)
+		}
+		value, err := strconv.ParseUint(rest[:digits], 10, 63)
+		if err != nil {
+			return 0, fmt.Errorf("toda: invalid duration %q: %w", s, err)
+		}
+		rest = rest[digits:]
+
+		end := strings.IndexAny(rest, " 0123456789")
+		if end < 0 {
+			end = len(rest)
+		}
+		unit, ok := humantimeUnits[rest[:end]]
+		if !ok {
+			return 0, fmt.Errorf("toda: unknown unit %q in duration %q", rest[:end], s)
+		}
+		duration += time.Duration(value) * unit
+		rest = strings.TrimLeft(rest[end:], " ")
+	}
+	return Duration(duration), nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration
+	return nil
+}
+
+// NewDuration returns the pointer to the Duration of `d`, for the optional
+// durations of the configs
+func NewDuration(d time.Duration) *Duration {
+	duration := Duration(d)
+	return &duration
+}
@@ -0,0 +1,3 @@
+module github.com/chaos-mesh/toda/client
+
+go 1.14
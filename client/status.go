@@ -0,0 +1,157 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Status is returned by GetStatus and ResetStats
+type Status struct {
+	// Status is "ok", or the error which stopped the injection
+	Status string `json:"status"`
+	// Generation is the generation of the config applied
+	Generation uint64        `json:"generation"`
+	Mounts     []MountStatus `json:"mounts"`
+	Paused     bool          `json:"paused,omitempty"`
+}
+
+type MountStatus struct {
+	Path          string     `json:"path"`
+	Operations    uint64     `json:"operations"`
+	Injected      uint64     `json:"injected"`
+	LastInjection *time.Time `json:"lastInjection"`
+	// Injectors are the status of all the injectors, and NamedInjectors are
+	// the ones with a name
+	Injectors      []InjectorStatus          `json:"injectors"`
+	Readonly       bool                      `json:"readonly"`
+	NamedInjectors map[string]InjectorStatus `json:"namedInjectors,omitempty"`
+	Concurrency    *ConcurrencyStatus        `json:"concurrency,omitempty"`
+	Breaker        *BreakerStatus            `json:"breaker,omitempty"`
+	Capabilities   *Capabilities             `json:"capabilities,omitempty"`
+}
+
+// InjectorStatus is the config of an injector with its counters
+type InjectorStatus struct {
+	Config  InjectorConfig
+	Enabled bool
+	// Matched is how many operations have been injected, and Remaining is
+	// how many can still be injected by MaxInjections
+	Matched   uint64
+	Remaining *uint64
+	// Phase is the index of the current phase of a phases injector
+	Phase *int
+	Burst *BurstStatus
+}
+
+// injectorCounters are the fields of InjectorStatus beside the config, which
+// are flattened together in JSON
+type injectorCounters struct {
+	Enabled   bool         `json:"enabled"`
+	Matched   uint64       `json:"matched"`
+	Remaining *uint64      `json:"remaining,omitempty"`
+	Phase     *int         `json:"phase,omitempty"`
+	Burst     *BurstStatus `json:"burst,omitempty"`
+}
+
+func (s *InjectorStatus) UnmarshalJSON(data []byte) error {
+	var counters injectorCounters
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return err
+	}
+	var config InjectorConfig
+	if err := config.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*s = InjectorStatus{
+		Config:    config,
+		Enabled:   counters.Enabled,
+		Matched:   counters.Matched,
+		Remaining: counters.Remaining,
+		Phase:     counters.Phase,
+		Burst:     counters.Burst,
+	}
+	return nil
+}
+
+type BurstStatus struct {
+	Active bool   `json:"active"`
+	Bursts uint64 `json:"bursts"`
+}
+
+type ConcurrencyStatus struct {
+	Limit   uint64 `json:"limit"`
+	Running uint64 `json:"running"`
+	Queued  uint64 `json:"queued"`
+}
+
+type BreakerStatus struct {
+	Threshold         uint64   `json:"threshold"`
+	Cooldown          Duration `json:"cooldown"`
+	Open              bool     `json:"open"`
+	ConsecutiveErrors uint64   `json:"consecutiveErrors"`
+	Trips             uint64   `json:"trips"`
+}
+
+// Capabilities are the capabilities offered by the kernel in FUSE_INIT
+type Capabilities struct {
+	Flags uint32   `json:"flags"`
+	Names []string `json:"names"`
+}
+
+// DebugInfo is what toda thinks it has hijacked
+type DebugInfo struct {
+	Mounts    []MountDebugInfo `json:"mounts"`
+	Processes []Redirection    `json:"processes"`
+}
+
+type MountDebugInfo struct {
+	Path        string `json:"path"`
+	BackingPath string `json:"backingPath"`
+}
+
+// Redirection is a process whose files have been reopened on the mount
+type Redirection struct {
+	Pid int32 `json:"pid"`
+	// Fds are the fds and the paths they are reopened with
+	Fds   map[uint64]string `json:"fds"`
+	Cwd   *string           `json:"cwd"`
+	Mmaps []string          `json:"mmaps"`
+}
+
+// VersionInfo is returned by Version
+type VersionInfo struct {
+	Version string `json:"version"`
+	// GitSha is the commit toda is built from, if it's known when building
+	GitSha *string        `json:"gitSha"`
+	Fuser  string         `json:"fuser"`
+	Mounts []MountVersion `json:"mounts"`
+}
+
+type MountVersion struct {
+	Path string `json:"path"`
+	// Protocol is the protocol negotiated in FUSE_INIT, which is nil before
+	// mounted
+	Protocol *Protocol `json:"protocol"`
+}
+
+// Protocol is the version of the FUSE protocol. The minor is the lowest one
+// the kernel may have offered unless it's Exact, as fuser doesn't tell toda
+// the version of the kernel.
+type Protocol struct {
+	Major uint32 `json:"major"`
+	Minor uint32 `json:"minor"`
+	Exact bool   `json:"exact"`
+}
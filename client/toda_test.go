@@ -0,0 +1,138 @@
+// Copyright 2020 Chaos Mesh Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startToda runs the toda binary at $TODA_BIN on a temporary directory. It
+// mounts FUSE, so it needs the privileges of toda, and the test is skipped
+// without the binary.
+func startToda(t *testing.T) (*Client, string) {
+	bin := os.Getenv("TODA_BIN")
+	if bin == "" {
+		t.Skip("TODA_BIN is not set")
+	}
+
+	dir, err := ioutil.TempDir("", "toda-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "--path", dir, "--mount-only", "--verbose", "info")
+	cmd.Stderr = os.Stderr
+	c, err := Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+		os.RemoveAll(dir)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("toda failed to start: %v", err)
+	}
+	return c, dir
+}
+
+func TestToda(t *testing.T) {
+	c, dir := startToda(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	config := []InjectorConfig{
+		{&Latency{
+			Filter:  Filter{Name: "slow", Percent: 0},
+			Latency: Duration(10 * time.Millisecond),
+		}},
+		{&Fault{
+			Filter: Filter{Name: "eio", Methods: []string{"fsync"}, Percent: 0},
+			Faults: []FaultErrno{{Errno: 5, Weight: 1}},
+		}},
+	}
+	if err := c.Update(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	injectors, err := c.ListInjectors(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(injectors) != 2 {
+		t.Fatalf("unexpected injectors %+v", injectors)
+	}
+	if latency, ok := injectors[0].Config.Injector.(*Latency); !ok || time.Duration(latency.Latency) != 10*time.Millisecond {
+		t.Errorf("unexpected latency %+v", injectors[0].Config.Injector)
+	}
+
+	if err := c.DisableInjector(ctx, "eio", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateInjector(ctx, InjectorConfig{&Timeout{
+		Filter:  Filter{Name: "slow", Percent: 0},
+		Timeout: Duration(time.Second),
+	}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := c.GetStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "ok" || len(status.Mounts) != 1 || status.Mounts[0].Path != dir {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	named := status.Mounts[0].NamedInjectors
+	if _, ok := named["slow"].Config.Injector.(*Timeout); !ok {
+		t.Errorf("slow should be replaced by the timeout: %+v", named["slow"])
+	}
+	if named["eio"].Enabled {
+		t.Errorf("eio should be disabled: %+v", named["eio"])
+	}
+
+	errs, err := c.Validate(ctx, []InjectorConfig{{&Phases{}}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	version, err := c.Version(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version == "" || len(version.Mounts) != 1 || version.Mounts[0].Protocol == nil || version.Mounts[0].Protocol.Major != 7 {
+		t.Errorf("unexpected version %+v", version)
+	}
+
+	var statusErr *StatusError
+	if err := c.RemoveInjector(ctx, "missing", ""); !errors.As(err, &statusErr) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := c.Update(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,177 @@
+use std::fmt::Arguments;
+use std::fs::{self, File, OpenOptions};
+use std::io::{BufWriter, Write};
+use std::path::{Path, PathBuf};
+use std::sync::mpsc::{sync_channel, RecvTimeoutError, SyncSender, TrySendError};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime};
+
+use anyhow::{anyhow, Result};
+use once_cell::sync::OnceCell;
+use serde::Serialize;
+use tracing::{info, warn};
+
+use crate::hookfs::RequestContext;
+use crate::injector::Method;
+
+// the records beyond the queue are dropped rather than waited for, so that
+// the FUSE requests are never delayed by the log
+const QUEUE_SIZE: usize = 4096;
+// the buffered records are written to the file at least this often
+const FLUSH_INTERVAL: Duration = Duration::from_secs(1);
+const FLUSH_TIMEOUT: Duration = Duration::from_secs(2);
+
+// the injections are only recorded after the audit log is started
+static AUDIT_LOG: OnceCell<Mutex<SyncSender<Message>>> = OnceCell::new();
+
+// Record is one injection, written as a line of JSON
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct Record {
+    // RFC 3339 in UTC
+    pub timestamp: String,
+    pub method: String,
+    pub path: String,
+    pub ino: Option<u64>,
+    // the type of the injector, and its name if it's named
+    pub injector: String,
+    pub name: Option<String>,
+    // what is injected, like `errno 5` or `latency 100ms`
+    pub fault: String,
+}
+
+enum Message {
+    Record(Record),
+    // the buffered records are written before the sender is notified
+    Flush(SyncSender<()>),
+}
+
+// start appends the injections to the file at `path` from a new thread. Once
+// the file grows beyond `max_size`, it's renamed to `<path>.1`, replacing the
+// previous one, so the log takes at most about twice `max_size` of the disk.
+// It can only be started once.
+pub fn start(path: &Path, max_size: u64) -> Result<()> {
+    let mut writer = Writer::open(path.to_owned(), max_size)?;
+    let (tx, rx) = sync_channel::<Message>(QUEUE_SIZE);
+    AUDIT_LOG
+        .set(Mutex::new(tx))
+        .map_err(|_| anyhow!("audit log has been started"))?;
+    info!("write the injections to {}", path.display());
+
+    std::thread::spawn(move || loop {
+        match rx.recv_timeout(FLUSH_INTERVAL) {
+            Ok(Message::Record(record)) => writer.write(&record),
+            Ok(Message::Flush(done)) => {
+                writer.flush();
+                let _ = done.send(());
+            }
+            Err(RecvTimeoutError::Timeout) => writer.flush(),
+            Err(RecvTimeoutError::Disconnected) => {
+                writer.flush();
+                return;
+            }
+        }
+    });
+    Ok(())
+}
+
+// record queues the injection of the operation with what is injected, which
+// is only formatted if the audit log is started, and drops it if the queue
+// is full
+pub fn record(method: &Method, path: &Path, injector: &str, name: Option<&str>, fault: Arguments) {
+    let audit_log = match AUDIT_LOG.get() {
+        Some(audit_log) => audit_log,
+        None => return,
+    };
+    let record = Record {
+        timestamp: humantime::format_rfc3339_micros(SystemTime::now()).to_string(),
+        method: method.name(),
+        path: path.display().to_string(),
+        ino: RequestContext::current().and_then(|ctx| ctx.ino()),
+        injector: injector.to_owned(),
+        name: name.map(str::to_owned),
+        fault: fault.to_string(),
+    };
+    match audit_log.lock().unwrap().try_send(Message::Record(record)) {
+        Ok(()) => {}
+        Err(TrySendError::Full(_)) => warn!("audit log queue is full, drop a record"),
+        Err(TrySendError::Disconnected(_)) => {}
+    }
+}
+
+// flush writes the queued records to the file and waits for them, which is
+// called before toda exits
+pub fn flush() {
+    let audit_log = match AUDIT_LOG.get() {
+        Some(audit_log) => audit_log,
+        None => return,
+    };
+    let (tx, rx) = sync_channel(1);
+    // the flush waits for the queue rather than being dropped
+    if audit_log.lock().unwrap().send(Message::Flush(tx)).is_ok() {
+        let _ = rx.recv_timeout(FLUSH_TIMEOUT);
+    }
+}
+
+struct Writer {
+    path: PathBuf,
+    max_size: u64,
+    file: BufWriter<File>,
+    size: u64,
+}
+
+impl Writer {
+    fn open(path: PathBuf, max_size: u64) -> Result<Self> {
+        let file = OpenOptions::new().create(true).append(true).open(&path)?;
+        let size = file.metadata()?.len();
+        Ok(Self {
+            path,
+            max_size,
+            file: BufWriter::new(file),
+            size,
+        })
+    }
+
+    fn write(&mut self, record: &Record) {
+        let mut line = match serde_json::to_vec(record) {
+            Ok(line) => line,
+            Err(err) => {
+                warn!("fail to encode audit record {:?}: {:?}", record, err);
+                return;
+            }
+        };
+        line.push(b'\n');
+        if self.size > 0 && self.size + line.len() as u64 > self.max_size {
+            // the record is dropped rather than exceed the size
+            if let Err(err) = self.rotate() {
+                warn!(
+                    "fail to rotate audit log {}: {:?}",
+                    self.path.display(),
+                    err
+                );
+                return;
+            }
+        }
+        match self.file.write_all(&line) {
+            Ok(()) => self.size += line.len() as u64,
+            Err(err) => warn!("fail to write audit log {}: {:?}", self.path.display(), err),
+        }
+    }
+
+    fn flush(&mut self) {
+        if let Err(err) = self.file.flush() {
+            warn!("fail to flush audit log {}: {:?}", self.path.display(), err);
+        }
+    }
+
+    // rotate renames the full file to `<path>.1`, and continues with a new one
+    fn rotate(&mut self) -> Result<()> {
+        self.file.flush()?;
+        let mut rotated = self.path.clone().into_os_string();
+        rotated.push(".1");
+        fs::rename(&self.path, &rotated)?;
+        *self = Self::open(self.path.clone(), self.max_size)?;
+        info!("audit log is rotated to {:?}", rotated);
+        Ok(())
+    }
+}
@@ -0,0 +1,44 @@
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+use anyhow::Result;
+
+use crate::http::{self, Response};
+use crate::mount_injector;
+
+// the number of mounts injected successfully, 0 during the startup, after a
+// fatal mount error and during the recovering
+static MOUNTS: AtomicUsize = AtomicUsize::new(0);
+
+static JSONRPC_SERVING: AtomicBool = AtomicBool::new(false);
+
+pub fn set_mounts(mounts: usize) {
+    MOUNTS.store(mounts, Ordering::SeqCst);
+}
+
+pub fn set_jsonrpc_serving(serving: bool) {
+    JSONRPC_SERVING.store(serving, Ordering::SeqCst);
+}
+
+// healthy returns true if all the mounts are up and the jsonrpc server is
+// accepting calls. A mount is down if its FUSE session has exited.
+pub fn healthy() -> bool {
+    let mounts = MOUNTS.load(Ordering::SeqCst);
+    mounts > 0
+        && mount_injector::running_mounts() >= mounts
+        && JSONRPC_SERVING.load(Ordering::SeqCst)
+}
+
+pub fn start_server(addr: &str) -> Result<()> {
+    http::serve(addr, |path| match path {
+        "/healthz" => {
+            if healthy() {
+                Response::new(200, "text/plain", "ok\n".to_string())
+            } else {
+                Response::new(503, "text/plain", "unavailable\n".to_string())
+            }
+        }
+        _ => Response::not_found(),
+    })?;
+
+    Ok(())
+}
@@ -2,32 +2,284 @@ use std::ffi::OsString;
 use std::fmt::Debug;
 use std::future::Future;
 use std::path::{Path, PathBuf};
-use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
 
 use async_trait::async_trait;
 use fuser::*;
-use tracing::trace_span;
+use nix::errno::Errno;
+use serde::Serialize;
+use tokio::sync::{Semaphore, SemaphorePermit};
+use tracing::{info, trace_span, warn};
 use tracing_futures::Instrument;
 
-use super::errors::Result;
+use super::capabilities::Capabilities;
+use super::context::RequestContext;
+use super::errors::{HookFsError, Result};
 use super::reply::*;
 use super::runtime::spawn;
 
-pub fn spawn_reply<F, R, V>(id: u64, reply: R, f: F)
+pub fn spawn_reply<F, R, V>(req: &Request, reply: R, f: F)
 where
     F: Future<Output = Result<V>> + Send + 'static,
     R: FsReply<V> + Send + 'static,
     V: Debug,
 {
-    spawn(async move {
-        let result = f.instrument(trace_span!("request", id)).await;
+    spawn_request(req, async move {
+        let sampled = RequestContext::sampled_id().map(|id| (id, Instant::now()));
+        let result = f.await;
+        if let Some((id, start)) = sampled {
+            match &result {
+                Ok(_) => info!(id, elapsed = ?start.elapsed(), "sampled request succeeds"),
+                Err(err) => info!(id, elapsed = ?start.elapsed(), "sampled request fails: {}", err),
+            }
+        }
         reply.reply(result);
     });
 }
 
+static INFLIGHT_REQUESTS: AtomicUsize = AtomicUsize::new(0);
+static FINISHED_REQUESTS: AtomicU64 = AtomicU64::new(0);
+
+struct InflightGuard;
+
+impl InflightGuard {
+    fn new() -> Self {
+        INFLIGHT_REQUESTS.fetch_add(1, Ordering::SeqCst);
+        InflightGuard
+    }
+}
+
+impl Drop for InflightGuard {
+    fn drop(&mut self) {
+        FINISHED_REQUESTS.fetch_add(1, Ordering::SeqCst);
+        INFLIGHT_REQUESTS.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+// spawn_request runs the request with its context. It's used directly by the
+// requests which reply by themselves.
+pub fn spawn_request<F>(req: &Request, f: F)
+where
+    F: Future<Output = ()> + Send + 'static,
+{
+    let id = req.unique();
+    let ctx = RequestContext::new(req);
+    let guard = InflightGuard::new();
+    spawn(
+        ctx.scope(
+            async move {
+                f.await;
+                drop(guard);
+            }
+            .instrument(trace_span!("request", id)),
+        ),
+    );
+}
+
+// drain waits for the in-flight requests until all of them finish or the
+// timeout is reached. It returns the count of finished requests during the
+// waiting, and the count of the ones are still running.
+pub fn drain(timeout: Duration) -> (u64, usize) {
+    let finished = FINISHED_REQUESTS.load(Ordering::SeqCst);
+    let start = Instant::now();
+    info!(
+        "draining {} requests",
+        INFLIGHT_REQUESTS.load(Ordering::SeqCst)
+    );
+
+    while INFLIGHT_REQUESTS.load(Ordering::SeqCst) > 0 && start.elapsed() < timeout {
+        std::thread::sleep(Duration::from_millis(10));
+    }
+
+    (
+        FINISHED_REQUESTS.load(Ordering::SeqCst) - finished,
+        INFLIGHT_REQUESTS.load(Ordering::SeqCst),
+    )
+}
+
+// ConcurrencyLimit caps the requests handled at the same time, and the others
+// wait in the queue like a device with a limited queue depth
+#[derive(Debug)]
+pub struct ConcurrencyLimit {
+    semaphore: Semaphore,
+    limit: usize,
+    queued: AtomicUsize,
+}
+
+#[derive(Serialize, Debug, Clone, Copy, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct ConcurrencyStatus {
+    pub limit: usize,
+    pub running: usize,
+    // the requests waiting for the others to finish
+    pub queued: usize,
+}
+
+impl ConcurrencyLimit {
+    pub fn new(limit: usize) -> Self {
+        Self {
+            semaphore: Semaphore::new(limit),
+            limit,
+            queued: AtomicUsize::new(0),
+        }
+    }
+
+    async fn acquire(&self) -> SemaphorePermit<'_> {
+        self.queued.fetch_add(1, Ordering::SeqCst);
+        let permit = self.semaphore.acquire().await;
+        self.queued.fetch_sub(1, Ordering::SeqCst);
+        permit
+    }
+
+    pub fn status(&self) -> ConcurrencyStatus {
+        ConcurrencyStatus {
+            limit: self.limit,
+            running: self.limit - self.semaphore.available_permits(),
+            queued: self.queued.load(Ordering::SeqCst),
+        }
+    }
+}
+
+// CircuitBreaker disables the injection once the backing filesystem fails by
+// itself, so that the injected faults don't pile up on the real ones. It's
+// opened after `threshold` consecutive backing errors, and closed again after
+// `cooldown` without any of them.
+#[derive(Debug)]
+pub struct CircuitBreaker {
+    threshold: u64,
+    cooldown: Duration,
+    state: Mutex<BreakerState>,
+}
+
+#[derive(Debug, Default)]
+struct BreakerState {
+    consecutive_errors: u64,
+    open: bool,
+    last_error: Option<Instant>,
+    trips: u64,
+}
+
+#[derive(Serialize, Debug, Clone, Copy)]
+#[serde(rename_all = "camelCase")]
+pub struct BreakerStatus {
+    pub threshold: u64,
+    #[serde(with = "humantime_serde")]
+    pub cooldown: Duration,
+    // the injection is disabled while it's open
+    pub open: bool,
+    pub consecutive_errors: u64,
+    // how many times it has been opened
+    pub trips: u64,
+}
+
+impl CircuitBreaker {
+    pub fn new(threshold: u64, cooldown: Duration) -> Self {
+        Self {
+            threshold,
+            cooldown,
+            state: Mutex::new(BreakerState::default()),
+        }
+    }
+
+    // record counts the result of a request. Only the backing errors of the
+    // requests without any injection are counted, and the other errors (like
+    // ENOENT of `lookup`) don't break the consecutive ones.
+    pub fn record<V>(&self, result: &Result<V>) {
+        let injected = RequestContext::current().map_or(false, |ctx| ctx.injected());
+        let mut state = self.state.lock().unwrap();
+        match result {
+            Ok(_) => state.consecutive_errors = 0,
+            Err(err) if !injected && is_backing_error(err) => {
+                state.consecutive_errors += 1;
+                state.last_error = Some(Instant::now());
+                if !state.open && state.consecutive_errors >= self.threshold {
+                    warn!(
+                        "{} consecutive errors from the backing filesystem, disable injection for {:?}",
+                        state.consecutive_errors, self.cooldown
+                    );
+                    state.open = true;
+                    state.trips += 1;
+                }
+            }
+            Err(_) => {}
+        }
+    }
+
+    // is_open returns whether the injection is disabled, and closes the
+    // breaker if the cooldown has passed since the last backing error
+    pub fn is_open(&self) -> bool {
+        let mut state = self.state.lock().unwrap();
+        if state.open
+            && state
+                .last_error
+                .map_or(true, |last_error| last_error.elapsed() >= self.cooldown)
+        {
+            info!(
+                "no error from the backing filesystem in {:?}, enable injection",
+                self.cooldown
+            );
+            state.open = false;
+            state.consecutive_errors = 0;
+        }
+        state.open
+    }
+
+    pub fn status(&self) -> BreakerStatus {
+        let open = self.is_open();
+        let state = self.state.lock().unwrap();
+        BreakerStatus {
+            threshold: self.threshold,
+            cooldown: self.cooldown,
+            open,
+            consecutive_errors: state.consecutive_errors,
+            trips: state.trips,
+        }
+    }
+}
+
+// is_backing_error checks whether the error means the backing filesystem is
+// failing, rather than the request is invalid
+fn is_backing_error(err: &HookFsError) -> bool {
+    match err {
+        HookFsError::Sys(errno) => matches!(
+            errno,
+            Errno::EIO | Errno::ENXIO | Errno::ENODEV | Errno::ESTALE | Errno::ENOTCONN
+        ),
+        HookFsError::UnknownError => true,
+        _ => false,
+    }
+}
+
+async fn admit<T: AsyncFileSystemImpl>(fs: &T) -> Option<SemaphorePermit<'_>> {
+    match fs.concurrency_limit() {
+        Some(limit) => Some(limit.acquire().await),
+        None => None,
+    }
+}
+
 #[async_trait]
 pub trait AsyncFileSystemImpl: Send + Sync {
-    fn init(&self) -> Result<()>;
+    // init is called with the capabilities offered by the kernel, and
+    // returns the ones requested from them
+    fn init(&self, capabilities: Capabilities) -> Result<u32>;
+
+    // the requests are not limited by default
+    fn concurrency_limit(&self) -> Option<&ConcurrencyLimit> {
+        None
+    }
+
+    // the results of the requests are recorded by the breaker if it's set
+    fn circuit_breaker(&self) -> Option<&CircuitBreaker> {
+        None
+    }
+
+    // the kernel splits the writes and the readahead beyond the size if it's
+    // set. The reads are capped by the `max_read` mount option.
+    fn max_io_size(&self) -> Option<u32> {
+        None
+    }
 
     fn destroy(&self);
 
@@ -147,6 +399,14 @@ pub trait AsyncFileSystemImpl: Send + Sync {
         reply: &mut ReplyDirectory,
     ) -> Result<()>;
 
+    async fn readdirplus(
+        &self,
+        ino: u64,
+        fh: u64,
+        offset: i64,
+        reply: &mut ReplyDirectoryPlus,
+    ) -> Result<()>;
+
     async fn releasedir(&self, ino: u64, fh: u64, flags: i32) -> Result<()>;
 
     async fn fsyncdir(&self, ino: u64, fh: u64, datasync: bool) -> Result<()>;
@@ -204,7 +464,34 @@ pub trait AsyncFileSystemImpl: Send + Sync {
         sleep: bool,
     ) -> Result<()>;
 
-    async fn bmap(&self, ino: u64, blocksize: u32, idx: u64, reply: ReplyBmap);
+    async fn bmap(&self, ino: u64, blocksize: u32, idx: u64) -> Result<Bmap>;
+
+    async fn ioctl(
+        &self,
+        ino: u64,
+        fh: u64,
+        flags: u32,
+        cmd: u32,
+        in_data: Vec<u8>,
+        out_size: u32,
+    ) -> Result<Ioctl>;
+
+    async fn copy_file_range(
+        &self,
+        ino_in: u64,
+        fh_in: u64,
+        offset_in: i64,
+        ino_out: u64,
+        fh_out: u64,
+        offset_out: i64,
+        len: u64,
+        flags: u32,
+    ) -> Result<Write>;
+
+    async fn lseek(&self, ino: u64, fh: u64, offset: i64, whence: i32) -> Result<Lseek>;
+
+    async fn fallocate(&self, ino: u64, fh: u64, offset: i64, length: i64, mode: i32)
+        -> Result<()>;
 }
 
 pub struct AsyncFileSystem<T>(Arc<T>);
@@ -215,6 +502,39 @@ impl<T: AsyncFileSystemImpl> From<Arc<T>> for AsyncFileSystem<T> {
     }
 }
 
+impl<T: AsyncFileSystemImpl + 'static> AsyncFileSystem<T> {
+    // spawn_reply runs the request once it's admitted by the concurrency limit
+    // of the filesystem. The permit is held until the reply is sent, whatever
+    // the result is.
+    fn spawn_reply<F, R, V>(&self, req: &Request, reply: R, f: F)
+    where
+        F: Future<Output = Result<V>> + Send + 'static,
+        R: FsReply<V> + Send + 'static,
+        V: Debug,
+    {
+        let async_impl = self.0.clone();
+        spawn_reply(req, reply, async move {
+            let _permit = admit(&*async_impl).await;
+            let result = f.await;
+            if let Some(breaker) = async_impl.circuit_breaker() {
+                breaker.record(&result);
+            }
+            result
+        });
+    }
+
+    fn spawn_request<F>(&self, req: &Request, f: F)
+    where
+        F: Future<Output = ()> + Send + 'static,
+    {
+        let async_impl = self.0.clone();
+        spawn_request(req, async move {
+            let _permit = admit(&*async_impl).await;
+            f.await
+        });
+    }
+}
+
 impl<T: Debug> Debug for AsyncFileSystem<T> {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         self.0.fmt(f)
@@ -225,9 +545,26 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
     fn init(
         &mut self,
         _req: &fuser::Request,
-        _config: &mut fuser::KernelConfig,
+        config: &mut fuser::KernelConfig,
     ) -> std::result::Result<(), nix::libc::c_int> {
-        self.0.init().map_err(|err| err.into())
+        let requested = self
+            .0
+            .init(Capabilities::from_kernel(config))
+            .map_err(|err| err.into())?;
+        if let Err(unsupported) = config.add_capabilities(requested) {
+            warn!("capabilities {:#x} are not supported", unsupported);
+        }
+        if let Some(size) = self.0.max_io_size() {
+            if let Err(nearest) = config.set_max_write(size) {
+                warn!("max write {} is not supported, use {}", size, nearest);
+                let _ = config.set_max_write(nearest);
+            }
+            if let Err(nearest) = config.set_max_readahead(size) {
+                warn!("max readahead {} is not supported, use {}", size, nearest);
+                let _ = config.set_max_readahead(nearest);
+            }
+        }
+        Ok(())
     }
 
     fn destroy(&mut self, _req: &fuser::Request) {
@@ -237,27 +574,25 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
     fn lookup(&mut self, req: &Request, parent: u64, name: &std::ffi::OsStr, reply: ReplyEntry) {
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.lookup(parent, name).await
-        });
+        self.spawn_reply(
+            req,
+            reply,
+            async move { async_impl.lookup(parent, name).await },
+        );
     }
 
-    fn forget(&mut self, _req: &Request, ino: u64, nlookup: u64) {
+    // only FUSE_FORGET is handled. fuser 0.6 doesn't pass FUSE_BATCH_FORGET,
+    // which the kernel sends when several inodes are evicted at once.
+    fn forget(&mut self, req: &Request, ino: u64, nlookup: u64) {
         let async_impl = self.0.clone();
-
-        // TODO: union the spawn function for request without reply
-        spawn(async move {
+        self.spawn_request(req, async move {
             async_impl.forget(ino, nlookup).await;
         });
     }
 
     fn getattr(&mut self, req: &Request, ino: u64, reply: ReplyAttr) {
         let async_impl = self.0.clone();
-        spawn_reply(
-            req.unique(),
-            reply,
-            async move { async_impl.getattr(ino).await },
-        );
+        self.spawn_reply(req, reply, async move { async_impl.getattr(ino).await });
     }
 
     fn setattr(
@@ -279,7 +614,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         reply: ReplyAttr,
     ) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .setattr(
                     ino, mode, uid, gid, size, atime, mtime, ctime, fh, crtime, chgtime, bkuptime,
@@ -291,9 +626,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
 
     fn readlink(&mut self, req: &Request, ino: u64, reply: ReplyData) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.readlink(ino).await
-        });
+        self.spawn_reply(req, reply, async move { async_impl.readlink(ino).await });
     }
     fn mknod(
         &mut self,
@@ -309,7 +642,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         let name = name.to_owned();
         let uid = req.uid();
         let gid = req.gid();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .mknod(parent, name, mode, umask, rdev, uid, gid)
                 .await
@@ -329,23 +662,27 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
 
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.mkdir(parent, name, mode, umask, uid, gid).await
         });
     }
     fn unlink(&mut self, req: &Request, parent: u64, name: &std::ffi::OsStr, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.unlink(parent, name).await
-        });
+        self.spawn_reply(
+            req,
+            reply,
+            async move { async_impl.unlink(parent, name).await },
+        );
     }
     fn rmdir(&mut self, req: &Request, parent: u64, name: &std::ffi::OsStr, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.rmdir(parent, name).await
-        });
+        self.spawn_reply(
+            req,
+            reply,
+            async move { async_impl.rmdir(parent, name).await },
+        );
     }
     fn symlink(
         &mut self,
@@ -360,7 +697,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         let link = link.to_owned();
         let uid = req.uid();
         let gid = req.gid();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.symlink(parent, name, link, uid, gid).await
         });
     }
@@ -377,7 +714,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         let async_impl = self.0.clone();
         let name = name.to_owned();
         let newname = newname.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .rename(parent, name, newparent, newname, flags)
                 .await
@@ -393,15 +730,13 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
     ) {
         let async_impl = self.0.clone();
         let newname = newname.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.link(ino, newparent, newname).await
         });
     }
     fn open(&mut self, req: &Request, ino: u64, flags: i32, reply: ReplyOpen) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.open(ino, flags).await
-        });
+        self.spawn_reply(req, reply, async move { async_impl.open(ino, flags).await });
     }
     fn read(
         &mut self,
@@ -415,7 +750,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         reply: ReplyData,
     ) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .read(ino, fh, offset, size, flags, lock_owner)
                 .await
@@ -435,7 +770,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
     ) {
         let async_impl = self.0.clone();
         let data = data.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .write(ino, fh, offset, data, write_flags, flags, lock_owner)
                 .await
@@ -443,7 +778,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
     }
     fn flush(&mut self, req: &Request, ino: u64, fh: u64, lock_owner: u64, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.flush(ino, fh, lock_owner).await
         });
     }
@@ -458,57 +793,71 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         reply: ReplyEmpty,
     ) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.release(ino, fh, flags, lock_owner, flush).await
         });
     }
     fn fsync(&mut self, req: &Request, ino: u64, fh: u64, datasync: bool, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.fsync(ino, fh, datasync).await
         });
     }
     fn opendir(&mut self, req: &Request, ino: u64, flags: i32, reply: ReplyOpen) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.opendir(ino, flags).await
-        });
+        self.spawn_reply(
+            req,
+            reply,
+            async move { async_impl.opendir(ino, flags).await },
+        );
     }
     fn readdir(
         &mut self,
-        _req: &Request,
+        req: &Request,
         ino: u64,
         fh: u64,
         offset: i64,
         mut reply: ReplyDirectory,
     ) {
         let async_impl = self.0.clone();
-        spawn(async move {
+        self.spawn_request(req, async move {
             match async_impl.readdir(ino, fh, offset, &mut reply).await {
                 Ok(_) => reply.ok(),
                 Err(err) => reply.error(err.into()),
             }
         });
     }
+    fn readdirplus(
+        &mut self,
+        req: &Request,
+        ino: u64,
+        fh: u64,
+        offset: i64,
+        mut reply: ReplyDirectoryPlus,
+    ) {
+        let async_impl = self.0.clone();
+        self.spawn_request(req, async move {
+            match async_impl.readdirplus(ino, fh, offset, &mut reply).await {
+                Ok(_) => reply.ok(),
+                Err(err) => reply.error(err.into()),
+            }
+        });
+    }
     fn releasedir(&mut self, req: &Request, ino: u64, fh: u64, flags: i32, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.releasedir(ino, fh, flags).await
         });
     }
     fn fsyncdir(&mut self, req: &Request, ino: u64, fh: u64, datasync: bool, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.fsyncdir(ino, fh, datasync).await
         });
     }
     fn statfs(&mut self, req: &Request, ino: u64, reply: ReplyStatfs) {
         let async_impl = self.0.clone();
-        spawn_reply(
-            req.unique(),
-            reply,
-            async move { async_impl.statfs(ino).await },
-        );
+        self.spawn_reply(req, reply, async move { async_impl.statfs(ino).await });
     }
     fn setxattr(
         &mut self,
@@ -523,7 +872,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         let async_impl = self.0.clone();
         let name = name.to_owned();
         let value = value.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.setxattr(ino, name, value, flags, position).await
         });
     }
@@ -537,28 +886,32 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
     ) {
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.getxattr(ino, name, size).await
         });
     }
     fn listxattr(&mut self, req: &Request, ino: u64, size: u32, reply: ReplyXattr) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.listxattr(ino, size).await
-        });
+        self.spawn_reply(
+            req,
+            reply,
+            async move { async_impl.listxattr(ino, size).await },
+        );
     }
     fn removexattr(&mut self, req: &Request, ino: u64, name: &std::ffi::OsStr, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl.removexattr(ino, name).await
         });
     }
     fn access(&mut self, req: &Request, ino: u64, mask: i32, reply: ReplyEmpty) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
-            async_impl.access(ino, mask).await
-        });
+        self.spawn_reply(
+            req,
+            reply,
+            async move { async_impl.access(ino, mask).await },
+        );
     }
     fn create(
         &mut self,
@@ -575,7 +928,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
 
         let async_impl = self.0.clone();
         let name = name.to_owned();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .create(parent, name, mode, umask, flags, uid, gid)
                 .await
@@ -594,7 +947,7 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         reply: ReplyLock,
     ) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .getlk(ino, fh, lock_owner, start, end, typ, pid)
                 .await
@@ -614,16 +967,86 @@ impl<T: AsyncFileSystemImpl + 'static> Filesystem for AsyncFileSystem<T> {
         reply: ReplyEmpty,
     ) {
         let async_impl = self.0.clone();
-        spawn_reply(req.unique(), reply, async move {
+        self.spawn_reply(req, reply, async move {
             async_impl
                 .setlk(ino, fh, lock_owner, start, end, typ, pid, sleep)
                 .await
         });
     }
-    fn bmap(&mut self, _req: &Request, ino: u64, blocksize: u32, idx: u64, reply: ReplyBmap) {
+    fn bmap(&mut self, req: &Request, ino: u64, blocksize: u32, idx: u64, reply: ReplyBmap) {
+        let async_impl = self.0.clone();
+        self.spawn_reply(req, reply, async move {
+            async_impl.bmap(ino, blocksize, idx).await
+        });
+    }
+    fn ioctl(
+        &mut self,
+        req: &Request,
+        ino: u64,
+        fh: u64,
+        flags: u32,
+        cmd: u32,
+        in_data: &[u8],
+        out_size: u32,
+        reply: ReplyIoctl,
+    ) {
+        let async_impl = self.0.clone();
+        let in_data = in_data.to_vec();
+        self.spawn_reply(req, reply, async move {
+            async_impl
+                .ioctl(ino, fh, flags, cmd, in_data, out_size)
+                .await
+        });
+    }
+    fn fallocate(
+        &mut self,
+        req: &Request,
+        ino: u64,
+        fh: u64,
+        offset: i64,
+        length: i64,
+        mode: i32,
+        reply: ReplyEmpty,
+    ) {
+        let async_impl = self.0.clone();
+        self.spawn_reply(req, reply, async move {
+            async_impl.fallocate(ino, fh, offset, length, mode).await
+        });
+    }
+    fn copy_file_range(
+        &mut self,
+        req: &Request,
+        ino_in: u64,
+        fh_in: u64,
+        offset_in: i64,
+        ino_out: u64,
+        fh_out: u64,
+        offset_out: i64,
+        len: u64,
+        flags: u32,
+        reply: ReplyWrite,
+    ) {
+        let async_impl = self.0.clone();
+        self.spawn_reply(req, reply, async move {
+            async_impl
+                .copy_file_range(
+                    ino_in, fh_in, offset_in, ino_out, fh_out, offset_out, len, flags,
+                )
+                .await
+        });
+    }
+    fn lseek(
+        &mut self,
+        req: &Request,
+        ino: u64,
+        fh: u64,
+        offset: i64,
+        whence: i32,
+        reply: ReplyLseek,
+    ) {
         let async_impl = self.0.clone();
-        spawn(async move {
-            async_impl.bmap(ino, blocksize, idx, reply).await;
+        self.spawn_reply(req, reply, async move {
+            async_impl.lseek(ino, fh, offset, whence).await
         });
     }
 }
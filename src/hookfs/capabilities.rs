@@ -0,0 +1,115 @@
+use fuser::KernelConfig;
+use serde::Serialize;
+
+// the flags of FUSE_INIT from `fuse_kernel.h`, which fuser 0.6 doesn't name
+// for all the ABI versions, with the minor version of the protocol which
+// introduces them
+const FLAGS: &[(u32, &str, u32)] = &[
+    (1 << 0, "FUSE_ASYNC_READ", 6),
+    (1 << 1, "FUSE_POSIX_LOCKS", 7),
+    (1 << 2, "FUSE_FILE_OPS", 9),
+    (1 << 3, "FUSE_ATOMIC_O_TRUNC", 9),
+    (1 << 4, "FUSE_EXPORT_SUPPORT", 10),
+    (1 << 5, "FUSE_BIG_WRITES", 9),
+    (1 << 6, "FUSE_DONT_MASK", 12),
+    (1 << 7, "FUSE_SPLICE_WRITE", 14),
+    (1 << 8, "FUSE_SPLICE_MOVE", 14),
+    (1 << 9, "FUSE_SPLICE_READ", 14),
+    (1 << 10, "FUSE_FLOCK_LOCKS", 17),
+    (1 << 11, "FUSE_HAS_IOCTL_DIR", 18),
+    (1 << 12, "FUSE_AUTO_INVAL_DATA", 20),
+    (1 << 13, "FUSE_DO_READDIRPLUS", 21),
+    (1 << 14, "FUSE_READDIRPLUS_AUTO", 21),
+    (1 << 15, "FUSE_ASYNC_DIO", 22),
+    (1 << 16, "FUSE_WRITEBACK_CACHE", 23),
+    (1 << 17, "FUSE_NO_OPEN_SUPPORT", 23),
+    (1 << 18, "FUSE_PARALLEL_DIROPS", 25),
+    (1 << 19, "FUSE_HANDLE_KILLPRIV", 26),
+    (1 << 20, "FUSE_POSIX_ACL", 26),
+    (1 << 21, "FUSE_ABORT_ERROR", 27),
+    (1 << 22, "FUSE_MAX_PAGES", 28),
+    (1 << 23, "FUSE_CACHE_SYMLINKS", 28),
+    (1 << 24, "FUSE_NO_OPENDIR_SUPPORT", 29),
+    (1 << 25, "FUSE_EXPLICIT_INVAL_DATA", 30),
+    (1 << 26, "FUSE_MAP_ALIGNMENT", 31),
+    (1 << 27, "FUSE_SUBMOUNTS", 32),
+    (1 << 28, "FUSE_HANDLE_KILLPRIV_V2", 33),
+    (1 << 29, "FUSE_SETXATTR_EXT", 33),
+    (1 << 30, "FUSE_INIT_EXT", 36),
+];
+
+// the kernel sends the POSIX locks to the filesystem with it, rather than
+// keeping them locally
+pub const POSIX_LOCKS: u32 = 1 << 1;
+
+// the kernel buffers the writes in the page cache with it, and sends them
+// to the filesystem later
+pub const WRITEBACK_CACHE: u32 = 1 << 16;
+
+// the version of the FUSE protocol of fuser, which is chosen by the
+// `abi-7-28` feature in Cargo.toml
+const FUSER_MAJOR: u32 = 7;
+const FUSER_MINOR: u32 = 28;
+
+// the kernel never sends this bit, so that probing with it always fails
+const RESERVED_FLAG: u32 = 1 << 31;
+
+// Protocol is the version of the FUSE protocol negotiated in FUSE_INIT
+#[derive(Serialize, Debug, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct Protocol {
+    pub major: u32,
+    pub minor: u32,
+    // whether the minor is known, rather than the lowest one the kernel may
+    // have offered
+    pub exact: bool,
+}
+
+// Capabilities are the flags offered by the kernel in FUSE_INIT
+#[derive(Serialize, Debug, Clone, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct Capabilities {
+    pub flags: u32,
+    pub names: Vec<&'static str>,
+}
+
+impl Capabilities {
+    // from_kernel reads the flags offered by the kernel. `KernelConfig` of
+    // fuser 0.6 has no getter for them, but `add_capabilities` returns the
+    // unsupported ones if any of them is, without requesting the others.
+    pub fn from_kernel(config: &mut KernelConfig) -> Self {
+        let flags = match config.add_capabilities(u32::MAX) {
+            Err(unsupported) => !unsupported & !RESERVED_FLAG,
+            Ok(()) => unreachable!("the reserved flag is never supported"),
+        };
+        Self::from_flags(flags)
+    }
+
+    pub fn from_flags(flags: u32) -> Self {
+        let names = FLAGS
+            .iter()
+            .filter(|(flag, _, _)| flags & flag != 0)
+            .map(|(_, name, _)| *name)
+            .collect();
+        Capabilities { flags, names }
+    }
+
+    // protocol is the version negotiated with the kernel, whose minor is the
+    // lower one of the kernel and fuser. fuser 0.6 doesn't pass the version
+    // of the kernel to `init`, so it's inferred from the newest flag
+    // offered, which is only exact if the kernel is as new as fuser.
+    pub fn protocol(&self) -> Protocol {
+        let kernel = FLAGS
+            .iter()
+            .filter(|(flag, _, _)| self.flags & flag != 0)
+            .map(|(_, _, minor)| *minor)
+            .max()
+            // fuser refuses the kernels older than 7.6
+            .unwrap_or(6);
+        Protocol {
+            major: FUSER_MAJOR,
+            minor: kernel.min(FUSER_MINOR),
+            exact: kernel >= FUSER_MINOR,
+        }
+    }
+}
@@ -0,0 +1,348 @@
+use std::cell::{Cell, RefCell};
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::future::Future;
+use std::os::unix::fs::MetadataExt;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, Instant, SystemTime};
+
+use fuser::Request;
+use once_cell::sync::Lazy;
+
+tokio::task_local! {
+    static REQUEST_CONTEXT: RequestContext;
+}
+
+// the comm and the mount namespace of a pid are cached for `PROC_TTL`, so
+// that they are not read from `/proc` on every operation
+const PROC_TTL: Duration = Duration::from_secs(1);
+
+static COMMS: Lazy<Mutex<HashMap<u32, (Instant, Option<String>)>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+static MNT_NS: Lazy<Mutex<HashMap<u32, (Instant, Option<u64>)>>> =
+    Lazy::new(|| Mutex::new(HashMap::new()));
+
+// the unique ids of the requests seen in `RETRY_WINDOW` are kept, up to
+// `MAX_SEEN_REQUESTS` of them, so that a request sent again by the kernel is
+// told as a retry
+const RETRY_WINDOW: Duration = Duration::from_secs(10);
+const MAX_SEEN_REQUESTS: usize = 65536;
+
+#[derive(Default)]
+struct SeenRequests {
+    uniques: HashSet<u64>,
+    // the unique ids by the time they are seen
+    seen: VecDeque<(Instant, u64)>,
+}
+
+static SEEN_REQUESTS: Lazy<Mutex<SeenRequests>> = Lazy::new(|| Mutex::new(SeenRequests::default()));
+
+// seen records the unique id of a request, and returns whether it has been
+// seen recently
+fn seen(unique: u64) -> bool {
+    let now = Instant::now();
+    let mut requests = SEEN_REQUESTS.lock().unwrap();
+    while let Some((seen_at, unique)) = requests.seen.front().copied() {
+        if now.duration_since(seen_at) < RETRY_WINDOW && requests.seen.len() < MAX_SEEN_REQUESTS {
+            break;
+        }
+        requests.seen.pop_front();
+        requests.uniques.remove(&unique);
+    }
+
+    if !requests.uniques.insert(unique) {
+        return true;
+    }
+    requests.seen.push_back((now, unique));
+    false
+}
+
+// One in every `TRACE_SAMPLE_INTERVAL` requests is traced, and the tracing
+// is disabled if it's 0. The requests are counted rather than sampled by a
+// random number, so that the others only pay for an atomic increment.
+static TRACE_SAMPLE_INTERVAL: AtomicU64 = AtomicU64::new(0);
+static TRACE_SAMPLE_COUNTER: AtomicU64 = AtomicU64::new(0);
+
+// set_trace_sample_rate traces about `rate` of the requests through the
+// injectors with INFO logs. `0` disables the tracing.
+pub fn set_trace_sample_rate(rate: f64) {
+    let interval = if rate > 0f64 {
+        (1f64 / rate).round().max(1f64) as u64
+    } else {
+        0
+    };
+    TRACE_SAMPLE_INTERVAL.store(interval, Ordering::Relaxed);
+}
+
+fn sample() -> bool {
+    let interval = TRACE_SAMPLE_INTERVAL.load(Ordering::Relaxed);
+    interval != 0 && TRACE_SAMPLE_COUNTER.fetch_add(1, Ordering::Relaxed) % interval == 0
+}
+
+// RequestContext carries the information about the caller of a FUSE request.
+// It's set for the whole request, so the injectors can read it without
+// passing it through every method.
+#[derive(Debug, Clone, Default)]
+pub struct RequestContext {
+    pub unique: u64,
+    pub uid: u32,
+    pub gid: u32,
+    pub pid: u32,
+    // the sampled request is traced with INFO logs
+    pub sampled: bool,
+    // the request has the unique id of a recent one, which the kernel sent
+    // again
+    pub retry: bool,
+    // the flags passed to `open` or `create` of the file being operated
+    open_flags: Cell<Option<i32>>,
+    // the cached size of the file being operated
+    file_size: Cell<Option<u64>>,
+    // the creation time of the file being operated, cached when it's opened
+    file_created: Cell<Option<SystemTime>>,
+    // the permission bits of the file being operated, cached when it's opened
+    file_mode: Cell<Option<u32>>,
+    // the inode number of the file being operated
+    ino: Cell<Option<u64>>,
+    // the backing path of the file being operated, where it's read
+    backing_path: RefCell<Option<PathBuf>>,
+    // the command of the ioctl
+    ioctl_command: Cell<Option<u32>>,
+    // the offset and the length of the read, write or fallocate
+    io_range: Cell<Option<(u64, u64)>>,
+    // the `write_flags` of the write, like FUSE_WRITE_CACHE
+    write_flags: Cell<Option<u32>>,
+    // whether an injector has failed the request
+    injected: Cell<bool>,
+}
+
+impl RequestContext {
+    pub fn new(req: &Request) -> Self {
+        Self {
+            unique: req.unique(),
+            uid: req.uid(),
+            gid: req.gid(),
+            pid: req.pid(),
+            sampled: sample(),
+            retry: seen(req.unique()),
+            open_flags: Cell::new(None),
+            file_size: Cell::new(None),
+            file_created: Cell::new(None),
+            file_mode: Cell::new(None),
+            ino: Cell::new(None),
+            backing_path: RefCell::new(None),
+            ioctl_command: Cell::new(None),
+            io_range: Cell::new(None),
+            write_flags: Cell::new(None),
+            injected: Cell::new(false),
+        }
+    }
+
+    pub fn open_flags(&self) -> Option<i32> {
+        self.open_flags.get()
+    }
+
+    // set_open_flags records the open flags of the file for the rest of the
+    // current request. It does nothing outside of a FUSE request.
+    pub fn set_open_flags(flags: i32) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.open_flags.set(Some(flags)));
+    }
+
+    pub fn file_size(&self) -> Option<u64> {
+        self.file_size.get()
+    }
+
+    // set_file_size records the size of the file for the rest of the current
+    // request. It does nothing outside of a FUSE request.
+    pub fn set_file_size(size: u64) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.file_size.set(Some(size)));
+    }
+
+    pub fn file_created(&self) -> Option<SystemTime> {
+        self.file_created.get()
+    }
+
+    // set_file_created records the creation time of the file for the rest of
+    // the current request. It does nothing outside of a FUSE request.
+    pub fn set_file_created(created: SystemTime) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.file_created.set(Some(created)));
+    }
+
+    // file_mode returns the permission bits of the file, which are cached
+    // when it's opened, or read with `lstat` on the backing path for the
+    // operations without a file handle. It's `None` if the file doesn't
+    // exist (yet).
+    pub fn file_mode(&self) -> Option<u32> {
+        if let Some(mode) = self.file_mode.get() {
+            return Some(mode);
+        }
+        let path = self.backing_path.borrow();
+        let metadata = std::fs::symlink_metadata(path.as_ref()?).ok()?;
+        Some(metadata.mode() & 0o7777)
+    }
+
+    // set_file_mode records the permission bits of the file for the rest of
+    // the current request. It does nothing outside of a FUSE request.
+    pub fn set_file_mode(mode: u32) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.file_mode.set(Some(mode)));
+    }
+
+    pub fn ino(&self) -> Option<u64> {
+        self.ino.get()
+    }
+
+    // set_ino records the inode number of the file for the rest of the current
+    // request. It does nothing outside of a FUSE request.
+    pub fn set_ino(ino: u64) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.ino.set(Some(ino)));
+    }
+
+    pub fn ioctl_command(&self) -> Option<u32> {
+        self.ioctl_command.get()
+    }
+
+    pub fn set_ioctl_command(command: u32) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.ioctl_command.set(Some(command)));
+    }
+
+    pub fn io_range(&self) -> Option<(u64, u64)> {
+        self.io_range.get()
+    }
+
+    // set_io_range records the range of the file accessed by the current
+    // request. It does nothing outside of a FUSE request.
+    pub fn set_io_range(offset: i64, length: u64) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.io_range.set(Some((offset as u64, length))));
+    }
+
+    pub fn write_flags(&self) -> Option<u32> {
+        self.write_flags.get()
+    }
+
+    pub fn set_write_flags(flags: u32) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.write_flags.set(Some(flags)));
+    }
+
+    // in_syscall reads `/proc/<pid>/syscall` of the calling thread, which
+    // starts with -1 if it's blocked outside of any syscall, like in a page
+    // fault. It returns `None` if the thread has exited or is running.
+    pub fn in_syscall(&self) -> Option<bool> {
+        let syscall = std::fs::read_to_string(format!("/proc/{}/syscall", self.pid)).ok()?;
+        match syscall.split_whitespace().next()? {
+            "running" => None,
+            "-1" => Some(false),
+            _ => Some(true),
+        }
+    }
+
+    // signal_pending reads `/proc/<pid>/status` of the calling thread, and
+    // returns whether it has a signal pending which it doesn't block, so that
+    // the kernel would interrupt the request. It returns `None` if the thread
+    // has exited.
+    pub fn signal_pending(&self) -> Option<bool> {
+        let status = std::fs::read_to_string(format!("/proc/{}/status", self.pid)).ok()?;
+        let mask = |name: &str| {
+            status
+                .lines()
+                .find_map(|line| line.strip_prefix(name))
+                .and_then(|mask| u64::from_str_radix(mask.trim(), 16).ok())
+                .unwrap_or(0)
+        };
+        let pending = mask("SigPnd:") | mask("ShdPnd:");
+        Some(pending & !mask("SigBlk:") != 0)
+    }
+
+    pub fn backing_path(&self) -> Option<PathBuf> {
+        self.backing_path.borrow().clone()
+    }
+
+    // set_backing_path records the backing path of the file for the rest of
+    // the current request. It does nothing outside of a FUSE request.
+    pub fn set_backing_path(path: &Path) {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.backing_path.replace(Some(path.to_owned())));
+    }
+
+    // is_symlink checks whether the file is a symbolic link with `lstat`, and
+    // returns `None` if it doesn't exist. It's not cached, so that it sees the
+    // link created by the request itself.
+    pub fn is_symlink(&self) -> Option<bool> {
+        let path = self.backing_path.borrow();
+        let metadata = std::fs::symlink_metadata(path.as_ref()?).ok()?;
+        Some(metadata.file_type().is_symlink())
+    }
+
+    pub fn injected(&self) -> bool {
+        self.injected.get()
+    }
+
+    // set_injected records that the error of the current request is injected,
+    // so that it's not taken as the one of the backing filesystem. It does
+    // nothing outside of a FUSE request.
+    pub fn set_injected() {
+        let _ = REQUEST_CONTEXT.try_with(|ctx| ctx.injected.set(true));
+    }
+
+    // comm returns the name of the calling process from `/proc/<pid>/comm`,
+    // and `None` if the process has exited
+    pub fn comm(&self) -> Option<String> {
+        let now = Instant::now();
+        let mut comms = COMMS.lock().unwrap();
+        if let Some((read_at, comm)) = comms.get(&self.pid) {
+            if now.duration_since(*read_at) < PROC_TTL {
+                return comm.clone();
+            }
+        }
+
+        let comm = std::fs::read_to_string(format!("/proc/{}/comm", self.pid))
+            .ok()
+            .map(|comm| comm.trim_end_matches('\n').to_owned());
+        comms.retain(|_, (read_at, _)| now.duration_since(*read_at) < PROC_TTL);
+        comms.insert(self.pid, (now, comm.clone()));
+        comm
+    }
+
+    // mnt_ns returns the mount namespace of the calling process, which is the
+    // inode number of `/proc/<pid>/ns/mnt`, and `None` if the process has
+    // exited
+    pub fn mnt_ns(&self) -> Option<u64> {
+        let now = Instant::now();
+        let mut namespaces = MNT_NS.lock().unwrap();
+        if let Some((read_at, ns)) = namespaces.get(&self.pid) {
+            if now.duration_since(*read_at) < PROC_TTL {
+                return *ns;
+            }
+        }
+
+        let ns = std::fs::metadata(format!("/proc/{}/ns/mnt", self.pid))
+            .ok()
+            .map(|metadata| metadata.ino());
+        namespaces.retain(|_, (read_at, _)| now.duration_since(*read_at) < PROC_TTL);
+        namespaces.insert(self.pid, (now, ns));
+        ns
+    }
+
+    // sampled_id returns the unique id of the request if it's sampled to be
+    // traced. It's cheaper than `current`, as the context is not cloned.
+    pub fn sampled_id() -> Option<u64> {
+        REQUEST_CONTEXT
+            .try_with(|ctx| if ctx.sampled { Some(ctx.unique) } else { None })
+            .ok()
+            .flatten()
+    }
+
+    // is_retry returns whether the request being handled is a retry. It's
+    // cheaper than `current`, as the context is not cloned.
+    pub fn is_retry() -> bool {
+        REQUEST_CONTEXT.try_with(|ctx| ctx.retry).unwrap_or(false)
+    }
+
+    // current returns the context of the request being handled, and `None` if
+    // it's called outside of a FUSE request
+    pub fn current() -> Option<Self> {
+        REQUEST_CONTEXT.try_with(|ctx| ctx.clone()).ok()
+    }
+
+    pub async fn scope<F: Future>(self, f: F) -> F::Output {
+        REQUEST_CONTEXT.scope(self, f).await
+    }
+}
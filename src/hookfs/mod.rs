@@ -1,18 +1,32 @@
 mod async_fs;
+mod capabilities;
+mod context;
 mod errors;
+mod overlay;
 mod reply;
 pub mod runtime;
 mod utils;
 
 use std::collections::{HashMap, LinkedList};
+use std::convert::TryFrom;
 use std::ffi::{CString, OsStr, OsString};
+use std::mem::ManuallyDrop;
 use std::os::unix::ffi::OsStrExt;
-use std::os::unix::io::RawFd;
+use std::os::unix::fs::MetadataExt;
+use std::os::unix::io::{FromRawFd, RawFd};
 use std::path::{Path, PathBuf};
-use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 
-pub use async_fs::{AsyncFileSystem, AsyncFileSystemImpl};
+pub use async_fs::{
+    drain, AsyncFileSystem, AsyncFileSystemImpl, BreakerStatus, CircuitBreaker, ConcurrencyLimit,
+    ConcurrencyStatus,
+};
 use async_trait::async_trait;
+pub use capabilities::{Capabilities, Protocol};
+use capabilities::{POSIX_LOCKS, WRITEBACK_CACHE};
+pub use context::{set_trace_sample_rate, RequestContext};
 use derive_more::{Deref, DerefMut, From};
 pub use errors::{HookFsError as Error, Result};
 use fuser::*;
@@ -22,69 +36,126 @@ use nix::errno::Errno;
 use nix::fcntl::{open, readlink, renameat, OFlag};
 use nix::sys::{stat, statfs};
 use nix::unistd::{
-    close, fchownat, fsync, linkat, mkdir, symlinkat, truncate, unlink, AccessFlags, FchownatFlags,
+    close, fchownat, fdatasync, fsync, linkat, mkdir, symlinkat, truncate, unlink, FchownatFlags,
     Gid, LinkatFlags, Uid,
 };
-pub use reply::Reply;
+pub use overlay::DirEntry;
+use overlay::Overlay;
 use reply::*;
+pub use reply::{Bmap, Data, DirEntries, Reply};
 use runtime::spawn_blocking;
 use slab::Slab;
-use tokio::sync::RwLock;
-use tracing::{debug, error, instrument, trace};
+use tokio::sync::{Mutex, RwLock};
+use tracing::{debug, error, info, instrument, trace, warn};
 use utils::*;
 
 use crate::injector::{Injector, Method, MultiInjector};
+use crate::metrics;
 
 // use fuse::consts::FOPEN_DIRECT_IO;
 
 macro_rules! inject {
-    ($self:ident, $method:ident, $path:expr) => {
-        if $self.enable_injection.load(Ordering::SeqCst) {
+    ($self:ident, method = $method:expr, $path:expr) => {
+        metrics::operation(&$method, &$self.mount_path);
+        if $self.injection_enabled() {
+            $self.set_backing_path($path);
+            let mount_path = $self.rebuild_path($path)?;
+            trace_sampled(&$method, &mount_path);
             $self
-                .injector
-                .read()
+                .current_injector()
                 .await
-                .inject(&Method::$method, $self.rebuild_path($path)?.as_path())
-                .await?;
+                .inject(&$method, &mount_path)
+                .await
+                .map_err(injected)?;
         }
     };
+    ($self:ident, $method:ident, $path:expr) => {
+        inject!($self, method = Method::$method, $path)
+    };
 }
 
 macro_rules! inject_with_ino {
-    ($self:ident, $method:ident, $ino:ident) => {{
+    ($self:ident, method = $method:expr, $ino:ident) => {{
+        RequestContext::set_ino($ino);
         let inode_map = $self.inode_map.read().await;
         if let Ok(path) = inode_map.get_path($ino) {
             let path = path.to_owned();
             trace!("getting attr from path {}", path.display());
             drop(inode_map);
-            inject!($self, $method, &path);
+            inject!($self, method = $method, &path);
         }
     }};
+    ($self:ident, $method:ident, $ino:ident) => {
+        inject_with_ino!($self, method = Method::$method, $ino)
+    };
 }
 
 macro_rules! inject_with_fh {
-    ($self:ident, $method:ident, $fh:ident) => {{
+    ($self:ident, method = $method:expr, $fh:ident) => {{
         let opened_files = $self.opened_files.read().await;
         if let Ok(file) = opened_files.get($fh as usize) {
             let path = file.original_path().to_owned();
+            RequestContext::set_open_flags(file.flags());
+            RequestContext::set_file_size(file.size());
+            RequestContext::set_file_created(file.created());
+            RequestContext::set_file_mode(file.mode());
+            RequestContext::set_ino(file.ino());
             drop(opened_files);
-            inject!($self, $method, &path);
+            inject!($self, method = $method, &path);
+        }
+    }};
+    ($self:ident, $method:ident, $fh:ident) => {
+        inject_with_fh!($self, method = Method::$method, $fh)
+    };
+}
+
+macro_rules! inject_io_with_fh {
+    ($self:ident, $method:ident, $fh:ident, $offset:expr, $length:expr) => {{
+        let opened_files = $self.opened_files.read().await;
+        if let Ok(file) = opened_files.get($fh as usize) {
+            let path = file.original_path().to_owned();
+            RequestContext::set_open_flags(file.flags());
+            RequestContext::set_file_size(file.size());
+            RequestContext::set_file_created(file.created());
+            RequestContext::set_file_mode(file.mode());
+            RequestContext::set_ino(file.ino());
+            RequestContext::set_io_range($offset, $length as u64);
+            drop(opened_files);
+            if $self.injection_enabled() {
+                $self.set_backing_path(&path);
+                let mount_path = $self.rebuild_path(path)?;
+                trace_sampled(&Method::$method, &mount_path);
+                $self
+                    .current_injector()
+                    .await
+                    .inject_io(&Method::$method, &mount_path, $offset, $length)
+                    .await
+                    .map_err(injected)?;
+            }
         }
     }};
 }
 
 macro_rules! inject_write_data {
-    ($self:ident, $fh:ident, $data:ident) => {{
+    ($self:ident, $fh:ident, $offset:ident, $data:ident) => {{
         let opened_files = $self.opened_files.read().await;
         if let Ok(file) = opened_files.get($fh as usize) {
             let path = file.original_path().to_owned();
-            trace!("Write data before inject {:?}", $data);
-            $self
-                .injector
-                .read()
-                .await
-                .inject_write_data($self.rebuild_path(path)?.as_path(), &mut $data)?;
-            trace!("Write data after inject {:?}", $data);
+            RequestContext::set_open_flags(file.flags());
+            RequestContext::set_file_size(file.size());
+            RequestContext::set_file_created(file.created());
+            RequestContext::set_file_mode(file.mode());
+            RequestContext::set_ino(file.ino());
+            if $self.injection_enabled() {
+                $self.set_backing_path(&path);
+                trace!("Write data before inject {:?}", $data);
+                $self
+                    .current_injector()
+                    .await
+                    .inject_write_data($self.rebuild_path(path)?.as_path(), $offset, &mut $data)
+                    .map_err(injected)?;
+                trace!("Write data after inject {:?}", $data);
+            }
         }
     }};
 }
@@ -101,23 +172,25 @@ macro_rules! inject_with_dir_fh {
 }
 
 macro_rules! inject_with_parent_and_name {
-    ($self:ident, $method:ident, $parent:ident, $name:expr) => {{
+    ($self:ident, method = $method:expr, $parent:ident, $name:expr) => {{
         let inode_map = $self.inode_map.read().await;
         if let Ok(parent_path) = inode_map.get_path($parent) {
             let old_path = parent_path.join($name);
             trace!("get path: {}", old_path.display());
             drop(inode_map);
-            inject!($self, $method, old_path.as_path());
+            inject!($self, method = $method, old_path.as_path());
         }
     }};
+    ($self:ident, $method:ident, $parent:ident, $name:expr) => {
+        inject_with_parent_and_name!($self, method = Method::$method, $parent, $name)
+    };
 }
 
 macro_rules! inject_attr {
     ($self:ident, $attr:ident, $path:expr) => {
-        if $self.enable_injection.load(Ordering::SeqCst) {
+        if $self.injection_enabled() {
             $self
-                .injector
-                .read()
+                .current_injector()
                 .await
                 .inject_attr(&mut $attr, $self.rebuild_path($path)?.as_path());
         }
@@ -126,18 +199,158 @@ macro_rules! inject_attr {
 
 macro_rules! inject_reply {
     ($self:ident, $method:ident, $path:expr, $reply:ident, $reply_typ:ident) => {
-        if $self.enable_injection.load(Ordering::SeqCst) {
+        inject_reply!($self, method = Method::$method, $path, $reply, $reply_typ)
+    };
+    ($self:ident, method = $method:expr, $path:expr, $reply:ident, $reply_typ:ident) => {
+        if $self.injection_enabled() {
             trace!("before inject {:?}", $reply);
-            $self.injector.read().await.inject_reply(
-                &Method::$method,
-                $self.rebuild_path($path)?.as_path(),
-                &mut Reply::$reply_typ(&mut $reply),
-            )?;
+            $self
+                .current_injector()
+                .await
+                .inject_reply(
+                    &$method,
+                    $self.rebuild_path($path)?.as_path(),
+                    &mut Reply::$reply_typ(&mut $reply),
+                )
+                .map_err(injected)?;
             trace!("after inject {:?}", $reply);
         }
     };
 }
 
+// trace_sampled logs the operation if the request is sampled to be traced
+fn trace_sampled(method: &Method, path: &Path) {
+    if let Some(id) = RequestContext::sampled_id() {
+        info!(id, method = %method.name(), path = %path.display(), "sampled request");
+    }
+}
+
+// FIGETBSZ and FIBMAP are `_IO(0x00, 2)` and `_IO(0x00, 1)` in linux/fs.h
+const FIGETBSZ: libc::c_ulong = 2;
+const FIBMAP: libc::c_ulong = 1;
+
+// backing_bmap maps the block `idx` of `blocksize` bytes in the backing file
+// to the block of the device with FIBMAP. The backing filesystem may not map
+// the blocks (like tmpfs, or a filesystem on another FUSE), or toda may not be
+// allowed to, and then the block is reported as unmapped rather than failing.
+fn backing_bmap(path: &Path, blocksize: u32, idx: u64) -> Result<u64> {
+    let fd = open(
+        path,
+        OFlag::O_RDONLY | OFlag::O_CLOEXEC,
+        stat::Mode::empty(),
+    )?;
+    let result = map_block(fd, blocksize as u64, idx);
+    close(fd)?;
+
+    match result {
+        Err(Error::Sys(errno))
+            if [
+                Errno::ENOTTY,
+                Errno::EINVAL,
+                Errno::EOPNOTSUPP,
+                Errno::EPERM,
+            ]
+            .contains(&errno) =>
+        {
+            debug!("backing file doesn't support bmap: {}", errno);
+            Ok(0)
+        }
+        result => result,
+    }
+}
+
+fn map_block(fd: RawFd, blocksize: u64, idx: u64) -> Result<u64> {
+    if blocksize == 0 {
+        return Err(Error::Sys(Errno::EINVAL));
+    }
+    let mut backing_blocksize: libc::c_int = 0;
+    Errno::result(unsafe { libc::ioctl(fd, FIGETBSZ as _, &mut backing_blocksize) })?;
+    if backing_blocksize <= 0 {
+        return Err(Error::Sys(Errno::EINVAL));
+    }
+    let backing_blocksize = backing_blocksize as u64;
+
+    // the backing filesystem may use another block size than the kernel asks
+    // for, so the block is mapped through the offset in bytes
+    let offset = idx * blocksize;
+    let mut block =
+        libc::c_int::try_from(offset / backing_blocksize).map_err(|_| Error::Sys(Errno::EFBIG))?;
+    Errno::result(unsafe { libc::ioctl(fd, FIBMAP as _, &mut block) })?;
+    if block <= 0 {
+        return Ok(0);
+    }
+    Ok((block as u64 * backing_blocksize + offset % backing_blocksize) / blocksize)
+}
+
+// The ioctls in linux/fs.h which are passed through to the backing file, as
+// their arguments are plain data (or an fd for FICLONE). The others may carry
+// pointers into the caller, so they are rejected with ENOTTY.
+const FS_IOC_GETFLAGS: u32 = 0x8008_6601;
+const FS_IOC_SETFLAGS: u32 = 0x4008_6602;
+const FS_IOC_GETVERSION: u32 = 0x8008_7601;
+const FS_IOC_FSGETXATTR: u32 = 0x801c_581f;
+const FS_IOC_FSSETXATTR: u32 = 0x401c_5820;
+const FICLONE: u32 = 0x4004_9409;
+
+// SAFE_IOCTLS lists the passed through ioctls, with whether they change the
+// file, which is refused on a read-only mount
+const SAFE_IOCTLS: &[(u32, bool)] = &[
+    (FS_IOC_GETFLAGS, false),
+    (FS_IOC_SETFLAGS, true),
+    (FS_IOC_GETVERSION, false),
+    (FS_IOC_FSGETXATTR, false),
+    (FS_IOC_FSSETXATTR, true),
+    (FICLONE, true),
+];
+
+// setattr_method returns the methods of the changes in the setattr. A
+// setattr changing the size is a truncate, though the kernel may also change
+// the times with it.
+fn setattr_method(
+    mode: Option<u32>,
+    uid: Option<u32>,
+    gid: Option<u32>,
+    size: Option<u64>,
+    atime: Option<&TimeOrNow>,
+    mtime: Option<&TimeOrNow>,
+) -> Method {
+    let mut method = Method::empty();
+    if mode.is_some() {
+        method |= Method::CHMOD;
+    }
+    if uid.is_some() || gid.is_some() {
+        method |= Method::CHOWN;
+    }
+    if size.is_some() {
+        method |= Method::TRUNCATE;
+    } else if atime.is_some() || mtime.is_some() {
+        method |= Method::UTIMENS;
+    }
+    if method.is_empty() {
+        method = Method::SETATTR;
+    }
+    method
+}
+
+// PAUSED stops the injection of all the mounts at once, while the injectors
+// are kept to be resumed
+static PAUSED: AtomicBool = AtomicBool::new(false);
+
+pub fn set_paused(paused: bool) {
+    PAUSED.store(paused, Ordering::SeqCst);
+}
+
+pub fn paused() -> bool {
+    PAUSED.load(Ordering::SeqCst)
+}
+
+// injected marks the error returned by the injectors, so that it's not counted
+// by the circuit breaker
+fn injected(err: Error) -> Error {
+    RequestContext::set_injected();
+    err
+}
+
 #[derive(Debug)]
 pub struct HookFs {
     mount_path: PathBuf,
@@ -149,10 +362,46 @@ pub struct HookFs {
 
     opened_dirs: RwLock<FhMap<Dir>>,
 
-    pub injector: RwLock<MultiInjector>,
+    // the backing fds holding the POSIX locks of every lock owner on an inode.
+    // They are locked with OFD locks, which conflict between the fds as the
+    // POSIX locks do between the processes, and are released by closing.
+    lock_fds: RwLock<HashMap<(u64, u64), RawFd>>,
+
+    // The injectors are swapped as a whole on update. Every request holds its
+    // own reference to the injectors, so it's not blocked by the update and
+    // finishes with the injectors it started with.
+    injector: RwLock<Arc<MultiInjector>>,
 
     // map from inode to real path
     inode_map: RwLock<InodeMap>,
+
+    concurrency_limit: Option<ConcurrencyLimit>,
+
+    // the changes are redirected to the overlay if it's set, and the backing
+    // directory is never changed
+    overlay: Option<Arc<Overlay>>,
+
+    // the injection is disabled while the breaker is open
+    circuit_breaker: Option<CircuitBreaker>,
+
+    // the capabilities offered by the kernel, which are known after mounted
+    capabilities: std::sync::RwLock<Option<Capabilities>>,
+
+    // the kernel splits the reads and the writes beyond it if it's set
+    max_io_size: Option<u32>,
+
+    // a copy of the data is written to the same path in `shadow` before it's
+    // corrupted, so that the files can be compared afterwards
+    shadow: Option<PathBuf>,
+
+    // the writeback cache is requested if it's set, unless the writes are
+    // injected, and `writeback` tells whether it has been
+    writeback_cache: bool,
+    writeback: AtomicBool,
+
+    // all the changes fail with EROFS while it's set, like a filesystem
+    // remounted read-only after an error
+    readonly: AtomicBool,
 }
 
 #[derive(Debug, Default)]
@@ -199,12 +448,23 @@ impl InodeMap {
         }
     }
 
-    fn decrease_ref(&mut self, inode: u64, nlookup: u64) {
-        if let Some(node) = self.0.get_mut(&inode) {
-            if node.ref_count <= nlookup {
-                self.0.remove(&inode);
+    // decrease_ref returns whether the inode is removed, once the kernel has
+    // forgotten all of its lookups. The root is never removed.
+    fn decrease_ref(&mut self, inode: u64, nlookup: u64) -> bool {
+        if inode == 1 {
+            return false;
+        }
+        match self.0.get_mut(&inode) {
+            Some(node) => {
+                node.ref_count = node.ref_count.saturating_sub(nlookup);
+                if node.ref_count > 0 {
+                    return false;
+                }
             }
+            None => return false,
         }
+        self.0.remove(&inode);
+        true
     }
 
     fn insert_path<P: AsRef<Path>>(&mut self, inode: u64, path: P) {
@@ -224,6 +484,35 @@ impl InodeMap {
             }
         }
     }
+
+    // rename_paths moves the paths under `from` (including itself) to under
+    // `to`, so that the children of a renamed directory are kept. The paths
+    // under `to` are moved to under `from` if they are exchanged, or removed
+    // as they have been replaced.
+    fn rename_paths(&mut self, from: &Path, to: &Path, exchange: bool) {
+        let rebase = |base: &Path, rest: &Path| {
+            if rest.as_os_str().is_empty() {
+                base.to_owned()
+            } else {
+                base.join(rest)
+            }
+        };
+        for node in self.0.values_mut() {
+            node.paths = std::mem::take(&mut node.paths)
+                .into_iter()
+                .filter_map(|path| {
+                    if let Ok(rest) = path.strip_prefix(from) {
+                        return Some(rebase(to, rest));
+                    }
+                    match path.strip_prefix(to) {
+                        Ok(rest) if exchange => Some(rebase(from, rest)),
+                        Ok(_) => None,
+                        Err(_) => Some(path),
+                    }
+                })
+                .collect();
+        }
+    }
 }
 
 #[derive(Debug, Deref, DerefMut, From)]
@@ -238,12 +527,21 @@ impl<T> FhMap<T> {
             .get_mut(key)
             .ok_or(Error::FhNotFound { fh: key as u64 })
     }
+    fn take(&mut self, key: usize) -> Result<T> {
+        if self.0.contains(key) {
+            Ok(self.0.remove(key))
+        } else {
+            Err(Error::FhNotFound { fh: key as u64 })
+        }
+    }
 }
 
 #[derive(Debug)]
 pub struct Dir {
     dir: dir::Dir,
     original_path: PathBuf,
+    // the changed listing replied from the offset 0, see `dir_entries`
+    listing: Option<Vec<DirEntry>>,
 }
 
 impl Dir {
@@ -251,6 +549,7 @@ impl Dir {
         Dir {
             dir,
             original_path: path.as_ref().to_owned(),
+            listing: None,
         }
     }
     fn original_path(&self) -> &Path {
@@ -276,18 +575,66 @@ impl std::ops::DerefMut for Dir {
 pub struct File {
     pub fd: RawFd,
     original_path: PathBuf,
+    // the flags passed to `open` or `create`, before they are filtered
+    flags: i32,
+    // the size when the file is opened, and grows with the writes through it
+    size: AtomicU64,
+    // the birth time of the backing file, or the modification time when it's
+    // opened if the backing filesystem doesn't record the birth time
+    created: SystemTime,
+    // the permission bits of the backing file when it's opened
+    mode: u32,
+    ino: u64,
+    // the appends through the file are serialized, so that the end of the
+    // file doesn't move between finding it and writing there
+    appending: Arc<Mutex<()>>,
 }
 
 impl File {
-    fn new<P: AsRef<Path>>(fd: RawFd, path: P) -> File {
+    fn new<P: AsRef<Path>>(
+        fd: RawFd,
+        path: P,
+        flags: i32,
+        size: u64,
+        created: SystemTime,
+        mode: u32,
+        ino: u64,
+    ) -> File {
         File {
             fd,
             original_path: path.as_ref().to_owned(),
+            flags,
+            size: AtomicU64::new(size),
+            created,
+            mode,
+            ino,
+            appending: Arc::new(Mutex::new(())),
         }
     }
     fn original_path(&self) -> &Path {
         &self.original_path
     }
+    fn flags(&self) -> i32 {
+        self.flags
+    }
+    fn size(&self) -> u64 {
+        self.size.load(Ordering::Relaxed)
+    }
+    fn created(&self) -> SystemTime {
+        self.created
+    }
+    fn mode(&self) -> u32 {
+        self.mode
+    }
+    fn ino(&self) -> u64 {
+        self.ino
+    }
+    fn grow(&self, end: u64) {
+        self.size.fetch_max(end, Ordering::Relaxed);
+    }
+    fn is_append(&self) -> bool {
+        self.flags & libc::O_APPEND != 0
+    }
 }
 
 unsafe impl Send for Dir {}
@@ -309,10 +656,140 @@ impl HookFs {
             original_path: original_path.as_ref().to_owned(),
             opened_files: RwLock::new(FhMap::from(Slab::new())),
             opened_dirs: RwLock::new(FhMap::from(Slab::new())),
-            injector: RwLock::new(injector),
+            lock_fds: RwLock::new(HashMap::new()),
+            injector: RwLock::new(Arc::new(injector)),
             inode_map,
             enable_injection: AtomicBool::from(false),
+            concurrency_limit: None,
+            overlay: None,
+            circuit_breaker: None,
+            capabilities: std::sync::RwLock::new(None),
+            max_io_size: None,
+            shadow: None,
+            writeback_cache: false,
+            writeback: AtomicBool::new(false),
+            readonly: AtomicBool::new(false),
+        }
+    }
+
+    // with_concurrency_limit makes the requests beyond `limit` wait until the
+    // others finish
+    pub fn with_concurrency_limit(mut self, limit: usize) -> Self {
+        self.concurrency_limit = Some(ConcurrencyLimit::new(limit));
+        self
+    }
+
+    // with_overlay redirects the changes to `upper`, which should exist, and
+    // the backing directory can be read-only. A file is copied up to `upper`
+    // on its first change.
+    pub fn with_overlay<P: AsRef<Path>>(mut self, upper: P) -> Self {
+        self.overlay = Some(Arc::new(Overlay::new(&self.original_path, upper)));
+        self
+    }
+
+    // with_circuit_breaker disables the injection after `threshold`
+    // consecutive errors from the backing filesystem, until there is no error
+    // in `cooldown`
+    pub fn with_circuit_breaker(mut self, threshold: u64, cooldown: Duration) -> Self {
+        self.circuit_breaker = Some(CircuitBreaker::new(threshold, cooldown));
+        self
+    }
+
+    // with_max_io_size makes the kernel split the writes and the readahead
+    // into the requests of at most `size` bytes. The reads are only capped
+    // if the filesystem is also mounted with `max_read`.
+    pub fn with_max_io_size(mut self, size: u32) -> Self {
+        self.max_io_size = Some(size);
+        self
+    }
+
+    // with_shadow writes a copy of the data to the same path in `shadow`
+    // before it's corrupted, which should exist. The reads are still served
+    // from the backing directory.
+    pub fn with_shadow<P: AsRef<Path>>(mut self, shadow: P) -> Self {
+        self.shadow = Some(shadow.as_ref().to_owned());
+        self
+    }
+
+    // with_writeback_cache requests the writeback cache of the kernel, which
+    // buffers the writes and sends them later. It's not requested if the
+    // injectors inject the writes when mounted, as the faults would not reach
+    // the writes of the app.
+    pub fn with_writeback_cache(mut self) -> Self {
+        self.writeback_cache = true;
+        self
+    }
+
+    pub fn breaker(&self) -> Option<BreakerStatus> {
+        self.circuit_breaker
+            .as_ref()
+            .map(|breaker| breaker.status())
+    }
+
+    pub fn capabilities(&self) -> Option<Capabilities> {
+        self.capabilities.read().unwrap().clone()
+    }
+
+    pub fn concurrency(&self) -> Option<ConcurrencyStatus> {
+        self.concurrency_limit.as_ref().map(|limit| limit.status())
+    }
+
+    // inodes returns how many inodes are known by the kernel, including the
+    // root
+    pub async fn inodes(&self) -> usize {
+        self.inode_map.read().await.len()
+    }
+
+    pub async fn current_injector(&self) -> Arc<MultiInjector> {
+        self.injector.read().await.clone()
+    }
+
+    pub async fn update_injector(&self, injector: MultiInjector) {
+        if self.writeback.load(Ordering::Relaxed) && injector.injects(&Method::WRITE) {
+            warn!(
+                "writeback cache of {} buffers the writes, which are injected when flushed",
+                self.mount_path.display()
+            );
         }
+        *self.injector.write().await = Arc::new(injector);
+    }
+
+    async fn copy_by_read_write(
+        &self,
+        ino_in: u64,
+        fh_in: u64,
+        mut offset_in: i64,
+        ino_out: u64,
+        fh_out: u64,
+        mut offset_out: i64,
+        len: u64,
+    ) -> Result<u64> {
+        const CHUNK_SIZE: u64 = 128 * 1024;
+
+        let mut copied = 0;
+        while copied < len {
+            let size = std::cmp::min(CHUNK_SIZE, len - copied) as u32;
+            let data = self
+                .read(ino_in, fh_in, offset_in, size, 0, None)
+                .await?
+                .data;
+            if data.is_empty() {
+                break;
+            }
+            let read = data.len() as u64;
+
+            let written = self
+                .write(ino_out, fh_out, offset_out, data, 0, 0, None)
+                .await?
+                .size as u64;
+            copied += written;
+            offset_in += written as i64;
+            offset_out += written as i64;
+            if written < read {
+                break;
+            }
+        }
+        Ok(copied)
     }
 
     pub fn enable_injection(&self) {
@@ -323,6 +800,42 @@ impl HookFs {
         self.enable_injection.store(false, Ordering::SeqCst);
     }
 
+    pub fn set_readonly(&self, readonly: bool) {
+        self.readonly.store(readonly, Ordering::SeqCst);
+    }
+
+    pub fn readonly(&self) -> bool {
+        self.readonly.load(Ordering::SeqCst)
+    }
+
+    // check_readonly fails the change with EROFS before it's injected or
+    // applied, if the filesystem is made read-only. It's paused with the
+    // injectors.
+    fn check_readonly(&self) -> Result<()> {
+        if self.readonly() && !paused() {
+            trace!("fail the change as the filesystem is read-only");
+            return Err(injected(Error::Sys(Errno::EROFS)));
+        }
+        Ok(())
+    }
+
+    fn injection_enabled(&self) -> bool {
+        !paused()
+            && self.enable_injection.load(Ordering::SeqCst)
+            && !self
+                .circuit_breaker
+                .as_ref()
+                .map_or(false, |breaker| breaker.is_open())
+    }
+
+    pub fn mount_path(&self) -> &Path {
+        &self.mount_path
+    }
+
+    pub fn original_path(&self) -> &Path {
+        &self.original_path
+    }
+
     pub fn rebuild_path<P: AsRef<Path>>(&self, path: P) -> Result<PathBuf> {
         let path_tail = path.as_ref().strip_prefix(self.original_path.as_path())?;
         let path = self.mount_path.join(path_tail);
@@ -332,10 +845,239 @@ impl HookFs {
 }
 
 impl HookFs {
+    // resolve returns the path where the file is read, which is in the upper
+    // directory if it has been changed with the overlay
+    fn resolve(&self, path: &Path) -> Result<PathBuf> {
+        match &self.overlay {
+            Some(overlay) => overlay.resolve(path),
+            None => Ok(path.to_owned()),
+        }
+    }
+
+    // shadow_write writes the data to the copy of the file in the shadow
+    // directory, before the injectors change it. The copy is made from the
+    // backing file on its first write. A failure is only logged, so that the
+    // write of the app goes on.
+    async fn shadow_write(&self, fh: u64, offset: i64, data: &[u8]) {
+        let shadow = match &self.shadow {
+            Some(shadow) => shadow,
+            None => return,
+        };
+        let opened_files = self.opened_files.read().await;
+        let path = match opened_files.get(fh as usize) {
+            Ok(file) => file.original_path().to_owned(),
+            Err(_) => return,
+        };
+        drop(opened_files);
+
+        let shadow_path = match path.strip_prefix(&self.original_path) {
+            Ok(tail) => shadow.join(tail),
+            Err(_) => return,
+        };
+        let backing_path = match self.resolve(&path) {
+            Ok(backing_path) => backing_path,
+            Err(_) => return,
+        };
+        let data = data.to_vec();
+        let written = spawn_blocking(move || -> Result<()> {
+            use std::os::unix::fs::FileExt;
+
+            if std::fs::symlink_metadata(&shadow_path).is_err() {
+                if let Some(parent) = shadow_path.parent() {
+                    std::fs::create_dir_all(parent)?;
+                }
+                std::fs::copy(&backing_path, &shadow_path)?;
+            }
+            let file = std::fs::OpenOptions::new().write(true).open(&shadow_path)?;
+            file.write_all_at(&data, offset as u64)?;
+            Ok(())
+        })
+        .await;
+        match written {
+            Ok(Ok(())) => trace!("write shadow of {}", path.display()),
+            Ok(Err(err)) => warn!("fail to write shadow of {}: {}", path.display(), err),
+            Err(err) => warn!("fail to write shadow of {}: {}", path.display(), err),
+        }
+    }
+
+    // clone_source opens the source of FICLONE, whose argument is the fd in
+    // the caller. A file in the mount is opened in the backing directory, as
+    // the clone can't cross the filesystems.
+    async fn clone_source(&self, in_data: &[u8]) -> Result<RawFd> {
+        if in_data.len() < 4 {
+            return Err(Error::Sys(Errno::EINVAL));
+        }
+        let source_fd = i32::from_ne_bytes([in_data[0], in_data[1], in_data[2], in_data[3]]);
+        let pid = RequestContext::current()
+            .map(|ctx| ctx.pid)
+            .ok_or(Error::Sys(Errno::EBADF))?;
+
+        let link = async_readlink(Path::new(&format!("/proc/{}/fd/{}", pid, source_fd))).await?;
+        let link = PathBuf::from(link);
+        let path = match link.strip_prefix(&self.mount_path) {
+            Ok(tail) => self.resolve(&self.original_path.join(tail))?,
+            Err(_) => link,
+        };
+        trace!("clone from {}", path.display());
+
+        Ok(spawn_blocking(move || {
+            open(
+                &path,
+                OFlag::O_RDONLY | OFlag::O_CLOEXEC,
+                stat::Mode::empty(),
+            )
+        })
+        .await??)
+    }
+
+    // create_method returns OPEN for the create of a file which exists in the
+    // backing directory without O_EXCL. The kernel sends create for the files
+    // it has cached as missing, which may have been created in the backing
+    // directory since then, and it's only an open of the existing file.
+    async fn create_method(&self, parent: u64, name: &OsStr, flags: i32) -> Method {
+        if flags & libc::O_EXCL != 0 {
+            return Method::CREATE;
+        }
+        let inode_map = self.inode_map.read().await;
+        let exists = match inode_map.get_path(parent) {
+            Ok(parent_path) => self
+                .resolve(&parent_path.join(name))
+                .map_or(false, |path| path.symlink_metadata().is_ok()),
+            Err(_) => false,
+        };
+        if exists {
+            Method::OPEN
+        } else {
+            Method::CREATE
+        }
+    }
+
+    // writable returns the path where the file is changed. With the overlay,
+    // it's copied up on the first change.
+    async fn writable(&self, path: &Path) -> Result<PathBuf> {
+        match &self.overlay {
+            Some(overlay) => {
+                let overlay = overlay.clone();
+                let path = path.to_owned();
+                spawn_blocking(move || overlay.writable(&path)).await?
+            }
+            None => Ok(path.to_owned()),
+        }
+    }
+
+    // set_backing_path records where the file is read for the filters, like
+    // the one of `is_symlink`
+    fn set_backing_path<P: AsRef<Path>>(&self, path: P) {
+        if let Ok(path) = self.resolve(path.as_ref()) {
+            RequestContext::set_backing_path(&path);
+        }
+    }
+
+    fn ino(&self, path: &Path, ino: u64) -> u64 {
+        match &self.overlay {
+            Some(overlay) => overlay.ino(path, ino),
+            None => ino,
+        }
+    }
+
+    // dir_entries returns the entries of the opened directory for the page
+    // from `offset`. The page from 0 lists the directory again, and the
+    // others continue the listing before if it has been changed by the
+    // injectors, so that the pages neither repeat nor miss an entry.
+    async fn dir_entries(
+        &self,
+        method: Method,
+        fh: u64,
+        offset: i64,
+    ) -> Result<(PathBuf, Vec<Result<DirEntry>>)> {
+        if offset != 0 {
+            let opened_dirs = self.opened_dirs.read().await;
+            let dir = opened_dirs.get(fh as usize)?;
+            if let Some(entries) = &dir.listing {
+                let entries = entries.iter().cloned().map(Ok).collect();
+                return Ok((dir.original_path().to_owned(), entries));
+            }
+        }
+
+        let (dir_path, entries) = self.list_dir(fh).await?;
+        // the listing with an error is replied as it is
+        if offset != 0 || !entries.iter().all(|entry| entry.is_ok()) {
+            return Ok((dir_path, entries));
+        }
+        let entries = entries.into_iter().filter_map(|entry| entry.ok()).collect();
+        let mut reply = DirEntries::new(entries);
+        inject_reply!(self, method = method, &dir_path, reply, DirEntries);
+
+        if let Ok(dir) = self.opened_dirs.write().await.get_mut(fh as usize) {
+            dir.listing = if reply.changed {
+                Some(reply.entries.clone())
+            } else {
+                None
+            };
+        }
+        Ok((dir_path, reply.entries.into_iter().map(Ok).collect()))
+    }
+
+    // list_dir lists the opened directory. With the overlay, the upper files
+    // are listed over the lower ones.
+    async fn list_dir(&self, fh: u64) -> Result<(PathBuf, Vec<Result<DirEntry>>)> {
+        let (dir_path, entries) = {
+            let mut opened_dirs = self.opened_dirs.write().await;
+            let dir = opened_dirs.get_mut(fh as usize)?;
+            let entries = match self.overlay {
+                Some(_) => Vec::new(),
+                None => dir
+                    .iter()
+                    .map(|entry| -> Result<DirEntry> {
+                        let entry = entry?;
+                        Ok(DirEntry {
+                            ino: entry.ino(),
+                            kind: entry.file_type().map(convert_filetype),
+                            name: OsStr::from_bytes(entry.file_name().to_bytes()).to_owned(),
+                        })
+                    })
+                    .collect(),
+            };
+            (dir.original_path().to_owned(), entries)
+        };
+
+        let overlay = match &self.overlay {
+            Some(overlay) => overlay.clone(),
+            None => return Ok((dir_path, entries)),
+        };
+        let path = dir_path.clone();
+        let entries = spawn_blocking(move || -> Result<_> {
+            let dot = std::fs::metadata(overlay.resolve(&path)?)?.ino();
+            let dotdot = match path.parent() {
+                Some(parent) if path != overlay.lower() => {
+                    std::fs::metadata(overlay.resolve(parent)?)?.ino()
+                }
+                _ => dot,
+            };
+            let mut entries = vec![
+                DirEntry {
+                    ino: overlay.ino(&path, dot),
+                    kind: Some(FileType::Directory),
+                    name: OsString::from("."),
+                },
+                DirEntry {
+                    ino: dotdot,
+                    kind: Some(FileType::Directory),
+                    name: OsString::from(".."),
+                },
+            ];
+            entries.extend(overlay.entries(&path)?);
+            Ok(entries)
+        })
+        .await??;
+        Ok((dir_path, entries.into_iter().map(Ok).collect()))
+    }
+
     async fn get_file_attr(&self, path: &Path) -> Result<FileAttr> {
-        let mut attr = async_stat(&path)
+        let mut attr = async_stat(&self.resolve(path)?)
             .await
             .map(convert_libc_stat_to_fuse_stat)??;
+        attr.ino = self.ino(path, attr.ino);
 
         trace!("before inject attr {:?}", &attr);
         inject_attr!(self, attr, path);
@@ -347,12 +1089,51 @@ impl HookFs {
 
 #[async_trait]
 impl AsyncFileSystemImpl for HookFs {
-    fn init(&self) -> Result<()> {
+    fn concurrency_limit(&self) -> Option<&ConcurrencyLimit> {
+        self.concurrency_limit.as_ref()
+    }
+
+    fn circuit_breaker(&self) -> Option<&CircuitBreaker> {
+        self.circuit_breaker.as_ref()
+    }
+
+    fn max_io_size(&self) -> Option<u32> {
+        self.max_io_size
+    }
+
+    fn init(&self, capabilities: Capabilities) -> Result<u32> {
         trace!("init");
+        info!(
+            "kernel FUSE capabilities of {}: {:#x} {}",
+            self.mount_path.display(),
+            capabilities.flags,
+            capabilities.names.join(" ")
+        );
+        let mut requested = 0;
+        if self.writeback_cache {
+            if capabilities.flags & WRITEBACK_CACHE == 0 {
+                info!("writeback cache is not offered by the kernel");
+            } else if futures::executor::block_on(self.current_injector()).injects(&Method::WRITE) {
+                info!(
+                    "writeback cache is not requested for {}, as the writes are injected",
+                    self.mount_path.display()
+                );
+            } else {
+                info!("writeback cache is requested for {}", self.mount_path.display());
+                self.writeback.store(true, Ordering::Relaxed);
+                requested |= WRITEBACK_CACHE;
+            }
+        }
+        // the locks are forwarded to the backing files, so that they can be
+        // injected
+        if capabilities.flags & POSIX_LOCKS != 0 {
+            requested |= POSIX_LOCKS;
+        }
+        *self.capabilities.write().unwrap() = Some(capabilities);
 
         stat::umask(stat::Mode::from_bits_truncate(0));
 
-        Ok(())
+        Ok(requested)
     }
 
     fn destroy(&self) {
@@ -389,7 +1170,13 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn forget(&self, ino: u64, nlookup: u64) {
         trace!("forget");
-        self.inode_map.write().await.decrease_ref(ino, nlookup)
+        if !self.inode_map.write().await.decrease_ref(ino, nlookup) {
+            return;
+        }
+        trace!("remove {} from inode_map", ino);
+        // the state of the injectors replaced since the lookup is already
+        // dropped with them
+        self.current_injector().await.forget(ino);
     }
 
     #[instrument(skip(self))]
@@ -429,25 +1216,30 @@ impl AsyncFileSystemImpl for HookFs {
         _flags: Option<u32>,
     ) -> Result<Attr> {
         trace!("setattr");
-        inject_with_ino!(self, SETATTR, ino);
+        let method = setattr_method(mode, uid, gid, size, atime.as_ref(), mtime.as_ref());
+        if method != Method::SETATTR {
+            self.check_readonly()?;
+        }
+        inject_with_ino!(self, method = method, ino);
 
         // TODO: support setattr with fh
 
         let inode_map = self.inode_map.read().await;
         let path = inode_map.get_path(ino)?;
+        let target = self.writable(path).await?;
 
-        async_lchown(&path, uid, gid).await?;
+        async_lchown(&target, uid, gid).await?;
 
         if let Some(mode) = mode {
-            async_fchmodat(&path, mode).await?;
+            async_fchmodat(&target, mode).await?;
         }
 
         if let Some(size) = size {
-            async_truncate(&path, size as i64).await?;
+            async_truncate(&target, size as i64).await?;
         }
 
         let times = [convert_time(atime), convert_time(mtime)];
-        let cpath = CString::new(path.as_os_str().as_bytes())?;
+        let cpath = CString::new(target.as_os_str().as_bytes())?;
         async_utimensat(cpath, times).await?;
 
         let stat = self.get_file_attr(&path).await?;
@@ -466,7 +1258,7 @@ impl AsyncFileSystemImpl for HookFs {
         let inode_map = self.inode_map.read().await;
         let link_path = inode_map.get_path(ino)?;
 
-        let path = async_readlink(&link_path).await?;
+        let path = async_readlink(&self.resolve(link_path)?).await?;
 
         let path = CString::new(path.as_os_str().as_bytes())?;
 
@@ -491,18 +1283,19 @@ impl AsyncFileSystemImpl for HookFs {
         gid: u32,
     ) -> Result<Entry> {
         trace!("mknod");
+        self.check_readonly()?;
         inject_with_parent_and_name!(self, MKNOD, parent, &name);
 
         let mut inode_map = self.inode_map.write().await;
         let parent_path = inode_map.get_path(parent)?;
         let path = parent_path.join(&name);
-        inject!(self, MKNOD, path.as_path());
-        let cpath = CString::new(path.as_os_str().as_bytes())?;
+        let target = self.writable(&path).await?;
+        let cpath = CString::new(target.as_os_str().as_bytes())?;
 
         trace!("mknod for {:?}", cpath);
 
         async_mknod(cpath, mode, rdev as u64).await?;
-        async_lchown(&path, Some(uid), Some(gid)).await?;
+        async_lchown(&target, Some(uid), Some(gid)).await?;
 
         let stat = self.get_file_attr(&path).await?;
         inode_map.insert_path(stat.ino, path.clone());
@@ -524,6 +1317,7 @@ impl AsyncFileSystemImpl for HookFs {
         gid: u32,
     ) -> Result<Entry> {
         trace!("mkdir");
+        self.check_readonly()?;
         inject_with_parent_and_name!(self, MKDIR, parent, &name);
 
         let mut inode_map = self.inode_map.write().await;
@@ -532,11 +1326,13 @@ impl AsyncFileSystemImpl for HookFs {
             parent_path.join(&name)
         };
 
+        let target = self.writable(&path).await?;
+
         let mode = stat::Mode::from_bits_truncate(mode);
         trace!("create directory with mode: {:?}", mode);
-        async_mkdir(&path, mode).await?;
+        async_mkdir(&target, mode).await?;
         trace!("setting owner {}:{}", uid, gid);
-        async_lchown(&path, Some(uid), Some(gid)).await?;
+        async_lchown(&target, Some(uid), Some(gid)).await?;
 
         let stat = self.get_file_attr(&path).await?;
         inode_map.insert_path(stat.ino, path.clone());
@@ -550,6 +1346,7 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn unlink(&self, parent: u64, name: OsString) -> Result<()> {
         trace!("unlink");
+        self.check_readonly()?;
         inject_with_parent_and_name!(self, UNLINK, parent, &name);
 
         let mut inode_map = self.inode_map.write().await;
@@ -561,7 +1358,14 @@ impl AsyncFileSystemImpl for HookFs {
         let stat = self.get_file_attr(&path).await?;
 
         trace!("unlinking {}", path.display());
-        async_unlink(&path).await?;
+        match &self.overlay {
+            Some(overlay) => {
+                let overlay = overlay.clone();
+                let path = path.clone();
+                spawn_blocking(move || overlay.unlink(&path)).await??;
+            }
+            None => async_unlink(&path).await?,
+        }
 
         trace!("remove {:x} from inode_map", &stat.ino);
         inode_map.remove_path(stat.ino, &path);
@@ -572,6 +1376,7 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn rmdir(&self, parent: u64, name: OsString) -> Result<()> {
         trace!("rmdir");
+        self.check_readonly()?;
         inject_with_parent_and_name!(self, RMDIR, parent, &name);
 
         let mut inode_map = self.inode_map.write().await;
@@ -582,8 +1387,17 @@ impl AsyncFileSystemImpl for HookFs {
 
         let stat = self.get_file_attr(&path).await?;
 
-        let cpath = CString::new(path.as_os_str().as_bytes())?;
-        async_rmdir(cpath).await?;
+        match &self.overlay {
+            Some(overlay) => {
+                let overlay = overlay.clone();
+                let path = path.clone();
+                spawn_blocking(move || overlay.rmdir(&path)).await??;
+            }
+            None => {
+                let cpath = CString::new(path.as_os_str().as_bytes())?;
+                async_rmdir(cpath).await?;
+            }
+        }
 
         trace!("remove {:x} from inode_map", &stat.ino);
         inode_map.remove_path(stat.ino, &path);
@@ -601,6 +1415,7 @@ impl AsyncFileSystemImpl for HookFs {
         gid: u32,
     ) -> Result<Entry> {
         trace!("symlink");
+        self.check_readonly()?;
         inject_with_parent_and_name!(self, SYMLINK, parent, &name);
 
         let mut inode_map = self.inode_map.write().await;
@@ -611,11 +1426,12 @@ impl AsyncFileSystemImpl for HookFs {
 
         trace!("create symlink: {} => {}", path.display(), link.display());
 
-        let path_clone = path.clone();
-        spawn_blocking(move || symlinkat(&link, None, &path_clone)).await??;
+        let target = self.writable(&path).await?;
+        let target_clone = target.clone();
+        spawn_blocking(move || symlinkat(&link, None, &target_clone)).await??;
 
         trace!("setting owner {}:{}", uid, gid);
-        async_lchown(&path, Some(uid), Some(gid)).await?;
+        async_lchown(&target, Some(uid), Some(gid)).await?;
 
         let stat = self.get_file_attr(&path).await?;
         inode_map.insert_path(stat.ino, path.clone());
@@ -633,20 +1449,24 @@ impl AsyncFileSystemImpl for HookFs {
         name: OsString,
         newparent: u64,
         newname: OsString,
-        _flags: u32,
+        flags: u32,
     ) -> Result<()> {
         trace!("rename");
-        inject_with_parent_and_name!(self, RENAME, parent, &name);
+        self.check_readonly()?;
+        // the renames with flags (like RENAME_NOREPLACE and RENAME_EXCHANGE)
+        // come from renameat2, and are injected as `rename2`
+        if flags == 0 {
+            inject_with_parent_and_name!(self, RENAME, parent, &name);
+            inject_with_parent_and_name!(self, RENAME, newparent, &newname);
+        } else {
+            inject_with_parent_and_name!(self, RENAME2, parent, &name);
+            inject_with_parent_and_name!(self, RENAME2, newparent, &newname);
+        }
 
         let mut inode_map = self.inode_map.write().await;
-        let old_path = {
-            let parent_path = inode_map.get_path(parent)?;
-            parent_path.join(&name)
-        };
-        trace!("get original path: {}", old_path.display());
-
         let parent_path = inode_map.get_path(parent)?;
         let old_path = parent_path.join(&name);
+        trace!("get original path: {}", old_path.display());
 
         let new_parent_path = inode_map.get_path(newparent)?;
         let new_path = new_parent_path.join(&newname);
@@ -658,15 +1478,30 @@ impl AsyncFileSystemImpl for HookFs {
             new_path.display()
         );
 
-        let new_path_clone = new_path.clone();
-        let old_path_clone = old_path.clone();
-        spawn_blocking(move || renameat(None, &old_path_clone, None, &new_path_clone)).await??;
+        // the rename is passed to the backing filesystem as it is, so that
+        // it's still atomic
+        if let Some(overlay) = &self.overlay {
+            // the flags of renameat2 are not supported by the overlay
+            if flags != 0 {
+                return Err(Error::Sys(Errno::EINVAL));
+            }
+            let overlay = overlay.clone();
+            let old_path = old_path.clone();
+            let new_path = new_path.clone();
+            spawn_blocking(move || overlay.rename(&old_path, &new_path)).await??;
+        } else if flags == 0 {
+            let new_path_clone = new_path.clone();
+            let old_path_clone = old_path.clone();
+            spawn_blocking(move || renameat(None, &old_path_clone, None, &new_path_clone))
+                .await??;
+        } else {
+            let old_cpath = CString::new(old_path.as_os_str().as_bytes())?;
+            let new_cpath = CString::new(new_path.as_os_str().as_bytes())?;
+            async_renameat2(old_cpath, new_cpath, flags).await?;
+        }
 
-        let stat = self.get_file_attr(&new_path).await?;
-        trace!("remove ({:x}, {})", stat.ino, old_path.display());
-        inode_map.remove_path(stat.ino, &old_path);
-        trace!("insert ({:x}, {})", stat.ino, new_path.display());
-        inode_map.insert_path(stat.ino, &new_path);
+        let exchange = flags & libc::RENAME_EXCHANGE as u32 != 0;
+        inode_map.rename_paths(&old_path, &new_path, exchange);
 
         Ok(())
     }
@@ -674,7 +1509,9 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn link(&self, ino: u64, newparent: u64, newname: OsString) -> Result<Entry> {
         trace!("link");
+        self.check_readonly()?;
         inject_with_ino!(self, LINK, ino);
+        inject_with_parent_and_name!(self, LINK, newparent, &newname);
 
         let mut inode_map = self.inode_map.write().await;
         let original_path = inode_map.get_path(ino)?.to_owned();
@@ -687,17 +1524,13 @@ impl AsyncFileSystemImpl for HookFs {
             original_path.display()
         );
 
-        let new_path_clone = new_path.clone();
-        spawn_blocking(move || {
-            linkat(
-                None,
-                &original_path,
-                None,
-                &new_path_clone,
-                LinkatFlags::NoSymlinkFollow,
-            )
-        })
-        .await??;
+        let source = self.writable(&original_path).await?;
+        let target = self.writable(&new_path).await?;
+        spawn_blocking(move || linkat(None, &source, None, &target, LinkatFlags::NoSymlinkFollow))
+            .await??;
+        if let Some(overlay) = &self.overlay {
+            overlay.link(&original_path, &new_path);
+        }
 
         let stat = self.get_file_attr(&new_path).await?;
         inode_map.insert_path(stat.ino, new_path.clone());
@@ -711,6 +1544,10 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn open(&self, ino: u64, flags: i32) -> Result<Open> {
         trace!("open");
+        if flags & (libc::O_WRONLY | libc::O_RDWR | libc::O_TRUNC) != 0 {
+            self.check_readonly()?;
+        }
+        RequestContext::set_open_flags(flags);
         inject_with_ino!(self, OPEN, ino);
 
         // TODO: support direct io
@@ -724,11 +1561,30 @@ impl AsyncFileSystemImpl for HookFs {
 
         let inode_map = self.inode_map.read().await;
         let path = inode_map.get_path(ino)?;
+        // the file is copied up to the overlay once it's opened for writing
+        let target = if flags & (libc::O_WRONLY | libc::O_RDWR | libc::O_TRUNC) != 0 {
+            self.writable(path).await?
+        } else {
+            self.resolve(path)?
+        };
 
         trace!("open with flags: {:?}", filtered_flags);
 
-        let fd = async_open(&path, filtered_flags, stat::Mode::S_IRWXU).await?;
-        let fh = self.opened_files.write().await.insert(File::new(fd, path)) as u64;
+        let fd = async_open(&target, filtered_flags, stat::Mode::S_IRWXU).await?;
+        let stat = match async_fstat(fd).await {
+            Ok(stat) => stat,
+            Err(err) => {
+                async_close(fd).await?;
+                return Err(err);
+            }
+        };
+        let ino = self.ino(path, stat.st_ino);
+        let mtime =
+            UNIX_EPOCH + Duration::new(stat.st_mtime.max(0) as u64, stat.st_mtime_nsec as u32);
+        let created = async_birth_time(fd, mtime).await;
+        let mode = stat.st_mode & 0o7777;
+        let file = File::new(fd, path, flags, stat.st_size as u64, created, mode, ino);
+        let fh = self.opened_files.write().await.insert(file) as u64;
 
         trace!("return with fh: {}, flags: {}", fh, 0);
 
@@ -749,13 +1605,15 @@ impl AsyncFileSystemImpl for HookFs {
         _lock_owner: Option<u64>,
     ) -> Result<Data> {
         trace!("read");
+        RequestContext::set_io_range(offset, size as u64);
         inject_with_fh!(self, READ, fh);
+        inject_io_with_fh!(self, READ, fh, offset, size as usize);
 
         let opened_files = self.opened_files.read().await;
         let file = opened_files.get(fh as usize)?;
         let buf = async_read(file.fd, size as usize, offset).await?;
 
-        let mut reply = Data::new(buf);
+        let mut reply = Data::with_offset(buf, offset);
         inject_reply!(self, READ, &file.original_path(), reply, Data);
         Ok(reply)
     }
@@ -767,25 +1625,65 @@ impl AsyncFileSystemImpl for HookFs {
         fh: u64,
         offset: i64,
         mut data: Vec<u8>,
-        _write_flags: u32,
+        write_flags: u32,
         _flags: i32,
         _lock_owner: Option<u64>,
     ) -> Result<Write> {
         trace!("write");
+        self.check_readonly()?;
+        RequestContext::set_write_flags(write_flags);
+
+        // the backing file is opened without O_APPEND, so an append is written
+        // at the end of the backing file rather than the offset of the request,
+        // which comes from the size known by the kernel and may be stale. The
+        // offset is resolved before both of the injections, so that the
+        // injectors see the offset where the data is written.
+        let opened_files = self.opened_files.read().await;
+        let file = opened_files.get(fh as usize)?;
+        let fd = file.fd;
+        let appending = if file.is_append() {
+            Some(file.appending.clone())
+        } else {
+            None
+        };
+        drop(opened_files);
+        let guard = match &appending {
+            Some(appending) => Some(appending.lock().await),
+            None => None,
+        };
+        let offset = if guard.is_some() {
+            let end = async_fstat(fd).await?.st_size;
+            trace!("append at {} rather than {}", end, offset);
+            end
+        } else {
+            offset
+        };
+
+        RequestContext::set_io_range(offset, data.len() as u64);
         inject_with_fh!(self, WRITE, fh);
-        inject_write_data!(self, fh, data);
+        inject_io_with_fh!(self, WRITE, fh, offset, data.len());
+        self.shadow_write(fh, offset, &data).await;
+        inject_write_data!(self, fh, offset, data);
         let opened_files = self.opened_files.read().await;
         let file = opened_files.get(fh as usize)?;
 
         let size = async_write(file.fd, data, offset).await?;
+        file.grow(offset as u64 + size as u64);
         let mut reply = Write::new(size as u32);
         inject_reply!(self, WRITE, file.original_path(), reply, Write);
         Ok(reply)
     }
 
     #[instrument(skip(self))]
-    async fn flush(&self, _ino: u64, fh: u64, _lock_owner: u64) -> Result<()> {
+    async fn flush(&self, ino: u64, fh: u64, lock_owner: u64) -> Result<()> {
         trace!("flush");
+        // closing a file releases the POSIX locks of its owner on the file,
+        // even if a fault is injected
+        let lock_fd = self.lock_fds.write().await.remove(&(ino, lock_owner));
+        if let Some(fd) = lock_fd {
+            trace!("release the locks of {}", lock_owner);
+            async_close(fd).await?;
+        }
         inject_with_fh!(self, FLUSH, fh);
 
         // flush is implemented with fsync. Is it the correct way?
@@ -809,17 +1707,25 @@ impl AsyncFileSystemImpl for HookFs {
     ) -> Result<()> {
         trace!("release");
 
-        let mut opened_files = self.opened_files.write().await;
-        if let Ok(file) = opened_files.get(fh as usize) {
-            async_close(file.fd).await?;
+        let file = self.opened_files.write().await.take(fh as usize);
+        if let Ok(file) = file {
+            // the backing fd is closed even if a fault is injected
+            let closed = async_close(file.fd).await;
+            RequestContext::set_open_flags(file.flags());
+            RequestContext::set_file_size(file.size());
+            RequestContext::set_file_created(file.created());
+            RequestContext::set_file_mode(file.mode());
+            RequestContext::set_ino(file.ino());
+            inject!(self, RELEASE, file.original_path());
+            closed?;
         }
-        opened_files.remove(fh as usize);
         Ok(())
     }
 
     #[instrument(skip(self))]
-    async fn fsync(&self, _ino: u64, fh: u64, _datasync: bool) -> Result<()> {
+    async fn fsync(&self, _ino: u64, fh: u64, datasync: bool) -> Result<()> {
         trace!("fsync");
+        // the file is not flushed if a fault is injected
         inject_with_fh!(self, FSYNC, fh);
 
         let opened_files = self.opened_files.read().await;
@@ -828,7 +1734,11 @@ impl AsyncFileSystemImpl for HookFs {
             file.fd
         };
 
-        spawn_blocking(move || fsync(fd)).await??;
+        if datasync {
+            spawn_blocking(move || fdatasync(fd)).await??;
+        } else {
+            spawn_blocking(move || fsync(fd)).await??;
+        }
 
         Ok(())
     }
@@ -843,10 +1753,10 @@ impl AsyncFileSystemImpl for HookFs {
         let filtered_flags = flags & (!libc::O_APPEND);
         let filtered_flags = OFlag::from_bits_truncate(filtered_flags as i32);
 
-        let path_clone = path.clone();
+        let target = self.resolve(&path)?;
         let dir = spawn_blocking(move || {
-            trace!("opening directory {}", path_clone.display());
-            dir::Dir::open(&path_clone, filtered_flags, stat::Mode::S_IRWXU)
+            trace!("opening directory {}", target.display());
+            dir::Dir::open(&target, filtered_flags, stat::Mode::S_IRWXU)
         })
         .await??;
         trace!("directory {} opened", path.display());
@@ -869,32 +1779,105 @@ impl AsyncFileSystemImpl for HookFs {
         trace!("readdir");
         inject_with_dir_fh!(self, READDIR, fh);
 
-        let offset = offset as usize;
-        let mut opened_dirs = self.opened_dirs.write().await;
         // TODO: optimize the implementation
-        let all_entries: Vec<_> = {
-            let dir = opened_dirs.get_mut(fh as usize)?;
-
-            dir.iter().collect()
-        };
+        let (_, all_entries) = self.dir_entries(Method::READDIR, fh, offset).await?;
+        let offset = offset as usize;
         if offset >= all_entries.len() {
             trace!("empty reply");
             return Ok(());
         }
-        for (index, entry) in all_entries.iter().enumerate().skip(offset as usize) {
-            let entry = (*entry)?;
+        let mut added = false;
+        for (index, entry) in all_entries.into_iter().enumerate().skip(offset as usize) {
+            // the entries added before the error are returned, and the error
+            // will be returned by the next readdir from this entry
+            let (entry, file_type) = match entry.and_then(|entry| {
+                let file_type = entry.kind.ok_or(Error::UnknownFileType)?;
+                Ok((entry, file_type))
+            }) {
+                Ok(entry) => entry,
+                Err(err) if !added => return Err(err),
+                Err(err) => {
+                    debug!("stop readdir at {} because of {}", index, err);
+                    break;
+                }
+            };
+
+            if !reply.add(entry.ino, (index + 1) as i64, file_type, &entry.name) {
+                trace!("add file {:?}", entry);
+                added = true;
+            } else {
+                trace!("buffer is full");
+                break;
+            }
+        }
+
+        trace!("iterated all files");
+        Ok(())
+    }
 
-            let name = entry.file_name();
-            let name = OsStr::from_bytes(name.to_bytes());
+    #[instrument(skip(self, reply))]
+    async fn readdirplus(
+        &self,
+        _ino: u64,
+        fh: u64,
+        offset: i64,
+        reply: &mut ReplyDirectoryPlus,
+    ) -> Result<()> {
+        trace!("readdirplus");
+        inject_with_dir_fh!(self, READDIRPLUS, fh);
 
-            let file_type = convert_filetype(entry.file_type().ok_or(Error::UnknownFileType)?);
+        // the lock of opened dirs is released before locking the inode map,
+        // as opendir locks them in the reversed order
+        let (dir_path, all_entries) = self.dir_entries(Method::READDIRPLUS, fh, offset).await?;
+        let offset = offset as usize;
+        if offset >= all_entries.len() {
+            trace!("empty reply");
+            return Ok(());
+        }
 
-            if !reply.add(entry.ino(), (index + 1) as i64, file_type, name) {
-                trace!("add file {:?}", entry);
+        let mut added = false;
+        for (index, entry) in all_entries.into_iter().enumerate().skip(offset as usize) {
+            let entry = match entry {
+                Ok(entry) => entry,
+                Err(err) if !added => return Err(err),
+                Err(err) => {
+                    debug!("stop readdirplus at {} because of {}", index, err);
+                    break;
+                }
+            };
+
+            let name = entry.name.as_os_str();
+
+            // the kernel doesn't look up "." and ".."
+            let is_dot = name == "." || name == "..";
+            let path = if is_dot {
+                dir_path.clone()
             } else {
+                dir_path.join(name)
+            };
+            let attr = match self.get_file_attr(&path).await {
+                Ok(attr) => attr,
+                Err(err) if !added => return Err(err),
+                Err(err) => {
+                    debug!("stop readdirplus at {} because of {}", index, err);
+                    break;
+                }
+            };
+
+            let ino = if is_dot { entry.ino } else { attr.ino };
+            if reply.add(ino, (index + 1) as i64, name, &TTL, &attr, 0) {
                 trace!("buffer is full");
                 break;
             }
+            trace!("add file {:?}", entry);
+            added = true;
+
+            // every entry returned by readdirplus is looked up by the kernel
+            if !is_dot {
+                let mut inode_map = self.inode_map.write().await;
+                inode_map.insert_path(attr.ino, path);
+                inode_map.increase_ref(attr.ino);
+            }
         }
 
         trace!("iterated all files");
@@ -902,19 +1885,27 @@ impl AsyncFileSystemImpl for HookFs {
     }
 
     #[instrument(skip(self))]
-    async fn releasedir(&self, _ino: u64, fh: u64, _flags: i32) -> Result<()> {
+    async fn releasedir(&self, ino: u64, fh: u64, _flags: i32) -> Result<()> {
         trace!("releasedir");
 
-        self.opened_dirs.write().await.remove(fh as usize);
+        let dir = self.opened_dirs.write().await.take(fh as usize);
+        if let Ok(dir) = dir {
+            let path = dir.original_path().to_owned();
+            // the directory is closed even if a fault is injected
+            drop(dir);
+            RequestContext::set_ino(ino);
+            inject!(self, RELEASEDIR, &path);
+        }
         Ok(())
     }
 
     #[instrument(skip(self))]
     async fn fsyncdir(&self, ino: u64, _fh: u64, _datasync: bool) -> Result<()> {
-        // TODO: inject
+        trace!("fsyncdir");
+        inject_with_ino!(self, FSYNCDIR, ino);
 
         let inode_map = self.inode_map.read().await;
-        let path = inode_map.get_path(ino)?.to_owned();
+        let path = self.resolve(inode_map.get_path(ino)?)?;
         spawn_blocking(move || -> Result<_> {
             std::fs::File::open(path)?.sync_all()?;
 
@@ -960,10 +1951,11 @@ impl AsyncFileSystemImpl for HookFs {
         _position: u32,
     ) -> Result<()> {
         trace!("setxattr");
+        self.check_readonly()?;
         inject_with_ino!(self, SETXATTR, ino);
 
         let inode_map = self.inode_map.read().await;
-        let path = inode_map.get_path(ino)?.to_owned();
+        let path = self.writable(inode_map.get_path(ino)?).await?;
         let path = CString::new(path.as_os_str().as_bytes())?;
         let name = CString::new(name.as_bytes())?;
 
@@ -979,12 +1971,9 @@ impl AsyncFileSystemImpl for HookFs {
 
         let inode_map = self.inode_map.read().await;
         let path = inode_map.get_path(ino)?;
-        let cpath = CString::new(path.as_os_str().as_bytes())?;
+        let cpath = CString::new(self.resolve(path)?.as_os_str().as_bytes())?;
         let name = CString::new(name.as_bytes())?;
 
-        let mut buf = Vec::new();
-        buf.resize(size as usize, 0u8);
-
         let data = async_getxattr(cpath, name, size as usize).await?;
 
         let mut reply = if size == 0 {
@@ -1006,29 +1995,17 @@ impl AsyncFileSystemImpl for HookFs {
 
         let inode_map = self.inode_map.read().await;
         let path = inode_map.get_path(ino)?.to_owned();
-        let cpath = CString::new(path.as_os_str().as_bytes())?;
-
-        let mut buf = Vec::new();
-        buf.resize(size as usize, 0u8);
+        let cpath = CString::new(self.resolve(&path)?.as_os_str().as_bytes())?;
 
-        let shared_buf = std::sync::Arc::new(buf);
-        let buf_clone = shared_buf.clone();
-
-        let ret = spawn_blocking(move || {
-            let path_ptr = &cpath.as_bytes_with_nul()[0] as *const u8 as *const libc::c_char;
-            let buf_ptr = buf_clone.as_slice() as *const [u8] as *mut [u8] as *mut libc::c_char;
-            unsafe { llistxattr(path_ptr, buf_ptr, size as usize) }
-        })
-        .await?;
-
-        if ret == -1 {
-            return Err(Error::last());
-        }
+        let data = async_listxattr(cpath, size as usize).await?;
 
+        // the kernel probes the length of the list with size 0 at first
         let mut reply = if size == 0 {
-            Xattr::size(ret as u32)
+            trace!("return with size {}", data.len());
+            Xattr::size(data.len() as u32)
         } else {
-            Xattr::data(shared_buf.as_slice().to_owned())
+            trace!("return with data {:?}", data.as_slice());
+            Xattr::data(data)
         };
         inject_reply!(self, LISTXATTR, path, reply, Xattr);
 
@@ -1038,10 +2015,11 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn removexattr(&self, ino: u64, name: OsString) -> Result<()> {
         trace!("removexattr");
+        self.check_readonly()?;
         inject_with_ino!(self, REMOVEXATTR, ino);
 
         let inode_map = self.inode_map.read().await;
-        let path = inode_map.get_path(ino)?.to_owned();
+        let path = self.writable(inode_map.get_path(ino)?).await?;
         let path = CString::new(path.as_os_str().as_bytes())?;
         let name = CString::new(name.as_bytes())?;
 
@@ -1061,16 +2039,31 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn access(&self, ino: u64, mask: i32) -> Result<()> {
         trace!("access");
+        if mask & libc::W_OK != 0 {
+            self.check_readonly()?;
+        }
         inject_with_ino!(self, ACCESS, ino);
 
         let inode_map = self.inode_map.read().await;
         let path = inode_map.get_path(ino)?.to_owned();
-        let mask = AccessFlags::from_bits_truncate(mask as i32);
-        let path_clone = path.to_path_buf();
-
-        spawn_blocking(move || nix::unistd::access(&path_clone, mask)).await??;
+        drop(inode_map);
+        let target = self.resolve(&path)?;
+        // the lower files of the overlay are writable through their copies,
+        // but the read-only lower filesystem fails W_OK with EROFS
+        let mask = if self.overlay.is_some() && target == path {
+            mask & !libc::W_OK
+        } else {
+            mask
+        };
+        let path = CString::new(target.as_os_str().as_bytes())?;
 
-        Ok(())
+        // check with the credentials of the caller rather than toda's, so
+        // that the unfaulted checks behave as on the original filesystem
+        let (uid, gid) = match RequestContext::current() {
+            Some(ctx) => (Some(ctx.uid), Some(ctx.gid)),
+            None => (None, None),
+        };
+        async_faccessat(path, mask, uid, gid).await
     }
 
     #[instrument(skip(self))]
@@ -1085,7 +2078,10 @@ impl AsyncFileSystemImpl for HookFs {
         gid: u32,
     ) -> Result<Create> {
         trace!("create");
-        inject_with_parent_and_name!(self, CREATE, parent, &name);
+        self.check_readonly()?;
+        RequestContext::set_open_flags(flags);
+        let method = self.create_method(parent, &name, flags).await;
+        inject_with_parent_and_name!(self, method = method, parent, &name);
 
         let mut inode_map = self.inode_map.write().await;
         let path = {
@@ -1097,13 +2093,24 @@ impl AsyncFileSystemImpl for HookFs {
         let filtered_flags = OFlag::from_bits_truncate(filtered_flags as i32);
         let mode = stat::Mode::from_bits_truncate(mode);
 
+        let target = self.writable(&path).await?;
+
         trace!("create with flags: {:?}, mode: {:?}", filtered_flags, mode);
-        let fd = async_open(&path, filtered_flags, mode).await?;
+        let fd = async_open(&target, filtered_flags, mode).await?;
         trace!("setting owner {}:{} for file", uid, gid);
-        async_lchown(&path, Some(uid), Some(gid)).await?;
+        async_lchown(&target, Some(uid), Some(gid)).await?;
 
         let stat = self.get_file_attr(&path).await?;
-        let fh = self.opened_files.write().await.insert(File::new(fd, &path));
+        let created = async_birth_time(fd, stat.mtime).await;
+        let fh = self.opened_files.write().await.insert(File::new(
+            fd,
+            &path,
+            flags,
+            stat.size,
+            created,
+            stat.perm as u32,
+            stat.ino,
+        ));
 
         // TODO: support generation number
         // this can be implemented with ioctl FS_IOC_GETVERSION
@@ -1118,39 +2125,232 @@ impl AsyncFileSystemImpl for HookFs {
     #[instrument(skip(self))]
     async fn getlk(
         &self,
-        _ino: u64,
-        _fh: u64,
-        _lock_owner: u64,
-        _start: u64,
-        _end: u64,
-        _typ: i32,
+        ino: u64,
+        fh: u64,
+        lock_owner: u64,
+        start: u64,
+        end: u64,
+        typ: i32,
         _pid: u32,
     ) -> Result<Lock> {
         trace!("getlk");
-        // kernel will implement for hookfs
-        Err(Error::Sys(Errno::ENOSYS))
+        inject_with_fh!(self, GETLK, fh);
+
+        // the locks of the owner itself don't conflict
+        let lock_fd = self.lock_fds.read().await.get(&(ino, lock_owner)).copied();
+        let (fd, path) = {
+            let opened_files = self.opened_files.read().await;
+            let file = opened_files.get(fh as usize)?;
+            (lock_fd.unwrap_or(file.fd), file.original_path().to_owned())
+        };
+        let lock = async_lock(fd, libc::F_OFD_GETLK, to_flock(start, end, typ)).await?;
+        trace!("return with lock: {:?}", lock);
+
+        let mut reply = from_flock(&lock);
+        inject_reply!(self, GETLK, &path, reply, Lock);
+        Ok(reply)
     }
 
     #[instrument(skip(self))]
     async fn setlk(
         &self,
-        _ino: u64,
-        _fh: u64,
-        _lock_owner: u64,
-        _start: u64,
-        _end: u64,
-        _typ: i32,
+        ino: u64,
+        fh: u64,
+        lock_owner: u64,
+        start: u64,
+        end: u64,
+        typ: i32,
         _pid: u32,
-        _sleep: bool,
+        sleep: bool,
     ) -> Result<()> {
         trace!("setlk");
-        Err(Error::Sys(Errno::ENOSYS))
+        let (method, cmd) = if sleep {
+            (Method::SETLKW, libc::F_OFD_SETLKW)
+        } else {
+            (Method::SETLK, libc::F_OFD_SETLK)
+        };
+        inject_with_fh!(self, method = method, fh);
+
+        let mut lock_fds = self.lock_fds.write().await;
+        // unlocking the whole file releases all the locks of the owner, which
+        // is done by closing its fd. The kernel does so when the file is
+        // closed.
+        if typ == libc::F_UNLCK && start == 0 && end >= LOCK_END {
+            if let Some(fd) = lock_fds.remove(&(ino, lock_owner)) {
+                drop(lock_fds);
+                trace!("release the locks of {}", lock_owner);
+                async_close(fd).await?;
+            }
+            return Ok(());
+        }
+        let fd = match lock_fds.get(&(ino, lock_owner)) {
+            Some(fd) => *fd,
+            // the owner without a lock has nothing to unlock
+            None if typ == libc::F_UNLCK => return Ok(()),
+            None => {
+                let (fd, flags) = {
+                    let opened_files = self.opened_files.read().await;
+                    let file = opened_files.get(fh as usize)?;
+                    (file.fd, file.flags())
+                };
+                let fd = reopen(fd, flags).await?;
+                trace!("open fd {} for the locks of {}", fd, lock_owner);
+                lock_fds.insert((ino, lock_owner), fd);
+                fd
+            }
+        };
+        // the other requests are not blocked by the waiting one
+        drop(lock_fds);
+
+        async_lock(fd, cmd, to_flock(start, end, typ)).await?;
+        Ok(())
+    }
+
+    #[instrument(skip(self))]
+    async fn bmap(&self, ino: u64, blocksize: u32, idx: u64) -> Result<Bmap> {
+        trace!("bmap");
+        inject_with_ino!(self, BMAP, ino);
+
+        let inode_map = self.inode_map.read().await;
+        let path = inode_map.get_path(ino)?.to_owned();
+        drop(inode_map);
+
+        let backing_path = self.resolve(&path)?;
+        let block = spawn_blocking(move || backing_bmap(&backing_path, blocksize, idx)).await??;
+        trace!("map block {} to {}", idx, block);
+
+        let mut reply = Bmap::new(block);
+        inject_reply!(self, BMAP, &path, reply, Bmap);
+        Ok(reply)
+    }
+
+    #[instrument(skip(self, in_data))]
+    async fn ioctl(
+        &self,
+        _ino: u64,
+        fh: u64,
+        _flags: u32,
+        cmd: u32,
+        in_data: Vec<u8>,
+        out_size: u32,
+    ) -> Result<Ioctl> {
+        trace!("ioctl");
+        RequestContext::set_ioctl_command(cmd);
+        inject_with_fh!(self, IOCTL, fh);
+
+        let changes = match SAFE_IOCTLS.iter().find(|(command, _)| *command == cmd) {
+            Some((_, changes)) => *changes,
+            None => {
+                debug!("reject ioctl {:#x}", cmd);
+                return Err(Error::Sys(Errno::ENOTTY));
+            }
+        };
+        if changes {
+            self.check_readonly()?;
+        }
+
+        let opened_files = self.opened_files.read().await;
+        let fd = opened_files.get(fh as usize)?.fd;
+        drop(opened_files);
+
+        if cmd == FICLONE {
+            let source = self.clone_source(&in_data).await?;
+            let result = spawn_blocking(move || {
+                let result = Errno::result(unsafe { libc::ioctl(fd, FICLONE as _, source) });
+                close(source)?;
+                Ok::<_, Error>(result?)
+            })
+            .await??;
+            return Ok(Ioctl::new(result, Vec::new()));
+        }
+
+        let (result, data) = async_ioctl(fd, cmd, in_data, out_size as usize).await?;
+        Ok(Ioctl::new(result, data))
+    }
+
+    #[instrument(skip(self))]
+    async fn copy_file_range(
+        &self,
+        ino_in: u64,
+        fh_in: u64,
+        offset_in: i64,
+        ino_out: u64,
+        fh_out: u64,
+        offset_out: i64,
+        len: u64,
+        flags: u32,
+    ) -> Result<Write> {
+        trace!("copy_file_range");
+        self.check_readonly()?;
+        inject_with_fh!(self, COPY_FILE_RANGE, fh_in);
+        inject_with_fh!(self, COPY_FILE_RANGE, fh_out);
+
+        let opened_files = self.opened_files.read().await;
+        let fd_in = opened_files.get(fh_in as usize)?.fd;
+        let file_out = opened_files.get(fh_out as usize)?;
+        let fd_out = file_out.fd;
+        let path_out = file_out.original_path().to_owned();
+        drop(opened_files);
+
+        let size = match async_copy_file_range(fd_in, offset_in, fd_out, offset_out, len, flags)
+            .await
+        {
+            Err(Error::Sys(Errno::ENOSYS))
+            | Err(Error::Sys(Errno::EXDEV))
+            | Err(Error::Sys(Errno::EOPNOTSUPP)) => {
+                // the backing filesystem cannot copy, so copy through read and
+                // write, and the injectors on them still apply
+                debug!("copy_file_range is not supported, fallback to read and write");
+                self.copy_by_read_write(ino_in, fh_in, offset_in, ino_out, fh_out, offset_out, len)
+                    .await?
+            }
+            result => result?,
+        };
+
+        let mut reply = Write::new(size as u32);
+        inject_reply!(self, COPY_FILE_RANGE, &path_out, reply, Write);
+        Ok(reply)
+    }
+
+    // The kernel handles SEEK_SET, SEEK_CUR and SEEK_END by itself, and it only
+    // sends SEEK_DATA and SEEK_HOLE to the filesystem. All of them are
+    // forwarded to the backing file, so the offset is always right.
+    #[instrument(skip(self))]
+    async fn lseek(&self, _ino: u64, fh: u64, offset: i64, whence: i32) -> Result<Lseek> {
+        trace!("lseek");
+        inject_with_fh!(self, LSEEK, fh);
+
+        let opened_files = self.opened_files.read().await;
+        let fd: RawFd = {
+            let file = opened_files.get(fh as usize)?;
+            file.fd
+        };
+
+        let offset = async_lseek(fd, offset, whence).await?;
+        Ok(Lseek::new(offset))
     }
 
     #[instrument(skip(self))]
-    async fn bmap(&self, _ino: u64, _blocksize: u32, _idx: u64, reply: ReplyBmap) {
-        error!("unimplemented");
-        reply.error(nix::libc::ENOSYS);
+    async fn fallocate(
+        &self,
+        _ino: u64,
+        fh: u64,
+        offset: i64,
+        length: i64,
+        mode: i32,
+    ) -> Result<()> {
+        trace!("fallocate");
+        self.check_readonly()?;
+        RequestContext::set_io_range(offset, length as u64);
+        inject_with_fh!(self, FALLOCATE, fh);
+
+        let opened_files = self.opened_files.read().await;
+        let fd: RawFd = {
+            let file = opened_files.get(fh as usize)?;
+            file.fd
+        };
+
+        async_fallocate(fd, mode, offset, length).await
     }
 }
 
@@ -1158,7 +2358,8 @@ async fn async_setxattr(path: CString, name: CString, data: Vec<u8>, flags: i32)
     spawn_blocking(move || {
         let path_ptr = &path.as_bytes_with_nul()[0] as *const u8 as *const libc::c_char;
         let name_ptr = &name.as_bytes_with_nul()[0] as *const u8 as *const libc::c_char;
-        let data_ptr = &data[0] as *const u8 as *const libc::c_void;
+        // the value could be empty
+        let data_ptr = data.as_ptr() as *const libc::c_void;
         let ret = unsafe { lsetxattr(path_ptr, name_ptr, data_ptr, data.len(), flags) };
 
         if ret == -1 {
@@ -1190,6 +2391,27 @@ async fn async_getxattr(path: CString, name: CString, size: usize) -> Result<Vec
     .await?
 }
 
+async fn async_listxattr(path: CString, size: usize) -> Result<Vec<u8>> {
+    spawn_blocking(move || {
+        let mut buf = Vec::new();
+        buf.resize(size, 0);
+
+        let path_ptr = &path.as_bytes_with_nul()[0] as *const u8 as *const libc::c_char;
+        let buf_ptr = buf.as_mut_ptr() as *mut libc::c_char;
+
+        let ret = unsafe { llistxattr(path_ptr, buf_ptr, size) };
+        if ret == -1 {
+            Err(Error::last())
+        } else {
+            // with size 0, llistxattr returns the length without filling it,
+            // so the length is kept for the reply
+            buf.resize(ret as usize, 0);
+            Ok(buf)
+        }
+    })
+    .await?
+}
+
 async fn async_read(fd: RawFd, count: usize, offset: i64) -> Result<Vec<u8>> {
     spawn_blocking(move || unsafe {
         let mut buf = Vec::new();
@@ -1217,12 +2439,84 @@ async fn async_write(fd: RawFd, data: Vec<u8>, offset: i64) -> Result<isize> {
     .await?
 }
 
+async fn async_copy_file_range(
+    fd_in: RawFd,
+    offset_in: i64,
+    fd_out: RawFd,
+    offset_out: i64,
+    len: u64,
+    flags: u32,
+) -> Result<u64> {
+    spawn_blocking(move || {
+        let mut offset_in = offset_in;
+        let mut offset_out = offset_out;
+        let ret = unsafe {
+            libc::copy_file_range(
+                fd_in,
+                &mut offset_in,
+                fd_out,
+                &mut offset_out,
+                len as usize,
+                flags,
+            )
+        };
+        if ret == -1 {
+            Err(Error::last())
+        } else {
+            Ok(ret as u64)
+        }
+    })
+    .await?
+}
+
+async fn async_lseek(fd: RawFd, offset: i64, whence: i32) -> Result<i64> {
+    spawn_blocking(move || {
+        let ret = unsafe { libc::lseek(fd, offset, whence) };
+        if ret == -1 {
+            Err(Error::last())
+        } else {
+            Ok(ret)
+        }
+    })
+    .await?
+}
+
+async fn async_fallocate(fd: RawFd, mode: i32, offset: i64, length: i64) -> Result<()> {
+    spawn_blocking(move || {
+        let ret = unsafe { libc::fallocate(fd, mode, offset, length) };
+        if ret == -1 {
+            Err(Error::last())
+        } else {
+            Ok(())
+        }
+    })
+    .await?
+}
+
 async fn async_stat(path: &Path) -> Result<stat::FileStat> {
     let path_clone = path.to_path_buf();
     trace!("async read stat from path {}", path_clone.display());
     Ok(spawn_blocking(move || stat::lstat(&path_clone)).await??)
 }
 
+async fn async_fstat(fd: RawFd) -> Result<stat::FileStat> {
+    Ok(spawn_blocking(move || stat::fstat(fd)).await??)
+}
+
+// async_birth_time returns the birth time of the file from `statx`, or
+// `mtime` if the backing filesystem (or the kernel) doesn't report it
+async fn async_birth_time(fd: RawFd, mtime: SystemTime) -> SystemTime {
+    spawn_blocking(move || {
+        // the fd is borrowed, and it's not closed with the file
+        let file = ManuallyDrop::new(unsafe { std::fs::File::from_raw_fd(fd) });
+        file.metadata().and_then(|metadata| metadata.created()).ok()
+    })
+    .await
+    .ok()
+    .flatten()
+    .unwrap_or(mtime)
+}
+
 async fn async_lchown(path: &Path, uid: Option<u32>, gid: Option<u32>) -> Result<()> {
     let path_clone = path.to_path_buf();
     spawn_blocking(move || {
@@ -1258,6 +2552,55 @@ async fn async_truncate(path: &Path, len: i64) -> Result<()> {
     Ok(())
 }
 
+async fn async_renameat2(old_path: CString, new_path: CString, flags: u32) -> Result<()> {
+    spawn_blocking(move || unsafe {
+        let ret = libc::syscall(
+            libc::SYS_renameat2,
+            libc::AT_FDCWD,
+            old_path.as_ptr(),
+            libc::AT_FDCWD,
+            new_path.as_ptr(),
+            flags,
+        );
+
+        if ret != 0 {
+            Err(Error::last())
+        } else {
+            Ok(())
+        }
+    })
+    .await??;
+    Ok(())
+}
+
+async fn async_faccessat(
+    path: CString,
+    mask: i32,
+    uid: Option<u32>,
+    gid: Option<u32>,
+) -> Result<()> {
+    spawn_blocking(move || unsafe {
+        // fsuid and fsgid are per thread, so the other requests are not
+        // affected. The supplementary groups of the caller are unknown and
+        // toda's are used.
+        let original_gid = gid.map(|gid| libc::setfsgid(gid));
+        let original_uid = uid.map(|uid| libc::setfsuid(uid));
+
+        let ret = libc::faccessat(libc::AT_FDCWD, path.as_ptr(), mask, libc::AT_EACCESS);
+        let result = if ret != 0 { Err(Error::last()) } else { Ok(()) };
+
+        if let Some(original_uid) = original_uid {
+            libc::setfsuid(original_uid as u32);
+        }
+        if let Some(original_gid) = original_gid {
+            libc::setfsgid(original_gid as u32);
+        }
+        result
+    })
+    .await??;
+    Ok(())
+}
+
 async fn async_utimensat(path: CString, times: [libc::timespec; 2]) -> Result<()> {
     spawn_blocking(move || unsafe {
         let path_ptr = &path.as_bytes_with_nul()[0] as *const u8 as *mut i8;
@@ -1278,6 +2621,27 @@ async fn async_utimensat(path: CString, times: [libc::timespec; 2]) -> Result<()
     Ok(())
 }
 
+// async_ioctl passes the ioctl through with `in_data` as the argument, and
+// returns the first `out_size` bytes of it afterwards
+async fn async_ioctl(
+    fd: RawFd,
+    cmd: u32,
+    in_data: Vec<u8>,
+    out_size: usize,
+) -> Result<(i32, Vec<u8>)> {
+    spawn_blocking(move || {
+        let mut buf = in_data;
+        buf.resize(buf.len().max(out_size), 0);
+        let result = unsafe { libc::ioctl(fd, cmd as _, buf.as_mut_ptr()) };
+        if result == -1 {
+            return Err(Error::last());
+        }
+        buf.truncate(out_size);
+        Ok((result, buf))
+    })
+    .await?
+}
+
 async fn async_readlink(path: &Path) -> Result<OsString> {
     let path_clone = path.to_path_buf();
     Ok(spawn_blocking(move || readlink(&path_clone)).await??)
@@ -1329,6 +2693,59 @@ async fn async_open(path: &Path, filtered_flags: OFlag, mode: stat::Mode) -> Res
     Ok(fd)
 }
 
+// OFFSET_MAX of the kernel, which is the end of a lock to the end of file
+const LOCK_END: u64 = i64::MAX as u64;
+
+// to_flock converts the range of a FUSE lock, which includes `end`
+fn to_flock(start: u64, end: u64, typ: i32) -> libc::flock {
+    let mut lock: libc::flock = unsafe { std::mem::zeroed() };
+    lock.l_type = typ as libc::c_short;
+    lock.l_whence = libc::SEEK_SET as libc::c_short;
+    lock.l_start = start as libc::off_t;
+    lock.l_len = if end >= LOCK_END {
+        0
+    } else {
+        (end - start + 1) as libc::off_t
+    };
+    lock
+}
+
+fn from_flock(lock: &libc::flock) -> Lock {
+    let start = lock.l_start as u64;
+    let end = if lock.l_len == 0 {
+        LOCK_END
+    } else {
+        start + lock.l_len as u64 - 1
+    };
+    // the owner of an OFD lock is not a process, so there is no pid
+    Lock::new(start, end, lock.l_type as i32, 0)
+}
+
+async fn async_lock(fd: RawFd, cmd: i32, mut lock: libc::flock) -> Result<libc::flock> {
+    spawn_blocking(move || {
+        let ret = unsafe { libc::fcntl(fd, cmd, &mut lock) };
+        if ret == -1 {
+            Err(Error::last())
+        } else {
+            Ok(lock)
+        }
+    })
+    .await?
+}
+
+// reopen opens the file of `fd` again, so that it has an open file
+// description of its own. It's opened for both reading and writing if it can
+// be, as the fd is shared by all the files of the lock owner.
+async fn reopen(fd: RawFd, flags: i32) -> Result<RawFd> {
+    let path = PathBuf::from(format!("/proc/self/fd/{}", fd));
+    let flags = OFlag::from_bits_truncate(flags & libc::O_ACCMODE);
+    Ok(spawn_blocking(move || {
+        open(&path, OFlag::O_RDWR | OFlag::O_CLOEXEC, stat::Mode::empty())
+            .or_else(|_| open(&path, flags | OFlag::O_CLOEXEC, stat::Mode::empty()))
+    })
+    .await??)
+}
+
 async fn async_close(fd: RawFd) -> Result<()> {
     Ok(spawn_blocking(move || close(fd)).await??)
 }
@@ -0,0 +1,361 @@
+use std::collections::{HashMap, HashSet};
+use std::ffi::OsString;
+use std::fs::{self, DirBuilder, Permissions};
+use std::io::ErrorKind;
+use std::os::unix::fs::{symlink, DirBuilderExt, MetadataExt, PermissionsExt};
+use std::path::{Path, PathBuf};
+use std::sync::RwLock;
+
+use fuser::FileType;
+use nix::errno::Errno;
+use nix::unistd::{fchownat, FchownatFlags, Gid, Uid};
+use tracing::{debug, trace};
+
+use super::errors::{HookFsError as Error, Result};
+
+// The inodes of the files created in the upper directory are reported with
+// this bit, so that they never collide with the ones of the lower directory,
+// which is usually on another filesystem.
+const UPPER_INO_BIT: u64 = 1 << 63;
+
+// Overlay redirects the changes of the backing (lower) directory to the upper
+// directory, so that the lower one can be read-only. A file is copied up on
+// its first change, and then it's read from the copy.
+#[derive(Debug)]
+pub struct Overlay {
+    lower: PathBuf,
+    upper: PathBuf,
+    // the paths which are in the upper directory, with the inode of the lower
+    // file they are copied from, which is still reported to the kernel. It's
+    // `None` for the files created in the upper directory.
+    copies: RwLock<HashMap<PathBuf, Option<u64>>>,
+    // the paths whose lower files are hidden, with all the children, as they
+    // have been removed or replaced
+    removed: RwLock<HashSet<PathBuf>>,
+}
+
+#[derive(Debug, Clone)]
+pub struct DirEntry {
+    pub ino: u64,
+    pub kind: Option<FileType>,
+    pub name: OsString,
+}
+
+impl Overlay {
+    pub fn new<P1: AsRef<Path>, P2: AsRef<Path>>(lower: P1, upper: P2) -> Overlay {
+        Overlay {
+            lower: lower.as_ref().to_owned(),
+            upper: upper.as_ref().to_owned(),
+            copies: RwLock::new(HashMap::new()),
+            removed: RwLock::new(HashSet::new()),
+        }
+    }
+
+    pub fn lower(&self) -> &Path {
+        &self.lower
+    }
+
+    fn upper_path(&self, path: &Path) -> Result<PathBuf> {
+        Ok(self.upper.join(path.strip_prefix(&self.lower)?))
+    }
+
+    fn copied(&self, path: &Path) -> Option<Option<u64>> {
+        self.copies.read().unwrap().get(path).cloned()
+    }
+
+    // hidden checks whether the lower file is removed with itself or any of
+    // its parents
+    fn hidden(&self, path: &Path) -> bool {
+        let removed = self.removed.read().unwrap();
+        path.ancestors().any(|path| removed.contains(path))
+    }
+
+    // resolve returns the path where the file is read
+    pub fn resolve(&self, path: &Path) -> Result<PathBuf> {
+        if self.copied(path).is_some() {
+            return self.upper_path(path);
+        }
+        if self.hidden(path) {
+            return Err(Error::Sys(Errno::ENOENT));
+        }
+        Ok(path.to_owned())
+    }
+
+    // ino returns the inode reported to the kernel for the file, whose inode
+    // is `ino` where it's resolved
+    pub fn ino(&self, path: &Path, ino: u64) -> u64 {
+        match self.copied(path) {
+            Some(Some(lower)) => lower,
+            Some(None) => ino | UPPER_INO_BIT,
+            None => ino,
+        }
+    }
+
+    // writable returns the path in the upper directory where the file is
+    // changed. The lower file is copied up if it exists, and the parents are
+    // prepared if it's going to be created.
+    pub fn writable(&self, path: &Path) -> Result<PathBuf> {
+        let upper = self.upper_path(path)?;
+        let mut copies = self.copies.write().unwrap();
+        if copies.contains_key(path) {
+            return Ok(upper);
+        }
+
+        self.prepare_parents(path)?;
+        let lower = if self.hidden(path) {
+            None
+        } else {
+            self.copy_up(path, &upper)?
+        };
+        copies.insert(path.to_owned(), lower);
+        Ok(upper)
+    }
+
+    // prepare_parents creates the parents of the file in the upper directory
+    // with the modes of the lower ones
+    fn prepare_parents(&self, path: &Path) -> Result<()> {
+        let parent = match path.parent() {
+            Some(parent) => parent.strip_prefix(&self.lower)?,
+            None => return Ok(()),
+        };
+
+        let mut lower = self.lower.clone();
+        let mut upper = self.upper.clone();
+        for component in parent.components() {
+            lower.push(component);
+            upper.push(component);
+            if fs::symlink_metadata(&upper).is_ok() {
+                continue;
+            }
+
+            let mode = fs::metadata(&lower).map(|m| m.mode()).unwrap_or(0o755);
+            trace!("create upper directory {}", upper.display());
+            DirBuilder::new().mode(mode).create(&upper).map_err(sys)?;
+        }
+        Ok(())
+    }
+
+    // copy_up copies the lower file to the upper directory, and returns its
+    // inode, or `None` if it doesn't exist. The content of a directory is not
+    // copied, as the children are copied up on their own.
+    fn copy_up(&self, path: &Path, upper: &Path) -> Result<Option<u64>> {
+        let metadata = match fs::symlink_metadata(path) {
+            Ok(metadata) => metadata,
+            Err(err) if err.kind() == ErrorKind::NotFound => return Ok(None),
+            Err(err) => return Err(sys(err)),
+        };
+        debug!("copy up {} to {}", path.display(), upper.display());
+
+        let file_type = metadata.file_type();
+        if file_type.is_dir() {
+            // the directory may have been created as a parent of a child
+            match DirBuilder::new().mode(metadata.mode()).create(upper) {
+                Err(err) if err.kind() == ErrorKind::AlreadyExists => {
+                    fs::set_permissions(upper, Permissions::from_mode(metadata.mode()))
+                        .map_err(sys)?
+                }
+                result => result.map_err(sys)?,
+            }
+        } else if file_type.is_symlink() {
+            symlink(fs::read_link(path).map_err(sys)?, upper).map_err(sys)?;
+        } else if file_type.is_file() {
+            fs::copy(path, upper).map_err(sys)?;
+        } else {
+            // the special files are not copied, as they can't be changed
+            // without the lower filesystem anyway
+            return Err(Error::Sys(Errno::EROFS));
+        }
+        fchownat(
+            None,
+            upper,
+            Some(Uid::from_raw(metadata.uid())),
+            Some(Gid::from_raw(metadata.gid())),
+            FchownatFlags::NoFollowSymlink,
+        )?;
+
+        Ok(Some(metadata.ino()))
+    }
+
+    // entries lists the directory, with the upper files over the lower ones.
+    // "." and ".." are not included.
+    pub fn entries(&self, path: &Path) -> Result<Vec<DirEntry>> {
+        let mut entries = Vec::new();
+        let mut names = HashSet::new();
+
+        match fs::read_dir(self.upper_path(path)?) {
+            Ok(dir) => {
+                for entry in dir {
+                    let entry = entry.map_err(sys)?;
+                    let child = path.join(entry.file_name());
+                    // the directories only created as parents are skipped, as
+                    // the lower ones are listed
+                    let lower = match self.copied(&child) {
+                        Some(lower) => lower,
+                        None => continue,
+                    };
+                    let metadata = entry.metadata().map_err(sys)?;
+                    names.insert(entry.file_name());
+                    entries.push(DirEntry {
+                        ino: lower.unwrap_or(metadata.ino() | UPPER_INO_BIT),
+                        kind: Some(convert_file_type(metadata.file_type())),
+                        name: entry.file_name(),
+                    });
+                }
+            }
+            Err(err) if err.kind() == ErrorKind::NotFound => {}
+            Err(err) => return Err(sys(err)),
+        }
+
+        if self.hidden(path) {
+            return Ok(entries);
+        }
+        let removed = self.removed.read().unwrap();
+        match fs::read_dir(path) {
+            Ok(dir) => {
+                for entry in dir {
+                    let entry = entry.map_err(sys)?;
+                    if names.contains(&entry.file_name())
+                        || removed.contains(&path.join(entry.file_name()))
+                    {
+                        continue;
+                    }
+                    let metadata = entry.metadata().map_err(sys)?;
+                    entries.push(DirEntry {
+                        ino: metadata.ino(),
+                        kind: Some(convert_file_type(metadata.file_type())),
+                        name: entry.file_name(),
+                    });
+                }
+            }
+            Err(err) if err.kind() == ErrorKind::NotFound => {}
+            Err(err) => return Err(sys(err)),
+        }
+
+        Ok(entries)
+    }
+
+    // unlink removes the upper file, and hides the lower one
+    pub fn unlink(&self, path: &Path) -> Result<()> {
+        let target = self.resolve(path)?;
+        if fs::symlink_metadata(&target).map_err(sys)?.is_dir() {
+            return Err(Error::Sys(Errno::EISDIR));
+        }
+        if target != path {
+            fs::remove_file(&target).map_err(sys)?;
+        }
+
+        self.remove(path);
+        Ok(())
+    }
+
+    // rmdir removes the upper directory, and hides the lower one. It fails if
+    // any of them still has a child which isn't removed.
+    pub fn rmdir(&self, path: &Path) -> Result<()> {
+        let target = self.resolve(path)?;
+        if !fs::symlink_metadata(&target).map_err(sys)?.is_dir() {
+            return Err(Error::Sys(Errno::ENOTDIR));
+        }
+        if !self.entries(path)?.is_empty() {
+            return Err(Error::Sys(Errno::ENOTEMPTY));
+        }
+        match fs::remove_dir_all(self.upper_path(path)?) {
+            Err(err) if err.kind() != ErrorKind::NotFound => return Err(sys(err)),
+            _ => {}
+        }
+
+        self.remove(path);
+        Ok(())
+    }
+
+    fn remove(&self, path: &Path) {
+        self.copies.write().unwrap().remove(path);
+        self.removed.write().unwrap().insert(path.to_owned());
+    }
+
+    // rename moves the file in the upper directory. A lower directory is not
+    // moved with its children, and EXDEV is returned so that the caller (like
+    // `mv`) copies it instead.
+    pub fn rename(&self, from: &Path, to: &Path) -> Result<()> {
+        let source = self.resolve(from)?;
+        let is_dir = fs::symlink_metadata(&source).map_err(sys)?.is_dir();
+        if is_dir && self.copied(from) != Some(None) {
+            return Err(Error::Sys(Errno::EXDEV));
+        }
+        if let Ok(target) = self.resolve(to) {
+            if let Ok(metadata) = fs::symlink_metadata(&target) {
+                if metadata.is_dir() && !self.entries(to)?.is_empty() {
+                    return Err(Error::Sys(Errno::ENOTEMPTY));
+                }
+            }
+        }
+
+        let source = self.writable(from)?;
+        let target = self.writable(to)?;
+        fs::rename(&source, &target).map_err(sys)?;
+
+        let rebase = |base: &Path, rest: &Path| {
+            if rest.as_os_str().is_empty() {
+                base.to_owned()
+            } else {
+                base.join(rest)
+            }
+        };
+        let mut copies = self.copies.write().unwrap();
+        *copies = std::mem::take(&mut *copies)
+            .into_iter()
+            .filter_map(|(path, lower)| {
+                if let Ok(rest) = path.strip_prefix(from) {
+                    return Some((rebase(to, rest), lower));
+                }
+                if path.starts_with(to) {
+                    return None;
+                }
+                Some((path, lower))
+            })
+            .collect();
+        drop(copies);
+
+        // the lower files at both paths are replaced
+        let mut removed = self.removed.write().unwrap();
+        removed.insert(from.to_owned());
+        removed.insert(to.to_owned());
+        Ok(())
+    }
+
+    // link records the new path of the hard link, which is created in the
+    // upper directory, so that both of them are reported with the same inode
+    pub fn link(&self, from: &Path, to: &Path) {
+        let mut copies = self.copies.write().unwrap();
+        let lower = copies.get(from).cloned().flatten();
+        copies.insert(to.to_owned(), lower);
+    }
+}
+
+fn convert_file_type(file_type: fs::FileType) -> FileType {
+    use std::os::unix::fs::FileTypeExt;
+
+    if file_type.is_dir() {
+        FileType::Directory
+    } else if file_type.is_symlink() {
+        FileType::Symlink
+    } else if file_type.is_fifo() {
+        FileType::NamedPipe
+    } else if file_type.is_char_device() {
+        FileType::CharDevice
+    } else if file_type.is_block_device() {
+        FileType::BlockDevice
+    } else if file_type.is_socket() {
+        FileType::Socket
+    } else {
+        FileType::RegularFile
+    }
+}
+
+// sys keeps the errno of the io error, which is lost by the conversion of
+// `HookFsError`
+fn sys(err: std::io::Error) -> Error {
+    match err.raw_os_error() {
+        Some(errno) => Error::Sys(Errno::from_i32(errno)),
+        None => Error::from(err),
+    }
+}
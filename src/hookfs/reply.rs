@@ -5,8 +5,9 @@ use fuser::*;
 use tracing::{debug, error, trace};
 
 use super::errors::Result;
+use super::overlay::DirEntry;
 
-const TTL: Duration = Duration::from_secs(0);
+pub const TTL: Duration = Duration::from_secs(0);
 
 #[derive(Debug)]
 pub enum Reply<'a> {
@@ -17,8 +18,10 @@ pub enum Reply<'a> {
     StatFs(&'a mut StatFs),
     Write(&'a mut Write),
     Create(&'a mut Create),
-    _Lock(&'a mut Lock),
+    Lock(&'a mut Lock),
     Xattr(&'a mut Xattr),
+    Bmap(&'a mut Bmap),
+    DirEntries(&'a mut DirEntries),
 }
 
 #[derive(Debug)]
@@ -56,10 +59,16 @@ impl Attr {
 #[derive(Debug)]
 pub struct Data {
     pub data: Vec<u8>,
+    // offset in the file of the first byte, it's 0 if the data doesn't come
+    // from a file
+    pub offset: i64,
 }
 impl Data {
     pub fn new(data: Vec<u8>) -> Self {
-        Self { data }
+        Self { data, offset: 0 }
+    }
+    pub fn with_offset(data: Vec<u8>, offset: i64) -> Self {
+        Self { data, offset }
     }
 }
 
@@ -108,6 +117,40 @@ impl Write {
     }
 }
 
+#[derive(Debug)]
+pub struct Lseek {
+    pub offset: i64,
+}
+impl Lseek {
+    pub fn new(offset: i64) -> Self {
+        Self { offset }
+    }
+}
+
+// Bmap is the block of the device where a block of the file is stored. `0`
+// means the block isn't mapped, like a hole.
+#[derive(Debug)]
+pub struct Bmap {
+    pub block: u64,
+}
+impl Bmap {
+    pub fn new(block: u64) -> Self {
+        Self { block }
+    }
+}
+
+// Ioctl is the result of the ioctl, with the data written back to the caller
+#[derive(Debug)]
+pub struct Ioctl {
+    pub result: i32,
+    pub data: Vec<u8>,
+}
+impl Ioctl {
+    pub fn new(result: i32, data: Vec<u8>) -> Self {
+        Self { result, data }
+    }
+}
+
 #[derive(Debug)]
 pub struct Create {
     pub attr: FileAttr,
@@ -126,6 +169,24 @@ impl Create {
     }
 }
 
+// DirEntries are all the entries of a directory listed by readdir or
+// readdirplus, which are replied in pages from the offsets
+#[derive(Debug)]
+pub struct DirEntries {
+    pub entries: Vec<DirEntry>,
+    // the listing is kept for the following pages if it's changed
+    pub changed: bool,
+}
+
+impl DirEntries {
+    pub fn new(entries: Vec<DirEntry>) -> Self {
+        Self {
+            entries,
+            changed: false,
+        }
+    }
+}
+
 #[derive(Debug)]
 pub struct Lock {
     pub start: u64,
@@ -135,7 +196,7 @@ pub struct Lock {
 }
 
 impl Lock {
-    pub fn _new(start: u64, end: u64, typ: i32, pid: u32) -> Self {
+    pub fn new(start: u64, end: u64, typ: i32, pid: u32) -> Self {
         Self {
             start,
             end,
@@ -245,6 +306,15 @@ impl FsReply<Write> for ReplyWrite {
     }
 }
 
+impl FsReply<Lseek> for ReplyLseek {
+    fn reply_ok(self, item: Lseek) {
+        self.offset(item.offset);
+    }
+    fn reply_err(self, err: libc::c_int) {
+        self.error(err);
+    }
+}
+
 impl FsReply<Create> for ReplyCreate {
     fn reply_ok(self, item: Create) {
         self.created(
@@ -282,6 +352,24 @@ impl FsReply<Xattr> for ReplyXattr {
     }
 }
 
+impl FsReply<Bmap> for ReplyBmap {
+    fn reply_ok(self, item: Bmap) {
+        self.bmap(item.block);
+    }
+    fn reply_err(self, err: libc::c_int) {
+        self.error(err);
+    }
+}
+
+impl FsReply<Ioctl> for ReplyIoctl {
+    fn reply_ok(self, item: Ioctl) {
+        self.ioctl(item.result, &item.data);
+    }
+    fn reply_err(self, err: libc::c_int) {
+        self.error(err);
+    }
+}
+
 impl FsReply<()> for ReplyEmpty {
     fn reply_ok(self, _: ()) {
         self.ok();
@@ -0,0 +1,156 @@
+use std::io::{BufRead, BufReader, Write};
+use std::net::{TcpListener, TcpStream, ToSocketAddrs};
+use std::thread::JoinHandle;
+use std::time::Duration;
+
+use anyhow::{anyhow, Result};
+use tracing::{info, warn};
+
+pub struct Response {
+    pub status: u16,
+    pub content_type: &'static str,
+    pub body: String,
+}
+
+impl Response {
+    pub fn new(status: u16, content_type: &'static str, body: String) -> Self {
+        Self {
+            status,
+            content_type,
+            body,
+        }
+    }
+
+    pub fn not_found() -> Self {
+        Self::new(404, "text/plain", "not found\n".to_string())
+    }
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        404 => "Not Found",
+        503 => "Service Unavailable",
+        _ => "Unknown",
+    }
+}
+
+fn handle_connection<F: Fn(&str) -> Response>(stream: TcpStream, handler: &F) -> Result<()> {
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let mut request_line = String::new();
+    reader.read_line(&mut request_line)?;
+
+    // only the path of GET requests is used, the left part of the request
+    // is ignored
+    let mut parts = request_line.split_whitespace();
+    let response = match (parts.next(), parts.next()) {
+        (Some("GET"), Some(path)) => handler(path),
+        _ => Response::not_found(),
+    };
+
+    let mut stream = stream;
+    write!(
+        stream,
+        "HTTP/1.1 {} {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        response.status,
+        reason(response.status),
+        response.content_type,
+        response.body.len(),
+        response.body
+    )?;
+    stream.flush()?;
+
+    Ok(())
+}
+
+// serve starts a minimal HTTP server in a new thread. It's only used for the
+// lightweight endpoints (like metrics) and handles connections one by one.
+pub fn serve<F>(addr: &str, handler: F) -> Result<JoinHandle<()>>
+where
+    F: Fn(&str) -> Response + Send + 'static,
+{
+    let listener = TcpListener::bind(addr)?;
+    info!("http server listening on {}", addr);
+
+    Ok(std::thread::spawn(move || {
+        for stream in listener.incoming() {
+            match stream {
+                Ok(stream) => {
+                    if let Err(err) = handle_connection(stream, &handler) {
+                        warn!("fail to handle http connection: {:?}", err)
+                    }
+                }
+                Err(err) => warn!("fail to accept http connection: {:?}", err),
+            }
+        }
+    }))
+}
+
+// Url is the `http://` url which `post` sends to. TLS is not supported.
+#[derive(Debug, Clone)]
+pub struct Url {
+    host: String,
+    port: u16,
+    path: String,
+}
+
+impl Url {
+    pub fn parse(url: &str) -> Result<Self> {
+        let rest = url
+            .strip_prefix("http://")
+            .ok_or_else(|| anyhow!("unsupported url {}: expect http://", url))?;
+        let (authority, path) = match rest.find('/') {
+            Some(index) => (&rest[..index], &rest[index..]),
+            None => (rest, "/"),
+        };
+        let (host, port) = match authority.rfind(':') {
+            Some(index) => (
+                &authority[..index],
+                authority[index + 1..]
+                    .parse()
+                    .map_err(|_| anyhow!("invalid port in url {}", url))?,
+            ),
+            None => (authority, 80),
+        };
+        if host.is_empty() {
+            return Err(anyhow!("invalid host in url {}", url));
+        }
+
+        Ok(Self {
+            host: host.to_owned(),
+            port,
+            path: path.to_owned(),
+        })
+    }
+}
+
+// post sends the JSON body to the url, and returns the status of the response.
+// Every step of it gives up after the `timeout`.
+pub fn post(url: &Url, body: &str, timeout: Duration) -> Result<u16> {
+    let addr = (url.host.as_str(), url.port)
+        .to_socket_addrs()?
+        .next()
+        .ok_or_else(|| anyhow!("cannot resolve {}", url.host))?;
+    let mut stream = TcpStream::connect_timeout(&addr, timeout)?;
+    stream.set_read_timeout(Some(timeout))?;
+    stream.set_write_timeout(Some(timeout))?;
+
+    write!(
+        stream,
+        "POST {} HTTP/1.1\r\nHost: {}:{}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+        url.path,
+        url.host,
+        url.port,
+        body.len(),
+        body
+    )?;
+    stream.flush()?;
+
+    let mut status_line = String::new();
+    BufReader::new(stream).read_line(&mut status_line)?;
+    status_line
+        .split_whitespace()
+        .nth(1)
+        .and_then(|status| status.parse().ok())
+        .ok_or_else(|| anyhow!("invalid response {:?}", status_line))
+}
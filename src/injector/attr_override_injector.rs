@@ -2,7 +2,7 @@ use std::path::Path;
 
 use async_trait::async_trait;
 use fuser::{FileAttr, FileType};
-use tracing::{debug, trace};
+use tracing::{debug, info, trace};
 
 use super::injector_config::{AttrOverrideConfig, FileType as ConfigFileType, FilterConfig};
 use super::{filter, Injector};
@@ -24,6 +24,7 @@ pub struct AttrOverrideInjector {
     uid: Option<u32>,
     gid: Option<u32>,
     rdev: Option<u32>,
+    blksize: Option<u32>,
 }
 
 #[async_trait]
@@ -38,6 +39,48 @@ impl Injector for AttrOverrideInjector {
             return;
         }
 
+        if self.filter.dry_run() {
+            let mut overridden = *attr;
+            self.override_attr(&mut overridden);
+            info!(
+                "dry run: attr of {} would be overridden from {:?} to {:?}",
+                path.display(),
+                attr,
+                overridden
+            );
+            return;
+        }
+
+        if !self.filter.injected(
+            &filter::Method::GETATTR,
+            path,
+            "attr_override",
+            format_args!("override the attr"),
+        ) {
+            return;
+        }
+        self.override_attr(attr);
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl AttrOverrideInjector {
+    fn override_attr(&self, attr: &mut FileAttr) {
         if let Some(ino) = self.ino {
             trace!("overriding ino");
             attr.ino = ino
@@ -86,18 +129,25 @@ impl Injector for AttrOverrideInjector {
             trace!("overriding rdev");
             attr.rdev = rdev
         }
+        if let Some(blksize) = self.blksize {
+            trace!("overriding blksize");
+            attr.blksize = blksize
+        }
     }
-}
 
-impl AttrOverrideInjector {
-    pub fn build(conf: AttrOverrideConfig) -> anyhow::Result<Self> {
+    pub fn build(conf: AttrOverrideConfig, root: &Path) -> anyhow::Result<Self> {
         debug!("build attr override injector");
 
-        let filter = filter::Filter::build(FilterConfig {
-            path: Some(conf.path),
-            methods: None,
-            percent: conf.percent,
-        })?;
+        let filter = filter::Filter::build(
+            FilterConfig {
+                path: Some(conf.path),
+                methods: None,
+                percent: Some(conf.percent),
+                dry_run: conf.dry_run,
+                ..Default::default()
+            },
+            root,
+        )?;
 
         let atime = conf.atime;
         let mtime = conf.mtime;
@@ -128,6 +178,7 @@ impl AttrOverrideInjector {
             uid: conf.uid,
             gid: conf.gid,
             rdev: conf.rdev,
+            blksize: conf.blksize,
         })
     }
 }
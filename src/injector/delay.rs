@@ -0,0 +1,92 @@
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::time::Duration;
+
+use futures::future::{pending, select, Either};
+use nix::errno::Errno;
+use once_cell::sync::Lazy;
+use tokio::sync::watch;
+use tokio::time::delay_for;
+use tracing::{debug, warn};
+
+use crate::hookfs::{Error, RequestContext, Result};
+
+// the signals of the requesting thread are checked every `INTERRUPT_INTERVAL`
+// during a delay
+const INTERRUPT_INTERVAL: Duration = Duration::from_millis(100);
+
+// the cap of the injected latencies in nanoseconds, and 0 if there isn't
+static MAX_LATENCY: AtomicU64 = AtomicU64::new(0);
+
+// the delays stop waiting once it's set, so that they don't hold the
+// requests when toda is draining them
+static CANCELLED: Lazy<(watch::Sender<bool>, watch::Receiver<bool>)> =
+    Lazy::new(|| watch::channel(false));
+
+// set_max_latency caps the latencies of the latency, delayFault and timeout
+// injectors, so that a misconfigured one doesn't hang the workload. `None`
+// removes the cap.
+pub fn set_max_latency(max_latency: Option<Duration>) {
+    let nanos = max_latency.map_or(0, |latency| latency.as_nanos().max(1) as u64);
+    MAX_LATENCY.store(nanos, Ordering::Relaxed);
+}
+
+// cancel_delays wakes up all the injected delays, and the later ones don't
+// wait at all
+pub fn cancel_delays() {
+    let _ = CANCELLED.0.broadcast(true);
+}
+
+// cap clamps the latency to the max latency. The injector warns about it once
+// by `warned`, rather than on every operation.
+pub fn cap(latency: Duration, warned: &AtomicBool) -> Duration {
+    let max_latency = match MAX_LATENCY.load(Ordering::Relaxed) {
+        0 => return latency,
+        nanos => Duration::from_nanos(nanos),
+    };
+    if latency <= max_latency {
+        return latency;
+    }
+    if !warned.swap(true, Ordering::Relaxed) {
+        warn!(
+            "latency {:?} exceeds max latency {:?}, clamped",
+            latency, max_latency
+        );
+    }
+    max_latency
+}
+
+// interrupted finishes once the requesting thread has a signal pending, on
+// which the kernel sends FUSE_INTERRUPT. fuser 0.6 replies ENOSYS to it
+// without passing it to toda, so the thread is watched instead. It never
+// finishes outside of a FUSE request.
+async fn interrupted() {
+    let ctx = match RequestContext::current() {
+        Some(ctx) => ctx,
+        None => return pending().await,
+    };
+    loop {
+        delay_for(INTERRUPT_INTERVAL).await;
+        if ctx.signal_pending().unwrap_or(true) {
+            return;
+        }
+    }
+}
+
+// delay sleeps for the latency, or until the delays are cancelled. It returns
+// EINTR if the request is interrupted, e.g. the application is killed, so that
+// the request doesn't hold it until the latency passes.
+pub async fn delay(latency: Duration) -> Result<()> {
+    let mut cancelled = CANCELLED.1.clone();
+    // the first `recv` returns the current value at once
+    if cancelled.recv().await == Some(true) {
+        return Ok(());
+    }
+    let waiting = select(Box::pin(delay_for(latency)), Box::pin(cancelled.recv()));
+    match select(waiting, Box::pin(interrupted())).await {
+        Either::Left(_) => Ok(()),
+        Either::Right(_) => {
+            debug!("delay is interrupted");
+            Err(Error::Sys(Errno::EINTR))
+        }
+    }
+}
@@ -0,0 +1,104 @@
+use std::path::Path;
+use std::sync::atomic::AtomicBool;
+use std::time::Duration;
+
+use async_trait::async_trait;
+use nix::errno::Errno;
+use tracing::{debug, info, trace};
+
+use super::injector_config::{DelayFaultConfig, TimeoutConfig};
+use super::{delay, filter, Injector};
+use crate::hookfs::{Error, Result};
+use crate::metrics;
+
+// DelayFaultInjector delays a matched operation and then fails it, like a
+// request hanging until it times out
+#[derive(Debug)]
+pub struct DelayFaultInjector {
+    latency: Duration,
+    errno: Errno,
+    filter: filter::Filter,
+    // the type of the injector in the metrics
+    label: &'static str,
+    // whether the latency has been clamped by the max latency
+    capped: AtomicBool,
+}
+
+#[async_trait]
+impl Injector for DelayFaultInjector {
+    async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()> {
+        trace!("test for filter");
+        if self.filter.filter(method, path) {
+            let latency = delay::cap(self.latency, &self.capped);
+            if self.filter.dry_run() {
+                info!(
+                    "dry run: {:?} on {} would be delayed for {:?} and return with error {}",
+                    method,
+                    path.display(),
+                    latency,
+                    self.errno
+                );
+                return Ok(());
+            }
+            if !self.filter.injected(
+                method,
+                path,
+                self.label,
+                format_args!("latency {:?}, errno {:?}", latency, self.errno),
+            ) {
+                return Ok(());
+            }
+            debug!("inject io delay {:?}", latency);
+            metrics::injected_latency(latency);
+            delay::delay(latency).await?;
+            debug!("return with error {}", self.errno);
+            return Err(Error::Sys(self.errno));
+        }
+
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl DelayFaultInjector {
+    pub fn build(conf: DelayFaultConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build delay fault injector");
+
+        Ok(Self {
+            latency: conf.latency,
+            errno: Errno::from_i32(conf.errno),
+            filter: filter::Filter::build(conf.filter, root)?,
+            label: "delay_fault",
+            capped: AtomicBool::new(false),
+        })
+    }
+
+    // timeout builds the injector failing with ETIMEDOUT after the timeout.
+    // The waiting is cancelled if the request is interrupted.
+    pub fn timeout(conf: TimeoutConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build timeout injector");
+
+        Ok(Self {
+            latency: conf.timeout,
+            errno: Errno::ETIMEDOUT,
+            filter: filter::Filter::build(conf.filter, root)?,
+            label: "timeout",
+            capped: AtomicBool::new(false),
+        })
+    }
+}
@@ -1,62 +1,407 @@
-use std::path::Path;
+use std::collections::HashMap;
+use std::convert::TryFrom;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
 
+use anyhow::anyhow;
 use async_trait::async_trait;
 use nix::errno::Errno;
-use rand::Rng;
-use tracing::{debug, trace};
+use rand::rngs::StdRng;
+use rand::{Rng, SeedableRng};
+use tracing::{debug, info, trace};
 
-use super::injector_config::FaultsConfig;
-use super::{filter, Injector};
+use super::injector_config::{
+    BurstConfig, FaultConfig, FaultsConfig, FilterConfig, OpenFlagsConfig,
+};
+use super::{filter, BurstStatus, Injector};
 use crate::hookfs::{Error, Result};
 
 #[derive(Debug)]
-pub struct FaultInjector {
-    filter: filter::Filter,
+struct FaultRule {
+    // the rule built from the flat fields doesn't have a filter of its own
+    filter: Option<filter::Filter>,
 
     errnos: Vec<(Errno, i32)>,
 
     sum: i32,
 }
 
+impl FaultRule {
+    fn new(filter: Option<filter::Filter>, errnos: Vec<(Errno, i32)>) -> Self {
+        let sum = errnos.iter().fold(0, |acc, w| acc + w.1);
+        Self {
+            filter,
+            errnos,
+            sum,
+        }
+    }
+
+    fn pick(&self, rng: &mut StdRng) -> Option<Errno> {
+        if self.sum <= 0 {
+            return None;
+        }
+        let mut attempt = rng.gen_range(0, self.sum);
+
+        for (err, p) in self.errnos.iter() {
+            attempt -= p;
+
+            if attempt < 0 {
+                return Some(*err);
+            }
+        }
+
+        None
+    }
+}
+
+// check_weights rejects the weights which can't be picked from, so that a
+// broken config fails when it's applied rather than never injecting
+fn check_weights(faults: &[FaultConfig]) -> anyhow::Result<()> {
+    if faults.is_empty() {
+        return Err(anyhow!("either \"faults\" or \"rules\" is required"));
+    }
+    let mut sum: i32 = 0;
+    for fault in faults {
+        if fault.weight <= 0 {
+            return Err(anyhow!(
+                "invalid weight {} of errno {}: expect a positive weight",
+                fault.weight,
+                fault.errno
+            ));
+        }
+        sum = sum
+            .checked_add(fault.weight)
+            .ok_or_else(|| anyhow!("the sum of the weights overflows"))?;
+    }
+    Ok(())
+}
+
+// check_errno rejects the errno which isn't known, so that a typo doesn't
+// inject a meaningless error
+fn check_errno(errno: i32) -> anyhow::Result<Errno> {
+    match Errno::from_i32(errno) {
+        Errno::UnknownErrno => Err(anyhow!("unknown errno {}", errno)),
+        errno => Ok(errno),
+    }
+}
+
+// includes_io returns true if `methods` of a filter includes read or write,
+// which are parsed as the filter does. The filter without methods matches
+// all of them.
+fn includes_io(methods: &Option<Vec<String>>) -> bool {
+    match methods.as_ref().filter(|methods| !methods.is_empty()) {
+        Some(methods) => methods.iter().any(|method| {
+            filter::Method::try_from(method.as_str()).map_or(false, |method| {
+                method.intersects(filter::Method::READ | filter::Method::WRITE)
+            })
+        }),
+        None => true,
+    }
+}
+
+// check_eagain rejects the config returning EAGAIN from reads or writes of
+// the blocking files, as they never return it. It requires an `openFlags`
+// filter matching only the files opened with O_NONBLOCK.
+fn check_eagain(conf: &FaultsConfig) -> anyhow::Result<()> {
+    let eagain = match &conf.rules {
+        Some(rules) => rules
+            .iter()
+            .any(|rule| rule.errno == libc::EAGAIN && includes_io(&rule.methods)),
+        None => conf.faults.iter().any(|fault| fault.errno == libc::EAGAIN),
+    };
+    if !eagain || !includes_io(&conf.filter.methods) {
+        return Ok(());
+    }
+
+    match &conf.filter.open_flags {
+        Some(OpenFlagsConfig::Flags(flags))
+            if !flags.is_empty() && flags.iter().all(|flag| flag == "O_NONBLOCK") =>
+        {
+            Ok(())
+        }
+        _ => Err(anyhow!(
+            "EAGAIN on read or write requires \"openFlags\": [\"O_NONBLOCK\"]"
+        )),
+    }
+}
+
+const DEFAULT_RETRY_WINDOW: Duration = Duration::from_secs(1);
+
+// FailOnce remembers the failed operations, so that they succeed if they are
+// retried within the window
+#[derive(Debug)]
+struct FailOnce {
+    window: Duration,
+    failed: Mutex<HashMap<(filter::Method, PathBuf, Option<i64>), Instant>>,
+}
+
+impl FailOnce {
+    // retried returns true if the operation failed within the window, and
+    // forgets it. Otherwise the operation is remembered as failed.
+    fn retried(&self, method: &filter::Method, path: &Path, offset: Option<i64>) -> bool {
+        let now = Instant::now();
+        let mut failed = self.failed.lock().unwrap();
+        let window = self.window;
+        failed.retain(|_, failed_at| now.duration_since(*failed_at) < window);
+
+        let key = (*method, path.to_owned(), offset);
+        if failed.remove(&key).is_some() {
+            return true;
+        }
+        failed.insert(key, now);
+        false
+    }
+}
+
+// Burst fails all the matched operations for a while after one of them
+// starts it, and then keeps quiet
+#[derive(Debug)]
+struct Burst {
+    duration: Duration,
+    quiet: Duration,
+    probability: f64,
+    state: Mutex<BurstState>,
+}
+
+#[derive(Debug, Default)]
+struct BurstState {
+    started_at: Option<Instant>,
+    bursts: u64,
+}
+
+impl Burst {
+    fn build(conf: BurstConfig) -> anyhow::Result<Self> {
+        let probability = conf.probability.unwrap_or(1.0);
+        if !(0.0..=1.0).contains(&probability) {
+            return Err(anyhow!(
+                "invalid burst probability {}: expect 0 to 1",
+                probability
+            ));
+        }
+        if conf.duration == Duration::from_secs(0) {
+            return Err(anyhow!("burst duration should be positive"));
+        }
+        Ok(Self {
+            duration: conf.duration,
+            quiet: conf.quiet_duration,
+            probability,
+            state: Mutex::new(BurstState::default()),
+        })
+    }
+
+    // active returns true if the matched operation is in a burst, which may
+    // be started by it
+    fn active(&self, rng: &Mutex<StdRng>) -> bool {
+        let now = Instant::now();
+        let mut state = self.state.lock().unwrap();
+        if let Some(started_at) = state.started_at {
+            let elapsed = now.duration_since(started_at);
+            if elapsed < self.duration {
+                return true;
+            }
+            if elapsed < self.duration + self.quiet {
+                return false;
+            }
+        }
+
+        if !rng.lock().unwrap().gen_bool(self.probability) {
+            return false;
+        }
+        debug!("start a burst of faults");
+        state.started_at = Some(now);
+        state.bursts += 1;
+        true
+    }
+
+    fn status(&self) -> BurstStatus {
+        let state = self.state.lock().unwrap();
+        BurstStatus {
+            active: state
+                .started_at
+                .map_or(false, |started_at| started_at.elapsed() < self.duration),
+            bursts: state.bursts,
+        }
+    }
+}
+
+#[derive(Debug)]
+pub struct FaultInjector {
+    filter: filter::Filter,
+
+    rules: Vec<FaultRule>,
+
+    fail_once: Option<FailOnce>,
+
+    burst: Option<Burst>,
+
+    rng: Mutex<StdRng>,
+}
+
 #[async_trait]
 impl Injector for FaultInjector {
     async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()> {
+        // reads and writes are injected in `inject_io` with the offset
+        if self.fail_once.is_some()
+            && (*method == filter::Method::READ || *method == filter::Method::WRITE)
+        {
+            return Ok(());
+        }
+        self.inject_fault(method, path, None)
+    }
+
+    async fn inject_io(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        offset: i64,
+        _length: usize,
+    ) -> Result<()> {
+        if self.fail_once.is_none() {
+            return Ok(());
+        }
+        self.inject_fault(method, path, Some(offset))
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+
+    fn burst(&self) -> Option<BurstStatus> {
+        self.burst.as_ref().map(Burst::status)
+    }
+}
+
+impl FaultInjector {
+    fn inject_fault(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        offset: Option<i64>,
+    ) -> Result<()> {
         debug!("test filter");
         if self.filter.filter(method, path) {
+            if let Some(burst) = &self.burst {
+                if !burst.active(&self.rng) {
+                    return Ok(());
+                }
+            }
             debug!("inject io fault");
-            let mut rng = rand::thread_rng();
-            let attempt: f64 = rng.gen();
-            let mut attempt = (attempt * (self.sum as f64)) as i32;
-
-            for (err, p) in self.errnos.iter() {
-                attempt -= p;
+            for rule in self.rules.iter() {
+                let matched = match &rule.filter {
+                    Some(filter) => filter.filter(method, path),
+                    None => true,
+                };
+                if !matched {
+                    continue;
+                }
 
-                if attempt < 0 {
+                let picked = rule.pick(&mut self.rng.lock().unwrap());
+                if let Some(err) = picked {
+                    if self.filter.dry_run() {
+                        info!(
+                            "dry run: {:?} on {} would return with error {}",
+                            method,
+                            path.display(),
+                            err
+                        );
+                        return Ok(());
+                    }
+                    if let Some(fail_once) = &self.fail_once {
+                        if fail_once.retried(method, path, offset) {
+                            debug!("succeed on retry");
+                            return Ok(());
+                        }
+                    }
+                    if !self
+                        .filter
+                        .injected(method, path, "fault", format_args!("errno {:?}", err))
+                    {
+                        return Ok(());
+                    }
                     debug!("return with error {}", err);
-                    return Err(Error::Sys(*err));
+                    return Err(Error::Sys(err));
                 }
             }
         }
 
         Ok(())
     }
-}
 
-impl FaultInjector {
-    pub fn build(conf: FaultsConfig) -> anyhow::Result<Self> {
+    pub fn build(conf: FaultsConfig, root: &Path) -> anyhow::Result<Self> {
         trace!("build fault injector");
+        check_eagain(&conf)?;
 
-        let errnos: Vec<_> = conf
-            .faults
-            .iter()
-            .map(|item| (Errno::from_i32(item.errno), item.weight))
-            .collect();
+        // the rules are rolled only by their own percents if the flat
+        // `percent` is absent
+        let mut filter_conf = conf.filter;
+        if conf.rules.is_some() {
+            filter_conf.percent.get_or_insert(100);
+        }
+
+        // The flat `faults` are treated as a single rule if `rules` is absent
+        let rules = match conf.rules {
+            Some(rules) => rules
+                .into_iter()
+                .map(|rule| -> anyhow::Result<FaultRule> {
+                    let filter = filter::Filter::build(
+                        FilterConfig {
+                            path: None,
+                            methods: rule.methods,
+                            percent: Some(rule.percent),
+                            ..Default::default()
+                        },
+                        root,
+                    )?;
+                    Ok(FaultRule::new(
+                        Some(filter),
+                        vec![(check_errno(rule.errno)?, 1)],
+                    ))
+                })
+                .collect::<anyhow::Result<_>>()?,
+            None => {
+                check_weights(&conf.faults)?;
+                let errnos = conf
+                    .faults
+                    .iter()
+                    .map(|item| Ok((check_errno(item.errno)?, item.weight)))
+                    .collect::<anyhow::Result<Vec<_>>>()?;
+                vec![FaultRule::new(None, errnos)]
+            }
+        };
+
+        let fail_once = if conf.fail_once {
+            Some(FailOnce {
+                window: conf.retry_window.unwrap_or(DEFAULT_RETRY_WINDOW),
+                failed: Mutex::new(HashMap::new()),
+            })
+        } else {
+            None
+        };
+
+        let rng = match conf.seed {
+            Some(seed) => StdRng::seed_from_u64(seed),
+            None => StdRng::from_entropy(),
+        };
 
-        let sum = errnos.iter().fold(0, |acc, w| acc + w.1);
         Ok(Self {
-            filter: filter::Filter::build(conf.filter)?,
-            errnos,
-            sum,
+            filter: filter::Filter::build(filter_conf, root)?,
+            rules,
+            fail_once,
+            burst: conf.burst.map(Burst::build).transpose()?,
+            rng: Mutex::new(rng),
         })
     }
 }
@@ -1,16 +1,29 @@
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::convert::TryFrom;
-use std::path::Path;
+use std::fmt::Arguments;
+use std::os::unix::fs::MetadataExt;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, Instant, SystemTime};
 
 use anyhow::{anyhow, Error, Result};
 use bitflags::bitflags;
 use glob::{MatchOptions, Pattern};
 use rand::Rng;
+use regex::Regex;
 use tracing::{info, trace};
 
-use super::injector_config::FilterConfig;
+use super::injector_config::{
+    FilterConfig, FilterExprConfig, IdFilterConfig, ModeConfig, OpenFlagsConfig, OpenMode,
+    RetryMode,
+};
+use crate::hookfs::RequestContext;
+use crate::webhook::{self, EventKind};
+use crate::{audit, metrics};
 
 bitflags! {
-    pub struct Method: u32 {
+    pub struct Method: u64 {
         const LOOKUP = 1;
         const FORGET = 1<<1;
         const GETATTR = 1<<2;
@@ -43,6 +56,27 @@ bitflags! {
         const GETLK = 1<<29;
         const SETLK = 1<<30;
         const BMAP = 1<<31;
+        const FALLOCATE = 1<<32;
+        const COPY_FILE_RANGE = 1<<33;
+        const LSEEK = 1<<34;
+        const READDIRPLUS = 1<<35;
+        const RENAME2 = 1<<36;
+        const TRUNCATE = 1<<37;
+        // the setattr changing the mode, the owner or the times
+        const CHMOD = 1<<38;
+        const CHOWN = 1<<39;
+        const UTIMENS = 1<<40;
+        const IOCTL = 1<<41;
+        // the setlk waiting for the lock
+        const SETLKW = 1<<42;
+    }
+}
+
+impl Method {
+    // name returns the lowercase name of the method, which is the same as the
+    // one used in the config
+    pub fn name(&self) -> String {
+        format!("{:?}", self).to_lowercase()
     }
 }
 
@@ -52,7 +86,9 @@ impl TryFrom<&str> for Method {
             "lookup" => Ok(Method::LOOKUP),
             "forget" => Ok(Method::FORGET),
             "getattr" => Ok(Method::GETATTR),
-            "setattr" => Ok(Method::SETATTR),
+            // the setattr matches all the changes of attributes except the
+            // size, which is matched by `truncate`
+            "setattr" => Ok(Method::SETATTR | Method::CHMOD | Method::CHOWN | Method::UTIMENS),
             "readlink" => Ok(Method::READLINK),
             "mknod" => Ok(Method::MKNOD),
             "mkdir" => Ok(Method::MKDIR),
@@ -80,22 +116,397 @@ impl TryFrom<&str> for Method {
             "create" => Ok(Method::CREATE),
             "getlk" => Ok(Method::GETLK),
             "setlk" => Ok(Method::SETLK),
+            "setlkw" => Ok(Method::SETLKW),
             "bmap" => Ok(Method::BMAP),
+            "fallocate" => Ok(Method::FALLOCATE),
+            "copy_file_range" => Ok(Method::COPY_FILE_RANGE),
+            "lseek" => Ok(Method::LSEEK),
+            "readdirplus" => Ok(Method::READDIRPLUS),
+            "rename2" => Ok(Method::RENAME2),
+            "truncate" => Ok(Method::TRUNCATE),
+            "chmod" => Ok(Method::CHMOD),
+            "chown" => Ok(Method::CHOWN),
+            "utimens" => Ok(Method::UTIMENS),
+            "ioctl" => Ok(Method::IOCTL),
             _ => Err(anyhow!("")),
         }
     }
     type Error = Error;
 }
 
+#[derive(Debug)]
+enum PathFilter {
+    Absolute(Pattern),
+    Relative(Pattern),
+}
+
+const MATCH_OPTIONS: MatchOptions = MatchOptions {
+    case_sensitive: true,
+    require_literal_separator: true,
+    require_literal_leading_dot: false,
+};
+
+#[derive(Debug)]
+struct IdFilter {
+    ids: Vec<u32>,
+    negative: bool,
+}
+
+impl IdFilter {
+    fn new(conf: IdFilterConfig) -> Self {
+        match conf {
+            IdFilterConfig::Id(id) => Self {
+                ids: vec![id],
+                negative: false,
+            },
+            IdFilterConfig::Ids(ids) => Self {
+                ids,
+                negative: false,
+            },
+            IdFilterConfig::Not { not } => Self {
+                ids: not,
+                negative: true,
+            },
+        }
+    }
+
+    fn matches(&self, id: u32) -> bool {
+        self.ids.contains(&id) != self.negative
+    }
+}
+
+// open_mode returns the access mode of the open flags
+fn open_mode(flags: i32) -> Option<OpenMode> {
+    match flags & libc::O_ACCMODE {
+        libc::O_RDONLY => Some(OpenMode::Read),
+        libc::O_WRONLY => Some(OpenMode::Write),
+        libc::O_RDWR => Some(OpenMode::Readwrite),
+        _ => None,
+    }
+}
+
+#[derive(Debug)]
+struct OpenFlagsFilter {
+    flags: i32,
+    negative: bool,
+}
+
+impl OpenFlagsFilter {
+    fn build(conf: OpenFlagsConfig) -> Result<Self> {
+        let (names, negative) = match conf {
+            OpenFlagsConfig::Flags(names) => (names, false),
+            OpenFlagsConfig::Not { not } => (not, true),
+        };
+        let flags = names
+            .iter()
+            .map(|name| open_flag(name))
+            .collect::<Result<Vec<_>>>()?
+            .into_iter()
+            .fold(0, |flags, flag| flags | flag);
+        Ok(Self { flags, negative })
+    }
+
+    fn matches(&self, flags: i32) -> bool {
+        (flags & self.flags != 0) != self.negative
+    }
+}
+
+fn open_flag(name: &str) -> Result<i32> {
+    match name {
+        "O_WRONLY" => Ok(libc::O_WRONLY),
+        "O_RDWR" => Ok(libc::O_RDWR),
+        "O_APPEND" => Ok(libc::O_APPEND),
+        "O_CREAT" => Ok(libc::O_CREAT),
+        "O_EXCL" => Ok(libc::O_EXCL),
+        "O_TRUNC" => Ok(libc::O_TRUNC),
+        "O_DIRECT" => Ok(libc::O_DIRECT),
+        "O_SYNC" => Ok(libc::O_SYNC),
+        "O_DSYNC" => Ok(libc::O_DSYNC),
+        "O_NONBLOCK" => Ok(libc::O_NONBLOCK),
+        "O_NOATIME" => Ok(libc::O_NOATIME),
+        "O_NOFOLLOW" => Ok(libc::O_NOFOLLOW),
+        "O_CLOEXEC" => Ok(libc::O_CLOEXEC),
+        "O_TMPFILE" => Ok(libc::O_TMPFILE),
+        _ => Err(anyhow!("unknown open flag {}", name)),
+    }
+}
+
+// mode_bits parses the permission bits, whose string is octal
+fn mode_bits(mode: &ModeConfig) -> Result<u32> {
+    let bits = match mode {
+        ModeConfig::Bits(bits) => *bits,
+        ModeConfig::Octal(octal) => {
+            let digits = octal.strip_prefix("0o").unwrap_or(octal);
+            u32::from_str_radix(digits, 8).map_err(|_| anyhow!("invalid mode {:?}", octal))?
+        }
+    };
+    if bits & !0o7777 != 0 {
+        return Err(anyhow!("mode {:o} has the bits beyond 7777", bits));
+    }
+    Ok(bits)
+}
+
+// mnt_ns parses the mount namespace, either `mnt:[<inode>]` or the inode
+// number alone
+fn mnt_ns(ns: &str) -> Result<u64> {
+    let inode = ns
+        .strip_prefix("mnt:[")
+        .and_then(|ns| ns.strip_suffix(']'))
+        .unwrap_or(ns);
+    inode
+        .parse()
+        .map_err(|_| anyhow!("invalid mount namespace {}", ns))
+}
+
+// the write from the page cache, rather than from a `write` call, in
+// `fuse_kernel.h`
+const FUSE_WRITE_CACHE: u32 = 1;
+
+const DEFAULT_FIRST_ONLY_CAPACITY: usize = 65536;
+
+// FirstOnly remembers the inodes of the matched files, so that only the first
+// operation on each file is matched. The least recently matched inodes are
+// forgotten beyond the `capacity`, and then they are matched again, like a
+// file evicted from the cache.
+#[derive(Debug)]
+struct FirstOnly {
+    capacity: usize,
+    state: Mutex<FirstOnlyState>,
+}
+
+#[derive(Debug, Default)]
+struct FirstOnlyState {
+    // the inodes with when they were matched last time
+    seen: HashMap<u64, u64>,
+    // the inodes ordered by when they were matched last time
+    used: BTreeMap<u64, u64>,
+    clock: u64,
+}
+
+impl FirstOnly {
+    fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            state: Mutex::new(FirstOnlyState::default()),
+        }
+    }
+
+    // first records the operation on the file, and returns whether it's the
+    // first one
+    fn first(&self, ino: u64) -> bool {
+        let mut state = self.state.lock().unwrap();
+        state.clock += 1;
+        let clock = state.clock;
+        state.used.insert(clock, ino);
+        if let Some(used) = state.seen.insert(ino, clock) {
+            state.used.remove(&used);
+            return false;
+        }
+
+        while state.seen.len() > self.capacity {
+            let (oldest, ino) = match state.used.iter().next() {
+                Some((oldest, ino)) => (*oldest, *ino),
+                None => break,
+            };
+            state.used.remove(&oldest);
+            state.seen.remove(&ino);
+        }
+        true
+    }
+
+    // forget removes the inode, so that its next operation is the first one
+    // again
+    fn forget(&self, ino: u64) {
+        let mut state = self.state.lock().unwrap();
+        if let Some(used) = state.seen.remove(&ino) {
+            state.used.remove(&used);
+        }
+    }
+
+    fn clear(&self) {
+        *self.state.lock().unwrap() = FirstOnlyState::default();
+    }
+}
+
+// every_nth converts the percent to the N of every Nth operation, rounded to
+// the nearest, like 4 for 25 and 3 for 30
+fn every_nth(percent: i32) -> u64 {
+    if percent <= 0 {
+        return 0;
+    }
+    let percent = percent.min(100) as u64;
+    (100 + percent / 2) / percent
+}
+
+// RateLimiter is a token bucket holding at most one token, so the matched
+// operations are spread evenly rather than in bursts
+#[derive(Debug)]
+struct RateLimiter {
+    rate: f64,
+    // the tokens and when they were refilled
+    bucket: Mutex<(f64, Instant)>,
+}
+
+impl RateLimiter {
+    fn new(rate: f64) -> Self {
+        Self {
+            rate,
+            bucket: Mutex::new((1f64, Instant::now())),
+        }
+    }
+
+    fn take(&self) -> bool {
+        let mut bucket = self.bucket.lock().unwrap();
+        let (tokens, last) = &mut *bucket;
+
+        let now = Instant::now();
+        *tokens = (*tokens + now.duration_since(*last).as_secs_f64() * self.rate).min(1f64);
+        *last = now;
+
+        if *tokens >= 1f64 {
+            *tokens -= 1f64;
+            true
+        } else {
+            false
+        }
+    }
+}
+
+// FilterExpr is the tree of the sub-filters of `expr`. A sub-filter only
+// checks the conditions of the operation, and it's never counted.
+#[derive(Debug)]
+enum FilterExpr {
+    And(Vec<FilterExpr>),
+    Or(Vec<FilterExpr>),
+    Not(Box<FilterExpr>),
+    Filter(Box<Filter>),
+}
+
+impl FilterExpr {
+    fn build(conf: FilterExprConfig, root: &Path) -> Result<Self> {
+        let build_all = |exprs: Vec<FilterExprConfig>| -> Result<Vec<FilterExpr>> {
+            exprs
+                .into_iter()
+                .map(|expr| FilterExpr::build(expr, root))
+                .collect()
+        };
+        Ok(match conf {
+            FilterExprConfig::And(conf) => FilterExpr::And(build_all(conf.and)?),
+            FilterExprConfig::Or(conf) => FilterExpr::Or(build_all(conf.or)?),
+            FilterExprConfig::Not(conf) => {
+                FilterExpr::Not(Box::new(FilterExpr::build(*conf.not, root)?))
+            }
+            FilterExprConfig::Filter(conf) => {
+                let conf = *conf.0;
+                check_sub_filter(&conf)?;
+                FilterExpr::Filter(Box::new(Filter::build(conf, root)?))
+            }
+        })
+    }
+
+    fn matches(&self, method: &Method, path: &Path) -> bool {
+        match self {
+            FilterExpr::And(exprs) => exprs.iter().all(|expr| expr.matches(method, path)),
+            FilterExpr::Or(exprs) => exprs.iter().any(|expr| expr.matches(method, path)),
+            FilterExpr::Not(expr) => !expr.matches(method, path),
+            FilterExpr::Filter(filter) => {
+                filter.match_operation(method, path) && filter.match_process(method, path)
+            }
+        }
+    }
+}
+
+// check_sub_filter rejects the fields of a sub-filter which decide whether
+// and how often to inject rather than what to match, as they would be ignored
+fn check_sub_filter(conf: &FilterConfig) -> Result<()> {
+    let invalid = conf.name.is_some()
+        || conf.enabled.is_some()
+        || conf.percent != Some(100)
+        || conf.delay_start.is_some()
+        || conf.start_offset.is_some()
+        || conf.duration.is_some()
+        || conf.period.is_some()
+        || conf.dry_run
+        || conf.rate_per_sec.is_some()
+        || conf.deterministic
+        || conf.first_only
+        || conf.first_only_capacity.is_some()
+        || conf.retries.is_some()
+        || conf.max_injections.is_some();
+    if invalid {
+        return Err(anyhow!(
+            "sub-filter of expr should only have the conditions of the operation"
+        ));
+    }
+    Ok(())
+}
+
 #[derive(Debug)]
 pub struct Filter {
-    path_filter: Option<Pattern>,
+    // the events of the named filter are sent to the webhook
+    name: Option<String>,
+    triggered: AtomicBool,
+    window_passed: AtomicBool,
+
+    root: PathBuf,
+    path_filter: Option<PathFilter>,
+    path_regex: Option<Regex>,
     methods: Method,
     probability: f64,
+    // the limiter is shared by all the operations matching the filter
+    rate: Option<RateLimiter>,
+    // every Nth matching operation is injected in the deterministic mode, and
+    // none of them if N is 0
+    every_nth: Option<u64>,
+    // the operations counted for `every_nth`, which is cleared with `matched`
+    operations: AtomicU64,
+    first_only: Option<FirstOnly>,
+    retries: Option<RetryMode>,
+
+    applied_at: Instant,
+    delay_start: Duration,
+    start_offset: Duration,
+    duration: Option<Duration>,
+    period: Option<Duration>,
+
+    uid: Option<IdFilter>,
+    gid: Option<IdFilter>,
+    comm: Option<Vec<String>>,
+    mnt_ns: Option<Vec<u64>>,
+    open_flags: Option<OpenFlagsFilter>,
+    open_mode: Option<OpenMode>,
+    min_size: Option<u64>,
+    max_size: Option<u64>,
+    min_age: Option<Duration>,
+    max_age: Option<Duration>,
+    offset_min: Option<u64>,
+    offset_max: Option<u64>,
+    mmap: Option<bool>,
+    min_depth: Option<usize>,
+    max_depth: Option<usize>,
+    only_root: bool,
+    exclude_root: bool,
+    inodes: Option<HashSet<u64>>,
+    ioctl_commands: Option<Vec<u32>>,
+    is_symlink: Option<bool>,
+    // the mask and the value of the permission bits
+    mode: Option<(u32, u32)>,
+    expr: Option<FilterExpr>,
+
+    dry_run: bool,
+
+    max_injections: Option<u64>,
+    exhausted: AtomicBool,
+
+    // the injected operations, which are both the stats and the budget of
+    // `max_injections`
+    matched: AtomicU64,
+    // the `matched` when it was reset last time
+    reset_at: AtomicU64,
 }
 
 impl Filter {
-    pub fn build(conf: FilterConfig) -> Result<Self> {
+    pub fn build(conf: FilterConfig, root: &Path) -> Result<Self> {
         info!("build filter");
         let methods = conf
             .methods
@@ -108,44 +519,667 @@ impl Filter {
             })
             .unwrap_or(Method::all());
 
-        let path_filter = conf
-            .path
-            .map(|path| -> Option<Pattern> {
-                if !path.is_empty() {
-                    Pattern::new(&path).ok()
-                } else {
-                    None
-                }
+        let path_filter = match conf.path_pattern.filter(|pattern| !pattern.is_empty()) {
+            Some(pattern) => Some(PathFilter::Relative(
+                Pattern::new(&pattern)
+                    .map_err(|err| anyhow!("invalid path pattern {}: {}", pattern, err))?,
+            )),
+            None => conf
+                .path
+                .map(|path| -> Option<Pattern> {
+                    if !path.is_empty() {
+                        Pattern::new(&path).ok()
+                    } else {
+                        None
+                    }
+                })
+                .flatten()
+                .map(PathFilter::Absolute),
+        };
+
+        let path_regex = conf
+            .path_regex
+            .filter(|regex| !regex.is_empty())
+            .map(|regex| {
+                Regex::new(&regex).map_err(|err| anyhow!("invalid path regex {}: {}", regex, err))
             })
-            .flatten();
+            .transpose()?;
+
+        let percent = conf.percent.ok_or_else(|| anyhow!("percent is required"))?;
+        if percent < 0 || percent > 100 {
+            return Err(anyhow!("percent {} should be between 0 and 100", percent));
+        }
+        if conf.period == Some(Duration::from_secs(0)) {
+            return Err(anyhow!("period of active window should not be zero"));
+        }
+        if let (Some(min_size), Some(max_size)) = (conf.min_size, conf.max_size) {
+            if min_size > max_size {
+                return Err(anyhow!("min size should not be larger than max size"));
+            }
+        }
+        if let (Some(min_age), Some(max_age)) = (conf.min_age, conf.max_age) {
+            if min_age > max_age {
+                return Err(anyhow!("min age should not be larger than max age"));
+            }
+        }
+        if let (Some(offset_min), Some(offset_max)) = (conf.offset_min, conf.offset_max) {
+            if offset_min >= offset_max {
+                return Err(anyhow!("offset min should be smaller than offset max"));
+            }
+        }
+        if let (Some(min_depth), Some(max_depth)) = (conf.min_depth, conf.max_depth) {
+            if min_depth > max_depth {
+                return Err(anyhow!("min depth should not be larger than max depth"));
+            }
+        }
+        if conf.only_root && conf.exclude_root {
+            return Err(anyhow!("only root and exclude root should not be both set"));
+        }
+        let inodes = if conf.ino.is_some() || conf.ino_paths.is_some() {
+            let mut inodes: HashSet<u64> = conf.ino.unwrap_or_default().into_iter().collect();
+            for path in conf.ino_paths.unwrap_or_default() {
+                let metadata = std::fs::symlink_metadata(root.join(&path))
+                    .map_err(|err| anyhow!("cannot stat {}: {}", path, err))?;
+                inodes.insert(metadata.ino());
+            }
+            Some(inodes)
+        } else {
+            None
+        };
+        let mode = match (&conf.mode_mask, &conf.mode_value) {
+            (Some(mask), value) => {
+                let mask = mode_bits(mask)?;
+                let value = value.as_ref().map(mode_bits).transpose()?.unwrap_or(0);
+                if value & !mask != 0 {
+                    return Err(anyhow!(
+                        "mode value {:o} has the bits out of the mask {:o}",
+                        value,
+                        mask
+                    ));
+                }
+                Some((mask, value))
+            }
+            (None, Some(_)) => return Err(anyhow!("mode value should be set with mode mask")),
+            (None, None) => None,
+        };
+        let first_only_capacity = conf
+            .first_only_capacity
+            .unwrap_or(DEFAULT_FIRST_ONLY_CAPACITY);
+        if first_only_capacity == 0 {
+            return Err(anyhow!("first only capacity should be positive"));
+        }
+        if let Some(rate) = conf.rate_per_sec {
+            if rate.is_nan() || rate <= 0f64 {
+                return Err(anyhow!("rate per second should be positive"));
+            }
+        }
+
         Ok(Self {
+            name: conf.name,
+            triggered: AtomicBool::new(false),
+            window_passed: AtomicBool::new(false),
+            root: root.to_owned(),
             path_filter,
+            path_regex,
             methods,
-            probability: conf.percent as f64 / 100f64,
+            probability: percent as f64 / 100f64,
+            rate: conf.rate_per_sec.map(RateLimiter::new),
+            every_nth: if conf.deterministic {
+                Some(every_nth(percent))
+            } else {
+                None
+            },
+            operations: AtomicU64::new(0),
+            first_only: if conf.first_only {
+                Some(FirstOnly::new(first_only_capacity))
+            } else {
+                None
+            },
+            retries: conf.retries,
+            applied_at: Instant::now(),
+            delay_start: conf.delay_start.unwrap_or_default(),
+            start_offset: conf.start_offset.unwrap_or_default(),
+            duration: conf.duration,
+            period: conf.period,
+            uid: conf.uid.map(IdFilter::new),
+            gid: conf.gid.map(IdFilter::new),
+            comm: conf.comm,
+            mnt_ns: conf
+                .mnt_ns
+                .map(|namespaces| namespaces.iter().map(|ns| mnt_ns(ns)).collect())
+                .transpose()?,
+            open_flags: conf.open_flags.map(OpenFlagsFilter::build).transpose()?,
+            open_mode: conf.open_mode,
+            min_size: conf.min_size,
+            max_size: conf.max_size,
+            min_age: conf.min_age,
+            max_age: conf.max_age,
+            offset_min: conf.offset_min,
+            offset_max: conf.offset_max,
+            mmap: conf.mmap,
+            min_depth: conf.min_depth,
+            max_depth: conf.max_depth,
+            only_root: conf.only_root,
+            exclude_root: conf.exclude_root,
+            inodes,
+            ioctl_commands: conf.ioctl_commands,
+            is_symlink: conf.is_symlink,
+            mode,
+            expr: conf
+                .expr
+                .map(|expr| FilterExpr::build(expr, root))
+                .transpose()?,
+            dry_run: conf.dry_run,
+            max_injections: conf.max_injections,
+            exhausted: AtomicBool::new(false),
+            matched: AtomicU64::new(0),
+            reset_at: AtomicU64::new(0),
         })
     }
 
-    pub fn filter(&self, method: &Method, path: &Path) -> bool {
-        let mut rng = rand::thread_rng();
-        let p: f64 = rng.gen();
+    // active checks whether now is inside the active window. The clock starts
+    // when the filter is built, so it resets every time the config is updated.
+    // The window is measured from the end of the warm-up.
+    fn active(&self) -> bool {
+        let mut elapsed = match self.applied_at.elapsed().checked_sub(self.delay_start) {
+            Some(elapsed) => elapsed,
+            None => return false,
+        };
+        if let Some(period) = self.period {
+            elapsed = Duration::from_nanos((elapsed.as_nanos() % period.as_nanos()) as u64);
+        }
 
+        if elapsed < self.start_offset {
+            return false;
+        }
+        match self.duration {
+            Some(duration) => elapsed - self.start_offset < duration,
+            None => true,
+        }
+    }
+
+    // match_caller checks the caller of the current request. An operation
+    // outside of a FUSE request doesn't match if any of the filters is set.
+    fn match_caller(&self) -> bool {
+        if self.uid.is_none() && self.gid.is_none() {
+            return true;
+        }
+
+        match RequestContext::current() {
+            Some(ctx) => {
+                let match_uid = self.uid.as_ref().map_or(true, |f| f.matches(ctx.uid));
+                let match_gid = self.gid.as_ref().map_or(true, |f| f.matches(ctx.gid));
+                match_uid && match_gid
+            }
+            None => false,
+        }
+    }
+
+    // match_comm reads the name of the caller only if the filter is set, as it
+    // may read `/proc`
+    fn match_comm(&self) -> bool {
+        let names = match &self.comm {
+            Some(names) => names,
+            None => return true,
+        };
+
+        RequestContext::current()
+            .and_then(|ctx| ctx.comm())
+            .map_or(false, |comm| names.contains(&comm))
+    }
+
+    // match_mnt_ns reads the mount namespace of the caller only if the filter
+    // is set, as it may read `/proc`
+    fn match_mnt_ns(&self) -> bool {
+        let namespaces = match &self.mnt_ns {
+            Some(namespaces) => namespaces,
+            None => return true,
+        };
+
+        RequestContext::current()
+            .and_then(|ctx| ctx.mnt_ns())
+            .map_or(false, |ns| namespaces.contains(&ns))
+    }
+
+    fn match_open_flags(&self) -> bool {
+        match &self.open_flags {
+            Some(filter) => {
+                let flags = RequestContext::current()
+                    .and_then(|ctx| ctx.open_flags())
+                    .unwrap_or(0);
+                filter.matches(flags)
+            }
+            None => true,
+        }
+    }
+
+    fn match_open_mode(&self) -> bool {
+        match self.open_mode {
+            Some(mode) => RequestContext::current()
+                .and_then(|ctx| ctx.open_flags())
+                .map_or(false, |flags| open_mode(flags) == Some(mode)),
+            None => true,
+        }
+    }
+
+    // match_size checks the cached size of the file operated on against
+    // `[min_size, max_size]`
+    fn match_size(&self) -> bool {
+        if self.min_size.is_none() && self.max_size.is_none() {
+            return true;
+        }
+
+        match RequestContext::current().and_then(|ctx| ctx.file_size()) {
+            Some(size) => {
+                self.min_size.map_or(true, |min_size| size >= min_size)
+                    && self.max_size.map_or(true, |max_size| size <= max_size)
+            }
+            None => false,
+        }
+    }
+
+    // match_age checks the time since the cached creation time of the file
+    // operated on against `[min_age, max_age]`. A file created in the future,
+    // by the clock of toda, is taken as just created.
+    fn match_age(&self) -> bool {
+        if self.min_age.is_none() && self.max_age.is_none() {
+            return true;
+        }
+
+        match RequestContext::current().and_then(|ctx| ctx.file_created()) {
+            Some(created) => {
+                let age = SystemTime::now()
+                    .duration_since(created)
+                    .unwrap_or_default();
+                self.min_age.map_or(true, |min_age| age >= min_age)
+                    && self.max_age.map_or(true, |max_age| age <= max_age)
+            }
+            None => false,
+        }
+    }
+
+    // match_offset checks whether the range accessed by the operation overlaps
+    // `[offset_min, offset_max)`. The empty access is taken as a byte at the
+    // offset.
+    fn match_offset(&self) -> bool {
+        if self.offset_min.is_none() && self.offset_max.is_none() {
+            return true;
+        }
+
+        match RequestContext::current().and_then(|ctx| ctx.io_range()) {
+            Some((offset, length)) => {
+                let end = offset.saturating_add(length.max(1));
+                self.offset_min.map_or(true, |offset_min| end > offset_min)
+                    && self
+                        .offset_max
+                        .map_or(true, |offset_max| offset < offset_max)
+            }
+            None => false,
+        }
+    }
+
+    // match_depth checks the number of the components of the path relative to
+    // the root, which is 0 for the root itself
+    fn match_depth(&self, path: &Path) -> bool {
+        if self.min_depth.is_none() && self.max_depth.is_none() {
+            return true;
+        }
+
+        match path.strip_prefix(&self.root) {
+            Ok(relative_path) => {
+                let depth = relative_path.components().count();
+                self.min_depth.map_or(true, |min_depth| depth >= min_depth)
+                    && self.max_depth.map_or(true, |max_depth| depth <= max_depth)
+            }
+            Err(_) => false,
+        }
+    }
+
+    fn match_root(&self, path: &Path) -> bool {
+        let is_root = path == self.root;
+        match (self.only_root, self.exclude_root) {
+            (true, _) => is_root,
+            (_, true) => !is_root,
+            _ => true,
+        }
+    }
+
+    fn match_ino(&self) -> bool {
+        match &self.inodes {
+            Some(inodes) => RequestContext::current()
+                .and_then(|ctx| ctx.ino())
+                .map_or(false, |ino| inodes.contains(&ino)),
+            None => true,
+        }
+    }
+
+    fn match_ioctl_command(&self) -> bool {
+        match &self.ioctl_commands {
+            Some(commands) => RequestContext::current()
+                .and_then(|ctx| ctx.ioctl_command())
+                .map_or(false, |command| commands.contains(&command)),
+            None => true,
+        }
+    }
+
+    // may stat the backing file
+    fn match_mode(&self) -> bool {
+        match self.mode {
+            Some((mask, value)) => RequestContext::current()
+                .and_then(|ctx| ctx.file_mode())
+                .map_or(false, |mode| mode & mask == value),
+            None => true,
+        }
+    }
+
+    // may stat the backing file
+    fn match_symlink(&self) -> bool {
+        match self.is_symlink {
+            Some(is_symlink) => RequestContext::current()
+                .and_then(|ctx| ctx.is_symlink())
+                .map_or(false, |symlink| symlink == is_symlink),
+            None => true,
+        }
+    }
+
+    // match_mmap tells the reads and writes from the memory mappings by a
+    // heuristic. The kernel doesn't mark the reads of the page faults, but
+    // the caller of one is blocked outside of any syscall, as seen in
+    // `/proc/<pid>/syscall`. So a fault in a syscall, like `write` from a
+    // mapped buffer, is not counted. The writes of the dirty pages have
+    // FUSE_WRITE_CACHE, which the buffered writes also have with the
+    // writeback cache, though it's not requested if the writes are injected.
+    fn match_mmap(&self, method: &Method) -> bool {
+        let mmap = match self.mmap {
+            Some(mmap) => mmap,
+            None => return true,
+        };
+        let ctx = match RequestContext::current() {
+            Some(ctx) => ctx,
+            None => return false,
+        };
+
+        let from_mmap = if *method == Method::READ {
+            ctx.in_syscall().map(|in_syscall| !in_syscall)
+        } else if *method == Method::WRITE {
+            ctx.write_flags().map(|flags| flags & FUSE_WRITE_CACHE != 0)
+        } else {
+            None
+        };
+        from_mmap == Some(mmap)
+    }
+
+    // match_operation checks the conditions on the operation itself, which
+    // are cheap to check
+    fn match_operation(&self, method: &Method, path: &Path) -> bool {
+        let relative_path = path.strip_prefix(&self.root).unwrap_or(path);
         let match_path = match &self.path_filter {
-            Some(filter) => filter.matches_path_with(
-                path,
-                MatchOptions {
-                    case_sensitive: true,
-                    require_literal_separator: true,
-                    require_literal_leading_dot: false,
-                },
-            ),
+            Some(PathFilter::Absolute(filter)) => filter.matches_path_with(path, MATCH_OPTIONS),
+            Some(PathFilter::Relative(filter)) => {
+                filter.matches_path_with(relative_path, MATCH_OPTIONS)
+            }
+            None => true,
+        };
+        let match_regex = match &self.path_regex {
+            Some(regex) => regex.is_match(&relative_path.to_string_lossy()),
             None => true,
         };
         let match_method = !(self.methods & *method).is_empty();
-        let match_probability = p < self.probability;
+        let match_caller = self.match_caller();
+        let match_open_flags = self.match_open_flags();
+        let match_open_mode = self.match_open_mode();
+        let match_size = self.match_size();
+        let match_age = self.match_age();
+        let match_offset = self.match_offset();
+        let match_depth = self.match_depth(path);
+        let match_root = self.match_root(path);
+        let match_ino = self.match_ino();
+        let match_ioctl_command = self.match_ioctl_command();
         trace!("path filter: {}", match_path);
+        trace!("regex filter: {}", match_regex);
         trace!("method filter: {}", match_method);
+        trace!("caller filter: {}", match_caller);
+        trace!("open flags filter: {}", match_open_flags);
+        trace!("open mode filter: {}", match_open_mode);
+        trace!("size filter: {}", match_size);
+        trace!("age filter: {}", match_age);
+        trace!("offset filter: {}", match_offset);
+        trace!("depth filter: {}", match_depth);
+        trace!("root filter: {}", match_root);
+        trace!("ino filter: {}", match_ino);
+        trace!("ioctl command filter: {}", match_ioctl_command);
+
+        match_path
+            && match_regex
+            && match_method
+            && match_caller
+            && match_open_flags
+            && match_open_mode
+            && match_size
+            && match_age
+            && match_offset
+            && match_depth
+            && match_root
+            && match_ino
+            && match_ioctl_command
+    }
+
+    // match_process checks the comm, the mount namespace, the file type, the
+    // permission bits and the syscall, which may be read from `/proc` or the
+    // backing file, and then the expression, whose sub-filters may read them
+    // too
+    fn match_process(&self, method: &Method, path: &Path) -> bool {
+        self.match_comm()
+            && self.match_mnt_ns()
+            && self.match_symlink()
+            && self.match_mode()
+            && self.match_mmap(method)
+            && self
+                .expr
+                .as_ref()
+                .map_or(true, |expr| expr.matches(method, path))
+    }
+
+    pub fn filter(&self, method: &Method, path: &Path) -> bool {
+        if !self.active() {
+            trace!("filter is out of active window");
+            self.notify_window_passed(method);
+            return false;
+        }
+
+        let mut rng = rand::thread_rng();
+        let p: f64 = rng.gen();
+
+        let match_operation = self.match_operation(method, path);
+        // a retry only matches with `always`, which also skips the chance,
+        // the Nth, the first operation and the rate below
+        let retry = self.retries.is_some() && RequestContext::is_retry();
+        let forced = retry && self.retries == Some(RetryMode::Always);
+        let match_retry = !retry || forced;
+        let match_probability =
+            forced || self.rate.is_some() || self.every_nth.is_some() || p < self.probability;
+        trace!("retry filter: {}", match_retry);
         trace!("probability: {}", match_probability);
 
-        match_path && match_method && match_probability
+        let matched = match_operation && match_retry && match_probability;
+        // the process and the expression are only checked for the operations
+        // matching the others
+        let matched = matched && self.match_process(method, path);
+        // the deterministic mode only counts the operations matching the
+        // others, so that the Nth of them is chosen
+        let matched = matched && (forced || self.rate.is_some() || self.match_nth());
+        // the file is only recorded by the operations matching the others
+        let matched = matched && (forced || self.match_first());
+        trace!("matched: {}", matched);
+        // the token is only taken by the operations matching the others
+        let matched = matched && (forced || self.rate.as_ref().map_or(true, |rate| rate.take()));
+        // the budget is only charged by `injected`, as the injector may still
+        // pass the operation
+        matched && self.has_budget()
+    }
+
+    // match_first matches the first operation on each file. An operation
+    // without the inode doesn't match.
+    fn match_first(&self) -> bool {
+        match &self.first_only {
+            Some(first_only) => RequestContext::current()
+                .and_then(|ctx| ctx.ino())
+                .map_or(false, |ino| first_only.first(ino)),
+            None => true,
+        }
+    }
+
+    fn match_nth(&self) -> bool {
+        match self.every_nth {
+            Some(0) => false,
+            Some(n) => (self.operations.fetch_add(1, Ordering::Relaxed) + 1) % n == 0,
+            None => true,
+        }
+    }
+
+    // has_budget returns false once `max_injections` operations have been
+    // injected
+    fn has_budget(&self) -> bool {
+        let exhausted = self.max_injections.map_or(false, |max_injections| {
+            self.matched.load(Ordering::SeqCst) >= max_injections
+        });
+        if exhausted {
+            self.log_exhausted();
+        }
+        !exhausted
+    }
+
+    // injected charges the budget with the injection of a matched operation,
+    // and records it in the metrics and the audit log with the `fault` of the
+    // `injector`. It's the only way an injection is counted, and it's called
+    // once the injector has decided to inject, not in the dry run. It returns
+    // false if the budget has been exhausted since the operation was matched,
+    // and then nothing is recorded and the operation should be passed.
+    pub fn injected(&self, method: &Method, path: &Path, injector: &str, fault: Arguments) -> bool {
+        if !self.charge(method) {
+            return false;
+        }
+        metrics::injected(method, path, injector);
+        audit::record(method, path, injector, self.name(), fault);
+        true
+    }
+
+    fn charge(&self, method: &Method) -> bool {
+        let max_injections = match self.max_injections {
+            Some(max_injections) => max_injections,
+            None => {
+                let matched = self.matched.fetch_add(1, Ordering::Relaxed) + 1;
+                self.notify_matched(method, matched);
+                return true;
+            }
+        };
+
+        let counted = self
+            .matched
+            .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |matched| {
+                if matched < max_injections {
+                    Some(matched + 1)
+                } else {
+                    None
+                }
+            })
+            .map(|matched| self.notify_matched(method, matched + 1))
+            .is_ok();
+        if !counted {
+            self.log_exhausted();
+        }
+        counted
+    }
+
+    fn log_exhausted(&self) {
+        if let Some(max_injections) = self.max_injections {
+            if !self.exhausted.swap(true, Ordering::Relaxed) {
+                info!(
+                    "injector budget exhausted after {} injections",
+                    max_injections
+                );
+            }
+        }
+    }
+
+    // notify_matched sends the event of the first matched operation, and the
+    // one exhausting the budget. Nothing is sent in the dry run.
+    fn notify_matched(&self, method: &Method, matched: u64) {
+        let name = match &self.name {
+            Some(name) if !self.dry_run => name,
+            _ => return,
+        };
+        if !self.triggered.swap(true, Ordering::Relaxed) {
+            webhook::notify(name, EventKind::Triggered, method);
+        }
+        if self.max_injections == Some(matched) {
+            webhook::notify(name, EventKind::BudgetExhausted, method);
+        }
+    }
+
+    // notify_window_passed sends the event when the active window has passed
+    // after the filter was triggered. It can't pass with `period`, as the
+    // window comes again.
+    fn notify_window_passed(&self, method: &Method) {
+        let name = match &self.name {
+            Some(name) if !self.dry_run => name,
+            _ => return,
+        };
+        let duration = match self.duration {
+            Some(duration) if self.period.is_none() => duration,
+            _ => return,
+        };
+        let end = self.delay_start + self.start_offset + duration;
+        if self.applied_at.elapsed() >= end
+            && self.triggered.load(Ordering::Relaxed)
+            && !self.window_passed.swap(true, Ordering::Relaxed)
+        {
+            webhook::notify(name, EventKind::WindowExhausted, method);
+        }
+    }
+
+    pub fn name(&self) -> Option<&str> {
+        self.name.as_deref()
+    }
+
+    // dry_run returns whether the injector should only log the injection
+    pub fn dry_run(&self) -> bool {
+        self.dry_run
+    }
+
+    // matched returns how many operations have been counted by `injected`
+    // since it was reset
+    pub fn matched(&self) -> u64 {
+        let matched = self.matched.load(Ordering::Relaxed);
+        matched.saturating_sub(self.reset_at.load(Ordering::Relaxed))
+    }
+
+    // reset_matched clears the counter returned by `matched`, and returns the
+    // value before. The budget of `max_injections` is not refilled, while the
+    // count of the deterministic mode restarts, and the files of `first_only`
+    // are forgotten.
+    pub fn reset_matched(&self) -> u64 {
+        self.operations.store(0, Ordering::SeqCst);
+        if let Some(first_only) = &self.first_only {
+            first_only.clear();
+        }
+        let matched = self.matched.load(Ordering::SeqCst);
+        matched.saturating_sub(self.reset_at.swap(matched, Ordering::SeqCst))
+    }
+
+    // remaining returns how many operations can still be injected, or `None`
+    // if there is no `max_injections`
+    pub fn remaining(&self) -> Option<u64> {
+        let matched = self.matched.load(Ordering::Relaxed);
+        self.max_injections
+            .map(|max_injections| max_injections.saturating_sub(matched))
+    }
+
+    // forget removes the inode forgotten by the kernel from the files of
+    // `first_only`
+    pub fn forget(&self, ino: u64) {
+        if let Some(first_only) = &self.first_only {
+            first_only.forget(ino);
+        }
     }
 }
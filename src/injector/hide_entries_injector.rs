@@ -0,0 +1,146 @@
+use std::collections::hash_map::DefaultHasher;
+use std::hash::{Hash, Hasher};
+use std::os::unix::ffi::OsStrExt;
+use std::path::Path;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use glob::Pattern;
+use tracing::{debug, info, trace};
+
+use super::injector_config::HideEntriesConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Reply, Result};
+
+// HideEntriesInjector drops the entries from the listings of readdir and
+// readdirplus, while the files are still there to be looked up. The entries
+// matching `pattern` are hidden, or `ratio` of them. Whether an entry is
+// hidden only depends on its name and the seed, so it's hidden in every
+// listing and every page of it.
+#[derive(Debug)]
+pub struct HideEntriesInjector {
+    filter: filter::Filter,
+    pattern: Option<Pattern>,
+    ratio: Option<f64>,
+    seed: u64,
+}
+
+impl HideEntriesInjector {
+    fn hidden(&self, name: &[u8]) -> bool {
+        if name == b"." || name == b".." {
+            return false;
+        }
+        if let Some(pattern) = &self.pattern {
+            if !pattern.matches(&String::from_utf8_lossy(name)) {
+                return false;
+            }
+        }
+        match self.ratio {
+            Some(ratio) => {
+                let mut hasher = DefaultHasher::new();
+                (self.seed, name).hash(&mut hasher);
+                (hasher.finish() as f64 / u64::MAX as f64) < ratio
+            }
+            None => true,
+        }
+    }
+}
+
+#[async_trait]
+impl Injector for HideEntriesInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        if *method != Method::READDIR && *method != Method::READDIRPLUS {
+            return Ok(());
+        }
+        let listing = match reply {
+            Reply::DirEntries(listing) => listing,
+            _ => return Ok(()),
+        };
+        if !self.filter.filter(method, path) {
+            return Ok(());
+        }
+
+        let count = listing.entries.len();
+        let hidden = listing
+            .entries
+            .iter()
+            .filter(|entry| self.hidden(entry.name.as_bytes()))
+            .count();
+        if self.filter.dry_run() {
+            info!(
+                "dry run: {:?} on {} would hide {} of {} entries",
+                method,
+                path.display(),
+                hidden,
+                count
+            );
+            return Ok(());
+        }
+
+        if !self.filter.injected(
+            method,
+            path,
+            "hide_entries",
+            format_args!("hide {} of {} entries", hidden, count),
+        ) {
+            return Ok(());
+        }
+        listing
+            .entries
+            .retain(|entry| !self.hidden(entry.name.as_bytes()));
+        listing.changed = true;
+        debug!("hide {} of {} entries", hidden, count);
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl HideEntriesInjector {
+    pub fn build(conf: HideEntriesConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build hide entries injector");
+
+        if conf.pattern.is_none() && conf.ratio.is_none() {
+            return Err(anyhow!(
+                "either pattern or ratio of hidden entries is required"
+            ));
+        }
+        if let Some(ratio) = conf.ratio {
+            if !(0.0..=1.0).contains(&ratio) {
+                return Err(anyhow!("invalid ratio {}: expect 0 to 1", ratio));
+            }
+        }
+        let pattern = conf
+            .pattern
+            .map(|pattern| {
+                Pattern::new(&pattern)
+                    .map_err(|err| anyhow!("invalid pattern {}: {}", pattern, err))
+            })
+            .transpose()?;
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            pattern,
+            ratio: conf.ratio,
+            seed: conf.seed.unwrap_or(0),
+        })
+    }
+}
@@ -1,3 +1,4 @@
+use std::convert::TryFrom;
 use std::time::Duration;
 
 use serde::{Deserialize, Serialize};
@@ -10,15 +11,296 @@ pub enum InjectorConfig {
     Fault(FaultsConfig),
     AttrOverride(AttrOverrideConfig),
     Mistake(MistakesConfig),
+    Throttle(ThrottleConfig),
+    ShortIo(ShortIoConfig),
+    Quota(QuotaConfig),
+    DelayFault(DelayFaultConfig),
+    Timeout(TimeoutConfig),
+    StaleRead(StaleReadConfig),
+    StatfsOverride(StatfsOverrideConfig),
+    Phases(PhasesConfig),
+    ShuffleDir(ShuffleDirConfig),
+    HideEntries(HideEntriesConfig),
+    VolatileWrites(VolatileWritesConfig),
+    Sequence(SequenceConfig),
+    Readlink(ReadlinkConfig),
+}
+
+impl InjectorConfig {
+    // name returns the name of the injector, by which it can be updated or
+    // removed alone
+    pub fn name(&self) -> Option<&str> {
+        let name = match self {
+            InjectorConfig::Latency(conf) => &conf.filter.name,
+            InjectorConfig::Fault(conf) => &conf.filter.name,
+            InjectorConfig::AttrOverride(conf) => &conf.name,
+            InjectorConfig::Mistake(conf) => &conf.filter.name,
+            InjectorConfig::Throttle(conf) => &conf.filter.name,
+            InjectorConfig::ShortIo(conf) => &conf.filter.name,
+            InjectorConfig::Quota(conf) => &conf.filter.name,
+            InjectorConfig::DelayFault(conf) => &conf.filter.name,
+            InjectorConfig::Timeout(conf) => &conf.filter.name,
+            InjectorConfig::StaleRead(conf) => &conf.filter.name,
+            InjectorConfig::StatfsOverride(conf) => &conf.filter.name,
+            InjectorConfig::Phases(conf) => &conf.name,
+            InjectorConfig::ShuffleDir(conf) => &conf.filter.name,
+            InjectorConfig::HideEntries(conf) => &conf.filter.name,
+            InjectorConfig::VolatileWrites(conf) => &conf.filter.name,
+            InjectorConfig::Sequence(conf) => &conf.filter.name,
+            InjectorConfig::Readlink(conf) => &conf.filter.name,
+        };
+        name.as_deref()
+    }
+
+    // enabled returns whether the injector is enabled, which it is unless
+    // `enabled` is set to `false`
+    pub fn enabled(&self) -> bool {
+        let enabled = match self {
+            InjectorConfig::Latency(conf) => conf.filter.enabled,
+            InjectorConfig::Fault(conf) => conf.filter.enabled,
+            InjectorConfig::AttrOverride(conf) => conf.enabled,
+            InjectorConfig::Mistake(conf) => conf.filter.enabled,
+            InjectorConfig::Throttle(conf) => conf.filter.enabled,
+            InjectorConfig::ShortIo(conf) => conf.filter.enabled,
+            InjectorConfig::Quota(conf) => conf.filter.enabled,
+            InjectorConfig::DelayFault(conf) => conf.filter.enabled,
+            InjectorConfig::Timeout(conf) => conf.filter.enabled,
+            InjectorConfig::StaleRead(conf) => conf.filter.enabled,
+            InjectorConfig::StatfsOverride(conf) => conf.filter.enabled,
+            InjectorConfig::Phases(conf) => conf.enabled,
+            InjectorConfig::ShuffleDir(conf) => conf.filter.enabled,
+            InjectorConfig::HideEntries(conf) => conf.filter.enabled,
+            InjectorConfig::VolatileWrites(conf) => conf.filter.enabled,
+            InjectorConfig::Sequence(conf) => conf.filter.enabled,
+            InjectorConfig::Readlink(conf) => conf.filter.enabled,
+        };
+        enabled.unwrap_or(true)
+    }
+
+    pub fn set_enabled(&mut self, enabled: bool) {
+        *self.enabled_mut() = Some(enabled)
+    }
+
+    fn enabled_mut(&mut self) -> &mut Option<bool> {
+        match self {
+            InjectorConfig::Latency(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Fault(conf) => &mut conf.filter.enabled,
+            InjectorConfig::AttrOverride(conf) => &mut conf.enabled,
+            InjectorConfig::Mistake(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Throttle(conf) => &mut conf.filter.enabled,
+            InjectorConfig::ShortIo(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Quota(conf) => &mut conf.filter.enabled,
+            InjectorConfig::DelayFault(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Timeout(conf) => &mut conf.filter.enabled,
+            InjectorConfig::StaleRead(conf) => &mut conf.filter.enabled,
+            InjectorConfig::StatfsOverride(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Phases(conf) => &mut conf.enabled,
+            InjectorConfig::ShuffleDir(conf) => &mut conf.filter.enabled,
+            InjectorConfig::HideEntries(conf) => &mut conf.filter.enabled,
+            InjectorConfig::VolatileWrites(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Sequence(conf) => &mut conf.filter.enabled,
+            InjectorConfig::Readlink(conf) => &mut conf.filter.enabled,
+        }
+    }
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
 #[serde(rename_all = "camelCase")]
 pub struct LatencyConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // the mean of the distribution, 0 by default
+    #[serde(default, with = "humantime_serde")]
+    pub latency: Duration,
+    // the delay added for every byte of the reads and writes, so that the
+    // large ones are slower than the small ones, like on a HDD
+    #[serde(default, with = "humantime_serde")]
+    pub per_byte: Option<Duration>,
+
+    #[serde(default)]
+    pub distribution: LatencyDistribution,
+    // half width of the range of the uniform distribution
+    #[serde(default, with = "humantime_serde")]
+    pub jitter: Option<Duration>,
+    // standard deviation of the normal distribution
+    #[serde(default, with = "humantime_serde")]
+    pub stddev: Option<Duration>,
+    // the ramp goes from `start` to `end` linearly in `ramp_duration` since
+    // the config is applied, and then holds at `end`
+    #[serde(default, with = "humantime_serde")]
+    pub start: Option<Duration>,
+    #[serde(default, with = "humantime_serde")]
+    pub end: Option<Duration>,
+    #[serde(default, with = "humantime_serde")]
+    pub ramp_duration: Option<Duration>,
+}
+
+// DelayFaultConfig delays every matched operation for `latency`, and then
+// fails it with `errno`
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct DelayFaultConfig {
     #[serde(flatten)]
     pub filter: FilterConfig,
     #[serde(with = "humantime_serde")]
     pub latency: Duration,
+    pub errno: i32,
+}
+
+// TimeoutConfig delays every matched operation for `timeout`, and then fails
+// it with ETIMEDOUT without running it
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct TimeoutConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    #[serde(with = "humantime_serde")]
+    pub timeout: Duration,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub enum LatencyDistribution {
+    Fixed,
+    Uniform,
+    Normal,
+    Exponential,
+    Ramp,
+}
+
+impl Default for LatencyDistribution {
+    fn default() -> Self {
+        LatencyDistribution::Fixed
+    }
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ThrottleConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // bytes per second
+    pub rate: u64,
+    // bytes, equals to `rate` if it's 0
+    #[serde(default)]
+    pub burst: u64,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct QuotaConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // bytes which can be written by all the users before returning ENOSPC
+    pub quota: Option<u64>,
+    // bytes which can be written by every user before returning EDQUOT to
+    // the user. The bytes are counted from `reset_quota` or `reset_stats`.
+    pub user_quota: Option<u64>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ShortIoConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // The transferred length is `length * ratio`, capped by `max_length`. A
+    // random length smaller than the requested one is used if both of them
+    // are absent.
+    pub ratio: Option<f64>,
+    pub max_length: Option<usize>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct StatfsOverrideConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // the counts replied to `statfs`, which are left as they are if absent.
+    // The available blocks can't exceed the free ones, so they are capped.
+    pub free_blocks: Option<u64>,
+    pub available_blocks: Option<u64>,
+    pub free_inodes: Option<u64>,
+}
+
+// ReadlinkConfig replaces the targets replied to `readlink` of the matched
+// links with `target`. With `dangling`, a random suffix the filesystem
+// doesn't have is appended to the target, which is the real one if `target`
+// is absent, so that the link points to nothing.
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ReadlinkConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    pub target: Option<String>,
+    #[serde(default)]
+    pub dangling: bool,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct ShuffleDirConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // the order is shuffled by a random generator seeded with `seed` if it's
+    // set, so that the same listings are shuffled the same way
+    pub seed: Option<u64>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct HideEntriesConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // the entries whose names match the glob `pattern` are hidden, or only
+    // `ratio` of them if it's set. The ones of the ratio are chosen by the
+    // hash of the name with `seed`.
+    pub pattern: Option<String>,
+    pub ratio: Option<f64>,
+    pub seed: Option<u64>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct VolatileWritesConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // the data overwritten by the writes is kept up to `max_bytes` (64MiB by
+    // default), and the writes beyond it are not lost on crash
+    pub max_bytes: Option<usize>,
+}
+
+// SequenceConfig applies the `steps` to the matched operations on every file
+// by their positions, like delaying only the 3rd write. The operations are
+// counted from 1 on every inode, and again after the file is released or
+// unlinked, or `reset_stats`.
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct SequenceConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    pub steps: Vec<SequenceStepConfig>,
+}
+
+// SequenceStepConfig delays the `index`th operation for `latency`, and then
+// fails it with `errno`. At least one of them should be set.
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct SequenceStepConfig {
+    pub index: u64,
+    #[serde(default, with = "humantime_serde")]
+    pub latency: Option<Duration>,
+    pub errno: Option<i32>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct StaleReadConfig {
+    #[serde(flatten)]
+    pub filter: FilterConfig,
+    // the snapshots of the reads are kept for up to `max_regions` of them
+    // (1024 by default) and `max_bytes` in all (64MiB by default)
+    pub max_regions: Option<usize>,
+    pub max_bytes: Option<usize>,
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
@@ -27,15 +309,337 @@ pub struct FaultsConfig {
     #[serde(flatten)]
     pub filter: FilterConfig,
 
+    #[serde(default)]
     pub faults: Vec<FaultConfig>,
+
+    // rules are evaluated in order after the flat filter matches, and the
+    // first matching one decides the errno. `faults` is ignored if `rules`
+    // is present. The `percent` of each rule is rolled after the `percent` of
+    // the flat filter, so the probability of a rule is both of them
+    // multiplied, and the flat `percent` is 100 if it's absent with `rules`.
+    pub rules: Option<Vec<FaultRuleConfig>>,
+
+    // with `failOnce`, a failed operation succeeds if it's retried within the
+    // `retryWindow` (1s by default). Reads and writes are identified by the
+    // file and the offset, and the other operations by the method and the
+    // file. It's useful to test the retrying on EINTR.
+    #[serde(default)]
+    pub fail_once: bool,
+    #[serde(default, with = "humantime_serde")]
+    pub retry_window: Option<Duration>,
+
+    // the errno is picked from `faults` by the weights with a random
+    // generator seeded with `seed` if it's set, so that the picks are
+    // reproducible. Whether to fail is still decided by the filter.
+    #[serde(default)]
+    pub seed: Option<u64>,
+
+    // with `burst`, the faults are clustered rather than spread evenly
+    pub burst: Option<BurstConfig>,
+}
+
+// BurstConfig starts a burst on a matched operation by `probability` (1 by
+// default). Every matched operation fails for the `duration` of the burst,
+// and none of them fails or starts a burst in the `quietDuration` after it.
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct BurstConfig {
+    #[serde(with = "humantime_serde")]
+    pub duration: Duration,
+    #[serde(with = "humantime_serde")]
+    pub quiet_duration: Duration,
+    pub probability: Option<f64>,
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
 #[serde(rename_all = "camelCase")]
+pub struct FaultRuleConfig {
+    pub methods: Option<Vec<String>>,
+    pub errno: i32,
+    pub percent: i32,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug, Default)]
+#[serde(rename_all = "camelCase")]
 pub struct FilterConfig {
+    // `name` identifies the injector in `update_injector`, `remove_injector`
+    // and the status. It's not matched against anything.
+    pub name: Option<String>,
+    // a disabled injector injects nothing, and keeps its counters until it's
+    // enabled again by `enable_injector`
+    pub enabled: Option<bool>,
+
     pub path: Option<String>,
     pub methods: Option<Vec<String>>,
-    pub percent: i32,
+    // `percent` is required, except by the fault injector with `rules`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub percent: Option<i32>,
+
+    // `path_pattern` is a glob matched against the path relative to the
+    // mount point. If both `path` and `path_pattern` are set, `path_pattern`
+    // wins.
+    pub path_pattern: Option<String>,
+    // `path_regex` is matched against the path relative to the mount point,
+    // in addition to the glob
+    pub path_regex: Option<String>,
+
+    // `delay_start` is a warm-up after the config is applied, in which the
+    // filter matches nothing. The window below starts when it elapses.
+    #[serde(default, with = "humantime_serde")]
+    pub delay_start: Option<Duration>,
+    // The filter is only active in `[start_offset, start_offset + duration)`
+    // since the config was applied, and the warm-up passed. If `period` is
+    // set, the window repeats every `period`. A missing `duration` means the
+    // window never closes.
+    #[serde(default, with = "humantime_serde")]
+    pub start_offset: Option<Duration>,
+    #[serde(default, with = "humantime_serde")]
+    pub duration: Option<Duration>,
+    #[serde(default, with = "humantime_serde")]
+    pub period: Option<Duration>,
+
+    // `uid` and `gid` are matched against the caller of the operation
+    pub uid: Option<IdFilterConfig>,
+    pub gid: Option<IdFilterConfig>,
+    // `comm` is matched against the name of the calling process, which is
+    // truncated to 15 bytes by the kernel. The operations from an exited
+    // process don't match.
+    pub comm: Option<Vec<String>>,
+    // `mnt_ns` is matched against the mount namespace of the calling process,
+    // like `mnt:[4026531840]` as `/proc/<pid>/ns/mnt` links to or only the
+    // number, so that the processes of one container are matched but not the
+    // others sharing the volume. The operations from an exited process don't
+    // match.
+    pub mnt_ns: Option<Vec<String>>,
+
+    // `open_flags` is matched against the flags passed to `open` or `create`
+    // of the file operated on. The operations without a file handle (like
+    // `lookup`) are treated as without any flags.
+    pub open_flags: Option<OpenFlagsConfig>,
+    // `open_mode` is matched against the access mode in the flags of `open`
+    // or `create`, which is the intent of the open. The operations without a
+    // file handle don't match if it's set.
+    pub open_mode: Option<OpenMode>,
+
+    // `min_size` and `max_size` are matched against the size of the file
+    // operated on in bytes. The size is cached when the file is opened and
+    // only grows with the writes through the same file handle, so the changes
+    // from the others are not seen until the file is opened again. The
+    // operations without a file handle don't match if any of them is set.
+    pub min_size: Option<u64>,
+    pub max_size: Option<u64>,
+
+    // `min_age` and `max_age` are matched against the time since the file
+    // operated on was created, which is its birth time if the backing
+    // filesystem records it (like ext4, xfs and btrfs through `statx`), or its
+    // modification time when it's opened otherwise. The time is cached when
+    // the file is opened, and the age is computed on every operation. The
+    // operations without a file handle don't match if any of them is set.
+    #[serde(default, with = "humantime_serde")]
+    pub min_age: Option<Duration>,
+    #[serde(default, with = "humantime_serde")]
+    pub max_age: Option<Duration>,
+
+    // `offset_min` and `offset_max` are the range `[offset_min, offset_max)`
+    // of the file, and the reads, writes and fallocates overlapping it are
+    // matched. The other operations don't match if any of them is set.
+    pub offset_min: Option<u64>,
+    pub offset_max: Option<u64>,
+
+    // `mmap` matches the reads and writes from the memory mappings if it's
+    // true, and the other reads and writes if it's false. The other methods
+    // don't match if it's set. See `Filter::match_mmap` for how they are told
+    // apart.
+    pub mmap: Option<bool>,
+
+    // `min_depth` and `max_depth` are matched against the number of the
+    // components of the path relative to the mount point, which is 0 for the
+    // mount point itself, 1 for the files in it, and 2 for the files in its
+    // top-level directories. The paths outside of the mount point don't match
+    // if any of them is set.
+    pub min_depth: Option<usize>,
+    pub max_depth: Option<usize>,
+
+    // `only_root` matches only the operations on the mount point itself, like
+    // `statfs` and the `readdir` of it, and `exclude_root` matches all the
+    // others
+    #[serde(default)]
+    pub only_root: bool,
+    #[serde(default)]
+    pub exclude_root: bool,
+
+    // `ioctlCommands` are the command numbers matched by the ioctls, so that
+    // they can be failed with `ENOTTY` or `EINVAL` one by one. The other
+    // operations don't match if it's set.
+    pub ioctl_commands: Option<Vec<u32>>,
+
+    // `ino` and the inode numbers of `ino_paths` are matched against the
+    // inode of the file operated on, so that the filter follows the file
+    // across renames. The `ino_paths` are resolved once when the config is
+    // applied. The operations on a name (like `unlink`) don't match if any of
+    // them is set.
+    pub ino: Option<Vec<u64>>,
+    pub ino_paths: Option<Vec<String>>,
+
+    // `is_symlink` is matched against whether the file operated on is a
+    // symbolic link, which is checked with `lstat` on the backing path. The
+    // operations on a file which doesn't exist (yet) don't match if it's set.
+    pub is_symlink: Option<bool>,
+
+    // `mode_mask` and `mode_value` match the files whose permission bits
+    // masked by `mode_mask` are `mode_value`, like `"4000"` for both to match
+    // the setuid files, or `"2"` for both to match the world-writable ones.
+    // They are the numbers or the octal strings. The bits are cached when
+    // the file is opened, and read with `lstat` on the backing path for the
+    // operations without a file handle. `mode_value` is 0 by default.
+    pub mode_mask: Option<ModeConfig>,
+    pub mode_value: Option<ModeConfig>,
+
+    // If `dry_run` is set, the matched operations are logged with the
+    // injection which would be applied, but they are not modified
+    #[serde(default)]
+    pub dry_run: bool,
+
+    // `rate_per_sec` limits the matched operations to about the rate however
+    // many operations there are, and `percent` is ignored if it's set
+    pub rate_per_sec: Option<f64>,
+
+    // If `deterministic` is set, every Nth matching operation is injected
+    // rather than a random `percent` of them, with N from `percent` (like
+    // every 4th for 25), so that the tests see the same faults on every run
+    #[serde(default)]
+    pub deterministic: bool,
+
+    // If `first_only` is set, only the first matching operation on each file
+    // is injected, like the cold reads of a cache, until `reset_stats`. The
+    // files are told by their inodes, and beyond `first_only_capacity` of
+    // them (65536 by default) the least recently matched are forgotten, so
+    // that they are injected again.
+    #[serde(default)]
+    pub first_only: bool,
+    pub first_only_capacity: Option<usize>,
+
+    // `retries` decides the requests sent again by the kernel with the unique
+    // id of a recent one, which `always` match regardless of the chance and
+    // `never` match, so that a retry isn't delayed or failed twice by chance
+    pub retries: Option<RetryMode>,
+
+    // the injector stops matching after `max_injections` operations have
+    // been matched
+    pub max_injections: Option<u64>,
+
+    // `expr` is a tree of `and`, `or` and `not` over the sub-filters, which
+    // has to match in addition to the fields above. The fields above are the
+    // implicit `and` of the conditions present, so `{"path": "/a/*", "uid":
+    // 0}` is `{"and": [{"path": "/a/*"}, {"uid": 0}]}`, and the paths out of
+    // one glob are matched by `{"or": [{"path": "/a/*"}, {"path": "/b/*"}]}`.
+    pub expr: Option<FilterExprConfig>,
+}
+
+// FilterExprConfig is `{"and": [exprs]}`, `{"or": [exprs]}`, `{"not": expr}`,
+// or a sub-filter with the fields of a filter, like `{"path": "/a/*"}`, which
+// matches when all the conditions present in it match. A sub-filter can't
+// have the fields deciding whether and how often to inject, like `percent`,
+// `duration` or `firstOnly`. The empty `and` matches everything, and the
+// empty `or` nothing.
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(untagged)]
+pub enum FilterExprConfig {
+    And(AndConfig),
+    Or(OrConfig),
+    Not(NotConfig),
+    Filter(SubFilterConfig),
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(deny_unknown_fields)]
+pub struct AndConfig {
+    pub and: Vec<FilterExprConfig>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(deny_unknown_fields)]
+pub struct OrConfig {
+    pub or: Vec<FilterExprConfig>,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(deny_unknown_fields)]
+pub struct NotConfig {
+    pub not: Box<FilterExprConfig>,
+}
+
+// SubFilterConfig is a filter whose `percent` is 100 if it's absent, as it's
+// not used by a sub-filter
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(try_from = "serde_json::Value")]
+pub struct SubFilterConfig(pub Box<FilterConfig>);
+
+impl TryFrom<serde_json::Value> for SubFilterConfig {
+    type Error = serde_json::Error;
+
+    fn try_from(mut value: serde_json::Value) -> Result<Self, Self::Error> {
+        if let serde_json::Value::Object(fields) = &mut value {
+            // a malformed `and`, `or` or `not` is not taken as a sub-filter,
+            // which would match everything
+            if let Some(key) = ["and", "or", "not"]
+                .iter()
+                .find(|key| fields.contains_key(**key))
+            {
+                return Err(serde::de::Error::custom(format!("invalid {} of expr", key)));
+            }
+            fields
+                .entry("percent")
+                .or_insert_with(|| serde_json::Value::from(100));
+        }
+        Ok(SubFilterConfig(Box::new(serde_json::from_value(value)?)))
+    }
+}
+
+// IdFilterConfig is one id, a list of ids, or `{"not": [ids]}` to match the
+// ids out of the list
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(untagged)]
+pub enum IdFilterConfig {
+    Id(u32),
+    Ids(Vec<u32>),
+    Not { not: Vec<u32> },
+}
+
+// ModeConfig is the permission bits as a number, or an octal string like
+// `"4000"` or `"0o4000"`
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(untagged)]
+pub enum ModeConfig {
+    Bits(u32),
+    Octal(String),
+}
+
+// OpenFlagsConfig is a list of flags to match the files opened with any of
+// them, or `{"not": [flags]}` to match the ones opened with none of them. The
+// flags are named as in C, like `O_DIRECT`.
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(untagged)]
+pub enum OpenFlagsConfig {
+    Flags(Vec<String>),
+    Not { not: Vec<String> },
+}
+
+#[derive(Serialize, Deserialize, Clone, Copy, Debug, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub enum RetryMode {
+    Always,
+    Never,
+}
+
+// OpenMode is the access mode of the open flags, one of `O_RDONLY`,
+// `O_WRONLY` and `O_RDWR`
+#[derive(Serialize, Deserialize, Clone, Copy, Debug, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub enum OpenMode {
+    Read,
+    Write,
+    Readwrite,
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
@@ -48,8 +652,12 @@ pub struct FaultConfig {
 #[derive(Serialize, Deserialize, Clone, Debug)]
 #[serde(rename_all = "camelCase")]
 pub struct AttrOverrideConfig {
+    pub name: Option<String>,
+    pub enabled: Option<bool>,
     pub path: String,
     pub percent: i32,
+    #[serde(default)]
+    pub dry_run: bool,
 
     pub ino: Option<u64>,
     pub size: Option<u64>,
@@ -63,6 +671,7 @@ pub struct AttrOverrideConfig {
     pub uid: Option<u32>,
     pub gid: Option<u32>,
     pub rdev: Option<u32>,
+    pub blksize: Option<u32>,
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
@@ -84,19 +693,90 @@ pub struct Timespec {
     pub nsec: i32,
 }
 
+// MistakeType is "zero", "random", or a byte pattern repeated over the
+// range, written in hex with the "0x" prefix or in base64. The pattern is
+// decoded when the injector is built.
 #[derive(Serialize, Deserialize, Clone, Debug)]
-#[serde(rename_all = "camelCase")]
+#[serde(from = "String", into = "String")]
 pub enum MistakeType {
     Zero,
     Random,
+    Pattern(String),
+}
+
+impl From<String> for MistakeType {
+    fn from(filling: String) -> Self {
+        match filling.as_str() {
+            "zero" => MistakeType::Zero,
+            "random" => MistakeType::Random,
+            _ => MistakeType::Pattern(filling),
+        }
+    }
+}
+
+impl From<MistakeType> for String {
+    fn from(filling: MistakeType) -> Self {
+        match filling {
+            MistakeType::Zero => "zero".to_owned(),
+            MistakeType::Random => "random".to_owned(),
+            MistakeType::Pattern(pattern) => pattern,
+        }
+    }
+}
+
+impl Default for MistakeType {
+    fn default() -> Self {
+        MistakeType::Zero
+    }
+}
+
+#[derive(Serialize, Deserialize, Clone, Copy, Debug)]
+#[serde(rename_all = "camelCase")]
+pub enum MistakeMode {
+    // overwrite with the `filling`
+    Fill,
+    Zero,
+    Random,
+    // flip `bits` random bits
+    Bitflip,
+}
+
+impl Default for MistakeMode {
+    fn default() -> Self {
+        MistakeMode::Fill
+    }
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
 #[serde(rename_all = "camelCase")]
 pub struct MistakeConfig {
+    #[serde(default)]
+    pub mode: MistakeMode,
+    // only used by the `fill` mode
+    #[serde(default)]
     pub filling: MistakeType,
     pub max_length: usize,
     pub max_occurrences: usize,
+    // If `offset` is set, the range `[offset, offset + max_length)` of the
+    // file is corrupted on every matched read or write, and
+    // `max_occurrences` is ignored. The filling is generated once, so the
+    // same bytes are returned however the reads are chunked.
+    #[serde(default)]
+    pub offset: Option<u64>,
+    // how many bits are flipped in the range on every operation in the
+    // `bitflip` mode, 1 by default
+    #[serde(default)]
+    pub bits: Option<usize>,
+    // the random generator is seeded with `seed` if it's set, so that the
+    // mistakes are reproducible
+    #[serde(default)]
+    pub seed: Option<u64>,
+    // If `trackRegions` is set, the checksums of the corruptions written to
+    // the files are kept for up to the number of regions, and the reads
+    // covering a region log whether the corruption is still there or has been
+    // overwritten
+    #[serde(default)]
+    pub track_regions: Option<usize>,
 }
 
 #[derive(Serialize, Deserialize, Clone, Debug)]
@@ -106,3 +786,24 @@ pub struct MistakesConfig {
     #[serde(flatten)]
     pub filter: FilterConfig,
 }
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct PhasesConfig {
+    pub name: Option<String>,
+    pub enabled: Option<bool>,
+    // the phases are active one after another, from the time the config is
+    // applied. Nothing is injected after the last one, unless `loop` starts
+    // the cycle again.
+    pub phases: Vec<PhaseConfig>,
+    #[serde(default, rename = "loop")]
+    pub repeat: bool,
+}
+
+#[derive(Serialize, Deserialize, Clone, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct PhaseConfig {
+    #[serde(with = "humantime_serde")]
+    pub duration: Duration,
+    pub injectors: Vec<InjectorConfig>,
+}
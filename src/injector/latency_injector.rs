@@ -1,41 +1,210 @@
 use std::path::Path;
-use std::time::Duration;
+use std::sync::atomic::AtomicBool;
+use std::time::{Duration, Instant};
 
+use anyhow::anyhow;
 use async_trait::async_trait;
-use tokio::time::delay_for;
-use tracing::{debug, trace};
+use rand::distributions::{Distribution, Uniform};
+use rand_distr::{Exp, Normal};
+use tracing::{debug, info, trace};
 
-use super::injector_config::LatencyConfig;
-use super::{filter, Injector};
+use super::injector_config::{LatencyConfig, LatencyDistribution};
+use super::{delay, filter, Injector};
 use crate::hookfs::Result;
+use crate::metrics;
+
+// Sampler is built with the config, so sampling a delay is only a few
+// arithmetic operations on every injection
+#[derive(Debug)]
+enum Sampler {
+    Fixed(Duration),
+    Uniform(Uniform<f64>),
+    Normal(Normal<f64>),
+    Exponential(Exp<f64>),
+    Ramp(Ramp),
+}
+
+// Ramp is the latency going from `start` to `end` in `duration` since
+// `since`, which is when the injector is built
+#[derive(Debug)]
+struct Ramp {
+    start: Duration,
+    end: Duration,
+    duration: Duration,
+    since: Instant,
+}
+
+impl Ramp {
+    fn current(&self) -> Duration {
+        let elapsed = self.since.elapsed();
+        if elapsed >= self.duration {
+            return self.end;
+        }
+        let progress = elapsed.as_secs_f64() / self.duration.as_secs_f64();
+        let start = self.start.as_secs_f64();
+        Duration::from_secs_f64(start + (self.end.as_secs_f64() - start) * progress)
+    }
+}
+
+impl Sampler {
+    fn sample(&self) -> Duration {
+        let mut rng = rand::thread_rng();
+        let secs = match self {
+            Sampler::Fixed(latency) => return *latency,
+            Sampler::Ramp(ramp) => return ramp.current(),
+            Sampler::Uniform(dist) => dist.sample(&mut rng),
+            Sampler::Normal(dist) => dist.sample(&mut rng),
+            Sampler::Exponential(dist) => dist.sample(&mut rng),
+        };
+
+        // negative samples are clamped to zero
+        Duration::from_secs_f64(secs.max(0f64))
+    }
+}
+
+// sized returns true if the length of the operation is known in `inject_io`
+fn sized(method: &filter::Method) -> bool {
+    *method == filter::Method::READ || *method == filter::Method::WRITE
+}
 
 #[derive(Debug)]
 pub struct LatencyInjector {
-    latency: Duration,
+    sampler: Sampler,
+    per_byte: Option<Duration>,
     filter: filter::Filter,
+    // whether the latency has been clamped by the max latency
+    capped: AtomicBool,
 }
 
 #[async_trait]
 impl Injector for LatencyInjector {
     async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()> {
+        // the reads and writes are delayed with the length in `inject_io`
+        if self.per_byte.is_some() && sized(method) {
+            return Ok(());
+        }
+        self.delay(method, path, 0).await
+    }
+
+    async fn inject_io(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        _offset: i64,
+        length: usize,
+    ) -> Result<()> {
+        if self.per_byte.is_none() || !sized(method) {
+            return Ok(());
+        }
+        self.delay(method, path, length).await
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl LatencyInjector {
+    // delay sleeps for the sampled latency, and `perByte` for every byte of
+    // the `length`. It returns EINTR if the request is interrupted.
+    async fn delay(&self, method: &filter::Method, path: &Path, length: usize) -> Result<()> {
         trace!("test for filter");
         if self.filter.filter(method, path) {
-            debug!("inject io delay {:?}", self.latency);
-            delay_for(self.latency).await;
+            let mut latency = self.sampler.sample();
+            if let Some(per_byte) = self.per_byte {
+                latency += per_byte * length as u32;
+            }
+            let latency = delay::cap(latency, &self.capped);
+            if self.filter.dry_run() {
+                info!(
+                    "dry run: {:?} on {} would be delayed for {:?}",
+                    method,
+                    path.display(),
+                    latency
+                );
+                return Ok(());
+            }
+            if !self.filter.injected(
+                method,
+                path,
+                "latency",
+                format_args!("latency {:?}", latency),
+            ) {
+                return Ok(());
+            }
+            debug!("inject io delay {:?}", latency);
+            metrics::injected_latency(latency);
+            delay::delay(latency).await?;
             debug!("latency finished");
         }
-
         Ok(())
     }
-}
 
-impl LatencyInjector {
-    pub fn build(conf: LatencyConfig) -> anyhow::Result<Self> {
+    pub fn build(conf: LatencyConfig, root: &Path) -> anyhow::Result<Self> {
         trace!("build latency injector");
 
+        let mean = conf.latency.as_secs_f64();
+        let sampler = match conf.distribution {
+            LatencyDistribution::Fixed => Sampler::Fixed(conf.latency),
+            LatencyDistribution::Uniform => {
+                let jitter = conf.jitter.unwrap_or_default().as_secs_f64();
+                Sampler::Uniform(Uniform::new_inclusive(mean - jitter, mean + jitter))
+            }
+            LatencyDistribution::Normal => {
+                let stddev = conf
+                    .stddev
+                    .ok_or_else(|| anyhow!("stddev is required by normal distribution"))?;
+                Sampler::Normal(
+                    Normal::new(mean, stddev.as_secs_f64())
+                        .map_err(|err| anyhow!("invalid normal distribution: {:?}", err))?,
+                )
+            }
+            LatencyDistribution::Exponential => {
+                if mean == 0f64 {
+                    return Err(anyhow!(
+                        "latency of exponential distribution should not be zero"
+                    ));
+                }
+                Sampler::Exponential(
+                    Exp::new(1f64 / mean)
+                        .map_err(|err| anyhow!("invalid exponential distribution: {:?}", err))?,
+                )
+            }
+            LatencyDistribution::Ramp => {
+                let (start, end, duration) = match (conf.start, conf.end, conf.ramp_duration) {
+                    (Some(start), Some(end), Some(duration)) => (start, end, duration),
+                    _ => {
+                        return Err(anyhow!(
+                            "start, end and rampDuration are required by ramp distribution"
+                        ))
+                    }
+                };
+                Sampler::Ramp(Ramp {
+                    start,
+                    end,
+                    duration,
+                    since: Instant::now(),
+                })
+            }
+        };
+
         Ok(Self {
-            latency: conf.latency,
-            filter: filter::Filter::build(conf.filter)?,
+            sampler,
+            per_byte: conf.per_byte,
+            filter: filter::Filter::build(conf.filter, root)?,
+            capped: AtomicBool::new(false),
         })
     }
 }
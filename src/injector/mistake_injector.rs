@@ -1,17 +1,163 @@
 use std::cmp::{max, min};
+use std::collections::hash_map::DefaultHasher;
+use std::collections::BTreeMap;
+use std::hash::{Hash, Hasher};
 use std::path::Path;
+use std::sync::Mutex;
 
 use async_trait::async_trait;
-use rand::Rng;
-use tracing::{debug, trace};
+use rand::rngs::StdRng;
+use rand::{Rng, SeedableRng};
+use tracing::{debug, info, trace};
 
-use super::injector_config::{MistakeConfig, MistakeType, MistakesConfig};
+use super::injector_config::{MistakeConfig, MistakeMode, MistakeType, MistakesConfig};
 use super::{filter, Injector};
-use crate::hookfs::{Reply, Result};
+use crate::hookfs::{Reply, RequestContext, Result};
+
+#[derive(Debug, Clone, Copy)]
+enum Corruption {
+    Zero,
+    Random,
+    // repeat the `pattern`
+    Pattern,
+    // flip the number of bits
+    Bitflip(usize),
+}
+
+// Tracker keeps the checksums of the corruptions written to the files, so
+// that the later reads tell whether the app gets the corrupted data, or the
+// corruption has been overwritten. The least recently used regions are
+// forgotten beyond the `capacity`.
+#[derive(Debug)]
+struct Tracker {
+    capacity: usize,
+    state: Mutex<TrackerState>,
+}
+
+#[derive(Debug, Default)]
+struct TrackerState {
+    // the regions indexed by the inode and the offset where they begin
+    regions: BTreeMap<(u64, u64), Region>,
+    // the keys of the regions ordered by the last use
+    used: BTreeMap<u64, (u64, u64)>,
+    clock: u64,
+}
+
+#[derive(Debug)]
+struct Region {
+    end: u64,
+    checksum: u64,
+    used: u64,
+}
+
+impl TrackerState {
+    fn touch(&mut self, key: (u64, u64)) -> u64 {
+        self.clock += 1;
+        self.used.insert(self.clock, key);
+        self.clock
+    }
+
+    fn remove(&mut self, key: (u64, u64)) {
+        if let Some(region) = self.regions.remove(&key) {
+            self.used.remove(&region.used);
+        }
+    }
+}
+
+impl Tracker {
+    fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            state: Mutex::new(TrackerState::default()),
+        }
+    }
+
+    // record tracks the corrupted `data` written at `offset` of the file
+    fn record(&self, ino: u64, offset: u64, data: &[u8]) {
+        let mut state = self.state.lock().unwrap();
+        let key = (ino, offset);
+        state.remove(key);
+        let used = state.touch(key);
+        state.regions.insert(
+            key,
+            Region {
+                end: offset + data.len() as u64,
+                checksum: checksum(data),
+                used,
+            },
+        );
+
+        while state.regions.len() > self.capacity {
+            let oldest = match state.used.keys().next() {
+                Some(oldest) => *oldest,
+                None => break,
+            };
+            let key = state.used[&oldest];
+            state.remove(key);
+        }
+    }
+
+    // verify checks the regions fully covered by the `data` read at `offset`
+    // of the file. The overwritten ones are not tracked any more.
+    fn verify(&self, ino: u64, path: &Path, offset: u64, data: &[u8]) {
+        let mut state = self.state.lock().unwrap();
+        let end = offset + data.len() as u64;
+        let covered: Vec<_> = state
+            .regions
+            .range((ino, offset)..(ino, end))
+            .filter(|(_, region)| region.end <= end)
+            .map(|(key, region)| (*key, region.end, region.checksum))
+            .collect();
+
+        for (key, region_end, region_checksum) in covered {
+            let begin = key.1;
+            let read = &data[(begin - offset) as usize..(region_end - offset) as usize];
+            if checksum(read) == region_checksum {
+                info!(
+                    "corrupted data of {} [{},{}) is read",
+                    path.display(),
+                    begin,
+                    region_end
+                );
+                let used = state.touch(key);
+                let last = state
+                    .regions
+                    .get_mut(&key)
+                    .map(|region| std::mem::replace(&mut region.used, used));
+                if let Some(last) = last {
+                    state.used.remove(&last);
+                }
+            } else {
+                info!(
+                    "corruption of {} [{},{}) has been overwritten",
+                    path.display(),
+                    begin,
+                    region_end
+                );
+                state.remove(key);
+            }
+        }
+    }
+}
+
+fn checksum(data: &[u8]) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    data.hash(&mut hasher);
+    hasher.finish()
+}
 
 #[derive(Debug)]
 pub struct MistakeInjector {
     mistake: MistakeConfig,
+    corruption: Corruption,
+    // decoded bytes of the filling, only used by `Corruption::Pattern`
+    pattern: Vec<u8>,
+    // filling of the fixed range, only used when `mistake.offset` is set and
+    // the bits are not flipped
+    filling: Vec<u8>,
+    rng: Mutex<StdRng>,
+    // the corruptions written to the files, only with `trackRegions`
+    tracker: Option<Tracker>,
     filter: filter::Filter,
 }
 
@@ -23,36 +169,207 @@ impl Injector for MistakeInjector {
     }
 
     fn inject_reply(&self, method: &super::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        // the reads are verified whether they match the filter or not, as
+        // the corruptions are usually written by another method
+        if let (Some(tracker), Reply::Data(data)) = (&self.tracker, &*reply) {
+            if *method == super::Method::READ {
+                if let Some(ino) = RequestContext::current().and_then(|ctx| ctx.ino()) {
+                    tracker.verify(ino, path, data.offset as u64, &data.data);
+                }
+            }
+        }
+
         if self.filter.filter(method, path) {
+            if self.filter.dry_run() {
+                self.log_dry_run(method, path);
+                return Ok(());
+            }
+            if !self.filter.injected(
+                method,
+                path,
+                "mistake",
+                format_args!("corrupt the data read"),
+            ) {
+                return Ok(());
+            }
             debug!("MI:Injecting reply");
-            if let Reply::Data(data) = reply {
-                let data = &mut data.data;
-                self.handle(data)?;
+            match reply {
+                Reply::Data(data) => {
+                    let offset = data.offset;
+                    self.handle(&mut data.data, offset)?;
+                }
+                // the block number is sabotaged as the data of its bytes, so
+                // that the tools trusting the mapping get a garbage block
+                Reply::Bmap(bmap) => {
+                    let mut data = bmap.block.to_le_bytes().to_vec();
+                    self.handle(&mut data, 0)?;
+                    let mut block = [0u8; 8];
+                    block.copy_from_slice(&data);
+                    bmap.block = u64::from_le_bytes(block);
+                }
+                _ => {}
             }
         }
         Ok(())
     }
 
-    fn inject_write_data(&self, path: &Path, data: &mut Vec<u8>) -> Result<()> {
+    fn inject_write_data(&self, path: &Path, offset: i64, data: &mut Vec<u8>) -> Result<()> {
         if self.filter.filter(&super::Method::WRITE, path) {
+            if self.filter.dry_run() {
+                self.log_dry_run(&super::Method::WRITE, path);
+                return Ok(());
+            }
+            if !self.filter.injected(
+                &super::Method::WRITE,
+                path,
+                "mistake",
+                format_args!("corrupt the data written at {}", offset),
+            ) {
+                return Ok(());
+            }
             debug!("MI:Injecting write data");
-            self.handle(data)?;
+            let regions = self.handle(data, offset)?;
+            if let Some(tracker) = &self.tracker {
+                if let Some(ino) = RequestContext::current().and_then(|ctx| ctx.ino()) {
+                    for (begin, end) in regions {
+                        let corrupted =
+                            &data[(begin - offset as u64) as usize..(end - offset as u64) as usize];
+                        tracker.record(ino, begin, corrupted);
+                    }
+                }
+            }
         }
         Ok(())
     }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
 }
 
 impl MistakeInjector {
-    pub fn build(conf: MistakesConfig) -> anyhow::Result<Self> {
+    pub fn build(conf: MistakesConfig, root: &Path) -> anyhow::Result<Self> {
         trace!("build mistake injector");
+        let mut pattern = Vec::new();
+        let corruption = match conf.mistake.mode {
+            MistakeMode::Fill => match &conf.mistake.filling {
+                MistakeType::Zero => Corruption::Zero,
+                MistakeType::Random => Corruption::Random,
+                MistakeType::Pattern(filling) => {
+                    pattern = decode_pattern(filling)?;
+                    Corruption::Pattern
+                }
+            },
+            MistakeMode::Zero => Corruption::Zero,
+            MistakeMode::Random => Corruption::Random,
+            MistakeMode::Bitflip => Corruption::Bitflip(conf.mistake.bits.unwrap_or(1)),
+        };
+        let mut rng = match conf.mistake.seed {
+            Some(seed) => StdRng::seed_from_u64(seed),
+            None => StdRng::from_entropy(),
+        };
+
+        let mut filling = Vec::new();
+        if conf.mistake.offset.is_some() {
+            match corruption {
+                Corruption::Zero => filling.resize(conf.mistake.max_length, 0),
+                Corruption::Random => {
+                    filling.resize(conf.mistake.max_length, 0);
+                    rng.fill(filling.as_mut_slice());
+                }
+                Corruption::Pattern => {
+                    fill_pattern(&mut filling, &pattern, conf.mistake.max_length)
+                }
+                Corruption::Bitflip(_) => {}
+            }
+        }
+        let tracker = conf.mistake.track_regions.map(Tracker::new);
         Ok(Self {
+            tracker,
             mistake: conf.mistake,
-            filter: filter::Filter::build(conf.filter)?,
+            corruption,
+            pattern,
+            filling,
+            rng: Mutex::new(rng),
+            filter: filter::Filter::build(conf.filter, root)?,
         })
     }
-    pub fn handle(&self, data: &mut Vec<u8>) -> Result<()> {
+
+    fn log_dry_run(&self, method: &super::Method, path: &Path) {
+        info!(
+            "dry run: data of {:?} on {} would be sabotaged with {:?}",
+            method,
+            path.display(),
+            self.mistake
+        );
+    }
+
+    // handle sabotages the data, whose first byte is at `offset` of the file,
+    // and returns the ranges of the file which are sabotaged
+    pub fn handle(&self, data: &mut Vec<u8>, offset: i64) -> Result<Vec<(u64, u64)>> {
         trace!("sabotage data");
-        let mut rng = rand::thread_rng();
+        let regions = match self.mistake.offset {
+            Some(start) => self
+                .handle_range(data, offset as u64, start)
+                .into_iter()
+                .collect(),
+            None => self.handle_random(data, offset as u64),
+        };
+        Ok(regions)
+    }
+
+    fn handle_range(&self, data: &mut Vec<u8>, offset: u64, start: u64) -> Option<(u64, u64)> {
+        let begin = max(start, offset);
+        let end = min(
+            start + self.mistake.max_length as u64,
+            offset + data.len() as u64,
+        );
+        if begin >= end {
+            return None;
+        }
+
+        debug!(
+            "Setting file range [{},{}) to {:?}",
+            begin, end, self.corruption
+        );
+        if let Corruption::Bitflip(bits) = self.corruption {
+            let range = &mut data[(begin - offset) as usize..(end - offset) as usize];
+            flip_bits(&mut *self.rng.lock().unwrap(), range, bits);
+            return Some((begin, end));
+        }
+        for pos in begin..end {
+            data[(pos - offset) as usize] = self.filling[(pos - start) as usize];
+        }
+        Some((begin, end))
+    }
+
+    fn handle_random(&self, data: &mut Vec<u8>, offset: u64) -> Vec<(u64, u64)> {
+        let mut rng = self.rng.lock().unwrap();
+        // the bits are flipped in the whole data
+        if let Corruption::Bitflip(bits) = self.corruption {
+            debug!(
+                "Flipping {} bits in file range [{},{})",
+                bits,
+                offset,
+                offset + data.len() as u64
+            );
+            flip_bits(&mut *rng, data, bits);
+            return vec![(offset, offset + data.len() as u64)];
+        }
+
+        let mut regions = Vec::new();
         let data_length = data.len();
         let mistake = &self.mistake;
         let occurrence = match mistake.max_occurrences {
@@ -66,20 +383,104 @@ impl MistakeInjector {
                 l => rng.gen_range(1, l + 1),
             };
             debug!(
-                "Setting index [{},{}) to {:?}",
-                pos,
-                pos + length,
-                mistake.filling
+                "Setting file range [{},{}) to {:?}",
+                offset + pos as u64,
+                offset + (pos + length) as u64,
+                self.corruption
             );
-            match mistake.filling {
-                MistakeType::Zero => {
+            match self.corruption {
+                Corruption::Zero => {
                     for i in pos..pos + length {
                         data[i] = 0;
                     }
                 }
-                MistakeType::Random => rng.fill(&mut data[pos..pos + length]),
+                Corruption::Random => rng.fill(&mut data[pos..pos + length]),
+                Corruption::Pattern => {
+                    for i in 0..length {
+                        data[pos + i] = self.pattern[i % self.pattern.len()];
+                    }
+                }
+                Corruption::Bitflip(_) => unreachable!(),
+            }
+            if length > 0 {
+                regions.push((offset + pos as u64, offset + (pos + length) as u64));
             }
         }
-        Ok(())
+        regions
+    }
+}
+
+// flip_bits flips `bits` different bits of the data, or all of them if the
+// data is too short
+fn flip_bits(rng: &mut StdRng, data: &mut [u8], bits: usize) {
+    let length = data.len() * 8;
+    for bit in rand::seq::index::sample(rng, length, min(bits, length)).iter() {
+        data[bit / 8] ^= 1 << (bit % 8);
+    }
+}
+
+// fill_pattern appends the pattern repeatedly to `filling` until it's
+// `length` bytes long, truncating the last repetition
+fn fill_pattern(filling: &mut Vec<u8>, pattern: &[u8], length: usize) {
+    filling.extend(pattern.iter().cycle().take(length));
+}
+
+// decode_pattern decodes the filling written in hex with the "0x" prefix, or
+// in base64 otherwise
+fn decode_pattern(filling: &str) -> anyhow::Result<Vec<u8>> {
+    let pattern = match filling.strip_prefix("0x") {
+        Some(hex) => decode_hex(hex),
+        None => decode_base64(filling),
+    }
+    .ok_or_else(|| {
+        anyhow::anyhow!(
+            "invalid filling {:?}: expect zero, random, hex or base64",
+            filling
+        )
+    })?;
+    if pattern.is_empty() {
+        return Err(anyhow::anyhow!(
+            "invalid filling {:?}: the pattern is empty",
+            filling
+        ));
+    }
+    Ok(pattern)
+}
+
+fn decode_hex(hex: &str) -> Option<Vec<u8>> {
+    if hex.len() % 2 != 0 || !hex.is_ascii() {
+        return None;
+    }
+    (0..hex.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(&hex[i..i + 2], 16).ok())
+        .collect()
+}
+
+// decode_base64 decodes the standard alphabet, with or without the padding
+fn decode_base64(text: &str) -> Option<Vec<u8>> {
+    let trimmed = text.trim_end_matches('=');
+    if trimmed.len() % 4 == 1 || text.len() - trimmed.len() > 2 {
+        return None;
+    }
+    let mut decoded = Vec::with_capacity(text.len() * 3 / 4);
+    let mut buffer = 0u32;
+    let mut bits = 0;
+    for c in trimmed.bytes() {
+        let value = match c {
+            b'A'..=b'Z' => c - b'A',
+            b'a'..=b'z' => c - b'a' + 26,
+            b'0'..=b'9' => c - b'0' + 52,
+            b'+' => 62,
+            b'/' => 63,
+            _ => return None,
+        };
+        buffer = (buffer << 6 | value as u32) & 0xffff;
+        bits += 6;
+        if bits >= 8 {
+            bits -= 8;
+            decoded.push((buffer >> bits) as u8);
+        }
     }
+    Some(decoded)
 }
@@ -1,25 +1,61 @@
 mod attr_override_injector;
+mod delay;
+mod delay_fault_injector;
 mod fault_injector;
 mod filter;
+mod hide_entries_injector;
 mod injector_config;
 mod latency_injector;
 mod mistake_injector;
 mod multi_injector;
+mod phases_injector;
+mod quota_injector;
+mod readlink_injector;
+mod sequence_injector;
+mod short_io_injector;
+mod shuffle_dir_injector;
+mod stale_read_injector;
+mod statfs_override_injector;
+mod throttle_injector;
+mod volatile_writes_injector;
 
 use std::path::Path;
 
 use async_trait::async_trait;
+pub use delay::{cancel_delays, set_max_latency};
 pub use filter::Method;
 use fuser::FileAttr;
 pub use injector_config::InjectorConfig;
-pub use multi_injector::MultiInjector;
+pub use multi_injector::{InjectorStatus, MultiInjector};
+use serde::Serialize;
 
 use crate::hookfs::{Reply, Result};
 
+// BurstStatus tells whether the faults are in a burst, and how many bursts
+// have been started
+#[derive(Serialize, Debug, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct BurstStatus {
+    pub active: bool,
+    pub bursts: u64,
+}
+
 #[async_trait]
 pub trait Injector: Send + Sync + std::fmt::Debug {
     async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()>;
 
+    // inject_io is called before read and write with the offset in the file
+    // and the length of the data
+    async fn inject_io(
+        &self,
+        _method: &filter::Method,
+        _path: &Path,
+        _offset: i64,
+        _length: usize,
+    ) -> Result<()> {
+        Ok(())
+    }
+
     fn inject_reply(
         &self,
         _method: &filter::Method,
@@ -28,9 +64,48 @@ pub trait Injector: Send + Sync + std::fmt::Debug {
     ) -> Result<()> {
         Ok(())
     }
-    fn inject_write_data(&self, _path: &Path, _data: &mut Vec<u8>) -> Result<()> {
+    // inject_write_data is called before write with the offset in the file
+    fn inject_write_data(&self, _path: &Path, _offset: i64, _data: &mut Vec<u8>) -> Result<()> {
         Ok(())
     }
 
     fn inject_attr(&self, _attr: &mut FileAttr, _path: &Path) {}
+
+    // reset_quota clears the bytes counted by the quota injectors
+    fn reset_quota(&self) {}
+
+    // crash simulates a crash of the machine, which loses the writes not
+    // synced by the volatile writes injectors
+    fn crash(&self) -> anyhow::Result<()> {
+        Ok(())
+    }
+
+    // matched returns how many operations have been injected by this
+    // injector, not counting the ones passed by its own checks after the
+    // filter, like the percent of a fault rule or the dry run
+    fn matched(&self) -> u64;
+
+    // reset_matched clears the counter of `matched`, and returns the value
+    // before
+    fn reset_matched(&self) -> u64;
+
+    // remaining returns how many operations can still be injected, and `None`
+    // if there is no limit
+    fn remaining(&self) -> Option<u64>;
+
+    // forget drops the state kept for the inode, once the kernel has
+    // forgotten it and it may not be seen again
+    fn forget(&self, _ino: u64) {}
+
+    // phase returns the index of the active phase, for the injectors run in
+    // phases
+    fn phase(&self) -> Option<usize> {
+        None
+    }
+
+    // burst returns the state of the bursts, for the injectors failing in
+    // bursts
+    fn burst(&self) -> Option<BurstStatus> {
+        None
+    }
 }
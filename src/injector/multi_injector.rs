@@ -1,61 +1,349 @@
+use std::collections::HashSet;
+use std::convert::TryFrom;
 use std::path::Path;
+use std::sync::Arc;
 
+use anyhow::anyhow;
 use async_trait::async_trait;
 use fuser::FileAttr;
+use serde::Serialize;
 use tracing::trace;
 
 use super::attr_override_injector::AttrOverrideInjector;
+use super::delay_fault_injector::DelayFaultInjector;
 use super::fault_injector::FaultInjector;
+use super::hide_entries_injector::HideEntriesInjector;
 use super::injector_config::InjectorConfig;
 use super::latency_injector::LatencyInjector;
 use super::mistake_injector::MistakeInjector;
-use super::{filter, Injector};
+use super::phases_injector::PhasesInjector;
+use super::quota_injector::QuotaInjector;
+use super::readlink_injector::ReadlinkInjector;
+use super::sequence_injector::SequenceInjector;
+use super::short_io_injector::ShortIoInjector;
+use super::shuffle_dir_injector::ShuffleDirInjector;
+use super::stale_read_injector::StaleReadInjector;
+use super::statfs_override_injector::StatfsOverrideInjector;
+use super::throttle_injector::ThrottleInjector;
+use super::volatile_writes_injector::VolatileWritesInjector;
+use super::{filter, BurstStatus, Injector};
 use crate::hookfs::{Reply, Result};
 
 #[derive(Debug)]
 pub struct MultiInjector {
-    injectors: Vec<Box<dyn Injector>>,
+    // the injectors are shared with the `MultiInjector` they are updated
+    // from, so that the others keep their state when one of them is updated
+    injectors: Vec<Arc<dyn Injector>>,
+
+    config: Vec<InjectorConfig>,
+    // whether each of the injectors is enabled, by its config
+    enabled: Vec<bool>,
+}
+
+#[derive(Serialize, Debug, Clone)]
+pub struct InjectorStatus {
+    #[serde(flatten)]
+    pub config: InjectorConfig,
+    pub enabled: bool,
+    pub matched: u64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub remaining: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub phase: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub burst: Option<BurstStatus>,
+}
+
+fn build_injector(conf: InjectorConfig, root: &Path) -> anyhow::Result<Box<dyn Injector>> {
+    let injector = match conf {
+        InjectorConfig::Fault(faults) => {
+            (box FaultInjector::build(faults, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Latency(latency) => {
+            (box LatencyInjector::build(latency, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::AttrOverride(attr) => {
+            (box AttrOverrideInjector::build(attr, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Mistake(mistakes) => {
+            (box MistakeInjector::build(mistakes, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Throttle(throttle) => {
+            (box ThrottleInjector::build(throttle, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::ShortIo(short) => {
+            (box ShortIoInjector::build(short, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Quota(quota) => {
+            (box QuotaInjector::build(quota, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::DelayFault(delay_fault) => {
+            (box DelayFaultInjector::build(delay_fault, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Timeout(timeout) => {
+            (box DelayFaultInjector::timeout(timeout, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::StaleRead(stale_read) => {
+            (box StaleReadInjector::build(stale_read, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::StatfsOverride(statfs) => {
+            (box StatfsOverrideInjector::build(statfs, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::ShuffleDir(shuffle) => {
+            (box ShuffleDirInjector::build(shuffle, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::HideEntries(hide) => {
+            (box HideEntriesInjector::build(hide, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::VolatileWrites(volatile) => {
+            (box VolatileWritesInjector::build(volatile, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Sequence(sequence) => {
+            (box SequenceInjector::build(sequence, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Readlink(readlink) => {
+            (box ReadlinkInjector::build(readlink, root)?) as Box<dyn Injector>
+        }
+        InjectorConfig::Phases(phases) => {
+            (box PhasesInjector::build(phases, root)?) as Box<dyn Injector>
+        }
+    };
+    Ok(injector)
+}
+
+// includes returns whether the methods of a filter include the method. The
+// filter without methods matches all of them.
+fn includes(methods: &Option<Vec<String>>, method: &filter::Method) -> bool {
+    match methods.as_ref().filter(|methods| !methods.is_empty()) {
+        Some(methods) => methods
+            .iter()
+            .filter_map(|name| filter::Method::try_from(name.as_str()).ok())
+            .any(|methods| methods.intersects(*method)),
+        None => true,
+    }
+}
+
+// injects returns whether any of the enabled configs may inject the method.
+// The phases inject what any of them does.
+fn injects(config: &[InjectorConfig], method: &filter::Method) -> bool {
+    config
+        .iter()
+        .filter(|conf| conf.enabled())
+        .any(|conf| match conf {
+            InjectorConfig::AttrOverride(_) => false,
+            InjectorConfig::Fault(conf) => match &conf.rules {
+                Some(rules) => rules.iter().any(|rule| includes(&rule.methods, method)),
+                None => includes(&conf.filter.methods, method),
+            },
+            InjectorConfig::Latency(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Mistake(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Throttle(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::ShortIo(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Quota(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::DelayFault(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Timeout(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::StaleRead(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::StatfsOverride(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::ShuffleDir(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::HideEntries(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::VolatileWrites(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Sequence(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Readlink(conf) => includes(&conf.filter.methods, method),
+            InjectorConfig::Phases(conf) => conf
+                .phases
+                .iter()
+                .any(|phase| injects(&phase.injectors, method)),
+        })
 }
 
 impl MultiInjector {
-    pub fn build(conf: Vec<InjectorConfig>) -> anyhow::Result<Self> {
+    // build creates injectors from the config. The `root` is the mount point, which
+    // relative path filters are matched against.
+    pub fn build(conf: Vec<InjectorConfig>, root: &Path) -> anyhow::Result<Self> {
         trace!("build multiinjectors");
-        let mut injectors = Vec::new();
-
-        for injector in conf.into_iter() {
-            let injector = match injector {
-                InjectorConfig::Fault(faults) => {
-                    (box FaultInjector::build(faults)?) as Box<dyn Injector>
-                }
-                InjectorConfig::Latency(latency) => {
-                    (box LatencyInjector::build(latency)?) as Box<dyn Injector>
-                }
-                InjectorConfig::AttrOverride(attr_override) => {
-                    (box AttrOverrideInjector::build(attr_override)?) as Box<dyn Injector>
-                }
-                InjectorConfig::Mistake(mistakes) => {
-                    (box MistakeInjector::build(mistakes)?) as Box<dyn Injector>
-                }
-            };
-            injectors.push(injector)
-        }
-
-        Ok(Self { injectors })
+        Self::try_build(conf, root).map_err(|errors| anyhow!(errors.join("; ")))
+    }
+
+    // validate checks the config as `build` does without applying it, and
+    // returns all the errors rather than the first one
+    pub fn validate(conf: Vec<InjectorConfig>, root: &Path) -> Vec<String> {
+        trace!("validate multiinjectors");
+        Self::try_build(conf, root).err().unwrap_or_default()
+    }
+
+    fn try_build(
+        conf: Vec<InjectorConfig>,
+        root: &Path,
+    ) -> std::result::Result<Self, Vec<String>> {
+        let mut errors = Vec::new();
+        let mut names = HashSet::new();
+        for name in conf.iter().filter_map(|conf| conf.name()) {
+            if !names.insert(name) {
+                errors.push(format!("duplicate injector name {}", name));
+            }
+        }
+
+        let mut injectors: Vec<Arc<dyn Injector>> = Vec::new();
+        for (index, injector) in conf.iter().enumerate() {
+            match build_injector(injector.clone(), root) {
+                Ok(built) => injectors.push(Arc::from(built)),
+                Err(err) => match injector.name() {
+                    Some(name) => errors.push(format!("injector {} ({}): {}", index, name, err)),
+                    None => errors.push(format!("injector {}: {}", index, err)),
+                },
+            }
+        }
+        if !errors.is_empty() {
+            return Err(errors);
+        }
+
+        Ok(Self::new(injectors, conf))
+    }
+
+    fn new(injectors: Vec<Arc<dyn Injector>>, config: Vec<InjectorConfig>) -> Self {
+        let enabled = config.iter().map(InjectorConfig::enabled).collect();
+        Self {
+            injectors,
+            config,
+            enabled,
+        }
+    }
+
+    // active returns the enabled injectors
+    fn active(&self) -> impl Iterator<Item = &Arc<dyn Injector>> {
+        self.injectors
+            .iter()
+            .zip(self.enabled.iter())
+            .filter(|(_, enabled)| **enabled)
+            .map(|(injector, _)| injector)
+    }
+
+    pub fn config(&self) -> &[InjectorConfig] {
+        &self.config
+    }
+
+    // injects returns whether any of the injectors may inject the method, by
+    // the methods of their filters
+    pub fn injects(&self, method: &filter::Method) -> bool {
+        injects(&self.config, method)
+    }
+
+    // update returns the injectors with the one of the same name replaced by
+    // `conf`, or `conf` appended if there isn't. The others are kept with
+    // their state, like the counters and the active window.
+    pub fn update(&self, conf: InjectorConfig, root: &Path) -> anyhow::Result<Self> {
+        let name = conf
+            .name()
+            .ok_or(anyhow!("the injector to update should have a name"))?;
+        let injector: Arc<dyn Injector> = Arc::from(build_injector(conf.clone(), root)?);
+
+        let mut injectors = self.injectors.clone();
+        let mut config = self.config.clone();
+        match self.position(name) {
+            Some(index) => {
+                injectors[index] = injector;
+                config[index] = conf;
+            }
+            None => {
+                injectors.push(injector);
+                config.push(conf);
+            }
+        }
+        Ok(Self::new(injectors, config))
+    }
+
+    // remove returns the injectors without the one of the `name`
+    pub fn remove(&self, name: &str) -> anyhow::Result<Self> {
+        let index = self
+            .position(name)
+            .ok_or(anyhow!("unknown injector {}", name))?;
+
+        let mut injectors = self.injectors.clone();
+        let mut config = self.config.clone();
+        injectors.remove(index);
+        config.remove(index);
+        Ok(Self::new(injectors, config))
+    }
+
+    // set_enabled returns the injectors with the one of the `name` enabled or
+    // disabled. It keeps its state, so a disabled injector keeps its counters
+    // as they are, and goes on from them when it's enabled again.
+    pub fn set_enabled(&self, name: &str, enabled: bool) -> anyhow::Result<Self> {
+        let index = self
+            .position(name)
+            .ok_or(anyhow!("unknown injector {}", name))?;
+
+        let mut config = self.config.clone();
+        config[index].set_enabled(enabled);
+        Ok(Self::new(self.injectors.clone(), config))
+    }
+
+    fn position(&self, name: &str) -> Option<usize> {
+        self.config
+            .iter()
+            .position(|conf| conf.name() == Some(name))
+    }
+
+    // status returns the config of every injector, together with its counter
+    pub fn status(&self) -> Vec<InjectorStatus> {
+        self.config
+            .iter()
+            .zip(self.injectors.iter())
+            .map(|(config, injector)| InjectorStatus {
+                config: config.clone(),
+                enabled: config.enabled(),
+                matched: injector.matched(),
+                remaining: injector.remaining(),
+                phase: injector.phase(),
+                burst: injector.burst(),
+            })
+            .collect()
+    }
+
+    // reset_status clears the counters of every injector, and returns the
+    // status before
+    pub fn reset_status(&self) -> Vec<InjectorStatus> {
+        self.config
+            .iter()
+            .zip(self.injectors.iter())
+            .map(|(config, injector)| InjectorStatus {
+                config: config.clone(),
+                enabled: config.enabled(),
+                matched: injector.reset_matched(),
+                remaining: injector.remaining(),
+                phase: injector.phase(),
+                burst: injector.burst(),
+            })
+            .collect()
     }
 }
 
 #[async_trait]
 impl Injector for MultiInjector {
     async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()> {
-        for injector in self.injectors.iter() {
+        for injector in self.active() {
             injector.inject(method, path).await?
         }
 
         Ok(())
     }
 
+    async fn inject_io(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        offset: i64,
+        length: usize,
+    ) -> Result<()> {
+        for injector in self.active() {
+            injector.inject_io(method, path, offset, length).await?
+        }
+
+        Ok(())
+    }
+
     fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
-        for injector in self.injectors.iter() {
+        for injector in self.active() {
             injector.inject_reply(method, path, reply)?
         }
 
@@ -63,15 +351,62 @@ impl Injector for MultiInjector {
     }
 
     fn inject_attr(&self, attr: &mut FileAttr, path: &Path) {
-        for injector in self.injectors.iter() {
+        for injector in self.active() {
             injector.inject_attr(attr, path)
         }
     }
 
-    fn inject_write_data(&self, path: &Path, data: &mut Vec<u8>) -> Result<()> {
+    fn inject_write_data(&self, path: &Path, offset: i64, data: &mut Vec<u8>) -> Result<()> {
+        for injector in self.active() {
+            injector.inject_write_data(path, offset, data)?;
+        }
+        Ok(())
+    }
+
+    fn reset_quota(&self) {
         for injector in self.injectors.iter() {
-            injector.inject_write_data(path, data)?;
+            injector.reset_quota()
+        }
+    }
+
+    // the disabled injectors forget the inode too, as they keep their state
+    // until enabled again
+    fn forget(&self, ino: u64) {
+        for injector in self.injectors.iter() {
+            injector.forget(ino)
+        }
+    }
+
+    // crash is passed to all of the enabled injectors, even if some of them
+    // fail
+    fn crash(&self) -> anyhow::Result<()> {
+        let errors: Vec<_> = self
+            .active()
+            .filter_map(|injector| injector.crash().err())
+            .map(|err| err.to_string())
+            .collect();
+        if !errors.is_empty() {
+            return Err(anyhow!(errors.join("; ")));
         }
         Ok(())
     }
+
+    fn matched(&self) -> u64 {
+        self.injectors
+            .iter()
+            .map(|injector| injector.matched())
+            .sum()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.injectors
+            .iter()
+            .map(|injector| injector.reset_matched())
+            .sum()
+    }
+
+    // the budgets are per injector, see `status`
+    fn remaining(&self) -> Option<u64> {
+        None
+    }
 }
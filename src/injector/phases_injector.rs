@@ -0,0 +1,155 @@
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use fuser::FileAttr;
+use tracing::trace;
+
+use super::injector_config::PhasesConfig;
+use super::{filter, Injector, MultiInjector};
+use crate::hookfs::{Reply, Result};
+
+// PhasesInjector runs the injectors of one phase at a time. The active phase
+// is chosen by the time elapsed since the config is applied, on the monotonic
+// clock, so it's not moved by the changes of the wall clock.
+#[derive(Debug)]
+pub struct PhasesInjector {
+    phases: Vec<(Duration, MultiInjector)>,
+    // the sum of the durations of the phases
+    cycle: Duration,
+    repeat: bool,
+    applied_at: Instant,
+}
+
+impl PhasesInjector {
+    pub fn build(conf: PhasesConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build phases injector");
+
+        if conf.phases.is_empty() {
+            return Err(anyhow!("phases should not be empty"));
+        }
+
+        let mut phases = Vec::new();
+        let mut cycle = Duration::from_secs(0);
+        for (index, phase) in conf.phases.into_iter().enumerate() {
+            if phase.duration == Duration::from_secs(0) {
+                return Err(anyhow!("duration of phase {} should be positive", index));
+            }
+            let injectors = MultiInjector::build(phase.injectors, root)
+                .map_err(|err| anyhow!("phase {}: {}", index, err))?;
+            cycle += phase.duration;
+            phases.push((phase.duration, injectors));
+        }
+
+        Ok(Self {
+            phases,
+            cycle,
+            repeat: conf.repeat,
+            applied_at: Instant::now(),
+        })
+    }
+
+    fn current(&self) -> Option<&MultiInjector> {
+        self.phase().map(|index| &self.phases[index].1)
+    }
+}
+
+#[async_trait]
+impl Injector for PhasesInjector {
+    async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()> {
+        match self.current() {
+            Some(injector) => injector.inject(method, path).await,
+            None => Ok(()),
+        }
+    }
+
+    async fn inject_io(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        offset: i64,
+        length: usize,
+    ) -> Result<()> {
+        match self.current() {
+            Some(injector) => injector.inject_io(method, path, offset, length).await,
+            None => Ok(()),
+        }
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        match self.current() {
+            Some(injector) => injector.inject_reply(method, path, reply),
+            None => Ok(()),
+        }
+    }
+
+    fn inject_write_data(&self, path: &Path, offset: i64, data: &mut Vec<u8>) -> Result<()> {
+        match self.current() {
+            Some(injector) => injector.inject_write_data(path, offset, data),
+            None => Ok(()),
+        }
+    }
+
+    fn inject_attr(&self, attr: &mut FileAttr, path: &Path) {
+        if let Some(injector) = self.current() {
+            injector.inject_attr(attr, path)
+        }
+    }
+
+    fn reset_quota(&self) {
+        for (_, injector) in self.phases.iter() {
+            injector.reset_quota()
+        }
+    }
+
+    fn forget(&self, ino: u64) {
+        for (_, injector) in self.phases.iter() {
+            injector.forget(ino)
+        }
+    }
+
+    // only the current phase crashes, as the past ones haven't seen the
+    // fsyncs since they ended
+    fn crash(&self) -> anyhow::Result<()> {
+        match self.current() {
+            Some(injector) => injector.crash(),
+            None => Ok(()),
+        }
+    }
+
+    fn matched(&self) -> u64 {
+        self.phases
+            .iter()
+            .map(|(_, injector)| injector.matched())
+            .sum()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.phases
+            .iter()
+            .map(|(_, injector)| injector.reset_matched())
+            .sum()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        None
+    }
+
+    // phase returns `None` after the last phase, if they are not looped
+    fn phase(&self) -> Option<usize> {
+        let mut elapsed = self.applied_at.elapsed();
+        if self.repeat {
+            elapsed = Duration::from_nanos((elapsed.as_nanos() % self.cycle.as_nanos()) as u64);
+        }
+
+        let mut end = Duration::from_secs(0);
+        for (index, (duration, _)) in self.phases.iter().enumerate() {
+            end += *duration;
+            if elapsed < end {
+                return Some(index);
+            }
+        }
+        None
+    }
+}
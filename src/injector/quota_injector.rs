@@ -0,0 +1,155 @@
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::Mutex;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use nix::errno::Errno;
+use tracing::{debug, info, trace};
+
+use super::injector_config::QuotaConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Error, RequestContext, Result};
+
+// QuotaInjector counts the bytes written by the matched writes, in all and
+// by every uid. It returns EDQUOT for the writes which would exceed the quota
+// of their user, and ENOSPC for the ones which would exceed the shared quota.
+#[derive(Debug)]
+pub struct QuotaInjector {
+    filter: filter::Filter,
+
+    quota: Option<u64>,
+    user_quota: Option<u64>,
+    usage: Mutex<Usage>,
+}
+
+#[derive(Debug, Default)]
+struct Usage {
+    written: u64,
+    // the bytes written by every uid
+    users: HashMap<u32, u64>,
+}
+
+impl Usage {
+    // reserve counts the bytes if they fit both of the quotas, or returns the
+    // errno and the exceeded quota
+    fn reserve(
+        &mut self,
+        uid: Option<u32>,
+        length: u64,
+        quota: Option<u64>,
+        user_quota: Option<u64>,
+    ) -> std::result::Result<(), (Errno, u64)> {
+        let user = uid.map_or(0, |uid| self.users.get(&uid).copied().unwrap_or(0));
+        match (uid, user_quota) {
+            (Some(_), Some(user_quota)) if user + length > user_quota => {
+                return Err((Errno::EDQUOT, user_quota))
+            }
+            _ => {}
+        }
+        match quota {
+            Some(quota) if self.written + length > quota => return Err((Errno::ENOSPC, quota)),
+            _ => {}
+        }
+
+        self.written += length;
+        if let Some(uid) = uid {
+            self.users.insert(uid, user + length);
+        }
+        Ok(())
+    }
+}
+
+#[async_trait]
+impl Injector for QuotaInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    async fn inject_io(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        _offset: i64,
+        length: usize,
+    ) -> Result<()> {
+        if *method != Method::WRITE || !self.filter.filter(method, path) {
+            return Ok(());
+        }
+
+        // the bytes are reserved under the lock, so the quotas are never
+        // exceeded by concurrent writers. The writes outside of a FUSE request
+        // are only counted in all.
+        let uid = RequestContext::current().map(|ctx| ctx.uid);
+        let reserved =
+            self.usage
+                .lock()
+                .unwrap()
+                .reserve(uid, length as u64, self.quota, self.user_quota);
+        let (errno, quota) = match reserved {
+            Ok(()) => return Ok(()),
+            Err(exceeded) => exceeded,
+        };
+
+        if self.filter.dry_run() {
+            info!(
+                "dry run: {:?} on {} would exceed the quota {} and return with {:?}",
+                method,
+                path.display(),
+                quota,
+                errno
+            );
+            return Ok(());
+        }
+        if !self.filter.injected(
+            method,
+            path,
+            "quota",
+            format_args!("quota {} exceeded, errno {:?}", quota, errno),
+        ) {
+            return Ok(());
+        }
+        debug!("quota {} exceeded, return with {:?}", quota, errno);
+        Err(Error::Sys(errno))
+    }
+
+    fn reset_quota(&self) {
+        *self.usage.lock().unwrap() = Usage::default();
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    // the bytes are cleared with the counter, so `reset_stats` starts the
+    // quotas again
+    fn reset_matched(&self) -> u64 {
+        self.reset_quota();
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl QuotaInjector {
+    pub fn build(conf: QuotaConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build quota injector");
+
+        if conf.quota.is_none() && conf.user_quota.is_none() {
+            return Err(anyhow!("quota or userQuota should be set"));
+        }
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            quota: conf.quota,
+            user_quota: conf.user_quota,
+            usage: Mutex::new(Usage::default()),
+        })
+    }
+}
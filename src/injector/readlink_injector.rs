@@ -0,0 +1,107 @@
+use std::path::Path;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use rand::Rng;
+use tracing::{debug, info, trace};
+
+use super::injector_config::ReadlinkConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Reply, Result};
+
+// ReadlinkInjector replaces the targets replied to `readlink`, so that the
+// links point to a wrong or missing file
+#[derive(Debug)]
+pub struct ReadlinkInjector {
+    filter: filter::Filter,
+    target: Option<Vec<u8>>,
+    // the suffix appended to the targets to make them dangling, which is
+    // random so that no file is named with it in practice
+    dangling_suffix: Option<String>,
+}
+
+#[async_trait]
+impl Injector for ReadlinkInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        let data = match reply {
+            Reply::Data(data) if *method == Method::READLINK => data,
+            _ => return Ok(()),
+        };
+        if !self.filter.filter(method, path) {
+            return Ok(());
+        }
+        if self.filter.dry_run() {
+            info!("dry run: target of {} would be replaced", path.display());
+            return Ok(());
+        }
+
+        let mut target = self.target.clone().unwrap_or_else(|| data.data.clone());
+        if let Some(suffix) = &self.dangling_suffix {
+            target.extend_from_slice(suffix.as_bytes());
+        }
+        if !self.filter.injected(
+            method,
+            path,
+            "readlink",
+            format_args!("target {}", String::from_utf8_lossy(&target)),
+        ) {
+            return Ok(());
+        }
+        data.data = target;
+        debug!(
+            "replace target of {} with {}",
+            path.display(),
+            String::from_utf8_lossy(&data.data)
+        );
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl ReadlinkInjector {
+    pub fn build(conf: ReadlinkConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build readlink injector");
+
+        if conf.target.is_none() && !conf.dangling {
+            return Err(anyhow!("readlink should have target or dangling"));
+        }
+        if let Some(target) = &conf.target {
+            if target.is_empty() || target.contains('\0') {
+                return Err(anyhow!("invalid readlink target {:?}", target));
+            }
+        }
+        let dangling_suffix = if conf.dangling {
+            Some(format!(
+                ".dangling-{:016x}",
+                rand::thread_rng().gen::<u64>()
+            ))
+        } else {
+            None
+        };
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            target: conf.target.map(String::into_bytes),
+            dangling_suffix,
+        })
+    }
+}
@@ -0,0 +1,183 @@
+use std::collections::{BTreeMap, HashMap};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::AtomicBool;
+use std::sync::Mutex;
+use std::time::Duration;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use nix::errno::Errno;
+use tracing::{debug, info, trace};
+
+use super::injector_config::SequenceConfig;
+use super::{delay, filter, Injector, Method};
+use crate::hookfs::{Error, RequestContext, Result};
+use crate::metrics;
+
+// SequenceInjector counts the matched operations on every inode, and applies
+// the step of the position of the operation, so that only the Nth of them is
+// delayed or failed. The operations without the inode are not counted.
+#[derive(Debug)]
+pub struct SequenceInjector {
+    filter: filter::Filter,
+    // the steps indexed by the position from 1
+    steps: BTreeMap<u64, Step>,
+    counters: Mutex<HashMap<u64, Counter>>,
+    // whether a latency has been clamped by the max latency
+    capped: AtomicBool,
+}
+
+#[derive(Debug, Clone, Copy)]
+struct Step {
+    latency: Option<Duration>,
+    errno: Option<Errno>,
+}
+
+#[derive(Debug)]
+struct Counter {
+    // the path the inode is last operated on, by which it's forgotten when
+    // it's unlinked
+    path: PathBuf,
+    operations: u64,
+}
+
+impl SequenceInjector {
+    pub fn build(conf: SequenceConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build sequence injector");
+
+        if conf.steps.is_empty() {
+            return Err(anyhow!("steps of sequence should not be empty"));
+        }
+        let mut steps = BTreeMap::new();
+        for step in conf.steps {
+            if step.index == 0 {
+                return Err(anyhow!("index of sequence step should start from 1"));
+            }
+            if step.latency.is_none() && step.errno.is_none() {
+                return Err(anyhow!(
+                    "sequence step {} should have latency or errno",
+                    step.index
+                ));
+            }
+            let step_index = step.index;
+            let previous = steps.insert(
+                step.index,
+                Step {
+                    latency: step.latency,
+                    errno: step.errno.map(Errno::from_i32),
+                },
+            );
+            if previous.is_some() {
+                return Err(anyhow!("sequence step {} is duplicated", step_index));
+            }
+        }
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            steps,
+            counters: Mutex::new(HashMap::new()),
+            capped: AtomicBool::new(false),
+        })
+    }
+
+    // next counts the operation on the inode, and returns the step of its
+    // position
+    fn next(&self, ino: u64, path: &Path) -> Option<Step> {
+        let mut counters = self.counters.lock().unwrap();
+        let counter = counters.entry(ino).or_insert_with(|| Counter {
+            path: path.to_owned(),
+            operations: 0,
+        });
+        if counter.path != path {
+            counter.path = path.to_owned();
+        }
+        counter.operations += 1;
+        trace!("operation {} on inode {}", counter.operations, ino);
+        self.steps.get(&counter.operations).copied()
+    }
+
+    // forget_file drops the counter of the file released or unlinked, so that
+    // the next operations on it are counted from 1 again
+    fn forget_file(&self, method: &filter::Method, ino: Option<u64>, path: &Path) {
+        if *method == Method::RELEASE {
+            if let Some(ino) = ino {
+                self.counters.lock().unwrap().remove(&ino);
+            }
+        } else if *method == Method::UNLINK {
+            // the unlink is on a name, without the inode
+            self.counters
+                .lock()
+                .unwrap()
+                .retain(|_, counter| counter.path != path);
+        }
+    }
+}
+
+#[async_trait]
+impl Injector for SequenceInjector {
+    async fn inject(&self, method: &filter::Method, path: &Path) -> Result<()> {
+        let ino = RequestContext::current().and_then(|ctx| ctx.ino());
+        let step = match ino {
+            Some(ino) if self.filter.filter(method, path) => self.next(ino, path),
+            _ => None,
+        };
+        self.forget_file(method, ino, path);
+        let step = match step {
+            Some(step) => step,
+            None => return Ok(()),
+        };
+
+        let latency = step
+            .latency
+            .map(|latency| delay::cap(latency, &self.capped));
+        if self.filter.dry_run() {
+            info!(
+                "dry run: {:?} on {} would be delayed for {:?} and return with error {:?}",
+                method,
+                path.display(),
+                latency,
+                step.errno
+            );
+            return Ok(());
+        }
+        if !self.filter.injected(
+            method,
+            path,
+            "sequence",
+            format_args!("latency {:?}, errno {:?}", latency, step.errno),
+        ) {
+            return Ok(());
+        }
+        if let Some(latency) = latency {
+            debug!("inject sequence delay {:?}", latency);
+            metrics::injected_latency(latency);
+            delay::delay(latency).await?;
+        }
+        match step.errno {
+            Some(errno) => {
+                debug!("return with error {}", errno);
+                Err(Error::Sys(errno))
+            }
+            None => Ok(()),
+        }
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    // the positions are counted from 1 again after `reset_stats`
+    fn reset_matched(&self) -> u64 {
+        self.counters.lock().unwrap().clear();
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.counters.lock().unwrap().remove(&ino);
+        self.filter.forget(ino)
+    }
+}
@@ -0,0 +1,126 @@
+use std::cmp::min;
+use std::path::Path;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use rand::Rng;
+use tracing::{debug, info, trace};
+
+use super::injector_config::ShortIoConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Reply, Result};
+
+// ShortIoInjector makes read, write and copy_file_range transfer fewer bytes
+// than requested. The data of write is cut before it's written, so only the
+// reported bytes are persisted.
+#[derive(Debug)]
+pub struct ShortIoInjector {
+    filter: filter::Filter,
+    ratio: Option<f64>,
+    max_length: Option<usize>,
+}
+
+#[async_trait]
+impl Injector for ShortIoInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        match reply {
+            Reply::Data(data) if *method == Method::READ => {
+                if let Some(length) = self.shorten(method, path, data.data.len()) {
+                    data.data.truncate(length);
+                }
+            }
+            // copy_file_range has been done, so only the reply is shortened
+            Reply::Write(write) if *method == Method::COPY_FILE_RANGE => {
+                if let Some(length) = self.shorten(method, path, write.size as usize) {
+                    write.size = length as u32;
+                }
+            }
+            _ => {}
+        }
+        Ok(())
+    }
+
+    fn inject_write_data(&self, path: &Path, _offset: i64, data: &mut Vec<u8>) -> Result<()> {
+        if let Some(length) = self.shorten(&Method::WRITE, path, data.len()) {
+            data.truncate(length);
+        }
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl ShortIoInjector {
+    pub fn build(conf: ShortIoConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build short io injector");
+
+        if let Some(ratio) = conf.ratio {
+            if !(0f64..=1f64).contains(&ratio) {
+                return Err(anyhow!("ratio of short io should be in [0, 1]"));
+            }
+        }
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            ratio: conf.ratio,
+            max_length: conf.max_length,
+        })
+    }
+
+    // shorten returns the shortened length, or `None` if the operation isn't
+    // injected
+    fn shorten(&self, method: &filter::Method, path: &Path, length: usize) -> Option<usize> {
+        if length == 0 || !self.filter.filter(method, path) {
+            return None;
+        }
+
+        let shortened = match (self.ratio, self.max_length) {
+            (None, None) => rand::thread_rng().gen_range(0, length),
+            (ratio, max_length) => {
+                let by_ratio = ratio.map_or(length, |ratio| (length as f64 * ratio) as usize);
+                min(by_ratio, max_length.unwrap_or(length))
+            }
+        };
+        let shortened = min(shortened, length);
+
+        if self.filter.dry_run() {
+            info!(
+                "dry run: {:?} on {} would be shortened from {} to {}",
+                method,
+                path.display(),
+                length,
+                shortened
+            );
+            return None;
+        }
+
+        if !self.filter.injected(
+            method,
+            path,
+            "short_io",
+            format_args!("shorten {} bytes to {}", length, shortened),
+        ) {
+            return None;
+        }
+        debug!("shorten {:?} from {} to {}", method, length, shortened);
+        Some(shortened)
+    }
+}
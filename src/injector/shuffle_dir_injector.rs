@@ -0,0 +1,109 @@
+use std::path::Path;
+use std::sync::Mutex;
+
+use async_trait::async_trait;
+use rand::rngs::StdRng;
+use rand::seq::SliceRandom;
+use rand::SeedableRng;
+use tracing::{debug, info, trace};
+
+use super::injector_config::ShuffleDirConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Reply, Result};
+
+// ShuffleDirInjector shuffles the entries listed by readdir and readdirplus,
+// except `.` and `..`, which are kept where they are. The listing is shuffled
+// once when it's read from the start, and the following pages are cut from
+// it, see `HookFs::dir_entries`.
+#[derive(Debug)]
+pub struct ShuffleDirInjector {
+    filter: filter::Filter,
+    rng: Mutex<StdRng>,
+}
+
+#[async_trait]
+impl Injector for ShuffleDirInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        if *method != Method::READDIR && *method != Method::READDIRPLUS {
+            return Ok(());
+        }
+        let listing = match reply {
+            Reply::DirEntries(listing) => listing,
+            _ => return Ok(()),
+        };
+        if !self.filter.filter(method, path) {
+            return Ok(());
+        }
+        if self.filter.dry_run() {
+            info!(
+                "dry run: {:?} on {} would shuffle {} entries",
+                method,
+                path.display(),
+                listing.entries.len()
+            );
+            return Ok(());
+        }
+
+        if !self.filter.injected(
+            method,
+            path,
+            "shuffle_dir",
+            format_args!("shuffle {} entries", listing.entries.len()),
+        ) {
+            return Ok(());
+        }
+        let positions: Vec<usize> = listing
+            .entries
+            .iter()
+            .enumerate()
+            .filter(|(_, entry)| entry.name != "." && entry.name != "..")
+            .map(|(index, _)| index)
+            .collect();
+        let mut shuffled = positions.clone();
+        shuffled.shuffle(&mut *self.rng.lock().unwrap());
+
+        let entries = listing.entries.clone();
+        for (position, from) in positions.into_iter().zip(shuffled) {
+            listing.entries[position] = entries[from].clone();
+        }
+        listing.changed = true;
+        debug!("shuffle {} entries", entries.len());
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl ShuffleDirInjector {
+    pub fn build(conf: ShuffleDirConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build shuffle dir injector");
+
+        let rng = match conf.seed {
+            Some(seed) => StdRng::seed_from_u64(seed),
+            None => StdRng::from_entropy(),
+        };
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            rng: Mutex::new(rng),
+        })
+    }
+}
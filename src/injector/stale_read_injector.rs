@@ -0,0 +1,169 @@
+use std::collections::{BTreeMap, HashMap};
+use std::path::Path;
+use std::sync::Mutex;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use tracing::{debug, info, trace};
+
+use super::injector_config::StaleReadConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Reply, RequestContext, Result};
+
+const DEFAULT_MAX_REGIONS: usize = 1024;
+const DEFAULT_MAX_BYTES: usize = 64 << 20;
+
+// StaleReadInjector keeps a snapshot of the regions read recently, and
+// replies to a later read of the same region with the snapshot rather than
+// the current data, once the data has changed. Unlike a mistake, the data
+// returned is what the file used to contain. The least recently read regions
+// are dropped beyond `max_regions` or `max_bytes`.
+#[derive(Debug)]
+pub struct StaleReadInjector {
+    filter: filter::Filter,
+    max_regions: usize,
+    max_bytes: usize,
+    state: Mutex<Snapshots>,
+}
+
+#[derive(Debug, Default)]
+struct Snapshots {
+    // the snapshots indexed by the inode and the offset of the read
+    regions: HashMap<(u64, i64), Snapshot>,
+    // the keys of the snapshots ordered by the last read
+    used: BTreeMap<u64, (u64, i64)>,
+    clock: u64,
+    bytes: usize,
+}
+
+#[derive(Debug)]
+struct Snapshot {
+    data: Vec<u8>,
+    used: u64,
+}
+
+impl Snapshots {
+    fn remove(&mut self, key: (u64, i64)) -> Option<Vec<u8>> {
+        let snapshot = self.regions.remove(&key)?;
+        self.used.remove(&snapshot.used);
+        self.bytes -= snapshot.data.len();
+        Some(snapshot.data)
+    }
+
+    fn insert(&mut self, key: (u64, i64), data: Vec<u8>) {
+        self.remove(key);
+        self.clock += 1;
+        self.used.insert(self.clock, key);
+        self.bytes += data.len();
+        self.regions.insert(
+            key,
+            Snapshot {
+                data,
+                used: self.clock,
+            },
+        );
+    }
+}
+
+#[async_trait]
+impl Injector for StaleReadInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        if *method != Method::READ {
+            return Ok(());
+        }
+        let data = match reply {
+            Reply::Data(data) => data,
+            _ => return Ok(()),
+        };
+        let ino = match RequestContext::current().and_then(|ctx| ctx.ino()) {
+            Some(ino) => ino,
+            None => return Ok(()),
+        };
+        let key = (ino, data.offset);
+
+        let mut state = self.state.lock().unwrap();
+        let stale = state.regions.get(&key).and_then(|snapshot| {
+            // the snapshot is only served if it covers the read, and differs
+            // from the current data
+            let stale = snapshot.data.get(..data.data.len())?;
+            if stale == &data.data[..] {
+                None
+            } else {
+                Some(stale.to_vec())
+            }
+        });
+        if let Some(stale) = stale {
+            if self.filter.filter(method, path) {
+                if self.filter.dry_run() {
+                    info!(
+                        "dry run: read of {} at {} would return the stale data",
+                        path.display(),
+                        data.offset
+                    );
+                } else if self.filter.injected(
+                    method,
+                    path,
+                    "stale_read",
+                    format_args!("stale data at {}", data.offset),
+                ) {
+                    debug!("return the stale data at {}", data.offset);
+                    data.data = stale;
+                    // the snapshot is kept, so the read stays stale
+                    let snapshot = state.remove(key).unwrap_or_default();
+                    state.insert(key, snapshot);
+                    return Ok(());
+                }
+            }
+        }
+
+        trace!("snapshot {} bytes at {}", data.data.len(), data.offset);
+        state.insert(key, data.data.clone());
+        while state.regions.len() > self.max_regions || state.bytes > self.max_bytes {
+            let key = match state.used.values().next() {
+                Some(key) => *key,
+                None => break,
+            };
+            state.remove(key);
+        }
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl StaleReadInjector {
+    pub fn build(conf: StaleReadConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build stale read injector");
+
+        let max_regions = conf.max_regions.unwrap_or(DEFAULT_MAX_REGIONS);
+        let max_bytes = conf.max_bytes.unwrap_or(DEFAULT_MAX_BYTES);
+        if max_regions == 0 || max_bytes == 0 {
+            return Err(anyhow!("cache size of stale read should be positive"));
+        }
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            max_regions,
+            max_bytes,
+            state: Mutex::new(Snapshots::default()),
+        })
+    }
+}
@@ -0,0 +1,96 @@
+use std::cmp::min;
+use std::path::Path;
+
+use async_trait::async_trait;
+use tracing::{debug, info, trace};
+
+use super::injector_config::StatfsOverrideConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{Reply, Result};
+
+// StatfsOverrideInjector replaces the counts of the free blocks and inodes
+// replied to `statfs`, like a disk which is full in the output of `df`
+#[derive(Debug)]
+pub struct StatfsOverrideInjector {
+    filter: filter::Filter,
+    free_blocks: Option<u64>,
+    available_blocks: Option<u64>,
+    free_inodes: Option<u64>,
+}
+
+#[async_trait]
+impl Injector for StatfsOverrideInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    fn inject_reply(&self, method: &filter::Method, path: &Path, reply: &mut Reply) -> Result<()> {
+        let stat = match reply {
+            Reply::StatFs(stat) if *method == Method::STATFS => stat,
+            _ => return Ok(()),
+        };
+        if !self.filter.filter(method, path) {
+            return Ok(());
+        }
+        if self.filter.dry_run() {
+            info!("dry run: statfs of {} would be overridden", path.display());
+            return Ok(());
+        }
+
+        let bfree = self
+            .free_blocks
+            .map_or(stat.bfree, |free_blocks| min(free_blocks, stat.blocks));
+        let bavail = min(self.available_blocks.unwrap_or(stat.bavail), bfree);
+        let ffree = self
+            .free_inodes
+            .map_or(stat.ffree, |free_inodes| min(free_inodes, stat.files));
+        if !self.filter.injected(
+            method,
+            path,
+            "statfs_override",
+            format_args!(
+                "{} free blocks, {} available blocks, {} free inodes",
+                bfree, bavail, ffree
+            ),
+        ) {
+            return Ok(());
+        }
+        stat.bfree = bfree;
+        stat.bavail = bavail;
+        stat.ffree = ffree;
+        debug!(
+            "override statfs with {} free blocks, {} available blocks and {} free inodes",
+            stat.bfree, stat.bavail, stat.ffree
+        );
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl StatfsOverrideInjector {
+    pub fn build(conf: StatfsOverrideConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build statfs override injector");
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            free_blocks: conf.free_blocks,
+            available_blocks: conf.available_blocks,
+            free_inodes: conf.free_inodes,
+        })
+    }
+}
@@ -0,0 +1,145 @@
+use std::cmp::min;
+use std::path::Path;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use tokio::time::delay_for;
+use tracing::{debug, info, trace};
+
+use super::injector_config::ThrottleConfig;
+use super::{filter, Injector};
+use crate::hookfs::Result;
+use crate::metrics;
+
+#[derive(Debug)]
+struct Bucket {
+    // tokens can be negative, which means the throughput has been reserved by
+    // former requests and the latter ones should wait longer.
+    tokens: f64,
+    last: Instant,
+}
+
+#[derive(Debug)]
+pub struct ThrottleInjector {
+    filter: filter::Filter,
+
+    rate: u64,
+    burst: u64,
+
+    // the bucket is shared by all requests matching this injector
+    bucket: Mutex<Bucket>,
+}
+
+#[async_trait]
+impl Injector for ThrottleInjector {
+    async fn inject(&self, _: &filter::Method, _: &Path) -> Result<()> {
+        Ok(())
+    }
+
+    async fn inject_io(
+        &self,
+        method: &filter::Method,
+        path: &Path,
+        _offset: i64,
+        length: usize,
+    ) -> Result<()> {
+        trace!("test for filter");
+        if self.filter.filter(method, path) {
+            if self.filter.dry_run() {
+                info!(
+                    "dry run: {} bytes of {:?} on {} would be throttled to {} bytes/s",
+                    length,
+                    method,
+                    path.display(),
+                    self.rate
+                );
+                return Ok(());
+            }
+            if !self.filter.injected(
+                method,
+                path,
+                "throttle",
+                format_args!("throttle {} bytes to {} bytes/s", length, self.rate),
+            ) {
+                return Ok(());
+            }
+            // a request larger than the burst is split into several chunks,
+            // so it will be delayed chunk by chunk rather than wait for a
+            // bucket which can never be filled.
+            let mut remain = length as u64;
+            while remain > 0 {
+                let chunk = min(remain, self.burst);
+                remain -= chunk;
+
+                let wait = self.reserve(chunk);
+                if wait > Duration::from_secs(0) {
+                    debug!("throttle {} bytes for {:?}", chunk, wait);
+                    metrics::injected_latency(wait);
+                    delay_for(wait).await;
+                }
+            }
+        }
+
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl ThrottleInjector {
+    pub fn build(conf: ThrottleConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build throttle injector");
+
+        if conf.rate == 0 {
+            return Err(anyhow!("rate of throttle should be positive"));
+        }
+        let burst = match conf.burst {
+            0 => conf.rate,
+            burst => burst,
+        };
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            rate: conf.rate,
+            burst,
+            bucket: Mutex::new(Bucket {
+                tokens: burst as f64,
+                last: Instant::now(),
+            }),
+        })
+    }
+
+    // reserve takes `amount` tokens from the bucket and returns the time to
+    // wait before the tokens are really available.
+    fn reserve(&self, amount: u64) -> Duration {
+        let mut bucket = self.bucket.lock().unwrap();
+
+        let now = Instant::now();
+        let elapsed = now.duration_since(bucket.last).as_secs_f64();
+        bucket.tokens = (bucket.tokens + elapsed * self.rate as f64).min(self.burst as f64);
+        bucket.last = now;
+
+        bucket.tokens -= amount as f64;
+        if bucket.tokens >= 0f64 {
+            Duration::from_secs(0)
+        } else {
+            Duration::from_secs_f64(-bucket.tokens / self.rate as f64)
+        }
+    }
+}
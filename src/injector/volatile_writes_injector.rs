@@ -0,0 +1,237 @@
+use std::collections::HashMap;
+use std::fs::{self, File, OpenOptions};
+use std::os::unix::fs::FileExt;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Mutex;
+
+use anyhow::anyhow;
+use async_trait::async_trait;
+use tracing::{debug, info, trace, warn};
+
+use super::injector_config::VolatileWritesConfig;
+use super::{filter, Injector, Method};
+use crate::hookfs::{RequestContext, Result};
+
+const DEFAULT_MAX_BYTES: usize = 64 << 20;
+
+// VolatileWritesInjector loses the writes since the last fsync of a file when
+// a crash is simulated. The writes still go to the backing file, so they are
+// read as usual until the crash, and the data they overwrite is kept to be
+// written back by the crash. An fsync drops what's kept of the file, so the
+// synced data always persists.
+#[derive(Debug)]
+pub struct VolatileWritesInjector {
+    filter: filter::Filter,
+    max_bytes: usize,
+    state: Mutex<Unsynced>,
+    // whether the writes beyond `max_bytes` have been warned about
+    warned: AtomicBool,
+}
+
+#[derive(Debug, Default)]
+struct Unsynced {
+    // the files indexed by the inode
+    files: HashMap<u64, UnsyncedFile>,
+    bytes: usize,
+}
+
+#[derive(Debug)]
+struct UnsyncedFile {
+    backing_path: PathBuf,
+    // the size of the file at the last fsync
+    size: u64,
+    // the offsets and the data overwritten by the writes, in the order of
+    // the writes
+    overwritten: Vec<(u64, Vec<u8>)>,
+}
+
+impl UnsyncedFile {
+    // restore writes the overwritten data back from the last write to the
+    // first one, and truncates the file to the size at the last fsync
+    fn restore(&self) -> std::io::Result<()> {
+        let file = OpenOptions::new().write(true).open(&self.backing_path)?;
+        for (offset, data) in self.overwritten.iter().rev() {
+            file.write_all_at(data, *offset)?;
+        }
+        file.set_len(self.size)?;
+        file.sync_all()
+    }
+}
+
+// overwritten reads the data of the file which a write of `length` bytes at
+// `offset` overwrites. It's shorter than `length` if the write extends the
+// file.
+fn overwritten(path: &Path, offset: u64, length: usize) -> std::io::Result<Vec<u8>> {
+    let file = File::open(path)?;
+    let mut data = vec![0; length];
+    let mut read = 0;
+    while read < length {
+        match file.read_at(&mut data[read..], offset + read as u64)? {
+            0 => break,
+            n => read += n,
+        }
+    }
+    data.truncate(read);
+    Ok(data)
+}
+
+#[async_trait]
+impl Injector for VolatileWritesInjector {
+    // an fsync makes the writes of the file durable, even if it's not matched
+    // by the filter
+    async fn inject(&self, method: &filter::Method, _: &Path) -> Result<()> {
+        if *method != Method::FSYNC {
+            return Ok(());
+        }
+        if let Some(ino) = RequestContext::current().and_then(|ctx| ctx.ino()) {
+            let mut state = self.state.lock().unwrap();
+            if let Some(file) = state.files.remove(&ino) {
+                trace!("fsync {} writes of {}", file.overwritten.len(), ino);
+                state.bytes -= file
+                    .overwritten
+                    .iter()
+                    .map(|(_, data)| data.len())
+                    .sum::<usize>();
+            }
+        }
+        Ok(())
+    }
+
+    fn inject_write_data(&self, path: &Path, offset: i64, data: &mut Vec<u8>) -> Result<()> {
+        let method = Method::WRITE;
+        if !self.filter.filter(&method, path) {
+            return Ok(());
+        }
+        let ctx = match RequestContext::current() {
+            Some(ctx) => ctx,
+            None => return Ok(()),
+        };
+        let (ino, backing_path) = match (ctx.ino(), ctx.backing_path()) {
+            (Some(ino), Some(backing_path)) => (ino, backing_path),
+            _ => return Ok(()),
+        };
+        if self.filter.dry_run() {
+            info!(
+                "dry run: write of {} at {} would be lost on crash",
+                path.display(),
+                offset
+            );
+            return Ok(());
+        }
+
+        let mut state = self.state.lock().unwrap();
+        if state.bytes + data.len() > self.max_bytes {
+            if !self.warned.swap(true, Ordering::Relaxed) {
+                warn!(
+                    "the writes beyond {} bytes are not lost on crash",
+                    self.max_bytes
+                );
+            }
+            return Ok(());
+        }
+        // the data is read while the lock is held, so the writes are kept in
+        // the order they overwrite each other
+        let kept = overwritten(&backing_path, offset as u64, data.len()).and_then(|kept| {
+            let size = match state.files.get(&ino) {
+                Some(_) => 0,
+                None => fs::metadata(&backing_path)?.len(),
+            };
+            Ok((kept, size))
+        });
+        let (kept, size) = match kept {
+            Ok(kept) => kept,
+            Err(err) => {
+                warn!(
+                    "fail to keep the data overwritten in {}: {}",
+                    backing_path.display(),
+                    err
+                );
+                return Ok(());
+            }
+        };
+
+        if !self.filter.injected(
+            &method,
+            path,
+            "volatile_writes",
+            format_args!("keep {} bytes overwritten at {}", kept.len(), offset),
+        ) {
+            return Ok(());
+        }
+        debug!("keep {} bytes overwritten at {}", kept.len(), offset);
+        state.bytes += kept.len();
+        state
+            .files
+            .entry(ino)
+            .or_insert_with(|| UnsyncedFile {
+                backing_path,
+                size,
+                overwritten: Vec::new(),
+            })
+            .overwritten
+            .push((offset as u64, kept));
+        Ok(())
+    }
+
+    // crash writes back the data overwritten since the last fsync of every
+    // file, and truncates them to their sizes at the last fsync
+    fn crash(&self) -> anyhow::Result<()> {
+        let mut state = self.state.lock().unwrap();
+        let files = std::mem::take(&mut *state).files;
+        let mut errors = Vec::new();
+        for (ino, file) in files {
+            info!(
+                "lose {} writes of {} since the last fsync",
+                file.overwritten.len(),
+                file.backing_path.display()
+            );
+            if let Err(err) = file.restore() {
+                errors.push(format!(
+                    "{} ({}): {}",
+                    file.backing_path.display(),
+                    ino,
+                    err
+                ));
+            }
+        }
+        if !errors.is_empty() {
+            return Err(anyhow!("fail to restore {}", errors.join("; ")));
+        }
+        Ok(())
+    }
+
+    fn matched(&self) -> u64 {
+        self.filter.matched()
+    }
+
+    fn reset_matched(&self) -> u64 {
+        self.filter.reset_matched()
+    }
+
+    fn remaining(&self) -> Option<u64> {
+        self.filter.remaining()
+    }
+
+    fn forget(&self, ino: u64) {
+        self.filter.forget(ino)
+    }
+}
+
+impl VolatileWritesInjector {
+    pub fn build(conf: VolatileWritesConfig, root: &Path) -> anyhow::Result<Self> {
+        trace!("build volatile writes injector");
+
+        let max_bytes = conf.max_bytes.unwrap_or(DEFAULT_MAX_BYTES);
+        if max_bytes == 0 {
+            return Err(anyhow!("max bytes of volatile writes should be positive"));
+        }
+
+        Ok(Self {
+            filter: filter::Filter::build(conf.filter, root)?,
+            max_bytes,
+            state: Mutex::new(Unsynced::default()),
+            warned: AtomicBool::new(false),
+        })
+    }
+}
@@ -1,12 +1,97 @@
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
 use std::sync::{mpsc, Arc, Mutex};
+use std::time::SystemTime;
 
 use jsonrpc_derive::rpc;
 use jsonrpc_stdio_server::jsonrpc_core::*;
 use jsonrpc_stdio_server::ServerBuilder;
-use tracing::{info, trace};
+use serde::Serialize;
+use tracing::{error, info, trace};
 
-use crate::hookfs::HookFs;
-use crate::injector::{InjectorConfig, MultiInjector};
+use crate::hookfs::{self, BreakerStatus, Capabilities, ConcurrencyStatus, HookFs, Protocol};
+use crate::injector::{Injector, InjectorConfig, InjectorStatus, MultiInjector};
+use crate::persist::PersistedConfig;
+use crate::replacer::{self, Redirection};
+use crate::{health, metrics};
+
+// `get_status` with this `inst` returns the `Status` rather than a string.
+// The string is kept for the other `inst` to be compatible with the
+// controllers which don't know the stats.
+pub const STATUS_WITH_STATS: &str = "stats";
+
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct Status {
+    pub status: String,
+    // the generation of the config applied
+    pub generation: u64,
+    pub mounts: Vec<MountStatus>,
+    // all the injection is stopped by `pause` until `resume`
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub paused: bool,
+}
+
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct MountStatus {
+    pub path: String,
+    pub operations: u64,
+    pub injected: u64,
+    #[serde(with = "humantime_serde")]
+    pub last_injection: Option<SystemTime>,
+    pub injectors: Vec<InjectorStatus>,
+    // the changes fail with EROFS if it's set by `set_readonly`
+    pub readonly: bool,
+    // the status of the named injectors, which are also in `injectors`
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    pub named_injectors: BTreeMap<String, InjectorStatus>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub concurrency: Option<ConcurrencyStatus>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub breaker: Option<BreakerStatus>,
+    // the capabilities offered by the kernel in FUSE_INIT
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub capabilities: Option<Capabilities>,
+}
+
+// DebugInfo is what toda thinks it has hijacked, returned by `debug_info`
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct DebugInfo {
+    pub mounts: Vec<MountDebugInfo>,
+    pub processes: Vec<Redirection>,
+}
+
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct MountDebugInfo {
+    pub path: String,
+    // the directory where the files are read, which is the original one
+    // moved away from the mount point
+    pub backing_path: String,
+}
+
+// VersionInfo is the build of toda and the FUSE protocol of every mount,
+// returned by `version`
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct VersionInfo {
+    pub version: &'static str,
+    // the commit toda is built from, if it's known when building
+    pub git_sha: Option<&'static str>,
+    // the version of fuser in Cargo.lock
+    pub fuser: &'static str,
+    pub mounts: Vec<MountVersion>,
+}
+
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct MountVersion {
+    pub path: String,
+    // the protocol negotiated in FUSE_INIT, which is null before mounted
+    pub protocol: Option<Protocol>,
+}
 
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub enum Comm {
@@ -17,7 +102,9 @@ pub async fn start_server(config: RpcImpl) {
     info!("Starting jsonrpc server");
     let server = new_server(config);
     let server = server.build();
+    health::set_jsonrpc_serving(true);
     server.await;
+    health::set_jsonrpc_serving(false);
 }
 
 pub fn new_server(config: RpcImpl) -> ServerBuilder {
@@ -36,15 +123,64 @@ pub fn new_handler(config: RpcImpl) -> IoHandler {
 #[rpc]
 pub trait Rpc {
     #[rpc(name = "get_status")]
-    fn get_status(&self, inst: String) -> Result<String>;
+    fn get_status(&self, inst: String, mount: Option<String>) -> Result<Value>;
     #[rpc(name = "update")]
-    fn update(&self, config: Vec<InjectorConfig>) -> Result<String>;
+    fn update(
+        &self,
+        config: Vec<InjectorConfig>,
+        mount: Option<String>,
+        generation: Option<u64>,
+    ) -> Result<String>;
+    // update_injector replaces the injector of the same name, or adds it if
+    // there isn't, and leaves the others as they are
+    #[rpc(name = "update_injector")]
+    fn update_injector(&self, config: InjectorConfig, mount: Option<String>) -> Result<String>;
+    #[rpc(name = "remove_injector")]
+    fn remove_injector(&self, name: String, mount: Option<String>) -> Result<String>;
+    // enable_injector and disable_injector switch the named injector on and
+    // off, which stays in the config with its counters while it's disabled
+    #[rpc(name = "enable_injector")]
+    fn enable_injector(&self, name: String, mount: Option<String>) -> Result<String>;
+    #[rpc(name = "disable_injector")]
+    fn disable_injector(&self, name: String, mount: Option<String>) -> Result<String>;
+    // set_readonly makes all the changes of the mount (or all the mounts)
+    // fail with EROFS, or lets them through again
+    #[rpc(name = "set_readonly")]
+    fn set_readonly(&self, readonly: bool, mount: Option<String>) -> Result<String>;
+    #[rpc(name = "pause")]
+    fn pause(&self) -> Result<String>;
+    #[rpc(name = "resume")]
+    fn resume(&self) -> Result<String>;
+    #[rpc(name = "list_injectors")]
+    fn list_injectors(&self) -> Result<Vec<InjectorStatus>>;
+    #[rpc(name = "reset_quota")]
+    fn reset_quota(&self) -> Result<String>;
+    // simulate_crash loses the writes since the last fsync kept by the
+    // `volatileWrites` injectors of the mount (or all the mounts)
+    #[rpc(name = "simulate_crash")]
+    fn simulate_crash(&self, mount: Option<String>) -> Result<String>;
+    #[rpc(name = "reset_stats")]
+    fn reset_stats(&self, mount: Option<String>) -> Result<Value>;
+    #[rpc(name = "debug_info")]
+    fn debug_info(&self) -> Result<DebugInfo>;
+    // validate checks the config as `update` does for the `mount` (or all the
+    // mounts) without applying it, and returns the errors, which are empty if
+    // the config can be applied
+    #[rpc(name = "validate")]
+    fn validate(&self, config: Vec<Value>, mount: Option<String>) -> Result<Vec<String>>;
+    #[rpc(name = "version")]
+    fn version(&self) -> Result<VersionInfo>;
 }
 
 pub struct RpcImpl {
     status: Mutex<anyhow::Result<()>>,
     tx: Mutex<mpsc::Sender<Comm>>,
-    hookfs: Option<Arc<HookFs>>,
+    hookfs: Vec<Arc<HookFs>>,
+    // the config is written to `persist_path` on every `update` if it's set
+    persist_path: Option<PathBuf>,
+    persisted: Mutex<PersistedConfig>,
+    // `debug_info` is only served if it's set
+    debug_info: bool,
 }
 
 impl RpcImpl {
@@ -53,7 +189,180 @@ impl RpcImpl {
         tx: Mutex<mpsc::Sender<Comm>>,
         hookfs: Option<Arc<HookFs>>,
     ) -> Self {
-        Self { status, tx, hookfs }
+        Self::with_mounts(status, tx, hookfs.into_iter().collect())
+    }
+
+    pub fn with_mounts(
+        status: Mutex<anyhow::Result<()>>,
+        tx: Mutex<mpsc::Sender<Comm>>,
+        hookfs: Vec<Arc<HookFs>>,
+    ) -> Self {
+        Self {
+            status,
+            tx,
+            hookfs,
+            persist_path: None,
+            persisted: Mutex::new(PersistedConfig::default()),
+            debug_info: false,
+        }
+    }
+
+    // with_debug_info serves `debug_info`, which exposes the paths of the
+    // mounts and the files of the redirected processes
+    pub fn with_debug_info(mut self) -> Self {
+        self.debug_info = true;
+        self
+    }
+
+    // with_persistence applies the config persisted in `path` to the mounts,
+    // and persists the later updates into it. A broken file is logged and
+    // overwritten by the next `update`.
+    pub fn with_persistence(mut self, path: PathBuf) -> Self {
+        match PersistedConfig::load(&path) {
+            Ok(persisted) => {
+                self.restore(&persisted);
+                self.persisted = Mutex::new(persisted);
+            }
+            Err(err) => error!("fail to load config from {}: {}", path.display(), err),
+        }
+        self.persist_path = Some(path);
+        self
+    }
+
+    fn restore(&self, persisted: &PersistedConfig) {
+        info!("restoring config of generation {}", persisted.generation);
+        for hookfs in self.hookfs.iter() {
+            let mount = hookfs.mount_path().display().to_string();
+            let config = match persisted.mounts.get(&mount) {
+                Some(config) => config.clone(),
+                None => continue,
+            };
+            match MultiInjector::build(config, hookfs.mount_path()) {
+                Ok(injectors) => futures::executor::block_on(hookfs.update_injector(injectors)),
+                Err(err) => error!("fail to restore config of {}: {}", mount, err),
+            }
+        }
+    }
+
+    // mounts returns the hookfs of the `mount`, or all of them if the `mount`
+    // is not specified. The `mount` is the path of the mount point.
+    fn mounts(&self, mount: Option<String>) -> Result<Vec<&Arc<HookFs>>> {
+        let mount = match mount {
+            Some(mount) => mount,
+            None => return Ok(self.hookfs.iter().collect()),
+        };
+        let hookfs = self
+            .hookfs
+            .iter()
+            .find(|hookfs| hookfs.mount_path() == Path::new(&mount))
+            .ok_or_else(|| Error::invalid_params(format!("unknown mount {}", mount)))?;
+        Ok(vec![hookfs])
+    }
+}
+
+impl RpcImpl {
+    // apply replaces the injectors of the `mount` (or all the mounts) with the
+    // ones built by `build` from the current ones, and persists their config.
+    // The generation is bumped if it's not specified.
+    fn apply<F>(&self, mount: Option<String>, generation: Option<u64>, build: F) -> Result<String>
+    where
+        F: Fn(&MultiInjector, &Path) -> anyhow::Result<MultiInjector>,
+    {
+        let mounts = self.mounts(mount)?;
+        if mounts.is_empty() {
+            return Err(Error::internal_error());
+        }
+        // the lock is held until the injectors are replaced, so that the
+        // concurrent changes are not built from the same injectors
+        let mut persisted = self.persisted.lock().unwrap();
+
+        // build all the injectors before replacing any of them, so that a bad
+        // config doesn't leave the mounts partially updated
+        let injectors = mounts
+            .iter()
+            .map(|hookfs| {
+                let current = futures::executor::block_on(hookfs.current_injector());
+                build(&current, hookfs.mount_path())
+            })
+            .collect::<anyhow::Result<Vec<_>>>()
+            .map_err(|e| Error::invalid_params(e.to_string()))?;
+
+        // the config is persisted before it's applied, so that a failure
+        // leaves both of them unchanged
+        let mut updated = persisted.clone();
+        updated.generation = generation.unwrap_or(persisted.generation + 1);
+        for (hookfs, injectors) in mounts.iter().zip(injectors.iter()) {
+            updated.mounts.insert(
+                hookfs.mount_path().display().to_string(),
+                injectors.config().to_vec(),
+            );
+        }
+        if let Some(path) = &self.persist_path {
+            updated.save(path).map_err(|e| Error {
+                code: ErrorCode::InternalError,
+                message: format!("fail to persist config: {}", e),
+                data: None,
+            })?;
+        }
+        *persisted = updated;
+
+        // only the injectors are replaced, and the mount and the ptrace
+        // redirection are left as they are
+        for (hookfs, injectors) in mounts.into_iter().zip(injectors) {
+            futures::executor::block_on(hookfs.update_injector(injectors));
+        }
+        Ok("ok".to_string())
+    }
+
+    // stats returns the `Status` of the `mount`. With `reset`, the counters
+    // are cleared, and the status before is returned.
+    fn stats(&self, status: String, mount: Option<String>, reset: bool) -> Result<Value> {
+        let mounts = self
+            .mounts(mount)?
+            .into_iter()
+            .map(|hookfs| {
+                let injector = futures::executor::block_on(hookfs.current_injector());
+                let (stats, injectors) = if reset {
+                    (
+                        metrics::reset_stats(hookfs.mount_path()),
+                        injector.reset_status(),
+                    )
+                } else {
+                    (metrics::stats(hookfs.mount_path()), injector.status())
+                };
+                let named_injectors = injectors
+                    .iter()
+                    .filter_map(|status| {
+                        let name = status.config.name()?;
+                        Some((name.to_owned(), status.clone()))
+                    })
+                    .collect();
+                MountStatus {
+                    path: hookfs.mount_path().display().to_string(),
+                    operations: stats.operations,
+                    injected: stats.injected,
+                    last_injection: stats.last_injection,
+                    injectors,
+                    readonly: hookfs.readonly(),
+                    named_injectors,
+                    concurrency: hookfs.concurrency(),
+                    breaker: hookfs.breaker(),
+                    capabilities: hookfs.capabilities(),
+                }
+            })
+            .collect();
+        let generation = self.persisted.lock().unwrap().generation;
+        serde_json::to_value(Status {
+            status,
+            generation,
+            mounts,
+            paused: hookfs::paused(),
+        })
+        .map_err(|e| Error {
+            code: ErrorCode::InternalError,
+            message: e.to_string(),
+            data: None,
+        })
     }
 }
 
@@ -64,32 +373,230 @@ impl Drop for RpcImpl {
 }
 
 impl Rpc for RpcImpl {
-    fn get_status(&self, _inst: String) -> Result<String> {
+    fn get_status(&self, inst: String, mount: Option<String>) -> Result<Value> {
         info!("rpc get_status called");
-        match &*self.status.lock().unwrap() {
-            Ok(_) => Ok("ok".to_string()),
+        let status = match &*self.status.lock().unwrap() {
+            Ok(_) => "ok".to_string(),
             Err(e) => {
                 let tx = &self.tx.lock().unwrap();
                 tx.send(Comm::Shutdown)
                     .expect("Send through channel failed");
-                Ok(e.to_string())
+                e.to_string()
             }
+        };
+        if inst != STATUS_WITH_STATS {
+            return Ok(Value::String(status));
         }
+
+        self.stats(status, mount, false)
     }
-    fn update(&self, config: Vec<InjectorConfig>) -> Result<String> {
+    fn update(
+        &self,
+        config: Vec<InjectorConfig>,
+        mount: Option<String>,
+        generation: Option<u64>,
+    ) -> Result<String> {
         info!("rpc update called");
         if let Err(e) = &*self.status.lock().unwrap() {
             return Ok(e.to_string());
         }
-        let injectors = MultiInjector::build(config);
-        if let Err(e) = &injectors {
+        self.apply(mount, generation, |_, root| {
+            MultiInjector::build(config.clone(), root)
+        })
+    }
+    fn update_injector(&self, config: InjectorConfig, mount: Option<String>) -> Result<String> {
+        info!("rpc update_injector called");
+        if let Err(e) = &*self.status.lock().unwrap() {
             return Ok(e.to_string());
         }
-        futures::executor::block_on((async || {
-            let hookfs = self.hookfs.as_ref().unwrap();
-            let mut current_injectors = hookfs.injector.write().await;
-            *current_injectors = injectors.unwrap();
-        })());
+        self.apply(mount, None, |injector, root| {
+            injector.update(config.clone(), root)
+        })
+    }
+    fn remove_injector(&self, name: String, mount: Option<String>) -> Result<String> {
+        info!("rpc remove_injector called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        self.apply(mount, None, |injector, _| injector.remove(&name))
+    }
+    fn enable_injector(&self, name: String, mount: Option<String>) -> Result<String> {
+        info!("rpc enable_injector called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        self.apply(mount, None, |injector, _| injector.set_enabled(&name, true))
+    }
+    fn disable_injector(&self, name: String, mount: Option<String>) -> Result<String> {
+        info!("rpc disable_injector called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        self.apply(mount, None, |injector, _| {
+            injector.set_enabled(&name, false)
+        })
+    }
+    fn set_readonly(&self, readonly: bool, mount: Option<String>) -> Result<String> {
+        info!("rpc set_readonly called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        let mounts = self.mounts(mount)?;
+        if mounts.is_empty() {
+            return Err(Error::internal_error());
+        }
+        for hookfs in mounts {
+            hookfs.set_readonly(readonly);
+        }
         Ok("ok".to_string())
     }
+    // pause stops all the injection at once without ptrace or unloading the
+    // injectors, and `resume` starts it again
+    fn pause(&self) -> Result<String> {
+        info!("rpc pause called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        hookfs::set_paused(true);
+        Ok("ok".to_string())
+    }
+    fn resume(&self) -> Result<String> {
+        info!("rpc resume called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        hookfs::set_paused(false);
+        Ok("ok".to_string())
+    }
+    fn list_injectors(&self) -> Result<Vec<InjectorStatus>> {
+        info!("rpc list_injectors called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Err(Error {
+                code: ErrorCode::InternalError,
+                message: e.to_string(),
+                data: None,
+            });
+        }
+        if self.hookfs.is_empty() {
+            return Err(Error::internal_error());
+        }
+        let status = self
+            .hookfs
+            .iter()
+            .flat_map(|hookfs| futures::executor::block_on(hookfs.current_injector()).status())
+            .collect();
+        Ok(status)
+    }
+    fn reset_quota(&self) -> Result<String> {
+        info!("rpc reset_quota called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        if self.hookfs.is_empty() {
+            return Err(Error::internal_error());
+        }
+        for hookfs in self.hookfs.iter() {
+            futures::executor::block_on(hookfs.current_injector()).reset_quota();
+        }
+        Ok("ok".to_string())
+    }
+    fn simulate_crash(&self, mount: Option<String>) -> Result<String> {
+        info!("rpc simulate_crash called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Ok(e.to_string());
+        }
+        let mounts = self.mounts(mount)?;
+        if mounts.is_empty() {
+            return Err(Error::internal_error());
+        }
+        for hookfs in mounts {
+            futures::executor::block_on(hookfs.current_injector())
+                .crash()
+                .map_err(|e| Error {
+                    code: ErrorCode::InternalError,
+                    message: format!("fail to simulate crash: {}", e),
+                    data: None,
+                })?;
+        }
+        Ok("ok".to_string())
+    }
+    // reset_stats clears the counters of the mounts and their injectors, and
+    // returns them before like `get_status`. The injectors are left as they are.
+    fn reset_stats(&self, mount: Option<String>) -> Result<Value> {
+        info!("rpc reset_stats called");
+        if let Err(e) = &*self.status.lock().unwrap() {
+            return Err(Error {
+                code: ErrorCode::InternalError,
+                message: e.to_string(),
+                data: None,
+            });
+        }
+        self.stats("ok".to_string(), mount, true)
+    }
+    fn debug_info(&self) -> Result<DebugInfo> {
+        info!("rpc debug_info called");
+        if !self.debug_info {
+            return Err(Error {
+                code: ErrorCode::InvalidRequest,
+                message: "debug_info is disabled, start toda with --debug-info".to_string(),
+                data: None,
+            });
+        }
+        let mounts = self
+            .hookfs
+            .iter()
+            .map(|hookfs| MountDebugInfo {
+                path: hookfs.mount_path().display().to_string(),
+                backing_path: hookfs.original_path().display().to_string(),
+            })
+            .collect();
+        Ok(DebugInfo {
+            mounts,
+            processes: replacer::redirections(),
+        })
+    }
+    fn validate(&self, config: Vec<Value>, mount: Option<String>) -> Result<Vec<String>> {
+        info!("rpc validate called");
+        // the config is parsed here rather than by the params, so that a
+        // malformed injector is reported with the others
+        let mut errors = Vec::new();
+        let mut parsed = Vec::new();
+        for (index, value) in config.into_iter().enumerate() {
+            match serde_json::from_value::<InjectorConfig>(value) {
+                Ok(conf) => parsed.push(conf),
+                Err(err) => errors.push(format!("injector {}: {}", index, err)),
+            }
+        }
+        if !errors.is_empty() {
+            return Ok(errors);
+        }
+
+        for hookfs in self.mounts(mount)? {
+            for error in MultiInjector::validate(parsed.clone(), hookfs.mount_path()) {
+                if !errors.contains(&error) {
+                    errors.push(error);
+                }
+            }
+        }
+        Ok(errors)
+    }
+    fn version(&self) -> Result<VersionInfo> {
+        info!("rpc version called");
+        let mounts = self
+            .hookfs
+            .iter()
+            .map(|hookfs| MountVersion {
+                path: hookfs.mount_path().display().to_string(),
+                protocol: hookfs
+                    .capabilities()
+                    .map(|capabilities| capabilities.protocol()),
+            })
+            .collect();
+        Ok(VersionInfo {
+            version: env!("CARGO_PKG_VERSION"),
+            git_sha: option_env!("TODA_GIT_SHA"),
+            fuser: env!("TODA_FUSER_VERSION"),
+            mounts,
+        })
+    }
 }
@@ -19,13 +19,19 @@
 #![allow(clippy::or_fun_call)]
 #![allow(clippy::too_many_arguments)]
 
+pub mod audit;
 pub mod fuse_device;
+pub mod health;
 pub mod hookfs;
+pub mod http;
 pub mod injector;
 pub mod jsonrpc;
+pub mod metrics;
 pub mod mount;
 pub mod mount_injector;
+pub mod persist;
 pub mod ptrace;
 pub mod replacer;
 pub mod stop;
 pub mod utils;
+pub mod webhook;
@@ -21,61 +21,191 @@
 
 extern crate derive_more;
 
+mod audit;
 mod fuse_device;
+mod health;
 mod hookfs;
+mod http;
 mod injector;
 mod jsonrpc;
+mod metrics;
 mod mount;
 mod mount_injector;
+mod persist;
 mod ptrace;
 mod replacer;
 mod stop;
 mod utils;
+mod webhook;
 
 use std::convert::TryFrom;
 use std::os::unix::io::RawFd;
 use std::path::PathBuf;
 use std::sync::{mpsc, Mutex};
+use std::time::Duration;
 use std::{io, thread};
 
 use anyhow::Result;
 use injector::InjectorConfig;
 use jsonrpc::{start_server, Comm};
-use mount_injector::{MountInjectionGuard, MountInjector};
+use mount_injector::{BreakerConfig, MultiMountInjectionGuard, MultiMountInjector};
 use nix::sys::signal::{signal, SigHandler, Signal};
 use nix::unistd::{pipe, read, write};
 use replacer::{Replacer, UnionReplacer};
 use structopt::StructOpt;
 use tokio::runtime::Runtime;
-use tracing::{info, instrument};
+use tracing::{info, info_span, instrument};
 use tracing_subscriber::EnvFilter;
 use utils::encode_path;
 
 #[derive(StructOpt, Debug, Clone)]
 #[structopt(name = "basic")]
 struct Options {
-    #[structopt(long)]
-    path: PathBuf,
+    // the mount points to inject, `--path` can be repeated
+    #[structopt(long, required = true, number_of_values = 1)]
+    path: Vec<PathBuf>,
 
     #[structopt(long = "mount-only")]
     mount_only: bool,
 
+    // mount without `default_permissions`, so that `access` reaches the
+    // injectors. The permissions are then only checked by `access`.
+    #[structopt(long = "no-default-permissions")]
+    no_default_permissions: bool,
+
+    // cap the requests handled at the same time on every mount, and queue the
+    // others, like a device with a limited queue depth
+    #[structopt(long = "max-concurrency")]
+    max_concurrency: Option<usize>,
+
+    // cap the size of the reads and the writes sent by the kernel, so that
+    // the IO of the apps is split into the smaller requests
+    #[structopt(long = "max-io-size")]
+    max_io_size: Option<u32>,
+
+    // redirect the changes to the directory, so that the mounted directories
+    // can be read-only. It should be empty or not exist.
+    #[structopt(long = "overlay")]
+    overlay: Option<PathBuf>,
+
+    // write a copy of the data to the directory before it's corrupted, so
+    // that the files can be compared with the mounted ones afterwards. Every
+    // write is doubled, and the reads are still served from the mounts.
+    #[structopt(long = "shadow")]
+    shadow: Option<PathBuf>,
+
+    // disable the injection after the consecutive errors from the backing
+    // filesystem, until there is no error in `breaker-cooldown`
+    #[structopt(long = "breaker-threshold")]
+    breaker_threshold: Option<u64>,
+
+    #[structopt(
+        long = "breaker-cooldown",
+        default_value = "30s",
+        parse(try_from_str = humantime::parse_duration)
+    )]
+    breaker_cooldown: Duration,
+
+    // request the writeback cache of the kernel, unless the config injects the
+    // writes, which would be buffered by the kernel rather than sent to toda
+    #[structopt(long = "writeback-cache")]
+    writeback_cache: bool,
+
+    // the fraction of the requests which are logged at INFO with the method,
+    // the path, the injection, the latency and the result
+    #[structopt(long = "trace-sample-rate")]
+    trace_sample_rate: Option<f64>,
+
+    // the cap of the delays of the latency, delayFault and timeout injectors,
+    // which clamps a misconfigured latency rather than hang the workload
+    #[structopt(long = "max-latency", parse(try_from_str = humantime::parse_duration))]
+    max_latency: Option<Duration>,
+
+    // the delay after a process is detached before the next one is traced,
+    // and the retries of attaching a task which fails with ESRCH or EPERM
+    // while it's still there. The delays are jittered by a half.
+    #[structopt(
+        long = "ptrace-settle-delay",
+        default_value = "10ms",
+        parse(try_from_str = humantime::parse_duration)
+    )]
+    ptrace_settle_delay: Duration,
+
+    #[structopt(long = "ptrace-attach-retries", default_value = "3")]
+    ptrace_attach_retries: u32,
+
+    #[structopt(
+        long = "ptrace-attach-retry-delay",
+        default_value = "10ms",
+        parse(try_from_str = humantime::parse_duration)
+    )]
+    ptrace_attach_retry_delay: Duration,
+
     #[structopt(short = "v", long = "verbose", default_value = "trace")]
     verbose: String,
+
+    // `text` is the human-readable format, and `json` prints one object per
+    // event with the fields of the spans
+    #[structopt(
+        long = "log-format",
+        default_value = "text",
+        possible_values = &["text", "json"]
+    )]
+    log_format: String,
+
+    #[structopt(long = "metrics-addr")]
+    metrics_addr: Option<String>,
+
+    // the address of the `/healthz` endpoint
+    #[structopt(long = "health-addr")]
+    health_addr: Option<String>,
+
+    // the `http://` url which the events of the named injectors are posted
+    // to, when they are triggered and exhausted
+    #[structopt(long = "webhook-url")]
+    webhook_url: Option<String>,
+
+    // every injection is appended to the file as a line of JSON. It's renamed
+    // to `<path>.1` once it grows beyond `audit-log-max-size` bytes.
+    #[structopt(long = "audit-log")]
+    audit_log: Option<PathBuf>,
+
+    #[structopt(long = "audit-log-max-size", default_value = "67108864")]
+    audit_log_max_size: u64,
+
+    // how long to wait for the in-flight requests before exiting
+    #[structopt(
+        long = "drain-timeout",
+        default_value = "5s",
+        parse(try_from_str = humantime::parse_duration)
+    )]
+    drain_timeout: Duration,
+
+    // the injector config is written to the file on every `update`, and
+    // applied again when toda starts. It's disabled if not set, and compressed
+    // if the file ends with `.zst` or `.gz`.
+    #[structopt(long = "persist-config")]
+    persist_config: Option<PathBuf>,
+
+    // serve `debug_info` over JSON-RPC, which returns the backing paths and
+    // the fds redirected by the replacers for debugging
+    #[structopt(long = "debug-info")]
+    debug_info: bool,
 }
 
 #[instrument(skip(option))]
-fn inject(option: Options, injector_config: Vec<InjectorConfig>) -> Result<MountInjectionGuard> {
+fn inject(
+    option: Options,
+    injector_config: Vec<InjectorConfig>,
+) -> Result<MultiMountInjectionGuard> {
     info!("inject with config {:?}", injector_config);
 
-    let path = option.path.clone();
-
-    info!("canonicalizing path {}", path.display());
-    let path = path.canonicalize()?;
+    let paths = canonicalize_paths(&option.path)?;
 
     let replacer = if !option.mount_only {
+        let mounts: Vec<_> = paths.iter().map(|path| (path, path)).collect();
         let mut replacer = UnionReplacer::new();
-        replacer.prepare(&path, &path)?;
+        replacer.prepare(&mounts)?;
 
         Some(replacer)
     } else {
@@ -86,7 +216,20 @@ fn inject(option: Options, injector_config: Vec<InjectorConfig>) -> Result<Mount
         info!("fail to make /dev/fuse node: {}", err)
     }
 
-    let mut injection = MountInjector::create_injection(&option.path, injector_config)?;
+    let mut injection = MultiMountInjector::create_injection(
+        &option.path,
+        injector_config,
+        !option.no_default_permissions,
+        option.max_concurrency,
+        option.max_io_size,
+        option.overlay.as_deref(),
+        option.shadow.as_deref(),
+        option.breaker_threshold.map(|threshold| BreakerConfig {
+            threshold,
+            cooldown: option.breaker_cooldown,
+        }),
+        option.writeback_cache,
+    )?;
     let mount_guard = injection.mount()?;
     info!("mount successfully");
 
@@ -105,19 +248,18 @@ fn inject(option: Options, injector_config: Vec<InjectorConfig>) -> Result<Mount
 }
 
 #[instrument(skip(option, mount_guard))]
-fn resume(option: Options, mount_guard: MountInjectionGuard) -> Result<()> {
+fn resume(option: Options, mount_guard: MultiMountInjectionGuard) -> Result<()> {
     info!("disable injection");
     mount_guard.disable_injection();
 
-    let path = option.path.clone();
-
-    info!("canonicalizing path {}", path.display());
-    let path = path.canonicalize()?;
-    let (_, new_path) = encode_path(&path)?;
+    let mounts = canonicalize_paths(&option.path)?
+        .iter()
+        .map(encode_path)
+        .collect::<Result<Vec<_>>>()?;
 
     let replacer = if !option.mount_only {
         let mut replacer = UnionReplacer::new();
-        replacer.prepare(&path, &new_path)?;
+        replacer.prepare(&mounts)?;
         info!("running replacer");
         let result = replacer.run();
         info!("replace result: {:?}", result);
@@ -137,6 +279,16 @@ fn resume(option: Options, mount_guard: MountInjectionGuard) -> Result<()> {
     Ok(())
 }
 
+fn canonicalize_paths(paths: &[PathBuf]) -> Result<Vec<PathBuf>> {
+    paths
+        .iter()
+        .map(|path| {
+            info!("canonicalizing path {}", path.display());
+            Ok(path.canonicalize()?)
+        })
+        .collect()
+}
+
 static mut SIGNAL_PIPE_WRITER: RawFd = 0;
 
 const SIGNAL_MSG: [u8; 6] = *b"SIGNAL";
@@ -167,12 +319,53 @@ fn main() -> Result<()> {
         .or_else(|_| EnvFilter::try_from(&option.verbose))
         .or_else(|_| EnvFilter::try_new("trace"))
         .unwrap();
-    tracing_subscriber::fmt()
+    let subscriber = tracing_subscriber::fmt()
         .with_writer(io::stderr)
-        .with_env_filter(env_filter)
-        .init();
+        .with_env_filter(env_filter);
+    if option.log_format == "json" {
+        subscriber
+            .json()
+            .with_current_span(true)
+            .with_span_list(true)
+            .init();
+    } else {
+        subscriber.init();
+    }
+    // the events of the main thread carry the pid of toda
+    let span = info_span!("toda", pid = std::process::id());
+    let _enter = span.enter();
     info!("start with option: {:?}", option);
+    if let Some(rate) = option.trace_sample_rate {
+        if !(rate > 0.0 && rate <= 1.0) {
+            return Err(anyhow::anyhow!(
+                "trace sample rate {} is not in (0, 1]",
+                rate
+            ));
+        }
+        hookfs::set_trace_sample_rate(rate);
+    }
+    injector::set_max_latency(option.max_latency);
+    ptrace::set_timing(
+        option.ptrace_settle_delay,
+        option.ptrace_attach_retries,
+        option.ptrace_attach_retry_delay,
+    );
+    if let Some(addr) = &option.metrics_addr {
+        metrics::start_server(addr)?;
+    }
+    if let Some(addr) = &option.health_addr {
+        health::start_server(addr)?;
+    }
+    if let Some(url) = &option.webhook_url {
+        webhook::start(url)?;
+    }
+    if let Some(path) = &option.audit_log {
+        audit::start(path, option.audit_log_max_size)?;
+    }
     let mount_injector = inject(option.clone(), vec![]);
+    if mount_injector.is_ok() {
+        health::set_mounts(option.path.len());
+    }
 
     let status = match &mount_injector {
         Ok(_) => Ok(()),
@@ -182,24 +375,42 @@ fn main() -> Result<()> {
     let (tx, rx) = mpsc::channel();
     {
         let hookfs = match &mount_injector {
-            Ok(e) => Some(e.hookfs.clone().into()),
-            Err(_) => None,
+            Ok(e) => e.hookfs(),
+            Err(_) => Vec::new(),
         };
+        let mut rpc = jsonrpc::RpcImpl::with_mounts(Mutex::new(status), Mutex::new(tx), hookfs);
+        // the persisted config is applied before serving
+        if let Some(path) = &option.persist_config {
+            rpc = rpc.with_persistence(path.clone());
+        }
+        if option.debug_info {
+            rpc = rpc.with_debug_info();
+        }
         thread::spawn(|| {
             Runtime::new()
                 .expect("Failed to create Tokio runtime")
-                .block_on(start_server(jsonrpc::RpcImpl::new(
-                    Mutex::new(status),
-                    Mutex::new(tx),
-                    hookfs,
-                )));
+                .block_on(start_server(rpc));
         });
     }
     info!("waiting for signal to exit");
     wait_for_signal(reader)?;
     info!("start to recover and exit");
     if let Ok(v) = mount_injector {
+        health::set_mounts(0);
+        // stop injecting and let the in-flight requests finish before the
+        // ptrace detaching and unmounting
+        v.disable_injection();
+        // the pending delays are woken up, so that a long one doesn't hold
+        // its request beyond the drain timeout
+        injector::cancel_delays();
+        let (drained, abandoned) = hookfs::drain(option.drain_timeout);
+        info!(
+            "{} requests drained, {} requests abandoned",
+            drained, abandoned
+        );
+
         resume(option, v)?;
     }
+    audit::flush();
     Ok(())
 }
@@ -0,0 +1,292 @@
+use std::collections::HashMap;
+use std::fmt::Write;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::RwLock;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::Result;
+use once_cell::sync::Lazy;
+use tracing::info;
+
+use crate::hookfs::RequestContext;
+use crate::http::{self, Response};
+use crate::injector::Method;
+
+// Metrics are only recorded after the metrics server is started, so that
+// toda behaves exactly the same without `--metrics-addr`.
+static ENABLED: AtomicBool = AtomicBool::new(false);
+
+static METRICS: Lazy<Metrics> = Lazy::new(Metrics::new);
+
+// Stats are always recorded, as they are reported by `get_status`. They are
+// kept for every mount of the process.
+static STATS: Lazy<RwLock<HashMap<PathBuf, Stats>>> = Lazy::new(|| RwLock::new(HashMap::new()));
+
+#[derive(Default)]
+struct Stats {
+    operations: AtomicU64,
+    injected: AtomicU64,
+    // nanoseconds since UNIX epoch, 0 means there has been no injection
+    last_injection: AtomicU64,
+}
+
+#[derive(Debug, Clone, Default)]
+pub struct StatsSnapshot {
+    pub operations: u64,
+    pub injected: u64,
+    pub last_injection: Option<SystemTime>,
+}
+
+const LATENCY_BUCKETS: [f64; 10] = [0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1.0, 5.0, 10.0, 60.0];
+
+struct CounterVec {
+    name: &'static str,
+    help: &'static str,
+    labels: [&'static str; 2],
+    values: RwLock<HashMap<(String, String), AtomicU64>>,
+}
+
+impl CounterVec {
+    fn new(name: &'static str, help: &'static str, labels: [&'static str; 2]) -> Self {
+        Self {
+            name,
+            help,
+            labels,
+            values: RwLock::new(HashMap::new()),
+        }
+    }
+
+    fn inc(&self, labels: (String, String)) {
+        if let Some(value) = self.values.read().unwrap().get(&labels) {
+            value.fetch_add(1, Ordering::Relaxed);
+            return;
+        }
+
+        self.values
+            .write()
+            .unwrap()
+            .entry(labels)
+            .or_insert_with(|| AtomicU64::new(0))
+            .fetch_add(1, Ordering::Relaxed);
+    }
+
+    fn render(&self, output: &mut String) {
+        writeln!(output, "# HELP {} {}", self.name, self.help).unwrap();
+        writeln!(output, "# TYPE {} counter", self.name).unwrap();
+        for ((first, second), value) in self.values.read().unwrap().iter() {
+            writeln!(
+                output,
+                "{}{{{}=\"{}\",{}=\"{}\"}} {}",
+                self.name,
+                self.labels[0],
+                first,
+                self.labels[1],
+                second,
+                value.load(Ordering::Relaxed)
+            )
+            .unwrap();
+        }
+    }
+}
+
+struct Histogram {
+    name: &'static str,
+    help: &'static str,
+    buckets: Vec<AtomicU64>,
+    count: AtomicU64,
+    sum_nanos: AtomicU64,
+}
+
+impl Histogram {
+    fn new(name: &'static str, help: &'static str) -> Self {
+        Self {
+            name,
+            help,
+            buckets: LATENCY_BUCKETS.iter().map(|_| AtomicU64::new(0)).collect(),
+            count: AtomicU64::new(0),
+            sum_nanos: AtomicU64::new(0),
+        }
+    }
+
+    fn observe(&self, duration: Duration) {
+        let seconds = duration.as_secs_f64();
+        for (bound, bucket) in LATENCY_BUCKETS.iter().zip(self.buckets.iter()) {
+            if seconds <= *bound {
+                bucket.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        self.count.fetch_add(1, Ordering::Relaxed);
+        self.sum_nanos
+            .fetch_add(duration.as_nanos() as u64, Ordering::Relaxed);
+    }
+
+    fn render(&self, output: &mut String) {
+        writeln!(output, "# HELP {} {}", self.name, self.help).unwrap();
+        writeln!(output, "# TYPE {} histogram", self.name).unwrap();
+        for (bound, bucket) in LATENCY_BUCKETS.iter().zip(self.buckets.iter()) {
+            writeln!(
+                output,
+                "{}_bucket{{le=\"{}\"}} {}",
+                self.name,
+                bound,
+                bucket.load(Ordering::Relaxed)
+            )
+            .unwrap();
+        }
+        let count = self.count.load(Ordering::Relaxed);
+        writeln!(output, "{}_bucket{{le=\"+Inf\"}} {}", self.name, count).unwrap();
+        writeln!(
+            output,
+            "{}_sum {}",
+            self.name,
+            self.sum_nanos.load(Ordering::Relaxed) as f64 / 1e9
+        )
+        .unwrap();
+        writeln!(output, "{}_count {}", self.name, count).unwrap();
+    }
+}
+
+struct Metrics {
+    operations: CounterVec,
+    injected: CounterVec,
+    injected_latency: Histogram,
+}
+
+impl Metrics {
+    fn new() -> Self {
+        Self {
+            operations: CounterVec::new(
+                "toda_operations_total",
+                "Total number of FUSE operations",
+                ["method", "mount"],
+            ),
+            injected: CounterVec::new(
+                "toda_injected_total",
+                "Total number of injected operations",
+                ["method", "injector_type"],
+            ),
+            injected_latency: Histogram::new(
+                "toda_injected_latency_seconds",
+                "Latency injected into operations",
+            ),
+        }
+    }
+
+    fn render(&self) -> String {
+        let mut output = String::new();
+        self.operations.render(&mut output);
+        self.injected.render(&mut output);
+        self.injected_latency.render(&mut output);
+        output
+    }
+}
+
+fn enabled() -> bool {
+    ENABLED.load(Ordering::Relaxed)
+}
+
+fn with_mount_stats<F: FnOnce(&Stats)>(mount: &Path, f: F) {
+    if let Some(stats) = STATS.read().unwrap().get(mount) {
+        f(stats);
+        return;
+    }
+
+    f(STATS
+        .write()
+        .unwrap()
+        .entry(mount.to_owned())
+        .or_insert_with(Stats::default));
+}
+
+pub fn operation(method: &Method, mount: &Path) {
+    with_mount_stats(mount, |stats| {
+        stats.operations.fetch_add(1, Ordering::Relaxed);
+    });
+    if enabled() {
+        METRICS
+            .operations
+            .inc((method.name(), mount.display().to_string()));
+    }
+}
+
+// injected records an injection on the `path`, which is counted into the
+// mount containing it
+pub fn injected(method: &Method, path: &Path, injector_type: &str) {
+    if let Some(id) = RequestContext::sampled_id() {
+        info!(id, method = %method.name(), injector = injector_type, "sampled request is injected");
+    }
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_nanos() as u64;
+    if let Some((_, stats)) = STATS
+        .read()
+        .unwrap()
+        .iter()
+        .filter(|(mount, _)| path.starts_with(mount))
+        .max_by_key(|(mount, _)| mount.as_os_str().len())
+    {
+        stats.injected.fetch_add(1, Ordering::Relaxed);
+        stats.last_injection.store(now, Ordering::Relaxed);
+    }
+    if enabled() {
+        METRICS
+            .injected
+            .inc((method.name(), injector_type.to_string()));
+    }
+}
+
+pub fn injected_latency(latency: Duration) {
+    if let Some(id) = RequestContext::sampled_id() {
+        info!(id, ?latency, "sampled request is delayed");
+    }
+    if enabled() {
+        METRICS.injected_latency.observe(latency);
+    }
+}
+
+fn last_injection(nanos: u64) -> Option<SystemTime> {
+    match nanos {
+        0 => None,
+        nanos => Some(UNIX_EPOCH + Duration::from_nanos(nanos)),
+    }
+}
+
+pub fn stats(mount: &Path) -> StatsSnapshot {
+    let all_stats = STATS.read().unwrap();
+    let stats = match all_stats.get(mount) {
+        Some(stats) => stats,
+        None => return StatsSnapshot::default(),
+    };
+    StatsSnapshot {
+        operations: stats.operations.load(Ordering::Relaxed),
+        injected: stats.injected.load(Ordering::Relaxed),
+        last_injection: last_injection(stats.last_injection.load(Ordering::Relaxed)),
+    }
+}
+
+// reset_stats clears the stats of the mount, and returns them before. The
+// stats are locked meanwhile, so that no operation is counted in between.
+pub fn reset_stats(mount: &Path) -> StatsSnapshot {
+    let all_stats = STATS.write().unwrap();
+    let stats = match all_stats.get(mount) {
+        Some(stats) => stats,
+        None => return StatsSnapshot::default(),
+    };
+    StatsSnapshot {
+        operations: stats.operations.swap(0, Ordering::Relaxed),
+        injected: stats.injected.swap(0, Ordering::Relaxed),
+        last_injection: last_injection(stats.last_injection.swap(0, Ordering::Relaxed)),
+    }
+}
+
+pub fn start_server(addr: &str) -> Result<()> {
+    http::serve(addr, |path| match path {
+        "/metrics" => Response::new(200, "text/plain; version=0.0.4", METRICS.render()),
+        _ => Response::not_found(),
+    })?;
+    ENABLED.store(true, Ordering::SeqCst);
+
+    Ok(())
+}
@@ -1,22 +1,59 @@
 use std::ffi::OsStr;
 use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicUsize, Ordering};
 use std::sync::Arc;
 use std::thread::JoinHandle;
+use std::time::Duration;
 
 use anyhow::{anyhow, Result};
 use nix::mount::umount;
 use retry::delay::Fixed;
 use retry::{retry, OperationResult};
-use tracing::info;
+use tracing::{error, info};
 
 use crate::injector::{InjectorConfig, MultiInjector};
 use crate::{hookfs, mount, stop};
 
+// The runtime of hookfs is shared by all the mounts of the process, so it's
+// dropped only after the last mount exits.
+static RUNNING_MOUNTS: AtomicUsize = AtomicUsize::new(0);
+
+// running_mounts returns how many FUSE sessions of the process are running
+pub fn running_mounts() -> usize {
+    RUNNING_MOUNTS.load(Ordering::SeqCst)
+}
+
+// the kernel doesn't split the requests into less than a page
+const MIN_IO_SIZE: u32 = 4096;
+
+// BreakerConfig disables the injection after `threshold` consecutive errors
+// from the backing filesystem, until there is no error in `cooldown`
+#[derive(Debug, Clone, Copy)]
+pub struct BreakerConfig {
+    pub threshold: u64,
+    pub cooldown: Duration,
+}
+
 #[derive(Debug)]
 pub struct MountInjector {
     original_path: PathBuf,
     new_path: PathBuf,
     injector_config: Vec<InjectorConfig>,
+    // the kernel checks the permissions itself with `default_permissions`,
+    // and never sends `access` to the hookfs
+    default_permissions: bool,
+    // the requests beyond `max_concurrency` wait in the queue
+    max_concurrency: Option<usize>,
+    // the kernel splits the reads and the writes beyond `max_io_size`
+    max_io_size: Option<u32>,
+    // the changes are redirected to `overlay`, and the mounted directory is
+    // never changed
+    overlay: Option<PathBuf>,
+    // a copy of the data is written to `shadow` before it's corrupted
+    shadow: Option<PathBuf>,
+    breaker: Option<BreakerConfig>,
+    // the writeback cache is requested unless the writes are injected
+    writeback_cache: bool,
 }
 
 pub struct MountInjectionGuard {
@@ -74,6 +111,13 @@ impl MountInjector {
     pub fn create_injection<P: AsRef<Path>>(
         path: P,
         injector_config: Vec<InjectorConfig>,
+        default_permissions: bool,
+        max_concurrency: Option<usize>,
+        max_io_size: Option<u32>,
+        overlay: Option<PathBuf>,
+        shadow: Option<PathBuf>,
+        breaker: Option<BreakerConfig>,
+        writeback_cache: bool,
     ) -> Result<MountInjector> {
         let original_path: PathBuf = path.as_ref().to_owned();
 
@@ -95,6 +139,13 @@ impl MountInjector {
             original_path,
             new_path,
             injector_config,
+            default_permissions,
+            max_concurrency,
+            max_io_size,
+            overlay,
+            shadow,
+            breaker,
+            writeback_cache,
         })
     }
 
@@ -103,6 +154,17 @@ impl MountInjector {
         let original_path = self.original_path.clone();
         let new_path = self.new_path.clone();
 
+        if let Some(overlay) = &self.overlay {
+            // the overlay only knows the files copied up by itself
+            std::fs::create_dir_all(overlay)?;
+            if std::fs::read_dir(overlay)?.next().is_some() {
+                return Err(anyhow!("overlay {} is not empty", overlay.display()));
+            }
+        }
+        if let Some(shadow) = &self.shadow {
+            std::fs::create_dir_all(shadow)?;
+        }
+
         let mounts = mount::MountsInfo::parse_mounts()?;
 
         if mounts.non_root(&original_path)? {
@@ -112,25 +174,47 @@ impl MountInjector {
             return Err(anyhow!("inject on a root mount"));
         }
 
-        let injectors = MultiInjector::build(self.injector_config.clone())?;
+        let injectors = MultiInjector::build(self.injector_config.clone(), &self.original_path)?;
 
-        let hookfs = Arc::new(hookfs::HookFs::new(
-            &self.original_path,
-            &self.new_path,
-            injectors,
-        ));
+        let mut hookfs = hookfs::HookFs::new(&self.original_path, &self.new_path, injectors);
+        if let Some(limit) = self.max_concurrency {
+            hookfs = hookfs.with_concurrency_limit(limit);
+        }
+        if let Some(size) = self.max_io_size {
+            hookfs = hookfs.with_max_io_size(size);
+        }
+        if let Some(overlay) = &self.overlay {
+            hookfs = hookfs.with_overlay(overlay);
+        }
+        if let Some(shadow) = &self.shadow {
+            hookfs = hookfs.with_shadow(shadow);
+        }
+        if let Some(breaker) = self.breaker {
+            hookfs = hookfs.with_circuit_breaker(breaker.threshold, breaker.cooldown);
+        }
+        if self.writeback_cache {
+            hookfs = hookfs.with_writeback_cache();
+        }
+        let hookfs = Arc::new(hookfs);
 
         let original_path = self.original_path.clone();
         let new_path = self.new_path.clone();
         let cloned_hookfs = hookfs.clone();
+        let mut args = vec!["allow_other".to_owned(), "fsname=toda".to_owned()];
+        if self.default_permissions {
+            args.push("default_permissions".to_owned());
+        }
+        if let Some(size) = self.max_io_size {
+            args.push(format!("max_read={}", size));
+        }
 
         let (before_mount_waiter, before_mount_guard) = stop::lock();
+        RUNNING_MOUNTS.fetch_add(1, Ordering::SeqCst);
         let handler = std::thread::spawn(box move || {
             let fs = hookfs::AsyncFileSystem::from(cloned_hookfs);
 
             std::fs::create_dir_all(new_path.as_path())?;
 
-            let args = ["allow_other", "fsname=toda", "default_permissions"];
             let flags: Vec<_> = args
                 .iter()
                 .flat_map(|item| vec![OsStr::new("-o"), OsStr::new(item)])
@@ -139,9 +223,13 @@ impl MountInjector {
             info!("mount with flags {:?}", flags);
 
             drop(before_mount_guard);
-            fuser::mount(fs, &original_path, &flags)?;
+            let result = fuser::mount(fs, &original_path, &flags);
 
-            drop(hookfs::runtime::RUNTIME.write().unwrap().take().unwrap());
+            if RUNNING_MOUNTS.fetch_sub(1, Ordering::SeqCst) == 1 {
+                drop(hookfs::runtime::RUNTIME.write().unwrap().take().unwrap());
+            }
+
+            result?;
 
             Ok(())
         });
@@ -158,3 +246,121 @@ impl MountInjector {
         })
     }
 }
+
+// MultiMountInjector coordinates the injections on several mount points. Each
+// of them has its own backing path and injectors.
+#[derive(Debug)]
+pub struct MultiMountInjector {
+    injectors: Vec<MountInjector>,
+}
+
+pub struct MultiMountInjectionGuard {
+    guards: Vec<MountInjectionGuard>,
+}
+
+impl MultiMountInjectionGuard {
+    pub fn enable_injection(&self) {
+        for guard in self.guards.iter() {
+            guard.enable_injection();
+        }
+    }
+
+    pub fn disable_injection(&self) {
+        for guard in self.guards.iter() {
+            guard.disable_injection();
+        }
+    }
+
+    pub fn hookfs(&self) -> Vec<Arc<hookfs::HookFs>> {
+        self.guards
+            .iter()
+            .map(|guard| guard.hookfs.clone())
+            .collect()
+    }
+
+    // recover_mount tries to recover every mount, even if some of them fail,
+    // and returns the first error
+    pub fn recover_mount(self) -> Result<()> {
+        let mut result = Ok(());
+        for guard in self.guards {
+            let path = guard.original_path.clone();
+            if let Err(err) = guard.recover_mount() {
+                error!("fail to recover mount {}: {:?}", path.display(), err);
+                if result.is_ok() {
+                    result = Err(err);
+                }
+            }
+        }
+
+        result
+    }
+}
+
+impl MultiMountInjector {
+    pub fn create_injection<P: AsRef<Path>>(
+        paths: &[P],
+        injector_config: Vec<InjectorConfig>,
+        default_permissions: bool,
+        max_concurrency: Option<usize>,
+        max_io_size: Option<u32>,
+        overlay: Option<&Path>,
+        shadow: Option<&Path>,
+        breaker: Option<BreakerConfig>,
+        writeback_cache: bool,
+    ) -> Result<MultiMountInjector> {
+        if max_concurrency == Some(0) {
+            return Err(anyhow!("max concurrency should be positive"));
+        }
+        if max_io_size.map_or(false, |size| size < MIN_IO_SIZE) {
+            return Err(anyhow!("max io size should be at least {}", MIN_IO_SIZE));
+        }
+        if breaker.map_or(false, |breaker| breaker.threshold == 0) {
+            return Err(anyhow!("breaker threshold should be positive"));
+        }
+        let injectors = paths
+            .iter()
+            .map(|path| {
+                // every mount has its own directory in the overlay
+                let overlay = overlay.map(|overlay| {
+                    overlay.join(path.as_ref().strip_prefix("/").unwrap_or(path.as_ref()))
+                });
+                let shadow = shadow.map(|shadow| {
+                    shadow.join(path.as_ref().strip_prefix("/").unwrap_or(path.as_ref()))
+                });
+                MountInjector::create_injection(
+                    path,
+                    injector_config.clone(),
+                    default_permissions,
+                    max_concurrency,
+                    max_io_size,
+                    overlay,
+                    shadow,
+                    breaker,
+                    writeback_cache,
+                )
+            })
+            .collect::<Result<_>>()?;
+
+        Ok(MultiMountInjector { injectors })
+    }
+
+    // This method should be called in host namespace. If any of the mounts
+    // fails, the mounted ones are recovered.
+    pub fn mount(&mut self) -> Result<MultiMountInjectionGuard> {
+        let mut guards = Vec::new();
+        for injector in self.injectors.iter_mut() {
+            match injector.mount() {
+                Ok(guard) => guards.push(guard),
+                Err(err) => {
+                    if let Err(recover_err) = (MultiMountInjectionGuard { guards }).recover_mount()
+                    {
+                        error!("fail to recover mounts: {:?}", recover_err);
+                    }
+                    return Err(err);
+                }
+            }
+        }
+
+        Ok(MultiMountInjectionGuard { guards })
+    }
+}
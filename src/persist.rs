@@ -0,0 +1,113 @@
+use std::collections::HashMap;
+use std::fs;
+use std::io::{ErrorKind, Read, Write};
+use std::path::Path;
+
+use anyhow::Result;
+use flate2::read::GzDecoder;
+use flate2::write::GzEncoder;
+use serde::{Deserialize, Serialize};
+use tracing::info;
+
+use crate::injector::InjectorConfig;
+
+const GZIP_MAGIC: &[u8] = &[0x1f, 0x8b];
+const ZSTD_MAGIC: &[u8] = &[0x28, 0xb5, 0x2f, 0xfd];
+
+// PersistedConfig is the injector config written on every `update`, so that
+// it can be applied again after toda restarts
+#[derive(Serialize, Deserialize, Clone, Debug, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct PersistedConfig {
+    // `generation` is bumped by every `update`, or set by the controller. It's
+    // returned by `get_status` to tell whether the config is stale.
+    pub generation: u64,
+    // the configs indexed by the path of the mount point
+    pub mounts: HashMap<String, Vec<InjectorConfig>>,
+}
+
+// Compression of the persisted file, which is chosen by the extension of the
+// path when it's saved, and detected by the magic bytes when it's loaded
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Compression {
+    None,
+    Gzip,
+    Zstd,
+}
+
+impl Compression {
+    // from_path chooses zstd for `.zst`, and gzip for `.gz`
+    pub fn from_path(path: &Path) -> Self {
+        match path.extension().and_then(|ext| ext.to_str()) {
+            Some("zst") | Some("zstd") => Compression::Zstd,
+            Some("gz") => Compression::Gzip,
+            _ => Compression::None,
+        }
+    }
+
+    pub fn detect(content: &[u8]) -> Self {
+        if content.starts_with(ZSTD_MAGIC) {
+            Compression::Zstd
+        } else if content.starts_with(GZIP_MAGIC) {
+            Compression::Gzip
+        } else {
+            Compression::None
+        }
+    }
+
+    fn compress(self, content: Vec<u8>) -> Result<Vec<u8>> {
+        match self {
+            Compression::None => Ok(content),
+            Compression::Gzip => {
+                let mut encoder = GzEncoder::new(Vec::new(), flate2::Compression::default());
+                encoder.write_all(&content)?;
+                Ok(encoder.finish()?)
+            }
+            Compression::Zstd => Ok(zstd::stream::encode_all(&content[..], 0)?),
+        }
+    }
+
+    fn decompress(self, content: Vec<u8>) -> Result<Vec<u8>> {
+        match self {
+            Compression::None => Ok(content),
+            Compression::Gzip => {
+                let mut decompressed = Vec::new();
+                GzDecoder::new(&content[..]).read_to_end(&mut decompressed)?;
+                Ok(decompressed)
+            }
+            Compression::Zstd => Ok(zstd::stream::decode_all(&content[..])?),
+        }
+    }
+}
+
+impl PersistedConfig {
+    // load reads the config from `path`, and returns the empty one if the file
+    // doesn't exist. A compressed file is decompressed whatever the extension
+    // is.
+    pub fn load<P: AsRef<Path>>(path: P) -> Result<Self> {
+        let path = path.as_ref();
+        info!("loading config from {}", path.display());
+        match fs::read(path) {
+            Ok(content) => {
+                let content = Compression::detect(&content).decompress(content)?;
+                Ok(serde_json::from_slice(&content)?)
+            }
+            Err(err) if err.kind() == ErrorKind::NotFound => Ok(Self::default()),
+            Err(err) => Err(err.into()),
+        }
+    }
+
+    // save writes the config to a temporary file and renames it to `path`, so
+    // that a crash in the middle doesn't leave a broken file. It's compressed
+    // as the extension of `path` tells.
+    pub fn save<P: AsRef<Path>>(&self, path: P) -> Result<()> {
+        let path = path.as_ref();
+        let mut tmp = path.as_os_str().to_owned();
+        tmp.push(".tmp");
+
+        let content = Compression::from_path(path).compress(serde_json::to_vec(self)?)?;
+        fs::write(&tmp, content)?;
+        fs::rename(&tmp, path)?;
+        Ok(())
+    }
+}
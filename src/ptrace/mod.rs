@@ -3,6 +3,8 @@ use std::collections::{HashMap, HashSet};
 use std::ffi::CString;
 use std::os::unix::ffi::OsStrExt;
 use std::path::Path;
+use std::sync::atomic::{AtomicU32, AtomicU64, Ordering};
+use std::time::Duration;
 
 use anyhow::{anyhow, Result};
 use nix::errno::Errno;
@@ -31,6 +33,29 @@ thread_local! {
     static PTRACE_MANAGER: PtraceManager = PtraceManager::default()
 }
 
+// the timing of attaching and detaching the tasks, with the durations in
+// nanoseconds, which is tuned for the busy nodes by `set_timing`
+static SETTLE_DELAY: AtomicU64 = AtomicU64::new(10_000_000);
+static ATTACH_RETRIES: AtomicU32 = AtomicU32::new(3);
+static ATTACH_RETRY_DELAY: AtomicU64 = AtomicU64::new(10_000_000);
+
+// set_timing sets the delay after a process is detached, before the next
+// process is traced, and how many times and how long after an `ESRCH` or
+// `EPERM` the attach is retried, as the tasks are briefly unattachable when
+// they are being released by the last tracer
+pub fn set_timing(settle_delay: Duration, attach_retries: u32, attach_retry_delay: Duration) {
+    SETTLE_DELAY.store(settle_delay.as_nanos() as u64, Ordering::Relaxed);
+    ATTACH_RETRIES.store(attach_retries, Ordering::Relaxed);
+    ATTACH_RETRY_DELAY.store(attach_retry_delay.as_nanos() as u64, Ordering::Relaxed);
+}
+
+// jitter spreads the delay in [delay / 2, delay * 3 / 2), so that the tasks
+// waiting together don't retry at the same time
+fn jitter(nanos: u64) -> Duration {
+    let delay = Duration::from_nanos(nanos);
+    delay / 2 + delay.mul_f64(rand::random::<f64>())
+}
+
 pub fn trace(pid: i32) -> Result<TracedProcess> {
     PTRACE_MANAGER.with(|pm| pm.trace(pid))
 }
@@ -40,24 +65,49 @@ fn thread_is_gone(state: char) -> bool {
     state == 'Z' || state == 'x' || state == 'X'
 }
 
-#[instrument]
+fn task_is_gone(tid: i32) -> bool {
+    match procfs::process::Process::new(tid) {
+        Ok(process) => thread_is_gone(process.stat.state),
+        Err(ProcError::NotFound(_)) => true,
+        Err(_) => false,
+    }
+}
+
+#[instrument(skip(task), fields(pid = task.tid))]
 fn attach_task(task: &Task) -> Result<()> {
     let pid = Pid::from_raw(task.tid);
-    let process = procfs::process::Process::new(task.tid)?;
 
     trace!("attach task: {}", task.tid);
-    match ptrace::attach(pid) {
-        Err(Sys(errno))
-            if errno == Errno::ESRCH
-                || (errno == Errno::EPERM && thread_is_gone(process.stat.state)) =>
-        {
-            info!("task {} doesn't exist, maybe has stopped", task.tid)
-        }
-        Err(err) => {
-            warn!("attach error: {:?}", err);
-            return Err(err.into());
+    let retries = ATTACH_RETRIES.load(Ordering::Relaxed);
+    let mut tries = 0;
+    loop {
+        match ptrace::attach(pid) {
+            Ok(()) => break,
+            Err(Sys(errno)) if errno == Errno::ESRCH || errno == Errno::EPERM => {
+                if task_is_gone(task.tid) {
+                    info!("task {} doesn't exist, maybe has stopped", task.tid);
+                    break;
+                }
+                if tries >= retries {
+                    if errno == Errno::ESRCH {
+                        info!("task {} doesn't exist, maybe has stopped", task.tid);
+                        break;
+                    }
+                    warn!("attach error: {:?}", errno);
+                    return Err(Sys(errno).into());
+                }
+                tries += 1;
+                info!(
+                    "fail to attach task {}: {:?}, retry {}/{}",
+                    task.tid, errno, tries, retries
+                );
+                std::thread::sleep(jitter(ATTACH_RETRY_DELAY.load(Ordering::Relaxed)));
+            }
+            Err(err) => {
+                warn!("attach error: {:?}", err);
+                return Err(err.into());
+            }
         }
-        _ => {}
     }
     info!("attach task: {} successfully", task.tid);
 
@@ -175,6 +225,13 @@ impl PtraceManager {
                             Internal(err) => error!("internal error: {:?}", err),
                         }
                     };
+
+                    // the tasks may still be released by the kernel, so that
+                    // the next trace of them fails
+                    let settle_delay = SETTLE_DELAY.load(Ordering::Relaxed);
+                    if settle_delay > 0 {
+                        std::thread::sleep(jitter(settle_delay));
+                    }
                 }
 
                 Ok(())
@@ -197,7 +254,7 @@ impl Clone for TracedProcess {
 }
 
 impl TracedProcess {
-    #[instrument]
+    #[instrument(skip(self), fields(pid = self.pid))]
     fn protect(&self) -> Result<ThreadGuard> {
         let regs = ptrace::getregs(Pid::from_raw(self.pid))?;
 
@@ -213,7 +270,7 @@ impl TracedProcess {
         Ok(guard)
     }
 
-    #[instrument(skip(f))]
+    #[instrument(skip(self, f), fields(pid = self.pid))]
     fn with_protect<R, F: Fn(&Self) -> Result<R>>(&self, f: F) -> Result<R> {
         let guard = self.protect()?;
 
@@ -224,7 +281,7 @@ impl TracedProcess {
         Ok(ret)
     }
 
-    #[instrument]
+    #[instrument(skip(self), fields(pid = self.pid))]
     fn syscall(&self, id: u64, args: &[u64]) -> Result<u64> {
         trace!("run syscall {} {:?}", id, args);
 
@@ -283,7 +340,7 @@ impl TracedProcess {
         })
     }
 
-    #[instrument]
+    #[instrument(skip(self), fields(pid = self.pid))]
     pub fn mmap(&self, length: u64, fd: u64) -> Result<u64> {
         let prot = ProtFlags::PROT_READ | ProtFlags::PROT_WRITE | ProtFlags::PROT_EXEC;
         let flags = MapFlags::MAP_PRIVATE | MapFlags::MAP_ANON;
@@ -294,12 +351,12 @@ impl TracedProcess {
         )
     }
 
-    #[instrument]
+    #[instrument(skip(self), fields(pid = self.pid))]
     pub fn munmap(&self, addr: u64, len: u64) -> Result<u64> {
         self.syscall(11, &[addr, len])
     }
 
-    #[instrument(skip(f))]
+    #[instrument(skip(self, f), fields(pid = self.pid))]
     pub fn with_mmap<R, F: Fn(&Self, u64) -> Result<R>>(&self, len: u64, f: F) -> Result<R> {
         let addr = self.mmap(len, 0)?;
 
@@ -310,7 +367,7 @@ impl TracedProcess {
         Ok(ret)
     }
 
-    #[instrument]
+    #[instrument(skip(self), fields(pid = self.pid))]
     pub fn chdir<P: AsRef<Path> + std::fmt::Debug>(&self, filename: P) -> Result<()> {
         let filename = CString::new(filename.as_ref().as_os_str().as_bytes())?;
         let path = filename.as_bytes_with_nul();
@@ -323,7 +380,7 @@ impl TracedProcess {
         })
     }
 
-    #[instrument]
+    #[instrument(skip(self), fields(pid = self.pid))]
     pub fn write_mem(&self, addr: u64, content: &[u8]) -> Result<()> {
         let pid = Pid::from_raw(self.pid);
 
@@ -339,7 +396,7 @@ impl TracedProcess {
         Ok(())
     }
 
-    #[instrument(skip(codes))]
+    #[instrument(skip(self, codes), fields(pid = self.pid))]
     pub fn run_codes<F: Fn(u64) -> Result<(u64, Vec<u8>)>>(&self, codes: F) -> Result<()> {
         let pid = Pid::from_raw(self.pid);
 
@@ -4,20 +4,16 @@ use std::path::{Path, PathBuf};
 use anyhow::Result;
 use tracing::{error, info, trace};
 
-use super::utils::all_processes;
-use super::{ptrace, Replacer};
+use super::utils::{all_processes, replace_path};
+use super::{ptrace, record, Replacer};
 
 #[derive(Debug)]
 pub struct CwdReplacer {
-    processes: Vec<ptrace::TracedProcess>,
-    new_path: PathBuf,
+    processes: Vec<(ptrace::TracedProcess, PathBuf)>,
 }
 
 impl CwdReplacer {
-    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(
-        detect_path: P1,
-        new_path: P2,
-    ) -> Result<CwdReplacer> {
+    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(mounts: &[(P1, P2)]) -> Result<CwdReplacer> {
         info!("preparing cmdreplacer");
 
         let processes = all_processes()?
@@ -33,9 +29,9 @@ impl CwdReplacer {
                     }
                 }
             })
-            .filter(|(_, path)| path.starts_with(detect_path.as_ref()))
-            .filter_map(|(pid, _)| match ptrace::trace(pid) {
-                Ok(process) => Some(process),
+            .filter_map(|(pid, path)| Some((pid, replace_path(&path, mounts)?)))
+            .filter_map(|(pid, new_path)| match ptrace::trace(pid) {
+                Ok(process) => Some((process, new_path)),
                 Err(err) => {
                     error!("fail to ptrace process: pid({}) with error: {:?}", pid, err);
                     None
@@ -43,18 +39,18 @@ impl CwdReplacer {
             })
             .collect();
 
-        Ok(CwdReplacer {
-            processes,
-            new_path: new_path.as_ref().to_owned(),
-        })
+        Ok(CwdReplacer { processes })
     }
 }
 
 impl Replacer for CwdReplacer {
     fn run(&mut self) -> Result<()> {
         info!("running cwd replacer");
-        for process in self.processes.iter() {
-            process.chdir(&self.new_path)?;
+        for (process, new_path) in self.processes.iter() {
+            process.chdir(new_path)?;
+            record(process.pid, |redirection| {
+                redirection.cwd = Some(new_path.clone())
+            });
         }
 
         Ok(())
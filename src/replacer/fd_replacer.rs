@@ -1,4 +1,4 @@
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap};
 use std::fmt::Debug;
 use std::io::{Cursor, Read, Write};
 use std::iter::FromIterator;
@@ -10,8 +10,8 @@ use itertools::Itertools;
 use procfs::process::FDTarget;
 use tracing::{error, info, trace};
 
-use super::utils::all_processes;
-use super::{ptrace, Replacer};
+use super::utils::{all_processes, replace_path};
+use super::{ptrace, record, Replacer};
 
 #[derive(Clone, Copy)]
 #[repr(packed)]
@@ -33,6 +33,8 @@ impl ReplaceCase {
 struct ProcessAccessorBuilder {
     cases: Vec<ReplaceCase>,
     new_paths: Cursor<Vec<u8>>,
+    // the new paths of the fds, which are recorded after they're reopened
+    fds: BTreeMap<u64, PathBuf>,
 }
 
 impl ProcessAccessorBuilder {
@@ -40,6 +42,7 @@ impl ProcessAccessorBuilder {
         ProcessAccessorBuilder {
             cases: Vec::new(),
             new_paths: Cursor::new(Vec::new()),
+            fds: BTreeMap::new(),
         }
     }
 
@@ -49,24 +52,26 @@ impl ProcessAccessorBuilder {
 
             cases: self.cases,
             new_paths: self.new_paths,
+            fds: self.fds,
         })
     }
 
     pub fn push_case(&mut self, fd: u64, new_path: PathBuf) -> anyhow::Result<()> {
         info!("push case fd: {}, new_path: {}", fd, new_path.display());
 
-        let mut new_path = new_path
+        let mut raw_path = new_path
             .to_str()
             .ok_or(anyhow!("fd contains non-UTF-8 character"))?
             .as_bytes()
             .to_vec();
 
-        new_path.push(0);
+        raw_path.push(0);
 
         let offset = self.new_paths.position();
-        self.new_paths.write_all(new_path.as_slice())?;
+        self.new_paths.write_all(raw_path.as_slice())?;
 
         self.cases.push(ReplaceCase::new(fd, offset));
+        self.fds.insert(fd, new_path);
 
         Ok(())
     }
@@ -90,6 +95,7 @@ struct ProcessAccessor {
 
     cases: Vec<ReplaceCase>,
     new_paths: Cursor<Vec<u8>>,
+    fds: BTreeMap<u64, PathBuf>,
 }
 
 impl Debug for ProcessAccessor {
@@ -194,15 +200,9 @@ pub struct FdReplacer {
 }
 
 impl FdReplacer {
-    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(
-        detect_path: P1,
-        new_path: P2,
-    ) -> Result<FdReplacer> {
+    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(mounts: &[(P1, P2)]) -> Result<FdReplacer> {
         info!("preparing fd replacer");
 
-        let detect_path = detect_path.as_ref();
-        let new_path = new_path.as_ref();
-
         let processes = all_processes()?
             .filter_map(|process| -> Option<_> {
                 let pid = process.pid;
@@ -224,11 +224,10 @@ impl FdReplacer {
                         FDTarget::Path(path) => Some((entry.fd as u64, path)),
                         _ => None,
                     })
-                    .filter(|(_, path)| path.starts_with(detect_path))
                     .filter_map(move |(fd, path)| {
+                        let new_path = replace_path(&path, mounts)?;
                         trace!("replace fd({}): {}", fd, path.display());
-                        let stripped_path = path.strip_prefix(&detect_path).ok()?;
-                        Some((process.clone(), (fd, new_path.join(stripped_path))))
+                        Some((process.clone(), (fd, new_path)))
                     })
             })
             .group_by(|(process, _)| process.pid)
@@ -254,8 +253,9 @@ impl FdReplacer {
 impl Replacer for FdReplacer {
     fn run(&mut self) -> Result<()> {
         info!("running fd replacer");
-        for (_, accessor) in self.processes.iter_mut() {
+        for (pid, accessor) in self.processes.iter_mut() {
             accessor.run()?;
+            record(*pid, |redirection| redirection.fds = accessor.fds.clone());
         }
 
         Ok(())
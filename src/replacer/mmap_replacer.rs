@@ -11,8 +11,8 @@ use nix::sys::mman::{MapFlags, ProtFlags};
 use procfs::process::MMapPath;
 use tracing::{error, info, trace};
 
-use super::utils::all_processes;
-use super::{ptrace, Replacer};
+use super::utils::{all_processes, replace_path};
+use super::{ptrace, record, Replacer};
 
 #[derive(Clone, Debug)]
 struct ReplaceCase {
@@ -60,6 +60,8 @@ impl RawReplaceCase {
 struct ProcessAccessorBuilder {
     cases: Vec<RawReplaceCase>,
     new_paths: Cursor<Vec<u8>>,
+    // the new paths of the mappings, which are recorded after they're mapped
+    paths: Vec<PathBuf>,
 }
 
 impl ProcessAccessorBuilder {
@@ -67,6 +69,7 @@ impl ProcessAccessorBuilder {
         ProcessAccessorBuilder {
             cases: Vec::new(),
             new_paths: Cursor::new(Vec::new()),
+            paths: Vec::new(),
         }
     }
 
@@ -76,6 +79,7 @@ impl ProcessAccessorBuilder {
 
             cases: self.cases,
             new_paths: self.new_paths,
+            paths: self.paths,
         })
     }
 
@@ -90,16 +94,16 @@ impl ProcessAccessorBuilder {
     ) -> anyhow::Result<()> {
         info!("push case");
 
-        let mut new_path = new_path
+        let mut raw_path = new_path
             .to_str()
             .ok_or(anyhow!("fd contains non-UTF-8 character"))?
             .as_bytes()
             .to_vec();
 
-        new_path.push(0);
+        raw_path.push(0);
 
         let new_path_offset = self.new_paths.position();
-        self.new_paths.write_all(new_path.as_slice())?;
+        self.new_paths.write_all(raw_path.as_slice())?;
 
         self.cases.push(RawReplaceCase::new(
             memory_addr,
@@ -109,6 +113,7 @@ impl ProcessAccessorBuilder {
             new_path_offset,
             offset,
         ));
+        self.paths.push(new_path);
 
         Ok(())
     }
@@ -139,6 +144,7 @@ struct ProcessAccessor {
 
     cases: Vec<RawReplaceCase>,
     new_paths: Cursor<Vec<u8>>,
+    paths: Vec<PathBuf>,
 }
 
 impl Debug for ProcessAccessor {
@@ -270,15 +276,9 @@ pub struct MmapReplacer {
 }
 
 impl MmapReplacer {
-    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(
-        detect_path: P1,
-        new_path: P2,
-    ) -> Result<MmapReplacer> {
+    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(mounts: &[(P1, P2)]) -> Result<MmapReplacer> {
         info!("preparing mmap replacer");
 
-        let detect_path = detect_path.as_ref();
-        let new_path = new_path.as_ref();
-
         let processes = all_processes()?
             .filter_map(|process| -> Option<_> {
                 let pid = process.pid;
@@ -311,10 +311,8 @@ impl MmapReplacer {
                             _ => None,
                         }
                     })
-                    .filter(|(_, case)| case.path.starts_with(detect_path))
-                    .filter_map(|(process, mut case)| {
-                        let stripped_path = case.path.strip_prefix(&detect_path).ok()?;
-                        case.path = new_path.join(stripped_path);
+                    .filter_map(move |(process, mut case)| {
+                        case.path = replace_path(&case.path, mounts)?;
                         Some((process, case))
                     })
             })
@@ -342,8 +340,11 @@ impl MmapReplacer {
 impl Replacer for MmapReplacer {
     fn run(&mut self) -> Result<()> {
         info!("running mmap replacer");
-        for (_, accessor) in self.processes.iter_mut() {
+        for (pid, accessor) in self.processes.iter_mut() {
             accessor.run()?;
+            record(*pid, |redirection| {
+                redirection.mmaps = accessor.paths.clone()
+            });
         }
 
         Ok(())
@@ -1,6 +1,10 @@
-use std::path::Path;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
 
 use anyhow::Result;
+use once_cell::sync::Lazy;
+use serde::Serialize;
 
 use crate::ptrace;
 
@@ -15,6 +19,36 @@ pub trait Replacer {
     fn run(&mut self) -> Result<()>;
 }
 
+// Redirection is what the replacers have redirected in a process on their
+// last run, which is reported by `debug_info`
+#[derive(Serialize, Clone, Debug, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct Redirection {
+    pub pid: i32,
+    // the fds and the paths they are reopened with
+    pub fds: BTreeMap<u64, PathBuf>,
+    pub cwd: Option<PathBuf>,
+    // the paths of the files mapped again
+    pub mmaps: Vec<PathBuf>,
+}
+
+static REDIRECTIONS: Lazy<Mutex<BTreeMap<i32, Redirection>>> =
+    Lazy::new(|| Mutex::new(BTreeMap::new()));
+
+// redirections returns the processes redirected by the last run, ordered by
+// the pid
+pub fn redirections() -> Vec<Redirection> {
+    REDIRECTIONS.lock().unwrap().values().cloned().collect()
+}
+
+fn record<F: FnOnce(&mut Redirection)>(pid: i32, update: F) {
+    let mut redirections = REDIRECTIONS.lock().unwrap();
+    update(redirections.entry(pid).or_insert_with(|| Redirection {
+        pid,
+        ..Default::default()
+    }));
+}
+
 pub struct UnionReplacer<'a> {
     replacers: Vec<Box<dyn Replacer + 'a>>,
 }
@@ -26,20 +60,18 @@ impl<'a> UnionReplacer<'a> {
         }
     }
 
-    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(
-        &mut self,
-        detect_path: P1,
-        new_path: P2,
-    ) -> Result<()> {
-        match FdReplacer::prepare(&detect_path, &new_path) {
+    // prepare attaches the processes once for all the `mounts`, which are
+    // pairs of the detect path and the new path
+    pub fn prepare<P1: AsRef<Path>, P2: AsRef<Path>>(&mut self, mounts: &[(P1, P2)]) -> Result<()> {
+        match FdReplacer::prepare(mounts) {
             Err(err) => error!("Error while preparing fd replacer: {:?}", err),
             Ok(replacer) => self.replacers.push(Box::new(replacer)),
         }
-        match CwdReplacer::prepare(&detect_path, &new_path) {
+        match CwdReplacer::prepare(mounts) {
             Err(err) => error!("Error while preparing cwd replacer: {:?}", err),
             Ok(replacer) => self.replacers.push(Box::new(replacer)),
         }
-        match MmapReplacer::prepare(&detect_path, &new_path) {
+        match MmapReplacer::prepare(mounts) {
             Err(err) => error!("Error while preparing mmap replacer: {:?}", err),
             Ok(replacer) => self.replacers.push(Box::new(replacer)),
         }
@@ -49,6 +81,7 @@ impl<'a> UnionReplacer<'a> {
 
 impl<'a> Replacer for UnionReplacer<'a> {
     fn run(&mut self) -> Result<()> {
+        REDIRECTIONS.lock().unwrap().clear();
         for replacer in self.replacers.iter_mut() {
             replacer.run()?;
         }
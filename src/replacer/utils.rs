@@ -1,3 +1,5 @@
+use std::path::{Path, PathBuf};
+
 use anyhow::Result;
 use procfs::process::{self, Process};
 
@@ -12,3 +14,15 @@ pub fn all_processes() -> Result<impl Iterator<Item = Process>> {
             }
         }))
 }
+
+// replace_path maps the `path` under the first detect path of `mounts` to the
+// same place under the corresponding new path
+pub fn replace_path<P1: AsRef<Path>, P2: AsRef<Path>>(
+    path: &Path,
+    mounts: &[(P1, P2)],
+) -> Option<PathBuf> {
+    mounts.iter().find_map(|(detect_path, new_path)| {
+        let stripped_path = path.strip_prefix(detect_path.as_ref()).ok()?;
+        Some(new_path.as_ref().join(stripped_path))
+    })
+}
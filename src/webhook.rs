@@ -0,0 +1,89 @@
+use std::sync::mpsc::{sync_channel, SyncSender, TrySendError};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime};
+
+use anyhow::{anyhow, Result};
+use once_cell::sync::OnceCell;
+use serde::Serialize;
+use tracing::{debug, info, warn};
+
+use crate::http::{self, Url};
+use crate::injector::Method;
+
+// the events beyond the queue are dropped rather than waited for
+const QUEUE_SIZE: usize = 64;
+const TIMEOUT: Duration = Duration::from_secs(2);
+
+// the events are only sent after the webhook is set
+static WEBHOOK: OnceCell<Mutex<SyncSender<Event>>> = OnceCell::new();
+
+#[derive(Serialize, Debug, Clone)]
+#[serde(rename_all = "camelCase")]
+pub enum EventKind {
+    // the injector matches an operation for the first time
+    Triggered,
+    // the injector has injected `maxInjections` times
+    BudgetExhausted,
+    // the active window of the injector has passed
+    WindowExhausted,
+}
+
+#[derive(Serialize, Debug, Clone)]
+#[serde(rename_all = "camelCase")]
+pub struct Event {
+    pub injector: String,
+    pub event: EventKind,
+    pub method: String,
+    // RFC 3339 in UTC
+    pub timestamp: String,
+}
+
+// start sends the events to the `url` from a new thread, so that the FUSE
+// requests never wait for them. It can only be started once.
+pub fn start(url: &str) -> Result<()> {
+    let url = Url::parse(url)?;
+    let (tx, rx) = sync_channel::<Event>(QUEUE_SIZE);
+    WEBHOOK
+        .set(Mutex::new(tx))
+        .map_err(|_| anyhow!("webhook has been started"))?;
+    info!("send the injector events to {:?}", url);
+
+    std::thread::spawn(move || {
+        for event in rx {
+            let body = match serde_json::to_string(&event) {
+                Ok(body) => body,
+                Err(err) => {
+                    warn!("fail to encode webhook event {:?}: {:?}", event, err);
+                    continue;
+                }
+            };
+            match http::post(&url, &body, TIMEOUT) {
+                Ok(status) if (200..300).contains(&status) => {
+                    debug!("webhook event sent: {}", body)
+                }
+                Ok(status) => warn!("webhook replies {} to event {}", status, body),
+                Err(err) => warn!("fail to send webhook event {}: {:?}", body, err),
+            }
+        }
+    });
+    Ok(())
+}
+
+// notify queues the event of the injector, and drops it if the queue is full
+pub fn notify(injector: &str, event: EventKind, method: &Method) {
+    let webhook = match WEBHOOK.get() {
+        Some(webhook) => webhook,
+        None => return,
+    };
+    let event = Event {
+        injector: injector.to_owned(),
+        event,
+        method: method.name(),
+        timestamp: humantime::format_rfc3339_millis(SystemTime::now()).to_string(),
+    };
+    match webhook.lock().unwrap().try_send(event) {
+        Ok(()) => {}
+        Err(TrySendError::Full(event)) => warn!("webhook queue is full, drop {:?}", event),
+        Err(TrySendError::Disconnected(_)) => {}
+    }
+}
@@ -0,0 +1,63 @@
+mod common;
+
+use std::fs::{read_to_string, remove_file};
+use std::path::Path;
+use std::sync::Arc;
+
+use futures::executor::block_on;
+use toda::audit;
+use toda::hookfs::runtime::spawn;
+use toda::hookfs::RequestContext;
+use toda::injector::{Injector, Method};
+
+fn records(path: &str) -> Vec<serde_json::Value> {
+    read_to_string(path)
+        .unwrap_or_default()
+        .lines()
+        .map(|line| serde_json::from_str(line).unwrap())
+        .collect()
+}
+
+// the audit log is global, so it's tested on its own
+#[test]
+fn audit_log() {
+    let path = "/tmp/toda_audit_test.log";
+    let rotated = "/tmp/toda_audit_test.log.1";
+    let _ = remove_file(path);
+    let _ = remove_file(rotated);
+    audit::start(Path::new(path), 1024).unwrap();
+
+    let injector = Arc::new(common::build(
+        r#"{"type": "fault", "name": "eio", "percent": 100, "methods": ["write"], "faults": [{"errno": 5, "weight": 1}]}"#,
+    ));
+    let write = |ino: u64| {
+        let injector = injector.clone();
+        block_on(spawn(RequestContext::default().scope(async move {
+            RequestContext::set_ino(ino);
+            injector.inject(&Method::WRITE, Path::new("/file")).await
+        })))
+        .unwrap()
+    };
+
+    assert!(write(42).is_err());
+    audit::flush();
+    let written = records(path);
+    assert_eq!(written.len(), 1);
+    assert_eq!(written[0]["method"], "write");
+    assert_eq!(written[0]["path"], "/file");
+    assert_eq!(written[0]["ino"], 42);
+    assert_eq!(written[0]["injector"], "fault");
+    assert_eq!(written[0]["name"], "eio");
+    assert_eq!(written[0]["fault"], "errno EIO");
+
+    // the file is rotated rather than exceed the max size, and the older
+    // records are dropped
+    for ino in 0..20 {
+        assert!(write(ino).is_err());
+    }
+    audit::flush();
+    assert!(read_to_string(path).unwrap().len() <= 1024);
+    assert!(read_to_string(rotated).unwrap().len() <= 1024);
+    assert!(!records(rotated).is_empty());
+    assert_eq!(records(path).last().unwrap()["ino"], 19);
+}
@@ -0,0 +1,64 @@
+use std::time::Duration;
+
+use nix::errno::Errno;
+use toda::hookfs::{CircuitBreaker, Error, Result};
+
+fn backing_error() -> Result<()> {
+    Err(Error::Sys(Errno::EIO))
+}
+
+#[test]
+fn open_after_threshold() {
+    let breaker = CircuitBreaker::new(3, Duration::from_secs(10));
+
+    breaker.record(&backing_error());
+    breaker.record(&backing_error());
+    // the successful request breaks the consecutive errors
+    breaker.record(&Ok(()));
+    breaker.record(&backing_error());
+    breaker.record(&backing_error());
+    assert!(!breaker.is_open());
+
+    breaker.record(&backing_error());
+    assert!(breaker.is_open());
+    let status = breaker.status();
+    assert_eq!(status.consecutive_errors, 3);
+    assert_eq!(status.trips, 1);
+}
+
+#[test]
+fn ignore_request_errors() {
+    let breaker = CircuitBreaker::new(2, Duration::from_secs(10));
+
+    // the errors of the requests themselves are not counted, and don't break
+    // the consecutive backing errors
+    breaker.record(&backing_error());
+    breaker.record::<()>(&Err(Error::Sys(Errno::ENOENT)));
+    breaker.record::<()>(&Err(Error::Sys(Errno::EEXIST)));
+    assert!(!breaker.is_open());
+
+    breaker.record(&backing_error());
+    assert!(breaker.is_open());
+}
+
+#[test]
+fn close_after_cooldown() {
+    let breaker = CircuitBreaker::new(1, Duration::from_millis(200));
+
+    breaker.record(&backing_error());
+    assert!(breaker.is_open());
+
+    // the cooldown restarts with every backing error
+    std::thread::sleep(Duration::from_millis(150));
+    breaker.record(&backing_error());
+    std::thread::sleep(Duration::from_millis(150));
+    assert!(breaker.is_open());
+
+    std::thread::sleep(Duration::from_millis(100));
+    assert!(!breaker.is_open());
+    assert_eq!(breaker.status().consecutive_errors, 0);
+
+    breaker.record(&backing_error());
+    assert!(breaker.is_open());
+    assert_eq!(breaker.status().trips, 2);
+}
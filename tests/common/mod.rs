@@ -0,0 +1,18 @@
+// The helpers shared by the tests, which not all of them use
+#![allow(dead_code)]
+
+use std::path::Path;
+
+use toda::injector::{InjectorConfig, MultiInjector};
+
+// build builds the injector of `config`, the json config of one injector, on
+// the mount at `/`
+pub fn build(config: &str) -> MultiInjector {
+    try_build(config).unwrap()
+}
+
+// try_build is `build` returning the error of the invalid config
+pub fn try_build(config: &str) -> anyhow::Result<MultiInjector> {
+    let config: InjectorConfig = serde_json::from_str(config).unwrap();
+    MultiInjector::build(vec![config], Path::new("/"))
+}
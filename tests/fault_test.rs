@@ -0,0 +1,642 @@
+mod common;
+
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+use std::time::Duration;
+
+use futures::executor::block_on;
+use toda::hookfs::RequestContext;
+use toda::injector::{Injector, InjectorConfig, Method, MultiInjector};
+
+fn build(retry_window: &str) -> MultiInjector {
+    common::build(&format!(
+        r#"{{"type": "fault", "percent": 100, "faults": [{{"errno": 4, "weight": 1}}], "failOnce": true, "retryWindow": "{}"}}"#,
+        retry_window
+    ))
+}
+
+fn read(injector: &MultiInjector, offset: i64) -> Option<i32> {
+    block_on(async {
+        injector.inject(&Method::READ, Path::new("/file")).await?;
+        injector
+            .inject_io(&Method::READ, Path::new("/file"), offset, 4096)
+            .await
+    })
+    .err()
+    .map(|err| err.into())
+}
+
+#[test]
+fn fail_once_then_succeed() {
+    let injector = build("1s");
+    assert_eq!(read(&injector, 0), Some(libc::EINTR));
+    assert_eq!(read(&injector, 4096), Some(libc::EINTR));
+    assert_eq!(read(&injector, 0), None);
+    assert_eq!(read(&injector, 4096), None);
+
+    // the next attempt fails again
+    assert_eq!(read(&injector, 0), Some(libc::EINTR));
+
+    let open = || -> Option<i32> {
+        block_on(injector.inject(&Method::OPEN, Path::new("/file")))
+            .err()
+            .map(|err| err.into())
+    };
+    assert_eq!(open(), Some(libc::EINTR));
+    assert_eq!(open(), None);
+}
+
+#[test]
+fn fail_again_after_window() {
+    let injector = build("50ms");
+    assert_eq!(read(&injector, 0), Some(libc::EINTR));
+    std::thread::sleep(Duration::from_millis(100));
+    assert_eq!(read(&injector, 0), Some(libc::EINTR));
+    assert_eq!(read(&injector, 0), None);
+}
+
+#[test]
+fn rate_per_sec() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 0, "ratePerSec": 10, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faults = |count: usize| {
+        (0..count)
+            .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+            .count()
+    };
+
+    // `percent` is ignored, and the bucket starts with one token
+    assert_eq!(faults(1000), 1);
+    std::thread::sleep(Duration::from_millis(350));
+    let refilled = faults(1000);
+    assert!((1..=2).contains(&refilled), "{} faults", refilled);
+}
+
+#[test]
+fn max_injections() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "maxInjections": 2, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faults = (0..10)
+        .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+        .count();
+
+    assert_eq!(faults, 2);
+    let status = injector.status();
+    assert_eq!(status[0].matched, 2);
+    assert_eq!(status[0].remaining, Some(0));
+}
+
+#[test]
+fn max_injections_of_rules() {
+    let build = |extra: &str| {
+        common::build(&format!(
+            r#"{{"type": "fault", "percent": 100, "maxInjections": 5, {}
+                "rules": [{{"methods": ["open"], "errno": 5, "percent": 50}}]}}"#,
+            extra
+        ))
+    };
+    let faults = |injector: &MultiInjector| {
+        (0..200)
+            .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+            .count()
+    };
+
+    // the operations passed by the percent of the rule don't use the budget,
+    // which is only charged by the faults
+    let injector = build("");
+    let mut injected = 0;
+    for _ in 0..200 {
+        if block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err() {
+            injected += 1;
+        }
+        assert_eq!(injector.status()[0].remaining, Some(5 - injected));
+    }
+    assert_eq!(injected, 5);
+    let status = injector.status();
+    assert_eq!(status[0].matched, 5);
+    assert_eq!(status[0].remaining, Some(0));
+
+    // and neither do the ones in the dry run
+    let dry_run = build(r#""dryRun": true,"#);
+    assert_eq!(faults(&dry_run), 0);
+    let status = dry_run.status();
+    assert_eq!(status[0].matched, 0);
+    assert_eq!(status[0].remaining, Some(5));
+}
+
+#[test]
+fn matched_of_rules() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "rules": [{"errno": 5, "percent": 30}]}"#,
+    );
+    let faults = (0..300)
+        .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+        .count() as u64;
+
+    // only the operations failed by the rule are counted
+    assert!(faults > 0 && faults < 300, "{} faults", faults);
+    assert_eq!(injector.status()[0].matched, faults);
+    assert_eq!(injector.reset_status()[0].matched, faults);
+    assert_eq!(injector.status()[0].matched, 0);
+}
+
+#[test]
+fn percent_of_rules() {
+    let build = |percent: &str| {
+        common::build(&format!(
+            r#"{{"type": "fault", {} "rules": [{{"errno": 5, "percent": 100}}]}}"#,
+            percent
+        ))
+    };
+    let faults = |injector: &MultiInjector| {
+        (0..100)
+            .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+            .count()
+    };
+
+    // the rules are rolled only by their own percents without `percent`
+    assert_eq!(faults(&build("")), 100);
+    assert_eq!(faults(&build(r#""percent": 0,"#)), 0);
+
+    // and `percent` is still required without `rules`
+    let err = common::try_build(r#"{"type": "fault", "faults": [{"errno": 5, "weight": 1}]}"#)
+        .unwrap_err();
+    assert!(err.to_string().contains("percent"), "{}", err);
+}
+
+#[test]
+fn delay_start() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "delayStart": "200ms", "duration": "1s", "maxInjections": 2, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faults = |count: usize| {
+        (0..count)
+            .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+            .count()
+    };
+
+    // nothing is matched or counted during the warm-up
+    assert_eq!(faults(10), 0);
+    assert_eq!(injector.status()[0].remaining, Some(2));
+    std::thread::sleep(Duration::from_millis(250));
+    assert_eq!(faults(10), 2);
+}
+
+#[test]
+fn reset_status() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "maxInjections": 4, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faults = |count: usize| {
+        (0..count)
+            .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+            .count()
+    };
+
+    assert_eq!(faults(3), 3);
+    let status = injector.reset_status();
+    assert_eq!(status[0].matched, 3);
+    assert_eq!(injector.status()[0].matched, 0);
+
+    // the budget is not refilled by the reset
+    assert_eq!(faults(3), 1);
+    let status = injector.status();
+    assert_eq!(status[0].matched, 1);
+    assert_eq!(status[0].remaining, Some(0));
+}
+
+#[test]
+fn ino_paths() {
+    let dir = std::env::temp_dir().join("toda_test_ino_paths");
+    std::fs::create_dir_all(&dir).unwrap();
+    std::fs::write(dir.join("app.log"), "hello").unwrap();
+    let ino = std::fs::metadata(dir.join("app.log")).unwrap().ino();
+
+    let conf: InjectorConfig = serde_json::from_str(
+        r#"{"type": "fault", "percent": 100, "inoPaths": ["app.log"], "faults": [{"errno": 5, "weight": 1}]}"#,
+    )
+    .unwrap();
+    let injector = MultiInjector::build(vec![conf], &dir).unwrap();
+    // the inode is resolved when the injector is built, so the fault follows
+    // the file after it's renamed
+    std::fs::rename(dir.join("app.log"), dir.join("app.log.1")).unwrap();
+    let inject = |ino: Option<u64>| {
+        block_on(RequestContext::default().scope(async {
+            if let Some(ino) = ino {
+                RequestContext::set_ino(ino);
+            }
+            injector
+                .inject(&Method::WRITE, &dir.join("app.log.1"))
+                .await
+        }))
+        .is_err()
+    };
+
+    assert!(inject(Some(ino)));
+    assert!(!inject(Some(ino + 1)));
+    assert!(!inject(None));
+    std::fs::remove_dir_all(&dir).ok();
+}
+
+#[test]
+fn eagain_requires_nonblock() {
+    let build = |filter: &str| {
+        common::try_build(&format!(
+            r#"{{"type": "fault", "methods": ["read"], "percent": 100, {} "faults": [{{"errno": 11, "weight": 1}}]}}"#,
+            filter
+        ))
+    };
+
+    let err = build("").unwrap_err();
+    assert!(err.to_string().contains("O_NONBLOCK"), "{}", err);
+    assert!(build(r#""openFlags": ["O_NONBLOCK", "O_SYNC"],"#).is_err());
+    assert!(build(r#""openFlags": {"not": ["O_NONBLOCK"]},"#).is_err());
+    build(r#""openFlags": ["O_NONBLOCK"],"#).unwrap();
+
+    // the methods are matched regardless of the case
+    assert!(common::try_build(
+        r#"{"type": "fault", "methods": ["READ"], "percent": 100, "faults": [{"errno": 11, "weight": 1}]}"#,
+    )
+    .is_err());
+}
+
+#[test]
+fn weighted_errnos() {
+    let build = |faults: &str| {
+        common::try_build(&format!(
+            r#"{{"type": "fault", "percent": 100, "seed": 42, "faults": {}}}"#,
+            faults
+        ))
+    };
+    let faults =
+        r#"[{"errno": 5, "weight": 70}, {"errno": 28, "weight": 20}, {"errno": 30, "weight": 10}]"#;
+    let picks = |injector: &MultiInjector| -> Vec<i32> {
+        (0..1000)
+            .map(|offset| read(injector, offset).unwrap())
+            .collect()
+    };
+
+    let first = picks(&build(faults).unwrap());
+    let count = |errno: i32| first.iter().filter(|picked| **picked == errno).count();
+    assert!((600..800).contains(&count(libc::EIO)), "{:?}", first);
+    assert!((120..280).contains(&count(libc::ENOSPC)), "{:?}", first);
+    assert!((40..160).contains(&count(libc::EROFS)), "{:?}", first);
+    assert_eq!(
+        count(libc::EIO) + count(libc::ENOSPC) + count(libc::EROFS),
+        1000
+    );
+
+    // the same seed picks the same errnos
+    assert_eq!(first, picks(&build(faults).unwrap()));
+
+    assert!(build("[]").is_err());
+    assert!(build(r#"[{"errno": 5, "weight": 0}]"#).is_err());
+    assert!(build(r#"[{"errno": 5, "weight": -1}, {"errno": 28, "weight": 2}]"#).is_err());
+    assert!(build(r#"[{"errno": 5, "weight": 2147483647}, {"errno": 28, "weight": 1}]"#).is_err());
+}
+
+#[test]
+fn depth() {
+    let build = |depth: &str| {
+        let conf: InjectorConfig = serde_json::from_str(&format!(
+            r#"{{"type": "fault", "percent": 100, {}, "faults": [{{"errno": 5, "weight": 1}}]}}"#,
+            depth
+        ))
+        .unwrap();
+        MultiInjector::build(vec![conf], Path::new("/mnt"))
+    };
+    let faulted = |injector: &MultiInjector, path: &str| {
+        block_on(injector.inject(&Method::READ, Path::new(path))).is_err()
+    };
+
+    // the files in the top-level directories
+    let injector = build(r#""minDepth": 2, "maxDepth": 2"#).unwrap();
+    assert!(!faulted(&injector, "/mnt"));
+    assert!(!faulted(&injector, "/mnt/file"));
+    assert!(faulted(&injector, "/mnt/dir/file"));
+    assert!(!faulted(&injector, "/mnt/dir/nested/file"));
+    assert!(!faulted(&injector, "/other/dir/file"));
+
+    // the mount point itself is at depth 0
+    let injector = build(r#""maxDepth": 0"#).unwrap();
+    assert!(faulted(&injector, "/mnt"));
+    assert!(!faulted(&injector, "/mnt/file"));
+
+    let injector = build(r#""minDepth": 3"#).unwrap();
+    assert!(!faulted(&injector, "/mnt/dir/file"));
+    assert!(faulted(&injector, "/mnt/dir/nested/file"));
+
+    assert!(build(r#""minDepth": 2, "maxDepth": 1"#).is_err());
+}
+
+#[test]
+fn deterministic() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 25, "deterministic": true, "methods": ["READ"], "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faulted = |method: &Method| block_on(injector.inject(method, Path::new("/file"))).is_err();
+
+    // the operations of the other methods are not counted
+    assert!(!faulted(&Method::WRITE));
+    let faults: Vec<bool> = (0..8).map(|_| faulted(&Method::READ)).collect();
+    assert_eq!(
+        faults,
+        vec![false, false, false, true, false, false, false, true]
+    );
+
+    // the count restarts with the stats
+    faulted(&Method::READ);
+    injector.reset_status();
+    assert!(!faulted(&Method::READ));
+    assert!(!faulted(&Method::READ));
+    assert!(!faulted(&Method::READ));
+    assert!(faulted(&Method::READ));
+}
+
+#[test]
+fn first_only() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "firstOnly": true, "firstOnlyCapacity": 2, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faulted = |ino: Option<u64>| {
+        block_on(RequestContext::default().scope(async {
+            if let Some(ino) = ino {
+                RequestContext::set_ino(ino);
+            }
+            injector.inject(&Method::OPEN, Path::new("/file")).await
+        }))
+        .is_err()
+    };
+
+    assert!(faulted(Some(1)));
+    assert!(!faulted(Some(1)));
+    assert!(faulted(Some(2)));
+    assert!(!faulted(None));
+
+    // the least recently matched file is forgotten beyond the capacity
+    assert!(!faulted(Some(1)));
+    assert!(faulted(Some(3)));
+    assert!(faulted(Some(2)));
+    assert!(!faulted(Some(3)));
+
+    injector.reset_status();
+    assert!(faulted(Some(1)));
+}
+
+#[test]
+fn ioctl_commands() {
+    // FS_IOC_SETFLAGS
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "methods": ["IOCTL"], "ioctlCommands": [1074292226], "faults": [{"errno": 1, "weight": 1}]}"#,
+    );
+    let inject = |command: Option<u32>| {
+        block_on(RequestContext::default().scope(async {
+            if let Some(command) = command {
+                RequestContext::set_ioctl_command(command);
+            }
+            injector.inject(&Method::IOCTL, Path::new("/file")).await
+        }))
+        .is_err()
+    };
+
+    assert!(inject(Some(0x4008_6602)));
+    // FS_IOC_GETFLAGS
+    assert!(!inject(Some(0x8008_6601)));
+    assert!(!inject(None));
+}
+
+#[test]
+fn comm() {
+    let comm = std::fs::read_to_string("/proc/self/comm").unwrap();
+    let build = |comm: &str| {
+        common::build(&format!(
+            r#"{{"type": "fault", "percent": 100, "comm": ["{}"], "faults": [{{"errno": 5, "weight": 1}}]}}"#,
+            comm
+        ))
+    };
+    let inject = |injector: &MultiInjector, pid: u32| {
+        let mut ctx = RequestContext::default();
+        ctx.pid = pid;
+        block_on(ctx.scope(injector.inject(&Method::OPEN, Path::new("/file")))).is_err()
+    };
+
+    let injector = build(comm.trim_end());
+    assert!(inject(&injector, std::process::id()));
+    assert!(!inject(&build("other"), std::process::id()));
+
+    // the process has exited
+    let mut child = std::process::Command::new("true").spawn().unwrap();
+    let pid = child.id();
+    child.wait().unwrap();
+    assert!(!inject(&injector, pid));
+}
+
+#[test]
+fn mnt_ns() {
+    let ns = std::fs::metadata("/proc/self/ns/mnt").unwrap().ino();
+    let build = |ns: &str| {
+        common::build(&format!(
+            r#"{{"type": "fault", "percent": 100, "mntNs": ["{}"], "faults": [{{"errno": 5, "weight": 1}}]}}"#,
+            ns
+        ))
+    };
+    let inject = |injector: &MultiInjector, pid: u32| {
+        let mut ctx = RequestContext::default();
+        ctx.pid = pid;
+        block_on(ctx.scope(injector.inject(&Method::OPEN, Path::new("/file")))).is_err()
+    };
+
+    let injector = build(&format!("mnt:[{}]", ns));
+    assert!(inject(&injector, std::process::id()));
+    assert!(inject(&build(&ns.to_string()), std::process::id()));
+    assert!(!inject(&build(&(ns + 1).to_string()), std::process::id()));
+
+    // the process has exited
+    let mut child = std::process::Command::new("true").spawn().unwrap();
+    let pid = child.id();
+    child.wait().unwrap();
+    assert!(!inject(&injector, pid));
+
+    assert!(common::try_build(
+        r#"{"type": "fault", "percent": 100, "mntNs": ["net:[1]"], "faults": [{"errno": 5, "weight": 1}]}"#,
+    ).is_err());
+}
+
+#[test]
+fn phases() {
+    let build = |repeat: bool| {
+        common::build(&format!(
+            r#"{{"type": "phases", "loop": {}, "phases": [
+                {{"duration": "200ms", "injectors": [{{"type": "fault", "percent": 100, "faults": [{{"errno": 5, "weight": 1}}]}}]}},
+                {{"duration": "200ms", "injectors": []}}
+            ]}}"#,
+            repeat
+        ))
+    };
+    let faulted = |injector: &MultiInjector| {
+        block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err()
+    };
+    let once = build(false);
+    let looped = build(true);
+
+    assert!(faulted(&once) && faulted(&looped));
+    assert_eq!(once.status()[0].phase, Some(0));
+    std::thread::sleep(Duration::from_millis(250));
+    assert!(!faulted(&once) && !faulted(&looped));
+    assert_eq!(once.status()[0].phase, Some(1));
+
+    // the phases stop after the last one, unless they are looped
+    std::thread::sleep(Duration::from_millis(200));
+    assert!(!faulted(&once));
+    assert_eq!(once.status()[0].phase, None);
+    assert!(faulted(&looped));
+    assert_eq!(looped.status()[0].phase, Some(0));
+    assert_eq!(looped.status()[0].matched, 2);
+
+    assert!(common::try_build(
+        r#"{"type": "phases", "phases": [{"duration": "0s", "injectors": []}]}"#,
+    )
+    .is_err());
+}
+
+#[test]
+fn burst() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "faults": [{"errno": 5, "weight": 1}], "burst": {"duration": "200ms", "quietDuration": "200ms"}}"#,
+    );
+    let faults = |count: usize| {
+        (0..count)
+            .filter(|_| block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err())
+            .count()
+    };
+
+    // the first matched operation starts a burst
+    assert_eq!(faults(10), 10);
+    let burst = injector.status()[0].burst.clone().unwrap();
+    assert!(burst.active);
+    assert_eq!(burst.bursts, 1);
+
+    std::thread::sleep(Duration::from_millis(250));
+    assert_eq!(faults(10), 0);
+    assert!(!injector.status()[0].burst.clone().unwrap().active);
+
+    std::thread::sleep(Duration::from_millis(200));
+    assert_eq!(faults(10), 10);
+    assert_eq!(injector.status()[0].burst.clone().unwrap().bursts, 2);
+
+    assert!(common::try_build(
+        r#"{"type": "fault", "percent": 100, "faults": [{"errno": 5, "weight": 1}], "burst": {"duration": "1s", "quietDuration": "1s", "probability": 2}}"#,
+    ).is_err());
+}
+
+#[test]
+fn offset_range() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "methods": ["READ"], "offsetMin": 0, "offsetMax": 4096, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faulted = |range: Option<(i64, u64)>| {
+        block_on(RequestContext::default().scope(async {
+            if let Some((offset, length)) = range {
+                RequestContext::set_io_range(offset, length);
+            }
+            injector.inject(&Method::READ, Path::new("/file")).await
+        }))
+        .is_err()
+    };
+
+    // fully inside, straddling and fully outside of the range
+    assert!(faulted(Some((0, 4096))));
+    assert!(faulted(Some((1024, 100))));
+    assert!(faulted(Some((4000, 4096))));
+    assert!(!faulted(Some((4096, 4096))));
+    assert!(!faulted(Some((8192, 100))));
+    // the operation without the range doesn't match
+    assert!(!faulted(None));
+
+    assert!(common::try_build(
+        r#"{"type": "latency", "percent": 100, "offsetMin": 8192, "offsetMax": 4096, "latency": "1ms"}"#,
+    ).is_err());
+}
+
+#[test]
+fn disabled() {
+    let injector = common::build(
+        r#"{"type": "fault", "name": "eio", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    let faulted = |injector: &MultiInjector| {
+        block_on(injector.inject(&Method::OPEN, Path::new("/file"))).is_err()
+    };
+    assert!(faulted(&injector));
+
+    // the disabled injector passes everything through, and keeps its counter
+    let disabled = injector.set_enabled("eio", false).unwrap();
+    assert!(!faulted(&disabled));
+    assert!(!disabled.injects(&Method::OPEN));
+    assert!(!disabled.status()[0].enabled);
+    assert_eq!(disabled.status()[0].matched, 1);
+
+    let enabled = disabled.set_enabled("eio", true).unwrap();
+    assert!(faulted(&enabled));
+    assert_eq!(enabled.status()[0].matched, 2);
+    assert!(injector.set_enabled("unknown", false).is_err());
+}
+
+#[test]
+fn retries() {
+    let build = |retries: &str| {
+        common::build(&format!(
+            r#"{{"type": "fault", "percent": 0, "retries": "{}", "faults": [{{"errno": 5, "weight": 1}}]}}"#,
+            retries
+        ))
+    };
+    let inject = |injector: &MultiInjector, retry: bool| {
+        let mut ctx = RequestContext::default();
+        ctx.retry = retry;
+        block_on(ctx.scope(injector.inject(&Method::OPEN, Path::new("/file")))).is_err()
+    };
+
+    // the retries match regardless of the percent with `always`
+    let always = build("always");
+    assert!(inject(&always, true));
+    assert!(!inject(&always, false));
+
+    let never = common::build(
+        r#"{"type": "fault", "percent": 100, "retries": "never", "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    assert!(!inject(&never, true));
+    assert!(inject(&never, false));
+    assert!(serde_json::from_str::<InjectorConfig>(
+        r#"{"type": "fault", "percent": 100, "retries": "sometimes", "faults": []}"#
+    )
+    .is_err());
+}
+
+#[test]
+fn expr() {
+    let injector = common::build(
+        r#"{"type": "fault", "percent": 100, "methods": ["open"], "faults": [{"errno": 5, "weight": 1}],
+            "expr": {"or": [{"path": "/a/*"}, {"and": [{"path": "/b/*"}, {"not": {"path": "/b/keep"}}]}]}}"#,
+    );
+    let open = |path: &str| block_on(injector.inject(&Method::OPEN, Path::new(path))).is_err();
+
+    assert!(open("/a/file"));
+    assert!(open("/b/file"));
+    assert!(!open("/b/keep"));
+    assert!(!open("/c/file"));
+    // the flat fields are still matched
+    assert!(block_on(injector.inject(&Method::READ, Path::new("/a/file"))).is_ok());
+
+    // a sub-filter only has the conditions
+    let build = |expr: &str| {
+        let conf = serde_json::from_str::<InjectorConfig>(&format!(
+            r#"{{"type": "fault", "percent": 100, "faults": [{{"errno": 5, "weight": 1}}], "expr": {}}}"#,
+            expr
+        ))?;
+        MultiInjector::build(vec![conf], Path::new("/"))
+    };
+    assert!(build(r#"{"and": []}"#).is_ok());
+    assert!(build(r#"{"or": [{"path": "/a/*", "percent": 50}]}"#).is_err());
+    assert!(build(r#"{"not": [{"path": "/a/*"}]}"#).is_err());
+}
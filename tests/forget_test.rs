@@ -0,0 +1,110 @@
+use std::ffi::OsString;
+use std::future::Future;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+use futures::executor::block_on;
+use toda::hookfs::runtime::spawn;
+use toda::hookfs::{AsyncFileSystemImpl, HookFs, RequestContext};
+use toda::injector::{InjectorConfig, MultiInjector};
+
+const FILES: usize = 100;
+
+// init creates the files in a new backing directory, and the hookfs on it
+// without mounting, so that the operations are called directly
+fn init(name: &str, config: &str) -> Arc<HookFs> {
+    let backend: PathBuf = ["/tmp/test_forget_backend", name].iter().collect();
+    let mount: PathBuf = ["/tmp/test_forget", name].iter().collect();
+    std::fs::remove_dir_all(&backend).ok();
+    std::fs::create_dir_all(&backend).unwrap();
+    for i in 0..FILES {
+        std::fs::write(backend.join(format!("file-{}", i)), "hello").unwrap();
+    }
+
+    let config: Vec<InjectorConfig> = serde_json::from_str(config).unwrap();
+    let hookfs = HookFs::new(
+        &mount,
+        &backend,
+        MultiInjector::build(config, &mount).unwrap(),
+    );
+    hookfs.enable_injection();
+    Arc::new(hookfs)
+}
+
+fn run<F>(future: F) -> F::Output
+where
+    F: Future + Send + 'static,
+    F::Output: Send + 'static,
+{
+    block_on(spawn(RequestContext::default().scope(future))).unwrap()
+}
+
+fn lookup(hookfs: &Arc<HookFs>, i: usize) -> u64 {
+    let hookfs = hookfs.clone();
+    let name = OsString::from(format!("file-{}", i));
+    let entry = run(async move { hookfs.lookup(1, name).await }).unwrap();
+    entry.stat.ino
+}
+
+fn forget(hookfs: &Arc<HookFs>, ino: u64, nlookup: u64) {
+    let hookfs = hookfs.clone();
+    run(async move { hookfs.forget(ino, nlookup).await });
+}
+
+fn inodes(hookfs: &Arc<HookFs>) -> usize {
+    let hookfs = hookfs.clone();
+    run(async move { hookfs.inodes().await })
+}
+
+fn getattr(hookfs: &Arc<HookFs>, ino: u64) -> Option<i32> {
+    let hookfs = hookfs.clone();
+    run(async move { hookfs.getattr(ino).await })
+        .err()
+        .map(|err| err.into())
+}
+
+#[test]
+fn forget_inodes() {
+    let hookfs = init("forget_inodes", "[]");
+    assert_eq!(inodes(&hookfs), 1);
+
+    let mut inos = Vec::new();
+    for i in 0..FILES {
+        inos.push(lookup(&hookfs, i));
+        lookup(&hookfs, i);
+    }
+    assert_eq!(inodes(&hookfs), FILES + 1);
+
+    // the inodes are kept until all of their lookups are forgotten
+    for ino in inos.iter() {
+        forget(&hookfs, *ino, 1);
+    }
+    assert_eq!(inodes(&hookfs), FILES + 1);
+    for ino in inos.iter() {
+        forget(&hookfs, *ino, 1);
+    }
+    assert_eq!(inodes(&hookfs), 1);
+
+    // the root is never forgotten
+    forget(&hookfs, 1, 1);
+    assert_eq!(inodes(&hookfs), 1);
+}
+
+#[test]
+fn forget_first_only() {
+    let hookfs = init(
+        "forget_first_only",
+        r#"[{"type": "fault", "percent": 100, "methods": ["getattr"], "firstOnly": true,
+             "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+
+    let ino = lookup(&hookfs, 0);
+    assert_eq!(getattr(&hookfs, ino), Some(libc::EIO));
+    assert_eq!(getattr(&hookfs, ino), None);
+
+    // the forgotten file is the first one again when it's looked up later
+    forget(&hookfs, ino, 1);
+    assert_eq!(inodes(&hookfs), 1);
+    assert_eq!(lookup(&hookfs, 0), ino);
+    assert_eq!(getattr(&hookfs, ino), Some(libc::EIO));
+}
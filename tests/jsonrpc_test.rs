@@ -1,7 +1,10 @@
+use std::path::Path;
 use std::sync::mpsc::channel;
-use std::sync::Mutex;
+use std::sync::{Arc, Mutex};
 
 use anyhow::anyhow;
+use toda::hookfs::{Capabilities, HookFs};
+use toda::injector::MultiInjector;
 use toda::jsonrpc::{self, new_handler, Comm};
 #[test]
 fn test_status_good() {
@@ -16,6 +19,34 @@ fn test_status_good() {
     assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
 }
 
+#[test]
+fn test_status_with_stats() {
+    let (tx, _rx) = channel();
+    let io = new_handler(jsonrpc::RpcImpl::new(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        None,
+    ));
+    let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+    let response =
+        r#"{"jsonrpc":"2.0","result":{"generation":0,"mounts":[],"status":"ok"},"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+}
+
+#[test]
+fn test_reset_stats() {
+    let (tx, _rx) = channel();
+    let io = new_handler(jsonrpc::RpcImpl::new(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        None,
+    ));
+    let request = r#"{"jsonrpc": "2.0","method":"reset_stats","params":[],"id":1}"#;
+    let response =
+        r#"{"jsonrpc":"2.0","result":{"generation":0,"mounts":[],"status":"ok"},"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+}
+
 #[test]
 fn test_status_bad() {
     let (tx, rx) = channel();
@@ -55,3 +86,384 @@ fn test_should_fail_if_config_is_bad() {
     ));
     assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
 }
+
+#[test]
+fn test_status_of_unknown_mount() {
+    let (tx, _rx) = channel();
+    let io = new_handler(jsonrpc::RpcImpl::new(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        None,
+    ));
+    let request =
+        r#"{"jsonrpc": "2.0","method":"get_status","params":["stats","/mnt/unknown"],"id":1}"#;
+    let response = r#"{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params: unknown mount /mnt/unknown"},"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+}
+
+#[test]
+fn test_restore_persisted_config() {
+    let persist_path = std::env::temp_dir().join("toda_test_persisted_config.json");
+    std::fs::remove_file(&persist_path).ok();
+    let handler = || {
+        let (tx, _rx) = channel();
+        let hookfs = HookFs::new(
+            "/mnt/persisted",
+            "/mnt/persisted_backend",
+            MultiInjector::build(vec![], Path::new("/mnt/persisted")).unwrap(),
+        );
+        new_handler(
+            jsonrpc::RpcImpl::with_mounts(
+                Mutex::new(Ok(())),
+                Mutex::new(tx),
+                vec![Arc::new(hookfs)],
+            )
+            .with_persistence(persist_path.clone()),
+        )
+    };
+    let generation = |io: &jsonrpc_core::IoHandler| {
+        let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+        let response: serde_json::Value =
+            serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+        let result = &response["result"];
+        (
+            result["generation"].as_u64().unwrap(),
+            result["mounts"][0]["injectors"].as_array().unwrap().len(),
+        )
+    };
+
+    let io = handler();
+    assert_eq!(generation(&io), (0, 0));
+    let request = r#"{"jsonrpc": "2.0","method":"update","params":[[{"type": "fault", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]],"id":1}"#;
+    let response = r#"{"jsonrpc":"2.0","result":"ok","id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+    assert_eq!(generation(&io), (1, 1));
+
+    // the config and the generation survive the restart
+    drop(io);
+    let io = handler();
+    assert_eq!(generation(&io), (1, 1));
+
+    // the controller can set the generation
+    let request = r#"{"jsonrpc": "2.0","method":"update","params":[[], null, 7],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+    assert_eq!(generation(&io), (7, 0));
+    std::fs::remove_file(&persist_path).ok();
+}
+
+#[test]
+fn test_update_named_injector() {
+    let (tx, _rx) = channel();
+    let hookfs = HookFs::new(
+        "/mnt/named",
+        "/mnt/named_backend",
+        MultiInjector::build(vec![], Path::new("/mnt/named")).unwrap(),
+    );
+    let io = new_handler(jsonrpc::RpcImpl::with_mounts(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        vec![Arc::new(hookfs)],
+    ));
+    let injectors = |io: &jsonrpc_core::IoHandler| {
+        let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+        let response: serde_json::Value =
+            serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+        let mount = &response["result"]["mounts"][0];
+        let mut names: Vec<_> = mount["namedInjectors"]
+            .as_object()
+            .map(|named| named.keys().cloned().collect())
+            .unwrap_or_default();
+        names.sort();
+        (mount["injectors"].as_array().unwrap().len(), names)
+    };
+    let ok = Some(r#"{"jsonrpc":"2.0","result":"ok","id":1}"#.to_string());
+
+    let request = r#"{"jsonrpc": "2.0","method":"update","params":[[{"type": "fault", "name": "eio", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}, {"type": "latency", "percent": 100, "latency": "1ms"}]],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert_eq!(injectors(&io), (2, vec!["eio".to_owned()]));
+
+    // the named injector is replaced, and the new one is appended
+    let request = r#"{"jsonrpc": "2.0","method":"update_injector","params":[{"type": "fault", "name": "eio", "percent": 50, "faults": [{"errno": 5, "weight": 1}]}],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    let request = r#"{"jsonrpc": "2.0","method":"update_injector","params":[{"type": "latency", "name": "slow", "percent": 100, "latency": "1ms"}],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert_eq!(
+        injectors(&io),
+        (3, vec!["eio".to_owned(), "slow".to_owned()])
+    );
+
+    let request = r#"{"jsonrpc": "2.0","method":"remove_injector","params":["eio"],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert_eq!(injectors(&io), (2, vec!["slow".to_owned()]));
+
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(
+        response["error"]["message"],
+        "Invalid params: unknown injector eio"
+    );
+
+    // the names are unique
+    let request = r#"{"jsonrpc": "2.0","method":"update","params":[[{"type": "latency", "name": "slow", "percent": 100, "latency": "1ms"}, {"type": "latency", "name": "slow", "percent": 100, "latency": "2ms"}]],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(
+        response["error"]["message"],
+        "Invalid params: duplicate injector name slow"
+    );
+    assert_eq!(injectors(&io), (2, vec!["slow".to_owned()]));
+}
+
+#[test]
+fn test_compressed_persisted_config() {
+    for (name, magic) in &[
+        (
+            "toda_test_persisted_config.json.zst",
+            &[0x28u8, 0xb5, 0x2f, 0xfd][..],
+        ),
+        ("toda_test_persisted_config.json.gz", &[0x1fu8, 0x8b][..]),
+    ] {
+        let persist_path = std::env::temp_dir().join(name);
+        std::fs::remove_file(&persist_path).ok();
+        let handler = || {
+            let (tx, _rx) = channel();
+            let hookfs = HookFs::new(
+                "/mnt/compressed",
+                "/mnt/compressed_backend",
+                MultiInjector::build(vec![], Path::new("/mnt/compressed")).unwrap(),
+            );
+            new_handler(
+                jsonrpc::RpcImpl::with_mounts(
+                    Mutex::new(Ok(())),
+                    Mutex::new(tx),
+                    vec![Arc::new(hookfs)],
+                )
+                .with_persistence(persist_path.clone()),
+            )
+        };
+        let injectors = |io: &jsonrpc_core::IoHandler| {
+            let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+            let response: serde_json::Value =
+                serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+            response["result"]["mounts"][0]["injectors"]
+                .as_array()
+                .unwrap()
+                .len()
+        };
+
+        let io = handler();
+        let request = r#"{"jsonrpc": "2.0","method":"update","params":[[{"type": "fault", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]],"id":1}"#;
+        let response = r#"{"jsonrpc":"2.0","result":"ok","id":1}"#;
+        assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+        assert!(std::fs::read(&persist_path).unwrap().starts_with(*magic));
+
+        // the compression is detected when it's loaded
+        drop(io);
+        let io = handler();
+        assert_eq!(injectors(&io), 1);
+        std::fs::remove_file(&persist_path).ok();
+    }
+}
+
+#[test]
+fn test_set_readonly() {
+    let (tx, _rx) = channel();
+    let hookfs = Arc::new(HookFs::new(
+        "/mnt/readonly",
+        "/mnt/readonly_backend",
+        MultiInjector::build(vec![], Path::new("/mnt/readonly")).unwrap(),
+    ));
+    let io = new_handler(jsonrpc::RpcImpl::with_mounts(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        vec![hookfs.clone()],
+    ));
+    let readonly = |io: &jsonrpc_core::IoHandler| {
+        let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+        let response: serde_json::Value =
+            serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+        response["result"]["mounts"][0]["readonly"]
+            .as_bool()
+            .unwrap()
+    };
+    let response = Some(r#"{"jsonrpc":"2.0","result":"ok","id":1}"#.to_string());
+    assert!(!readonly(&io));
+
+    let request = r#"{"jsonrpc": "2.0","method":"set_readonly","params":[true],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), response);
+    assert!(readonly(&io));
+    assert!(hookfs.readonly());
+
+    // it's reversed by the same method
+    let request =
+        r#"{"jsonrpc": "2.0","method":"set_readonly","params":[false, "/mnt/readonly"],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), response);
+    assert!(!readonly(&io));
+}
+
+#[test]
+fn test_debug_info() {
+    let (tx, _rx) = channel();
+    let rpc = || {
+        jsonrpc::RpcImpl::with_mounts(
+            Mutex::new(Ok(())),
+            Mutex::new(tx.clone()),
+            vec![Arc::new(HookFs::new(
+                "/mnt/debug",
+                "/mnt/debug_backend",
+                MultiInjector::build(vec![], Path::new("/mnt/debug")).unwrap(),
+            ))],
+        )
+    };
+    let request = r#"{"jsonrpc": "2.0","method":"debug_info","params":[],"id":1}"#;
+
+    // it's not exposed by default
+    let response: serde_json::Value =
+        serde_json::from_str(&new_handler(rpc()).handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(response["error"]["code"], -32600);
+
+    let io = new_handler(rpc().with_debug_info());
+    let response = r#"{"jsonrpc":"2.0","result":{"mounts":[{"backingPath":"/mnt/debug_backend","path":"/mnt/debug"}],"processes":[]},"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+}
+
+#[test]
+fn test_validate() {
+    let (tx, _rx) = channel();
+    let hookfs = HookFs::new(
+        "/mnt/validate",
+        "/mnt/validate_backend",
+        MultiInjector::build(vec![], Path::new("/mnt/validate")).unwrap(),
+    );
+    let io = new_handler(jsonrpc::RpcImpl::with_mounts(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        vec![Arc::new(hookfs)],
+    ));
+
+    let request = r#"{"jsonrpc": "2.0","method":"validate","params":[[{"type": "fault", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]],"id":1}"#;
+    let response = r#"{"jsonrpc":"2.0","result":[],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), Some(response.to_string()));
+
+    // all the errors are returned
+    let request = r#"{"jsonrpc": "2.0","method":"validate","params":[[{"type": "fault", "name": "bad", "percent": 120, "faults": [{"errno": 5, "weight": 1}]}, {"type": "fault", "percent": 100, "faults": [{"errno": 100000, "weight": 1}]}, {"type": "latency", "percent": 100, "latency": "1ms", "pathRegex": "("}]],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    let errors = response["result"].as_array().unwrap();
+    assert_eq!(errors.len(), 3, "{:?}", errors);
+    assert!(errors[0]
+        .as_str()
+        .unwrap()
+        .starts_with("injector 0 (bad): percent 120"));
+    assert!(errors[1].as_str().unwrap().contains("unknown errno 100000"));
+    assert!(errors[2].as_str().unwrap().contains("invalid path regex"));
+
+    let request = r#"{"jsonrpc": "2.0","method":"validate","params":[["blah"]],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(response["result"].as_array().unwrap().len(), 1);
+
+    // nothing is applied
+    let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(
+        response["result"]["mounts"][0]["injectors"],
+        serde_json::json!([])
+    );
+}
+
+#[test]
+fn test_enable_injector() {
+    let (tx, _rx) = channel();
+    let hookfs = HookFs::new(
+        "/mnt/enabled",
+        "/mnt/enabled_backend",
+        MultiInjector::build(vec![], Path::new("/mnt/enabled")).unwrap(),
+    );
+    let io = new_handler(jsonrpc::RpcImpl::with_mounts(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        vec![Arc::new(hookfs)],
+    ));
+    let enabled = |io: &jsonrpc_core::IoHandler| {
+        let request = r#"{"jsonrpc": "2.0","method":"list_injectors","params":[],"id":1}"#;
+        let response: serde_json::Value =
+            serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+        response["result"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|status| status["enabled"].as_bool().unwrap())
+            .collect::<Vec<_>>()
+    };
+    let ok = Some(r#"{"jsonrpc":"2.0","result":"ok","id":1}"#.to_string());
+
+    let request = r#"{"jsonrpc": "2.0","method":"update","params":[[{"type": "fault", "name": "eio", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}, {"type": "latency", "name": "slow", "enabled": false, "percent": 100, "latency": "1ms"}]],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert_eq!(enabled(&io), vec![true, false]);
+
+    let request = r#"{"jsonrpc": "2.0","method":"disable_injector","params":["eio"],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    let request = r#"{"jsonrpc": "2.0","method":"enable_injector","params":["slow"],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert_eq!(enabled(&io), vec![false, true]);
+
+    let request = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(
+        response["result"]["mounts"][0]["namedInjectors"]["eio"]["enabled"],
+        false
+    );
+
+    let request = r#"{"jsonrpc": "2.0","method":"enable_injector","params":["unknown"],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    assert_eq!(
+        response["error"]["message"],
+        "Invalid params: unknown injector unknown"
+    );
+}
+
+#[test]
+fn test_version() {
+    let (tx, _rx) = channel();
+    let io = new_handler(jsonrpc::RpcImpl::with_mounts(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        vec![Arc::new(HookFs::new(
+            "/mnt/version",
+            "/mnt/version_backend",
+            MultiInjector::build(vec![], Path::new("/mnt/version")).unwrap(),
+        ))],
+    ));
+    let request = r#"{"jsonrpc": "2.0","method":"version","params":[],"id":1}"#;
+    let response: serde_json::Value =
+        serde_json::from_str(&io.handle_request_sync(request).unwrap()).unwrap();
+    let result = &response["result"];
+    assert_eq!(result["version"], env!("CARGO_PKG_VERSION"));
+    assert!(result["fuser"].as_str().unwrap().starts_with("0.6"));
+    // the protocol is negotiated when it's mounted
+    assert_eq!(
+        result["mounts"],
+        serde_json::json!([{"path": "/mnt/version", "protocol": null}])
+    );
+}
+
+#[test]
+fn test_protocol_of_capabilities() {
+    // a kernel of 7.23 with the writeback cache
+    let protocol = Capabilities::from_flags((1 << 0) | (1 << 16)).protocol();
+    assert_eq!(
+        (protocol.major, protocol.minor, protocol.exact),
+        (7, 23, false)
+    );
+
+    // the kernels newer than fuser negotiate the version of fuser
+    let protocol = Capabilities::from_flags((1 << 0) | (1 << 24)).protocol();
+    assert_eq!(
+        (protocol.major, protocol.minor, protocol.exact),
+        (7, 28, true)
+    );
+}
@@ -0,0 +1,36 @@
+mod common;
+
+use std::path::Path;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use futures::executor::block_on;
+use toda::hookfs::runtime::spawn;
+use toda::injector::{Injector, Method, MultiInjector};
+
+fn read(injector: &Arc<MultiInjector>) -> Duration {
+    let injector = injector.clone();
+    let start = Instant::now();
+    let read = spawn(async move { injector.inject(&Method::READ, Path::new("/file")).await });
+    block_on(read).unwrap().unwrap();
+    start.elapsed()
+}
+
+#[test]
+fn ramp() {
+    let injector = Arc::new(common::build(
+        r#"{"type": "latency", "percent": 100, "methods": ["READ"], "distribution": "ramp", "start": "0ms", "end": "300ms", "rampDuration": "600ms"}"#,
+    ));
+
+    // it starts from `start`, and holds at `end` after the ramp
+    assert!(read(&injector) < Duration::from_millis(150));
+    std::thread::sleep(Duration::from_millis(600));
+    let latency = read(&injector);
+    assert!(latency >= Duration::from_millis(300));
+    assert!(latency < Duration::from_millis(600));
+
+    assert!(common::try_build(
+        r#"{"type": "latency", "percent": 100, "distribution": "ramp", "end": "1s", "rampDuration": "5m"}"#
+    )
+    .is_err());
+}
@@ -0,0 +1,38 @@
+mod common;
+
+use std::path::Path;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use futures::executor::block_on;
+use toda::hookfs::runtime::spawn;
+use toda::injector::{self, Injector, Method};
+
+// the cap and the cancelling are global, so they are tested on their own to
+// not affect the others
+#[test]
+fn max_latency() {
+    injector::set_max_latency(Some(Duration::from_millis(50)));
+    for conf in &[
+        r#"{"type": "latency", "percent": 100, "methods": ["READ"], "latency": "10s"}"#,
+        r#"{"type": "timeout", "percent": 100, "methods": ["READ"], "timeout": "10s"}"#,
+    ] {
+        let injector = Arc::new(common::build(conf));
+        let start = Instant::now();
+        let read = spawn(async move { injector.inject(&Method::READ, Path::new("/file")).await });
+        block_on(read).unwrap().ok();
+        assert!(start.elapsed() < Duration::from_secs(5));
+    }
+
+    // the pending delays are woken up by the drain
+    injector::set_max_latency(None);
+    let injector = Arc::new(common::build(
+        r#"{"type": "latency", "percent": 100, "methods": ["READ"], "latency": "10s"}"#,
+    ));
+    let start = Instant::now();
+    let read = spawn(async move { injector.inject(&Method::READ, Path::new("/file")).await });
+    std::thread::sleep(Duration::from_millis(100));
+    injector::cancel_delays();
+    assert!(block_on(read).unwrap().is_ok());
+    assert!(start.elapsed() < Duration::from_secs(5));
+}
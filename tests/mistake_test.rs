@@ -0,0 +1,147 @@
+mod common;
+
+use std::path::Path;
+
+use toda::hookfs::{Bmap, Data, Reply};
+use toda::injector::{Injector, Method, MultiInjector};
+
+// fill_config returns the config of the mistake with the `filling` at 1000
+fn fill_config(filling: &str) -> String {
+    format!(
+        r#"{{
+            "type": "mistake",
+            "percent": 100,
+            "mistake": {{
+                "filling": "{}",
+                "maxLength": 300,
+                "maxOccurrences": 1,
+                "offset": 1000
+            }}
+        }}"#,
+        filling
+    )
+}
+
+fn read(injector: &MultiInjector, content: &[u8], offset: usize) -> Vec<u8> {
+    let mut data = Data::with_offset(content.to_vec(), offset as i64);
+    injector
+        .inject_reply(
+            &Method::READ,
+            Path::new("/file"),
+            &mut Reply::Data(&mut data),
+        )
+        .unwrap();
+    data.data
+}
+
+fn check_chunked_read(filling: &str) {
+    let injector = common::build(&fill_config(filling));
+    let original: Vec<u8> = (0..4096).map(|i| (i % 251 + 1) as u8).collect();
+
+    let whole = read(&injector, &original, 0);
+
+    let mut chunked = Vec::new();
+    for (index, chunk) in original.chunks(128).enumerate() {
+        chunked.extend(read(&injector, chunk, index * 128));
+    }
+
+    assert_eq!(whole, chunked);
+    assert_eq!(&whole[..1000], &original[..1000]);
+    assert_eq!(&whole[1300..], &original[1300..]);
+    assert_ne!(&whole[1000..1300], &original[1000..1300]);
+}
+
+#[test]
+fn mistake_chunked_read_zero() {
+    check_chunked_read("zero");
+}
+
+#[test]
+fn mistake_chunked_read_random() {
+    check_chunked_read("random");
+}
+
+// bitflip_config returns the config of the mistake flipping 3 bits
+fn bitflip_config(offset: Option<u64>, seed: u64) -> String {
+    let offset = offset.map(|offset| format!(r#", "offset": {}"#, offset));
+    format!(
+        r#"{{
+            "type": "mistake",
+            "percent": 100,
+            "mistake": {{
+                "mode": "bitflip",
+                "bits": 3,
+                "maxLength": 300,
+                "maxOccurrences": 1,
+                "seed": {}{}
+            }}
+        }}"#,
+        seed,
+        offset.unwrap_or_default()
+    )
+}
+
+fn flipped_bits(left: &[u8], right: &[u8]) -> u32 {
+    left.iter()
+        .zip(right.iter())
+        .map(|(l, r)| (l ^ r).count_ones())
+        .sum()
+}
+
+#[test]
+fn mistake_bitflip_range() {
+    let injector = common::build(&bitflip_config(Some(1000), 42));
+    let original: Vec<u8> = (0..4096).map(|i| (i % 251) as u8).collect();
+
+    let sabotaged = read(&injector, &original, 0);
+    assert_eq!(flipped_bits(&sabotaged, &original), 3);
+    assert_eq!(&sabotaged[..1000], &original[..1000]);
+    assert_eq!(&sabotaged[1300..], &original[1300..]);
+}
+
+#[test]
+fn mistake_bitflip_seed() {
+    let original: Vec<u8> = (0..4096).map(|i| (i % 251) as u8).collect();
+
+    let first = read(&common::build(&bitflip_config(None, 7)), &original, 0);
+    let second = read(&common::build(&bitflip_config(None, 7)), &original, 0);
+    assert_eq!(flipped_bits(&first, &original), 3);
+    assert_eq!(first, second);
+}
+
+#[test]
+fn mistake_bmap() {
+    let mut bmap = Bmap::new(0x1234);
+    common::build(&bitflip_config(None, 42))
+        .inject_reply(
+            &Method::BMAP,
+            Path::new("/file"),
+            &mut Reply::Bmap(&mut bmap),
+        )
+        .unwrap();
+    assert_eq!((bmap.block ^ 0x1234).count_ones(), 3);
+}
+
+#[test]
+fn mistake_pattern_filling() {
+    let original: Vec<u8> = (0..4096).map(|i| (i % 251 + 1) as u8).collect();
+    for filling in &["0xdeadbeef", "3q2+7w=="] {
+        check_chunked_read(filling);
+
+        let sabotaged = read(&common::build(&fill_config(filling)), &original, 0);
+        let expected: Vec<u8> = [0xde, 0xad, 0xbe, 0xef]
+            .iter()
+            .cycle()
+            .take(300)
+            .cloned()
+            .collect();
+        assert_eq!(&sabotaged[1000..1300], expected.as_slice());
+    }
+}
+
+#[test]
+fn mistake_invalid_filling() {
+    for filling in &["0xdeadbee", "0xnotahex", "not base64!", "0x"] {
+        assert!(common::try_build(&fill_config(filling)).is_err());
+    }
+}
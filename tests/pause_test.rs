@@ -0,0 +1,31 @@
+use std::sync::mpsc::channel;
+use std::sync::Mutex;
+
+use toda::hookfs;
+use toda::jsonrpc::{self, new_handler};
+
+// pausing is global, so it's tested on its own to not affect the others
+#[test]
+fn pause_and_resume() {
+    let (tx, _rx) = channel();
+    let io = new_handler(jsonrpc::RpcImpl::new(
+        Mutex::new(Ok(())),
+        Mutex::new(tx),
+        None,
+    ));
+    let ok = Some(r#"{"jsonrpc":"2.0","result":"ok","id":1}"#.to_string());
+    let status = r#"{"jsonrpc": "2.0","method":"get_status","params":["stats"],"id":1}"#;
+
+    let request = r#"{"jsonrpc": "2.0","method":"pause","params":[],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert!(hookfs::paused());
+    let response = r#"{"jsonrpc":"2.0","result":{"generation":0,"mounts":[],"paused":true,"status":"ok"},"id":1}"#;
+    assert_eq!(io.handle_request_sync(status), Some(response.to_string()));
+
+    let request = r#"{"jsonrpc": "2.0","method":"resume","params":[],"id":1}"#;
+    assert_eq!(io.handle_request_sync(request), ok);
+    assert!(!hookfs::paused());
+    let response =
+        r#"{"jsonrpc":"2.0","result":{"generation":0,"mounts":[],"status":"ok"},"id":1}"#;
+    assert_eq!(io.handle_request_sync(status), Some(response.to_string()));
+}
@@ -11,23 +11,66 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-use std::ffi::OsStr;
+use std::ffi::{CString, OsStr};
 use std::fs::{read_link, read_to_string, write, File, OpenOptions};
 use std::io::{Read, Write};
-use std::os::unix::fs::symlink;
-use std::path::PathBuf;
+use std::os::unix::ffi::OsStrExt;
+use std::os::unix::fs::{symlink, MetadataExt, OpenOptionsExt, PermissionsExt};
+use std::os::unix::io::{AsRawFd, IntoRawFd};
+use std::path::{Path, PathBuf};
 use std::sync::{Arc, Once};
+use std::time::{Duration, Instant};
 
 use nix::sys::stat;
 use nix::{fcntl, unistd};
 use toda::hookfs;
-use toda::injector::MultiInjector;
+use toda::injector::{InjectorConfig, MultiInjector};
 
 // These tests are port from go-fuse test
 
 static INIT: Once = Once::new();
 
 fn init(name: &str) -> (PathBuf, fuser::BackgroundSession) {
+    init_with_config(name, "[]")
+}
+
+// init_with_config mounts the hookfs with injection enabled, and `config` is
+// a json array of injector configs
+fn init_with_config(name: &str, config: &str) -> (PathBuf, fuser::BackgroundSession) {
+    init_with_args(
+        name,
+        config,
+        &[
+            "allow_other",
+            "nonempty",
+            "fsname=toda",
+            "default_permissions",
+        ],
+    )
+}
+
+fn init_with_args(name: &str, config: &str, args: &[&str]) -> (PathBuf, fuser::BackgroundSession) {
+    init_with_hookfs(name, config, args, |hookfs| hookfs)
+}
+
+// init_with_hookfs lets `build` set up the hookfs before it's mounted
+fn init_with_hookfs<F: FnOnce(hookfs::HookFs) -> hookfs::HookFs>(
+    name: &str,
+    config: &str,
+    args: &[&str],
+    build: F,
+) -> (PathBuf, fuser::BackgroundSession) {
+    let (test_path, _, session) = mount(name, config, args, build);
+    (test_path, session)
+}
+
+// mount returns the mounted hookfs too, so that its state can be checked
+fn mount<F: FnOnce(hookfs::HookFs) -> hookfs::HookFs>(
+    name: &str,
+    config: &str,
+    args: &[&str],
+    build: F,
+) -> (PathBuf, Arc<hookfs::HookFs>, fuser::BackgroundSession) {
     let test_path_backend: PathBuf = ["/tmp/test_mnt_backend", name].iter().collect();
     let test_path: PathBuf = ["/tmp/test_mnt", name].iter().collect();
 
@@ -41,20 +84,16 @@ fn init(name: &str) -> (PathBuf, fuser::BackgroundSession) {
     std::fs::create_dir_all(&test_path_backend).ok();
     std::fs::create_dir_all(&test_path).ok();
 
-    let hookfs = Arc::new(hookfs::HookFs::new(
+    let config: Vec<InjectorConfig> = serde_json::from_str(config).unwrap();
+    let hookfs = Arc::new(build(hookfs::HookFs::new(
         &test_path,
         &test_path_backend,
-        MultiInjector::build(Vec::new()).unwrap(),
-    ));
+        MultiInjector::build(config, &test_path).unwrap(),
+    )));
+    hookfs.enable_injection();
 
-    let fs = hookfs::AsyncFileSystem::from(hookfs);
+    let fs = hookfs::AsyncFileSystem::from(hookfs.clone());
 
-    let args = [
-        "allow_other",
-        "nonempty",
-        "fsname=toda",
-        "default_permissions",
-    ];
     let flags: Vec<_> = args
         .iter()
         .flat_map(|item| vec![OsStr::new("-o"), OsStr::new(item)])
@@ -62,7 +101,7 @@ fn init(name: &str) -> (PathBuf, fuser::BackgroundSession) {
 
     let session = fuser::spawn_mount(fs, &test_path, &flags).unwrap();
     std::thread::sleep(std::time::Duration::from_secs(1));
-    (test_path, session)
+    (test_path, hookfs, session)
 }
 
 #[test]
@@ -98,6 +137,33 @@ fn file_basic() {
     drop(file);
 }
 
+#[test]
+fn statx_basic() {
+    let (test_path, _) = init("statx_basic");
+
+    let content = "hello world";
+    let target_file: PathBuf = test_path.join("target_file");
+    write(&target_file, content).unwrap();
+
+    // the basic stats are served by the kernel with getattr, and the sync
+    // makes sure it's asked rather than cached
+    let path = CString::new(target_file.as_os_str().as_bytes()).unwrap();
+    let mut stx: libc::statx = unsafe { std::mem::zeroed() };
+    let ret = unsafe {
+        libc::statx(
+            libc::AT_FDCWD,
+            path.as_ptr(),
+            libc::AT_SYMLINK_NOFOLLOW | libc::AT_STATX_FORCE_SYNC,
+            libc::STATX_BASIC_STATS,
+            &mut stx,
+        )
+    };
+    assert_eq!(ret, 0, "{}", std::io::Error::last_os_error());
+    assert_ne!(stx.stx_mask & libc::STATX_SIZE, 0);
+    assert_eq!(stx.stx_size as usize, content.len());
+    assert_eq!(stx.stx_ino, std::fs::metadata(&target_file).unwrap().ino());
+}
+
 #[test]
 fn truncate_file() {
     let (test_path, _) = init("truncate_file");
@@ -291,6 +357,209 @@ fn rename_overwrite(test_path: PathBuf, dest_exist: bool) {
     assert_eq!(before_ino, st.st_ino);
 }
 
+#[test]
+fn rename_dir_across_subdirectories() {
+    let (test_path, _) = init("rename_dir_across_subdirectories");
+    let src = test_path.join("first/dir");
+    let dest = test_path.join("second/dir");
+    std::fs::create_dir_all(&src).unwrap();
+    std::fs::create_dir_all(test_path.join("second")).unwrap();
+    write(src.join("file"), "hello").unwrap();
+    // look up the file before the rename, so that its inode is cached
+    assert_eq!(read_to_string(src.join("file")).unwrap(), "hello");
+
+    std::fs::rename(&src, &dest).unwrap();
+
+    assert!(!src.exists());
+    assert_eq!(read_to_string(dest.join("file")).unwrap(), "hello");
+    write(dest.join("file"), "world").unwrap();
+    assert_eq!(read_to_string(dest.join("file")).unwrap(), "world");
+}
+
+#[test]
+fn rename_to_existing() {
+    let (test_path, _) = init("rename_to_existing");
+    let src = test_path.join("file.tmp");
+    let dest = test_path.join("file");
+    write(&dest, "old").unwrap();
+    let mut opened = File::open(&dest).unwrap();
+    write(&src, "new").unwrap();
+
+    std::fs::rename(&src, &dest).unwrap();
+
+    assert!(!src.exists());
+    assert_eq!(read_to_string(&dest).unwrap(), "new");
+    // the replaced file is still readable through the opened fd
+    let mut content = String::new();
+    opened.read_to_string(&mut content).unwrap();
+    assert_eq!(content, "old");
+}
+
+fn renameat2(src: &Path, dest: &Path, flags: libc::c_uint) -> std::io::Result<()> {
+    let src = CString::new(src.as_os_str().as_bytes()).unwrap();
+    let dest = CString::new(dest.as_os_str().as_bytes()).unwrap();
+    let ret = unsafe {
+        libc::syscall(
+            libc::SYS_renameat2,
+            libc::AT_FDCWD,
+            src.as_ptr(),
+            libc::AT_FDCWD,
+            dest.as_ptr(),
+            flags,
+        )
+    };
+    if ret != 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+#[test]
+fn rename_noreplace_and_exchange() {
+    let (test_path, _) = init("rename_noreplace_and_exchange");
+    let first = test_path.join("first");
+    let second = test_path.join("second");
+    write(&first, "first").unwrap();
+    write(&second, "second").unwrap();
+
+    let err = renameat2(&first, &second, libc::RENAME_NOREPLACE as libc::c_uint).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EEXIST));
+
+    renameat2(&first, &second, libc::RENAME_EXCHANGE as libc::c_uint).unwrap();
+    assert_eq!(read_to_string(&first).unwrap(), "second");
+    assert_eq!(read_to_string(&second).unwrap(), "first");
+}
+
+#[test]
+fn rename_fault() {
+    let (test_path, _) = init_with_config(
+        "rename_fault",
+        r#"[{"type": "fault", "methods": ["rename"], "percent": 100, "faults": [{"errno": 18, "weight": 1}]}]"#,
+    );
+    let src = test_path.join("file.tmp");
+    let dest = test_path.join("file");
+    write(&src, "hello").unwrap();
+
+    let err = std::fs::rename(&src, &dest).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EXDEV));
+    assert_eq!(read_to_string(&src).unwrap(), "hello");
+    assert!(!dest.exists());
+}
+
+#[test]
+fn link_fault() {
+    let (test_path, _) = init_with_config(
+        "link_fault",
+        r#"[{"type": "fault", "methods": ["link"], "percent": 100, "faults": [{"errno": 1, "weight": 1}]}]"#,
+    );
+    let target = test_path.join("target");
+    write(&target, "hello").unwrap();
+
+    let err = std::fs::hard_link(&target, test_path.join("link")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EPERM));
+}
+
+#[test]
+fn mknod_fault() {
+    let (test_path, _) = init_with_config(
+        "mknod_fault",
+        r#"[{"type": "fault", "methods": ["mknod"], "path": "/tmp/test_mnt/mknod_fault/denied", "percent": 100, "faults": [{"errno": 30, "weight": 1}]}]"#,
+    );
+    let mode = stat::Mode::from_bits_truncate(0o644);
+
+    let err = unistd::mkfifo(&test_path.join("denied"), mode).unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::EROFS));
+    assert!(!Path::new("/tmp/test_mnt_backend/mknod_fault/denied").exists());
+
+    unistd::mkfifo(&test_path.join("allowed"), mode).unwrap();
+    let attr = stat::lstat(&test_path.join("allowed")).unwrap();
+    assert_eq!(attr.st_mode & libc::S_IFMT, libc::S_IFIFO);
+    assert!(Path::new("/tmp/test_mnt_backend/mknod_fault/allowed").exists());
+}
+
+#[test]
+fn create_fault() {
+    let (test_path, _) = init_with_config(
+        "create_fault",
+        r#"[{"type": "fault", "methods": ["create"], "percent": 100, "faults": [{"errno": 122, "weight": 1}]}]"#,
+    );
+    write("/tmp/test_mnt_backend/create_fault/existing", "existing").unwrap();
+
+    let err = File::create(test_path.join("new")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EDQUOT));
+    assert!(!Path::new("/tmp/test_mnt_backend/create_fault/new").exists());
+
+    // the existing file is opened even with O_CREAT
+    let mut file = OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .open(test_path.join("existing"))
+        .unwrap();
+    file.write_all(b"changed").unwrap();
+    drop(file);
+    assert_eq!(
+        read_to_string(test_path.join("existing")).unwrap(),
+        "changed"
+    );
+}
+
+#[test]
+fn mkdir_fault() {
+    let (test_path, _) = init_with_config(
+        "mkdir_fault",
+        r#"[{"type": "fault", "methods": ["mkdir"], "path": "/tmp/test_mnt/mkdir_fault/denied", "percent": 100, "faults": [{"errno": 17, "weight": 1}]}]"#,
+    );
+
+    let err = std::fs::create_dir(test_path.join("denied")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EEXIST));
+    assert!(!Path::new("/tmp/test_mnt_backend/mkdir_fault/denied").exists());
+
+    std::fs::create_dir(test_path.join("allowed")).unwrap();
+    assert!(test_path.join("allowed").is_dir());
+    write(test_path.join("allowed/file"), "hello").unwrap();
+    assert_eq!(
+        std::fs::read_to_string("/tmp/test_mnt_backend/mkdir_fault/allowed/file").unwrap(),
+        "hello"
+    );
+}
+
+#[test]
+fn rmdir_fault() {
+    let (test_path, _) = init_with_config(
+        "rmdir_fault",
+        r#"[{"type": "fault", "methods": ["rmdir"], "path": "/tmp/test_mnt/rmdir_fault/denied", "percent": 100, "faults": [{"errno": 16, "weight": 1}]}]"#,
+    );
+    std::fs::create_dir(test_path.join("denied")).unwrap();
+    std::fs::create_dir(test_path.join("allowed")).unwrap();
+
+    let err = std::fs::remove_dir(test_path.join("denied")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EBUSY));
+    assert!(test_path.join("denied").is_dir());
+
+    std::fs::remove_dir(test_path.join("allowed")).unwrap();
+    assert!(!test_path.join("allowed").exists());
+    assert!(!Path::new("/tmp/test_mnt_backend/rmdir_fault/allowed").exists());
+}
+
+#[test]
+fn unlink_fault() {
+    let (test_path, _) = init_with_config(
+        "unlink_fault",
+        r#"[{"type": "fault", "methods": ["unlink"], "path": "/tmp/test_mnt/unlink_fault/denied", "percent": 100, "faults": [{"errno": 30, "weight": 1}]}]"#,
+    );
+    write(test_path.join("denied"), "hello").unwrap();
+    write(test_path.join("allowed"), "hello").unwrap();
+
+    let err = std::fs::remove_file(test_path.join("denied")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EROFS));
+    assert_eq!(read_to_string(test_path.join("denied")).unwrap(), "hello");
+
+    std::fs::remove_file(test_path.join("allowed")).unwrap();
+    assert!(!test_path.join("allowed").exists());
+    assert!(!Path::new("/tmp/test_mnt_backend/unlink_fault/allowed").exists());
+}
+
 #[test]
 fn read_unlink() {
     let (test_path, _) = init("rename_overwrite_dest_no_exist");
@@ -325,6 +594,30 @@ fn append_write() {
     assert_eq!(output, "hello world");
 }
 
+#[test]
+fn append_offset_filter() {
+    let (test_path, _) = init_with_config(
+        "append_offset_filter",
+        r#"[{"type": "fault", "methods": ["write"], "percent": 100, "offsetMax": 8, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    // the write at 0 would fail
+    let backend = Path::new("/tmp/test_mnt_backend/append_offset_filter/file");
+    write(backend, "hello").unwrap();
+    let mut file = OpenOptions::new()
+        .append(true)
+        .open(test_path.join("file"))
+        .unwrap();
+
+    // the size known by the kernel is stale after the backing file grows, but
+    // the filter sees the offset at the end of the backing file
+    let mut backing = OpenOptions::new().append(true).open(backend).unwrap();
+    backing.write_all(b" world").unwrap();
+    file.write_all(b"!").unwrap();
+    drop(file);
+
+    assert_eq!(read_to_string(backend).unwrap(), "hello world!");
+}
+
 #[test]
 fn append_unlink_write() {
     let (test_path, _) = init("append_unlink_write");
@@ -348,6 +641,935 @@ fn append_unlink_write() {
     assert_eq!(&output, "hello world");
 }
 
+#[test]
+fn fallocate_file() {
+    let (test_path, _) = init("fallocate_file");
+    let path = test_path.join("file");
+    let file = OpenOptions::new()
+        .write(true)
+        .create(true)
+        .open(&path)
+        .unwrap();
+
+    fcntl::posix_fallocate(file.as_raw_fd(), 0, 4096).unwrap();
+    drop(file);
+
+    let meta = std::fs::metadata(&path).unwrap();
+    assert_eq!(meta.len(), 4096);
+}
+
+#[test]
+fn fallocate_fault() {
+    let (test_path, _) = init_with_config(
+        "fallocate_fault",
+        r#"[{"type": "fault", "methods": ["fallocate"], "path": "/tmp/test_mnt/fallocate_fault/full", "percent": 100, "faults": [{"errno": 28, "weight": 1}]}]"#,
+    );
+    let open = |name: &str| {
+        OpenOptions::new()
+            .write(true)
+            .create(true)
+            .open(test_path.join(name))
+            .unwrap()
+    };
+
+    let full = open("full");
+    let err = fcntl::posix_fallocate(full.as_raw_fd(), 0, 4096).unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::ENOSPC));
+    drop(full);
+    assert_eq!(std::fs::metadata(test_path.join("full")).unwrap().len(), 0);
+
+    let allowed = open("allowed");
+    fcntl::posix_fallocate(allowed.as_raw_fd(), 0, 4096).unwrap();
+    drop(allowed);
+    assert_eq!(
+        std::fs::metadata(test_path.join("allowed")).unwrap().len(),
+        4096
+    );
+}
+
+#[test]
+fn xattr() {
+    let (test_path, _) = init("xattr");
+    let path = test_path.join("file");
+    write(&path, "hello").unwrap();
+
+    let cpath = CString::new(path.as_os_str().as_bytes()).unwrap();
+    let name = CString::new("user.toda").unwrap();
+    let value = b"world";
+
+    let ret = unsafe {
+        libc::setxattr(
+            cpath.as_ptr(),
+            name.as_ptr(),
+            value.as_ptr() as *const libc::c_void,
+            value.len(),
+            0,
+        )
+    };
+    assert_eq!(ret, 0);
+
+    // probe the size with an empty buffer at first
+    let size = unsafe { libc::getxattr(cpath.as_ptr(), name.as_ptr(), std::ptr::null_mut(), 0) };
+    assert_eq!(size, value.len() as isize);
+    let mut buf = vec![0u8; size as usize];
+    let size = unsafe {
+        libc::getxattr(
+            cpath.as_ptr(),
+            name.as_ptr(),
+            buf.as_mut_ptr() as *mut libc::c_void,
+            buf.len(),
+        )
+    };
+    assert_eq!(&buf[..size as usize], value);
+
+    let size = unsafe { libc::listxattr(cpath.as_ptr(), std::ptr::null_mut(), 0) };
+    assert!(size > 0);
+    let mut list = vec![0u8; size as usize];
+    let size = unsafe {
+        libc::listxattr(
+            cpath.as_ptr(),
+            list.as_mut_ptr() as *mut libc::c_char,
+            list.len(),
+        )
+    };
+    assert!(list[..size as usize]
+        .split(|c| *c == 0)
+        .any(|item| item == name.as_bytes()));
+
+    let ret = unsafe { libc::removexattr(cpath.as_ptr(), name.as_ptr()) };
+    assert_eq!(ret, 0);
+    let size = unsafe { libc::getxattr(cpath.as_ptr(), name.as_ptr(), std::ptr::null_mut(), 0) };
+    assert_eq!(size, -1);
+    assert_eq!(nix::errno::errno(), libc::ENODATA);
+}
+
+#[test]
+fn fsync_latency() {
+    let (test_path, _) = init_with_config(
+        "fsync_latency",
+        r#"[{"type": "latency", "methods": ["fsync"], "percent": 100, "latency": "200ms"}]"#,
+    );
+    let path = test_path.join("file");
+    let mut file = File::create(&path).unwrap();
+    file.write_all(b"hello").unwrap();
+
+    let start = Instant::now();
+    file.sync_all().unwrap();
+    assert!(start.elapsed() >= Duration::from_millis(200));
+
+    // only fsync is delayed
+    let start = Instant::now();
+    file.write_all(b" world").unwrap();
+    assert!(start.elapsed() < Duration::from_millis(200));
+}
+
+#[test]
+fn per_byte_latency() {
+    let (test_path, _) = init_with_config(
+        "per_byte_latency",
+        r#"[{"type": "latency", "methods": ["write"], "percent": 100, "latency": "1ms", "perByte": "200ns"}]"#,
+    );
+    let mut file = File::create(test_path.join("file")).unwrap();
+
+    // 4KiB is delayed for about 1.8ms, and 1MiB for about 210ms in the writes
+    // split by the kernel
+    let start = Instant::now();
+    file.write_all(&[0u8; 4096]).unwrap();
+    let small = start.elapsed();
+    assert!(small < Duration::from_millis(100), "{:?}", small);
+
+    let start = Instant::now();
+    file.write_all(&vec![0u8; 1 << 20]).unwrap();
+    let large = start.elapsed();
+    assert!(large >= Duration::from_millis(200), "{:?}", large);
+}
+
+#[test]
+fn interrupted_latency() {
+    let (test_path, _) = init_with_config(
+        "interrupted_latency",
+        r#"[{"type": "latency", "methods": ["read"], "percent": 100, "latency": "10s"}]"#,
+    );
+    write("/tmp/test_mnt_backend/interrupted_latency/file", "hello").unwrap();
+
+    // the killed reader doesn't wait for the latency of its pending read
+    let mut reader = std::process::Command::new("cat")
+        .arg(test_path.join("file"))
+        .spawn()
+        .unwrap();
+    std::thread::sleep(Duration::from_millis(500));
+    let start = Instant::now();
+    reader.kill().unwrap();
+    reader.wait().unwrap();
+    let elapsed = start.elapsed();
+    assert!(elapsed < Duration::from_secs(2), "{:?}", elapsed);
+}
+
+#[test]
+fn append_with_mistake() {
+    let (test_path, _) = init_with_config(
+        "append_with_mistake",
+        r#"[{"type": "mistake", "methods": ["write"], "percent": 100, "mistake": {"filling": "0x2a2a2a", "maxLength": 3, "maxOccurrences": 1, "offset": 12}}]"#,
+    );
+    let backend_path = Path::new("/tmp/test_mnt_backend/append_with_mistake/log");
+    let mut file = OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(test_path.join("log"))
+        .unwrap();
+    file.write_all(b"rec0\n").unwrap();
+
+    // the backing file grows behind the kernel, so the size it knows is stale
+    OpenOptions::new()
+        .append(true)
+        .open(backend_path)
+        .unwrap()
+        .write_all(b"xxxxx")
+        .unwrap();
+    file.write_all(b"rec1\n").unwrap();
+    file.write_all(b"rec2\n").unwrap();
+
+    // the records are appended after the other writes, and the corruption
+    // lands at the offset of the file where the record is written
+    assert_eq!(
+        std::fs::read(backend_path).unwrap(),
+        b"rec0\nxxxxxre***rec2\n"
+    );
+}
+
+#[test]
+fn write_fault_with_writeback_cache() {
+    let (test_path, _) = init_with_hookfs(
+        "write_fault_with_writeback_cache",
+        r#"[{"type": "fault", "methods": ["write"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+        &["allow_other", "nonempty", "fsname=toda"],
+        |hookfs| hookfs.with_writeback_cache(),
+    );
+
+    // the writeback cache is not requested, so the fault is returned by the
+    // write rather than lost in the page cache
+    let mut file = File::create(test_path.join("file")).unwrap();
+    let err = file.write_all(b"hello").unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+}
+
+#[test]
+fn statfs_override() {
+    let (test_path, _) = init_with_config(
+        "statfs_override",
+        r#"[{"type": "statfsOverride", "methods": ["statfs"], "percent": 100, "onlyRoot": true, "freeBlocks": 0, "availableBlocks": 0, "freeInodes": 0}]"#,
+    );
+    std::fs::create_dir(test_path.join("dir")).unwrap();
+
+    let stat = nix::sys::statvfs::statvfs(&test_path).unwrap();
+    assert_eq!(stat.blocks_free(), 0);
+    assert_eq!(stat.blocks_available(), 0);
+    assert_eq!(stat.files_free(), 0);
+    assert!(stat.blocks() > 0);
+
+    // the statfs of a directory in the mount is not overridden
+    let stat = nix::sys::statvfs::statvfs(&test_path.join("dir")).unwrap();
+    assert!(stat.blocks_free() > 0);
+}
+
+#[test]
+fn shadow_write() {
+    let shadow_path = Path::new("/tmp/test_mnt_shadow/shadow_write");
+    std::fs::remove_dir_all(shadow_path).ok();
+    std::fs::create_dir_all(shadow_path).unwrap();
+    let backend_path = Path::new("/tmp/test_mnt_backend/shadow_write");
+    let (test_path, _) = init_with_hookfs(
+        "shadow_write",
+        r#"[{"type": "mistake", "methods": ["write"], "percent": 100, "mistake": {"filling": "0x2a2a2a", "maxLength": 3, "maxOccurrences": 1, "offset": 6}}]"#,
+        &["allow_other", "nonempty", "fsname=toda"],
+        |hookfs| hookfs.with_shadow(shadow_path),
+    );
+    write(backend_path.join("file"), b"hello world").unwrap();
+
+    let mut file = OpenOptions::new()
+        .write(true)
+        .open(test_path.join("file"))
+        .unwrap();
+    file.write_all(b"HELLO WORLD").unwrap();
+    drop(file);
+
+    // the shadow has the data before it's corrupted, and the existing content
+    // of the file is copied first
+    assert_eq!(
+        std::fs::read(backend_path.join("file")).unwrap(),
+        b"HELLO ***LD"
+    );
+    assert_eq!(
+        std::fs::read(shadow_path.join("file")).unwrap(),
+        b"HELLO WORLD"
+    );
+    assert_eq!(
+        read_to_string(test_path.join("file")).unwrap(),
+        "HELLO ***LD"
+    );
+}
+
+#[test]
+fn max_io_size() {
+    let (test_path, _) = init_with_hookfs(
+        "max_io_size",
+        "[]",
+        &["allow_other", "nonempty", "fsname=toda", "max_read=4096"],
+        |hookfs| hookfs.with_max_io_size(4096),
+    );
+    write(
+        Path::new("/tmp/test_mnt_backend/max_io_size/file"),
+        vec![1u8; 128 << 10],
+    )
+    .unwrap();
+
+    // the read of 128KiB is split into the FUSE reads of 4KiB, which are
+    // counted with the few other operations
+    let mut file = File::open(test_path.join("file")).unwrap();
+    toda::metrics::reset_stats(&test_path);
+    let mut content = Vec::new();
+    file.read_to_end(&mut content).unwrap();
+    assert_eq!(content.len(), 128 << 10);
+    let operations = toda::metrics::stats(&test_path).operations;
+    assert!(operations >= 32, "{}", operations);
+}
+
+#[test]
+fn delay_fault() {
+    let (test_path, _) = init_with_config(
+        "delay_fault",
+        r#"[{"type": "delayFault", "methods": ["fsync"], "percent": 100, "latency": "200ms", "errno": 110}]"#,
+    );
+    let path = test_path.join("file");
+    let mut file = File::create(&path).unwrap();
+    file.write_all(b"hello").unwrap();
+
+    // the operation is delayed first, and then fails
+    let start = Instant::now();
+    let err = file.sync_all().unwrap_err();
+    assert!(start.elapsed() >= Duration::from_millis(200));
+    assert_eq!(err.raw_os_error(), Some(libc::ETIMEDOUT));
+}
+
+#[test]
+fn timeout() {
+    let (test_path, _) = init_with_config(
+        "timeout",
+        r#"[{"type": "timeout", "methods": ["write"], "path": "/tmp/test_mnt/timeout/file", "percent": 100, "timeout": "200ms"}]"#,
+    );
+    let path = test_path.join("file");
+    File::create(&path).unwrap();
+
+    // the write times out without reaching the backing file
+    let start = Instant::now();
+    let err = write(&path, "hello").unwrap_err();
+    assert!(start.elapsed() >= Duration::from_millis(200));
+    assert_eq!(err.raw_os_error(), Some(libc::ETIMEDOUT));
+    assert_eq!(read_to_string(&path).unwrap(), "");
+}
+
+#[test]
+fn interrupted_timeout() {
+    let (test_path, _) = init_with_config(
+        "interrupted_timeout",
+        r#"[{"type": "timeout", "methods": ["read"], "percent": 100, "timeout": "10s"}]"#,
+    );
+    write("/tmp/test_mnt_backend/interrupted_timeout/file", "hello").unwrap();
+
+    // the killed reader doesn't wait for the timeout
+    let mut reader = std::process::Command::new("cat")
+        .arg(test_path.join("file"))
+        .spawn()
+        .unwrap();
+    std::thread::sleep(Duration::from_millis(500));
+    let start = Instant::now();
+    reader.kill().unwrap();
+    reader.wait().unwrap();
+    let elapsed = start.elapsed();
+    assert!(elapsed < Duration::from_secs(2), "{:?}", elapsed);
+}
+
+#[test]
+fn is_symlink() {
+    let (test_path, _) = init_with_config(
+        "is_symlink",
+        r#"[{"type": "mistake", "methods": ["readlink"], "percent": 100, "isSymlink": true, "mistake": {"filling": "0x2f6e6f6e65", "maxLength": 5, "maxOccurrences": 1, "offset": 0}}, {"type": "fault", "methods": ["open"], "percent": 100, "isSymlink": true, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let link = test_path.join("link");
+    write(test_path.join("file"), "hello").unwrap();
+    symlink("/foobar", &link).unwrap();
+
+    // the target of the link is corrupted
+    assert_eq!(read_link(&link).unwrap(), PathBuf::from("/nonear"));
+    // the opened file is resolved by the kernel, so it's not a symlink
+    assert_eq!(read_to_string(test_path.join("file")).unwrap(), "hello");
+}
+
+#[test]
+fn readlink_target() {
+    let (test_path, _) = init_with_config(
+        "readlink_target",
+        r#"[{"type": "readlink", "path": "/tmp/test_mnt/readlink_target/wrong", "percent": 100, "target": "/etc/hostname"}, {"type": "readlink", "path": "/tmp/test_mnt/readlink_target/dangling", "percent": 100, "dangling": true}]"#,
+    );
+    for name in &["wrong", "dangling", "intact"] {
+        symlink(test_path.join("file"), test_path.join(name)).unwrap();
+    }
+    write(test_path.join("file"), "hello").unwrap();
+
+    assert_eq!(
+        read_link(test_path.join("wrong")).unwrap(),
+        PathBuf::from("/etc/hostname")
+    );
+    // the dangling target is the real one with a suffix, which doesn't exist
+    let dangling = read_link(test_path.join("dangling")).unwrap();
+    let dangling = dangling.to_str().unwrap();
+    assert!(dangling.starts_with(test_path.join("file.dangling-").to_str().unwrap()));
+    assert!(!Path::new(dangling).exists());
+
+    assert_eq!(
+        read_link(test_path.join("intact")).unwrap(),
+        test_path.join("file")
+    );
+    assert_eq!(read_to_string(test_path.join("intact")).unwrap(), "hello");
+}
+
+#[test]
+fn readonly() {
+    let (test_path, _) = init_with_hookfs(
+        "readonly",
+        "[]",
+        &[
+            "allow_other",
+            "nonempty",
+            "fsname=toda",
+            "default_permissions",
+        ],
+        |hookfs| {
+            write("/tmp/test_mnt_backend/readonly/file", "hello").unwrap();
+            hookfs.set_readonly(true);
+            hookfs
+        },
+    );
+    let path = test_path.join("file");
+
+    // the reads still work
+    assert_eq!(read_to_string(&path).unwrap(), "hello");
+
+    let erofs = Some(libc::EROFS);
+    assert_eq!(write(&path, "world").unwrap_err().raw_os_error(), erofs);
+    let err = OpenOptions::new().append(true).open(&path).unwrap_err();
+    assert_eq!(err.raw_os_error(), erofs);
+    let err = File::create(test_path.join("new")).unwrap_err();
+    assert_eq!(err.raw_os_error(), erofs);
+    let err = std::fs::create_dir(test_path.join("dir")).unwrap_err();
+    assert_eq!(err.raw_os_error(), erofs);
+    let err = std::fs::rename(&path, test_path.join("renamed")).unwrap_err();
+    assert_eq!(err.raw_os_error(), erofs);
+    let err = std::fs::remove_file(&path).unwrap_err();
+    assert_eq!(err.raw_os_error(), erofs);
+    let err = unistd::chown(&path, Some(unistd::Uid::from_raw(1000)), None).unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::EROFS));
+
+    assert_eq!(read_to_string(&path).unwrap(), "hello");
+}
+
+#[test]
+fn max_concurrency() {
+    let (test_path, _) = init_with_hookfs(
+        "max_concurrency",
+        r#"[{"type": "latency", "methods": ["read"], "path": "/tmp/test_mnt/max_concurrency/slow", "percent": 100, "latency": "200ms"}, {"type": "fault", "methods": ["read"], "path": "/tmp/test_mnt/max_concurrency/broken", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+        &[
+            "allow_other",
+            "nonempty",
+            "fsname=toda",
+            "default_permissions",
+        ],
+        |hookfs| hookfs.with_concurrency_limit(1),
+    );
+    write(test_path.join("slow"), "hello").unwrap();
+    write(test_path.join("broken"), "hello").unwrap();
+
+    // the failed requests release their permits
+    for _ in 0..5 {
+        let err = read_to_string(test_path.join("broken")).unwrap_err();
+        assert_eq!(err.raw_os_error(), Some(libc::EIO));
+    }
+
+    // the reads are delayed one after another
+    let start = Instant::now();
+    let readers: Vec<_> = (0..2)
+        .map(|_| {
+            let path = test_path.join("slow");
+            std::thread::spawn(move || read_to_string(path).unwrap())
+        })
+        .collect();
+    for reader in readers {
+        assert_eq!(reader.join().unwrap(), "hello");
+    }
+    assert!(start.elapsed() >= Duration::from_millis(400));
+}
+
+#[test]
+fn overlay() {
+    let backend = PathBuf::from("/tmp/test_mnt_backend/overlay");
+    let upper = PathBuf::from("/tmp/test_mnt_overlay/overlay");
+    std::fs::remove_dir_all(&upper).ok();
+    std::fs::create_dir_all(&upper).unwrap();
+
+    let (test_path, _) = init_with_hookfs(
+        "overlay",
+        "[]",
+        &[
+            "allow_other",
+            "nonempty",
+            "fsname=toda",
+            "default_permissions",
+        ],
+        |hookfs| {
+            std::fs::create_dir_all(backend.join("dir")).unwrap();
+            write(backend.join("file"), "hello").unwrap();
+            write(backend.join("dir/inner"), "inner").unwrap();
+            hookfs.with_overlay(&upper)
+        },
+    );
+    let list = |path: &Path| -> Vec<String> {
+        let mut names: Vec<_> = std::fs::read_dir(path)
+            .unwrap()
+            .map(|entry| entry.unwrap().file_name().into_string().unwrap())
+            .collect();
+        names.sort();
+        names
+    };
+
+    // the file is copied up on the first change
+    assert_eq!(read_to_string(test_path.join("file")).unwrap(), "hello");
+    let ino = std::fs::metadata(test_path.join("file")).unwrap().ino();
+    write(test_path.join("file"), "changed").unwrap();
+    assert_eq!(read_to_string(test_path.join("file")).unwrap(), "changed");
+    assert_eq!(
+        std::fs::metadata(test_path.join("file")).unwrap().ino(),
+        ino
+    );
+    assert_eq!(read_to_string(backend.join("file")).unwrap(), "hello");
+    assert_eq!(read_to_string(upper.join("file")).unwrap(), "changed");
+
+    // the new files are listed with the lower ones
+    write(test_path.join("dir/new"), "new").unwrap();
+    assert_eq!(list(&test_path.join("dir")), vec!["inner", "new"]);
+    assert!(!backend.join("dir/new").exists());
+
+    // the removed lower files are hidden
+    std::fs::remove_file(test_path.join("dir/inner")).unwrap();
+    std::fs::rename(test_path.join("dir/new"), test_path.join("renamed")).unwrap();
+    assert_eq!(list(&test_path.join("dir")), Vec::<String>::new());
+    assert_eq!(list(&test_path), vec!["dir", "file", "renamed"]);
+    assert_eq!(read_to_string(test_path.join("renamed")).unwrap(), "new");
+    std::fs::remove_dir(test_path.join("dir")).unwrap();
+    assert!(!test_path.join("dir").exists());
+
+    assert_eq!(list(&backend), vec!["dir", "file"]);
+    assert_eq!(list(&backend.join("dir")), vec!["inner"]);
+}
+
+#[test]
+fn fsync_fault() {
+    let (test_path, _) = init_with_config(
+        "fsync_fault",
+        r#"[{"type": "fault", "methods": ["fsync"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    let mut file = File::create(&path).unwrap();
+    file.write_all(b"hello").unwrap();
+
+    let err = file.sync_all().unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+}
+
+#[test]
+fn flush_fault() {
+    let (test_path, _) = init_with_config(
+        "flush_fault",
+        r#"[{"type": "fault", "methods": ["flush"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    let mut file = File::create(&path).unwrap();
+    for _ in 0..10 {
+        file.write_all(b"hello").unwrap();
+    }
+
+    let err = unistd::close(file.into_raw_fd()).unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::EIO));
+    assert_eq!(
+        std::fs::read_to_string("/tmp/test_mnt_backend/flush_fault/file").unwrap(),
+        "hello".repeat(10)
+    );
+}
+
+#[test]
+fn release_fault() {
+    let (test_path, _) = init_with_config(
+        "release_fault",
+        r#"[{"type": "fault", "methods": ["release"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+
+    // the kernel doesn't report the error of `release` to `close`, but the
+    // backing file must still be closed
+    for _ in 0..10 {
+        let file = File::create(&path).unwrap();
+        unistd::close(file.into_raw_fd()).unwrap();
+    }
+    write(&path, b"hello").unwrap();
+    assert_eq!(read_to_string(&path).unwrap(), "hello");
+}
+
+#[test]
+fn access_fault() {
+    // the kernel sends `access` only without `default_permissions`
+    let (test_path, _) = init_with_args(
+        "access_fault",
+        r#"[{"type": "fault", "methods": ["access"], "path": "/tmp/test_mnt/access_fault/denied", "percent": 100, "faults": [{"errno": 13, "weight": 1}]}]"#,
+        &["allow_other", "nonempty", "fsname=toda"],
+    );
+    write(test_path.join("denied"), b"hello").unwrap();
+    write(test_path.join("allowed"), b"hello").unwrap();
+
+    let err = unistd::access(&test_path.join("denied"), unistd::AccessFlags::R_OK).unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::EACCES));
+    unistd::access(&test_path.join("allowed"), unistd::AccessFlags::R_OK).unwrap();
+    let err = unistd::access(&test_path.join("missing"), unistd::AccessFlags::R_OK).unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::ENOENT));
+}
+
+#[test]
+fn truncate() {
+    let (test_path, _) = init("truncate");
+    let path = test_path.join("file");
+    let file = File::create(&path).unwrap();
+    file.set_len(1024).unwrap();
+    assert_eq!(std::fs::metadata(&path).unwrap().len(), 1024);
+
+    std::fs::write(&path, b"hello").unwrap();
+    file.set_len(2).unwrap();
+    assert_eq!(read_to_string(&path).unwrap(), "he");
+}
+
+#[test]
+fn truncate_fault() {
+    let (test_path, _) = init_with_config(
+        "truncate_fault",
+        r#"[{"type": "fault", "methods": ["truncate"], "percent": 100, "faults": [{"errno": 26, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    let file = File::create(&path).unwrap();
+
+    let err = file.set_len(1024).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::ETXTBSY));
+    assert_eq!(std::fs::metadata(&path).unwrap().len(), 0);
+
+    // the other attributes can still be changed
+    let mut permissions = file.metadata().unwrap().permissions();
+    permissions.set_readonly(true);
+    file.set_permissions(permissions).unwrap();
+}
+
+#[test]
+fn setattr_fault_not_truncate() {
+    let (test_path, _) = init_with_config(
+        "setattr_fault_not_truncate",
+        r#"[{"type": "fault", "methods": ["setattr"], "percent": 100, "faults": [{"errno": 1, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    let file = File::create(&path).unwrap();
+
+    file.set_len(1024).unwrap();
+    assert_eq!(std::fs::metadata(&path).unwrap().len(), 1024);
+
+    let mut permissions = file.metadata().unwrap().permissions();
+    permissions.set_readonly(true);
+    let err = file.set_permissions(permissions).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EPERM));
+}
+
+#[test]
+fn chmod_fault() {
+    let (test_path, _) = init_with_config(
+        "chmod_fault",
+        r#"[{"type": "fault", "methods": ["chmod"], "percent": 100, "faults": [{"errno": 1, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    File::create(&path).unwrap();
+    let mode = std::fs::metadata(&path).unwrap().mode();
+
+    let err = stat::fchmodat(
+        None,
+        &path,
+        stat::Mode::from_bits_truncate(0o600),
+        stat::FchmodatFlags::FollowSymlink,
+    )
+    .unwrap_err();
+    assert_eq!(err.as_errno(), Some(nix::errno::Errno::EPERM));
+    assert_eq!(std::fs::metadata(&path).unwrap().mode(), mode);
+
+    // the owner and the size can still be changed
+    unistd::chown(&path, Some(unistd::Uid::from_raw(1000)), None).unwrap();
+    assert_eq!(std::fs::metadata(&path).unwrap().uid(), 1000);
+    File::create(&path).unwrap().set_len(1024).unwrap();
+    assert_eq!(std::fs::metadata(&path).unwrap().len(), 1024);
+}
+
+fn read_with_flags(path: &Path, flags: i32) -> std::io::Result<usize> {
+    let mut file = OpenOptions::new()
+        .read(true)
+        .custom_flags(flags)
+        .open(path)?;
+    let mut buf = vec![0u8; 4096];
+    file.read(&mut buf)
+}
+
+#[test]
+fn open_flags_fault() {
+    let (test_path, _) = init_with_config(
+        "open_flags_fault",
+        r#"[{"type": "fault", "methods": ["read"], "openFlags": ["O_DIRECT"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    write(&path, vec![1u8; 4096]).unwrap();
+
+    let err = read_with_flags(&path, libc::O_DIRECT).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+    assert_eq!(read_with_flags(&path, 0).unwrap(), 4096);
+}
+
+#[test]
+fn open_mode_fault() {
+    let (test_path, _) = init_with_config(
+        "open_mode_fault",
+        r#"[{"type": "fault", "methods": ["read"], "openMode": "readwrite", "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    write(&path, "hello").unwrap();
+
+    // the reads of the same file diverge by the intent of the open
+    assert_eq!(read_to_string(&path).unwrap(), "hello");
+    let mut file = OpenOptions::new()
+        .read(true)
+        .write(true)
+        .open(&path)
+        .unwrap();
+    let mut content = String::new();
+    let err = file.read_to_string(&mut content).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+}
+
+#[test]
+fn open_flags_not_fault() {
+    let (test_path, _) = init_with_config(
+        "open_flags_not_fault",
+        r#"[{"type": "fault", "methods": ["read"], "openFlags": {"not": ["O_DIRECT", "O_SYNC"]}, "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    write(&path, vec![1u8; 4096]).unwrap();
+
+    assert_eq!(read_with_flags(&path, libc::O_SYNC).unwrap(), 4096);
+    let err = read_with_flags(&path, 0).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+}
+
+#[test]
+fn nonblock_eagain() {
+    let (test_path, _) = init_with_config(
+        "nonblock_eagain",
+        r#"[{"type": "fault", "methods": ["read"], "openFlags": ["O_NONBLOCK"], "percent": 100, "faults": [{"errno": 11, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    write(&path, vec![1u8; 4096]).unwrap();
+
+    let err = read_with_flags(&path, libc::O_NONBLOCK).unwrap_err();
+    assert_eq!(err.kind(), std::io::ErrorKind::WouldBlock);
+    assert_eq!(read_with_flags(&path, 0).unwrap(), 4096);
+}
+
+#[test]
+fn size_fault() {
+    let (test_path, _) = init_with_config(
+        "size_fault",
+        r#"[{"type": "fault", "methods": ["read", "write"], "minSize": 4096, "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let small = test_path.join("small");
+    let large = test_path.join("large");
+    write(&small, vec![1u8; 1024]).unwrap();
+    std::fs::write("/tmp/test_mnt_backend/size_fault/large", vec![1u8; 8192]).unwrap();
+
+    assert_eq!(read_with_flags(&small, 0).unwrap(), 1024);
+    let err = read_with_flags(&large, 0).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+
+    // the cached size grows with the writes through the file handle
+    let mut file = OpenOptions::new().append(true).open(&small).unwrap();
+    file.write_all(&[1u8; 3072]).unwrap();
+    let err = file.write_all(b"hello").unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+}
+
+#[test]
+fn age_fault() {
+    let (test_path, _) = init_with_config(
+        "age_fault",
+        r#"[{"type": "fault", "methods": ["read"], "minAge": "1h", "percent": 100, "faults": [{"errno": 5, "weight": 1}]},
+            {"type": "fault", "methods": ["write"], "maxAge": "1h", "percent": 100, "faults": [{"errno": 28, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    std::fs::write("/tmp/test_mnt_backend/age_fault/file", vec![1u8; 1024]).unwrap();
+
+    // the file has just been created, so it's younger than both of the ages
+    assert_eq!(read_with_flags(&path, 0).unwrap(), 1024);
+    let mut file = OpenOptions::new().write(true).open(&path).unwrap();
+    let err = file.write_all(b"hello").unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::ENOSPC));
+}
+
+#[test]
+fn mode_fault() {
+    let (test_path, _) = init_with_config(
+        "mode_fault",
+        r#"[{"type": "fault", "methods": ["read"], "modeMask": "4000", "modeValue": "4000", "percent": 100, "faults": [{"errno": 5, "weight": 1}]},
+            {"type": "fault", "methods": ["open"], "modeMask": 2, "modeValue": 2, "percent": 100, "faults": [{"errno": 13, "weight": 1}]}]"#,
+    );
+    for (name, mode) in &[("setuid", 0o4755), ("regular", 0o644), ("writable", 0o666)] {
+        let backing_path = Path::new("/tmp/test_mnt_backend/mode_fault").join(name);
+        std::fs::write(&backing_path, vec![1u8; 1024]).unwrap();
+        std::fs::set_permissions(&backing_path, std::fs::Permissions::from_mode(*mode)).unwrap();
+    }
+
+    // the mode of the opened file is matched by the read
+    let err = read_with_flags(&test_path.join("setuid"), 0).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+    assert_eq!(
+        read_with_flags(&test_path.join("regular"), 0).unwrap(),
+        1024
+    );
+    // and the one of the backing file by the open
+    let err = File::open(test_path.join("writable")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EACCES));
+}
+
+#[test]
+fn fsync_fault_dry_run() {
+    let (test_path, _) = init_with_config(
+        "fsync_fault_dry_run",
+        r#"[{"type": "fault", "methods": ["fsync"], "percent": 100, "dryRun": true, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    let path = test_path.join("file");
+    let mut file = File::create(&path).unwrap();
+    file.write_all(b"hello").unwrap();
+
+    file.sync_all().unwrap();
+}
+
+#[test]
+fn lseek_hole_data() {
+    let (test_path, _) = init("lseek_hole_data");
+    let path = test_path.join("file");
+    let file = OpenOptions::new()
+        .write(true)
+        .read(true)
+        .create(true)
+        .open(&path)
+        .unwrap();
+
+    let data_offset = 1024 * 1024;
+    unistd::pwrite(file.as_raw_fd(), b"hello", data_offset).unwrap();
+
+    let fd = file.as_raw_fd();
+    assert_eq!(unistd::lseek(fd, 0, unistd::Whence::SeekHole).unwrap(), 0);
+    assert_eq!(
+        unistd::lseek(fd, 0, unistd::Whence::SeekData).unwrap(),
+        data_offset
+    );
+    assert_eq!(
+        unistd::lseek(fd, 0, unistd::Whence::SeekEnd).unwrap(),
+        data_offset + 5
+    );
+    assert_eq!(unistd::lseek(fd, 1, unistd::Whence::SeekSet).unwrap(), 1);
+    assert_eq!(unistd::lseek(fd, 1, unistd::Whence::SeekCur).unwrap(), 2);
+}
+
+#[test]
+fn attr_override() {
+    let (test_path, _) = init_with_config(
+        "attr_override",
+        &format!(
+            r#"[{{"type": "attrOverride", "path": "{}/*", "percent": 100, "blocks": 1024, "blksize": 8192, "ctime": {{"secs_since_epoch": 1000000000, "nanos_since_epoch": 0}}}}]"#,
+            "/tmp/test_mnt/attr_override"
+        ),
+    );
+    let path = test_path.join("file");
+    write(&path, "hello").unwrap();
+
+    let stat = stat::stat(&path).unwrap();
+    assert_eq!(stat.st_blocks, 1024);
+    assert_eq!(stat.st_blksize, 8192);
+    assert_eq!(stat.st_ctime, 1000000000);
+    // the other fields are reported by the backing file
+    assert_eq!(stat.st_size, 5);
+}
+
+#[test]
+fn readdir_many() {
+    let (test_path, _) = init("readdir_many");
+    for i in 0..1000 {
+        write(test_path.join(format!("file-{}", i)), "").unwrap();
+    }
+
+    let count = std::fs::read_dir(&test_path).unwrap().count();
+    assert_eq!(count, 1000);
+}
+
+#[test]
+fn readdir_fault() {
+    let (test_path, _) = init_with_config(
+        "readdir_fault",
+        r#"[{"type": "fault", "methods": ["readdir", "readdirplus"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    write(test_path.join("file"), "").unwrap();
+
+    let err = std::fs::read_dir(&test_path)
+        .unwrap()
+        .collect::<std::io::Result<Vec<_>>>()
+        .unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+}
+
+fn caller_filter(name: &str, uid: &str, gid: &str) -> std::io::Result<()> {
+    let (test_path, _) = init_with_config(
+        name,
+        &format!(
+            r#"[{{"type": "fault", "methods": ["fsync"], "percent": 100, "uid": {}, "gid": {}, "faults": [{{"errno": 5, "weight": 1}}]}}]"#,
+            uid, gid
+        ),
+    );
+    let path = test_path.join("file");
+    let file = File::create(&path).unwrap();
+    file.sync_all()
+}
+
+#[test]
+fn uid_gid_filter() {
+    let uid = unistd::getuid().as_raw();
+    let gid = unistd::getgid().as_raw();
+
+    let err = caller_filter("uid_match", &uid.to_string(), &format!("[{}]", gid)).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EIO));
+
+    caller_filter(
+        "uid_not_match",
+        &format!(r#"{{"not": [{}]}}"#, uid),
+        &gid.to_string(),
+    )
+    .unwrap();
+}
+
 // func RenameOpenDir(t *testing.T, mnt string) {
 // 	if err := os.Mkdir(mnt+"/dir1", 0755); err != nil {
 // 		t.Fatalf("Mkdir: %v", err)
@@ -467,3 +1689,242 @@ fn append_unlink_write() {
 // 		t.Fatalf("Read got %q want %q", back, content)
 // 	}
 // }
+
+#[test]
+fn opendir_releasedir() {
+    let (test_path, _) = init_with_config(
+        "opendir_releasedir",
+        r#"[{"type": "fault", "methods": ["opendir"], "percent": 100, "path": "/tmp/test_mnt/opendir_releasedir/faulted", "faults": [{"errno": 20, "weight": 1}]}, {"type": "fault", "methods": ["releasedir"], "percent": 100, "faults": [{"errno": 5, "weight": 1}]}]"#,
+    );
+    std::fs::create_dir(test_path.join("faulted")).unwrap();
+    std::fs::create_dir(test_path.join("dir")).unwrap();
+    write(test_path.join("dir/file"), b"hello").unwrap();
+
+    let err = std::fs::read_dir(test_path.join("faulted")).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::ENOTDIR));
+    // the files are opened as usual
+    assert_eq!(read_to_string(test_path.join("dir/file")).unwrap(), "hello");
+
+    // the backing directories are closed even if releasedir is faulted. The
+    // hookfs runs in this process, so its fds are counted here.
+    let fds = || std::fs::read_dir("/proc/self/fd").unwrap().count();
+    let before = fds();
+    for _ in 0..16 {
+        assert_eq!(std::fs::read_dir(test_path.join("dir")).unwrap().count(), 1);
+    }
+    assert!(fds() < before + 16);
+}
+
+fn ofd_lock(file: &File, cmd: i32, typ: i32) -> std::io::Result<libc::flock> {
+    let mut lock: libc::flock = unsafe { std::mem::zeroed() };
+    lock.l_type = typ as libc::c_short;
+    lock.l_whence = libc::SEEK_SET as libc::c_short;
+    if unsafe { libc::fcntl(file.as_raw_fd(), cmd, &mut lock) } == -1 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(lock)
+}
+
+#[test]
+fn file_lock() {
+    let (test_path, _) = init_with_config(
+        "file_lock",
+        r#"[{"type": "fault", "methods": ["setlk"], "path": "/tmp/test_mnt/file_lock/contended", "percent": 100, "faults": [{"errno": 11, "weight": 1}]}]"#,
+    );
+    write(test_path.join("file"), b"hello").unwrap();
+    write(test_path.join("contended"), b"hello").unwrap();
+
+    // the OFD locks of the files opened apart have their own owners
+    let open = |name: &str| {
+        OpenOptions::new()
+            .read(true)
+            .write(true)
+            .open(test_path.join(name))
+            .unwrap()
+    };
+    let first = open("file");
+    let second = open("file");
+    ofd_lock(&first, libc::F_OFD_SETLK, libc::F_WRLCK).unwrap();
+    let err = ofd_lock(&second, libc::F_OFD_SETLK, libc::F_RDLCK).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EAGAIN));
+    let lock = ofd_lock(&second, libc::F_OFD_GETLK, libc::F_RDLCK).unwrap();
+    assert_eq!(lock.l_type, libc::F_WRLCK as libc::c_short);
+
+    // the lock is released when its file is closed
+    drop(first);
+    ofd_lock(&second, libc::F_OFD_SETLK, libc::F_RDLCK).unwrap();
+
+    let err = ofd_lock(&open("contended"), libc::F_OFD_SETLK, libc::F_WRLCK).unwrap_err();
+    assert_eq!(err.raw_os_error(), Some(libc::EAGAIN));
+    // the blocking lock is not matched by `setlk`
+    ofd_lock(&open("contended"), libc::F_OFD_SETLKW, libc::F_WRLCK).unwrap();
+}
+
+#[test]
+fn mmap_filter() {
+    use nix::sys::mman::{mmap, msync, munmap, MapFlags, MsFlags, ProtFlags};
+
+    let (test_path, _) = init_with_config(
+        "mmap_filter",
+        r#"[{"type": "latency", "methods": ["read", "write"], "percent": 100, "mmap": true, "latency": "1ms"}]"#,
+    );
+    write(test_path.join("read"), vec![1u8; 4096]).unwrap();
+    write(test_path.join("mapped"), vec![1u8; 4096]).unwrap();
+    let injected = || toda::metrics::stats(&test_path).injected;
+
+    // the reads and writes by the syscalls are not matched
+    toda::metrics::reset_stats(&test_path);
+    assert_eq!(read_to_string(test_path.join("read")).unwrap().len(), 4096);
+    assert_eq!(injected(), 0);
+
+    let file = OpenOptions::new()
+        .read(true)
+        .write(true)
+        .open(test_path.join("mapped"))
+        .unwrap();
+    unsafe {
+        let addr = mmap(
+            std::ptr::null_mut(),
+            4096,
+            ProtFlags::PROT_READ | ProtFlags::PROT_WRITE,
+            MapFlags::MAP_SHARED,
+            file.as_raw_fd(),
+            0,
+        )
+        .unwrap() as *mut u8;
+        // the page fault reads the page
+        assert_eq!(std::ptr::read_volatile(addr), 1);
+        let faulted = injected();
+        assert!(faulted >= 1);
+
+        // the dirty page is written back by msync
+        std::ptr::write_volatile(addr, 2);
+        msync(addr as *mut libc::c_void, 4096, MsFlags::MS_SYNC).unwrap();
+        assert!(injected() > faulted);
+        munmap(addr as *mut libc::c_void, 4096).unwrap();
+    }
+}
+
+#[test]
+fn shuffle_dir() {
+    let (test_path, _) = init_with_config(
+        "shuffle_dir",
+        r#"[{"type": "shuffleDir", "methods": ["readdir", "readdirplus"], "percent": 100, "seed": 1}]"#,
+    );
+    let dir = test_path.join("dir");
+    std::fs::create_dir(&dir).unwrap();
+    for index in 0..300 {
+        write(dir.join(format!("file-{:03}", index)), b"").unwrap();
+    }
+    let list = |path: &Path| -> Vec<String> {
+        std::fs::read_dir(path)
+            .unwrap()
+            .map(|entry| entry.unwrap().file_name().into_string().unwrap())
+            .collect()
+    };
+
+    // the listing spans several pages, which neither repeat nor miss an
+    // entry
+    let shuffled = list(&dir);
+    let backing = list(Path::new("/tmp/test_mnt_backend/shuffle_dir/dir"));
+    assert_ne!(shuffled, backing);
+    let mut sorted = shuffled.clone();
+    sorted.sort();
+    let mut expected = backing;
+    expected.sort();
+    assert_eq!(sorted, expected);
+
+    // `.` and `..` are kept where the backing directory lists them
+    let dots = |path: &Path| -> Vec<usize> {
+        let mut handle =
+            nix::dir::Dir::open(path, fcntl::OFlag::O_RDONLY, stat::Mode::empty()).unwrap();
+        handle
+            .iter()
+            .map(|entry| entry.unwrap().file_name().to_bytes().to_owned())
+            .enumerate()
+            .filter(|(_, name)| name == b"." || name == b"..")
+            .map(|(index, _)| index)
+            .collect()
+    };
+    let positions = dots(&dir);
+    assert_eq!(positions.len(), 2);
+    assert_eq!(
+        positions,
+        dots(Path::new("/tmp/test_mnt_backend/shuffle_dir/dir"))
+    );
+}
+
+#[test]
+fn hide_entries() {
+    let (test_path, _) = init_with_config(
+        "hide_entries",
+        r#"[{"type": "hideEntries", "methods": ["readdir", "readdirplus"], "percent": 100, "pattern": "hidden-*", "ratio": 0.5}]"#,
+    );
+    let dir = test_path.join("dir");
+    std::fs::create_dir(&dir).unwrap();
+    for index in 0..300 {
+        write(dir.join(format!("file-{:03}", index)), b"").unwrap();
+        write(dir.join(format!("hidden-{:03}", index)), b"").unwrap();
+    }
+    let list = || -> Vec<String> {
+        let mut names: Vec<String> = std::fs::read_dir(&dir)
+            .unwrap()
+            .map(|entry| entry.unwrap().file_name().into_string().unwrap())
+            .collect();
+        names.sort();
+        names
+    };
+
+    // only the entries matching the pattern are hidden, about half of them,
+    // and the same ones on every page of every listing
+    let listed = list();
+    assert_eq!(
+        listed
+            .iter()
+            .filter(|name| name.starts_with("file-"))
+            .count(),
+        300
+    );
+    let shown = listed
+        .iter()
+        .filter(|name| name.starts_with("hidden-"))
+        .count();
+    assert!(shown > 50 && shown < 250, "{} shown", shown);
+    assert_eq!(list(), listed);
+
+    // the hidden files are still there
+    for index in 0..300 {
+        let name = format!("hidden-{:03}", index);
+        if !listed.contains(&name) {
+            std::fs::metadata(dir.join(&name)).unwrap();
+            read_to_string(dir.join(&name)).unwrap();
+        }
+    }
+}
+
+#[test]
+fn forget_unlinked() {
+    let (test_path, hookfs, _session) = mount(
+        "forget_unlinked",
+        "[]",
+        &["allow_other", "nonempty", "fsname=toda"],
+        |hookfs| hookfs,
+    );
+    let inodes = || futures::executor::block_on(hookfs.inodes());
+    assert_eq!(inodes(), 1);
+
+    // the unlinked files are evicted one by one, so the kernel forgets them
+    // with FUSE_FORGET rather than in a batch
+    for index in 0..20 {
+        let path = test_path.join(format!("file-{}", index));
+        write(&path, "hello").unwrap();
+        assert_eq!(inodes(), 2);
+        std::fs::remove_file(&path).unwrap();
+
+        let start = Instant::now();
+        while inodes() > 1 && start.elapsed() < Duration::from_secs(5) {
+            std::thread::sleep(Duration::from_millis(10));
+        }
+        assert_eq!(inodes(), 1, "file-{} is not forgotten", index);
+    }
+}
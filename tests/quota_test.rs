@@ -0,0 +1,70 @@
+mod common;
+
+use std::path::Path;
+
+use futures::executor::block_on;
+use toda::hookfs::RequestContext;
+use toda::injector::{Injector, Method, MultiInjector};
+
+fn write(injector: &MultiInjector, length: usize) -> Option<i32> {
+    block_on(injector.inject_io(&Method::WRITE, Path::new("/file"), 0, length))
+        .err()
+        .map(|err| err.into())
+}
+
+#[test]
+fn quota_exceeded() {
+    let injector = common::build(r#"{"type": "quota", "percent": 100, "quota": 10}"#);
+    assert_eq!(write(&injector, 6), None);
+    assert_eq!(write(&injector, 6), Some(libc::ENOSPC));
+    assert_eq!(write(&injector, 4), None);
+    assert_eq!(write(&injector, 1), Some(libc::ENOSPC));
+
+    // read is not counted
+    assert!(block_on(injector.inject_io(&Method::READ, Path::new("/file"), 0, 100)).is_ok());
+
+    injector.reset_quota();
+    assert_eq!(write(&injector, 10), None);
+}
+
+#[test]
+fn quota_concurrent() {
+    let injector = std::sync::Arc::new(common::build(
+        r#"{"type": "quota", "percent": 100, "quota": 1000}"#,
+    ));
+    let handles: Vec<_> = (0..8)
+        .map(|_| {
+            let injector = injector.clone();
+            std::thread::spawn(move || (0..100).filter(|_| write(&injector, 3).is_none()).count())
+        })
+        .collect();
+    let succeeded: usize = handles.into_iter().map(|h| h.join().unwrap()).sum();
+    assert_eq!(succeeded, 333);
+}
+
+#[test]
+fn user_quota() {
+    let injector =
+        common::build(r#"{"type": "quota", "percent": 100, "quota": 20, "userQuota": 8}"#);
+    let write_as = |uid: u32, length: usize| {
+        let mut ctx = RequestContext::default();
+        ctx.uid = uid;
+        block_on(ctx.scope(injector.inject_io(&Method::WRITE, Path::new("/file"), 0, length)))
+            .err()
+            .map(|err| -> i32 { err.into() })
+    };
+
+    assert_eq!(write_as(1000, 6), None);
+    assert_eq!(write_as(1000, 6), Some(libc::EDQUOT));
+    assert_eq!(write_as(1001, 8), None);
+    assert_eq!(write_as(1002, 7), Some(libc::ENOSPC));
+    // the failed writes are not counted
+    assert_eq!(write_as(1000, 2), None);
+
+    // the quotas start again from `reset_stats`, and only the failed writes
+    // have been counted
+    assert_eq!(injector.reset_status()[0].matched, 2);
+    assert_eq!(write_as(1000, 8), None);
+    assert_eq!(write_as(1003, 8), None);
+    assert_eq!(write_as(1004, 8), Some(libc::ENOSPC));
+}
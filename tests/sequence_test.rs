@@ -0,0 +1,82 @@
+mod common;
+
+use std::path::Path;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use futures::executor::block_on;
+use toda::hookfs::runtime::spawn;
+use toda::hookfs::RequestContext;
+use toda::injector::{Injector, Method, MultiInjector};
+
+const CONFIG: &str = r#"{"type": "sequence", "percent": 100, "methods": ["write"],
+    "steps": [{"index": 2, "errno": 5}, {"index": 3, "latency": "200ms"}]}"#;
+
+// operate injects the operation on the inode, and returns the errno and how
+// long it has been delayed
+fn operate(injector: &Arc<MultiInjector>, method: Method, ino: u64) -> (Option<i32>, Duration) {
+    let injector = injector.clone();
+    let start = Instant::now();
+    let result = block_on(spawn(RequestContext::default().scope(async move {
+        RequestContext::set_ino(ino);
+        injector.inject(&method, Path::new("/file")).await
+    })))
+    .unwrap();
+    (result.err().map(|err| err.into()), start.elapsed())
+}
+
+fn write(injector: &Arc<MultiInjector>, ino: u64) -> Option<i32> {
+    operate(injector, Method::WRITE, ino).0
+}
+
+#[test]
+fn nth_operation() {
+    let injector = Arc::new(common::build(CONFIG));
+
+    assert_eq!(write(&injector, 1), None);
+    // the operations out of the filter are not counted
+    assert_eq!(operate(&injector, Method::READ, 1).0, None);
+    assert_eq!(write(&injector, 1), Some(libc::EIO));
+    let (errno, elapsed) = operate(&injector, Method::WRITE, 1);
+    assert_eq!(errno, None);
+    assert!(elapsed >= Duration::from_millis(200));
+    let (errno, elapsed) = operate(&injector, Method::WRITE, 1);
+    assert_eq!(errno, None);
+    assert!(elapsed < Duration::from_millis(200));
+
+    // every inode has its own positions
+    assert_eq!(write(&injector, 2), None);
+    assert_eq!(write(&injector, 2), Some(libc::EIO));
+}
+
+#[test]
+fn reset_positions() {
+    let injector = Arc::new(common::build(CONFIG));
+    assert_eq!(write(&injector, 1), None);
+
+    // the release of the file forgets it
+    operate(&injector, Method::RELEASE, 1);
+    assert_eq!(write(&injector, 1), None);
+    assert_eq!(write(&injector, 1), Some(libc::EIO));
+
+    // and so does `reset_stats`
+    injector.reset_status();
+    assert_eq!(write(&injector, 1), None);
+    assert_eq!(write(&injector, 1), Some(libc::EIO));
+}
+
+#[test]
+fn invalid_steps() {
+    for steps in &[
+        "[]",
+        r#"[{"index": 0, "errno": 5}]"#,
+        r#"[{"index": 1}]"#,
+        r#"[{"index": 1, "errno": 5}, {"index": 1, "latency": "1s"}]"#,
+    ] {
+        assert!(common::try_build(&format!(
+            r#"{{"type": "sequence", "percent": 100, "steps": {}}}"#,
+            steps
+        ))
+        .is_err());
+    }
+}
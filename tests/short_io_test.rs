@@ -0,0 +1,53 @@
+mod common;
+
+use std::path::Path;
+
+use toda::hookfs::{Data, Reply};
+use toda::injector::{Injector, Method, MultiInjector};
+
+fn write(injector: &MultiInjector, content: &[u8]) -> Vec<u8> {
+    let mut data = content.to_vec();
+    injector
+        .inject_write_data(Path::new("/file"), 0, &mut data)
+        .unwrap();
+    data
+}
+
+#[test]
+fn short_write_zero() {
+    let injector = common::build(r#"{"type": "shortIo", "percent": 100, "maxLength": 0}"#);
+    assert!(write(&injector, b"hello world").is_empty());
+}
+
+#[test]
+fn short_write_random() {
+    let injector = common::build(r#"{"type": "shortIo", "percent": 100}"#);
+    let content = b"hello world";
+    for _ in 0..100 {
+        let data = write(&injector, content);
+        assert!(data.len() < content.len());
+        assert_eq!(&data[..], &content[..data.len()]);
+    }
+}
+
+#[test]
+fn short_write_ratio() {
+    let injector =
+        common::build(r#"{"type": "shortIo", "percent": 100, "ratio": 0.5, "maxLength": 4}"#);
+    assert_eq!(write(&injector, b"hello world"), b"hell");
+    assert_eq!(write(&injector, b"hello"), b"he");
+}
+
+#[test]
+fn short_read() {
+    let injector = common::build(r#"{"type": "shortIo", "percent": 100, "ratio": 0.5}"#);
+    let mut data = Data::with_offset(b"hello world".to_vec(), 0);
+    injector
+        .inject_reply(
+            &Method::READ,
+            Path::new("/file"),
+            &mut Reply::Data(&mut data),
+        )
+        .unwrap();
+    assert_eq!(data.data, b"hello");
+}
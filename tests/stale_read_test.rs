@@ -0,0 +1,57 @@
+mod common;
+
+use std::path::Path;
+
+use futures::executor::block_on;
+use toda::hookfs::{Data, Reply, RequestContext};
+use toda::injector::{Injector, Method, MultiInjector};
+
+// read returns the data replied to the read of `content` at `offset` of the
+// file `ino`
+fn read(injector: &MultiInjector, ino: u64, offset: i64, content: &[u8]) -> Vec<u8> {
+    let mut data = Data::with_offset(content.to_vec(), offset);
+    block_on(RequestContext::default().scope(async {
+        RequestContext::set_ino(ino);
+        injector
+            .inject_reply(
+                &Method::READ,
+                Path::new("/file"),
+                &mut Reply::Data(&mut data),
+            )
+            .unwrap();
+    }));
+    data.data
+}
+
+#[test]
+fn stale_read() {
+    let injector = common::build(r#"{"type": "staleRead", "percent": 100}"#);
+    assert_eq!(read(&injector, 1, 0, b"old"), b"old");
+    // the snapshot is returned once the data changes, and it stays
+    assert_eq!(read(&injector, 1, 0, b"new"), b"old");
+    assert_eq!(read(&injector, 1, 0, b"new"), b"old");
+    // the snapshot shorter than the read is replaced
+    assert_eq!(read(&injector, 1, 0, b"newer"), b"newer");
+    assert_eq!(read(&injector, 1, 0, b"other"), b"newer");
+
+    // the other regions and files have their own snapshots
+    assert_eq!(read(&injector, 1, 4096, b"new"), b"new");
+    assert_eq!(read(&injector, 2, 0, b"new"), b"new");
+}
+
+#[test]
+fn stale_read_evicted() {
+    let injector = common::build(r#"{"type": "staleRead", "percent": 100, "maxRegions": 2}"#);
+    read(&injector, 1, 0, b"old");
+    read(&injector, 2, 0, b"old");
+    read(&injector, 3, 0, b"old");
+
+    // the least recently read region is dropped
+    assert_eq!(read(&injector, 1, 0, b"new"), b"new");
+    assert_eq!(read(&injector, 3, 0, b"new"), b"old");
+
+    let injector = common::build(r#"{"type": "staleRead", "percent": 100, "maxBytes": 4}"#);
+    read(&injector, 1, 0, b"old");
+    read(&injector, 2, 0, b"old");
+    assert_eq!(read(&injector, 1, 0, b"new"), b"new");
+}
@@ -0,0 +1,56 @@
+mod common;
+
+use std::fs::OpenOptions;
+use std::os::unix::fs::FileExt;
+use std::path::Path;
+
+use futures::executor::block_on;
+use toda::hookfs::RequestContext;
+use toda::injector::{Injector, Method, MultiInjector};
+
+// write writes the data to the backing file through the injector, as the
+// write of hookfs does
+fn write(injector: &MultiInjector, backing_path: &Path, offset: u64, data: &[u8]) {
+    let mut data = data.to_vec();
+    block_on(RequestContext::default().scope(async {
+        RequestContext::set_ino(1);
+        RequestContext::set_backing_path(backing_path);
+        injector
+            .inject_write_data(Path::new("/file"), offset as i64, &mut data)
+            .unwrap();
+    }));
+    let file = OpenOptions::new().write(true).open(backing_path).unwrap();
+    file.write_all_at(&data, offset).unwrap();
+}
+
+fn fsync(injector: &MultiInjector) {
+    block_on(RequestContext::default().scope(async {
+        RequestContext::set_ino(1);
+        injector.inject(&Method::FSYNC, Path::new("/file")).await
+    }))
+    .unwrap();
+}
+
+#[test]
+fn lose_unsynced_writes() {
+    let path = std::env::temp_dir().join("toda_test_volatile_writes");
+    std::fs::write(&path, b"hello world").unwrap();
+    let injector = common::build(r#"{"type": "volatileWrites", "percent": 100}"#);
+
+    write(&injector, &path, 0, b"HELLO");
+    fsync(&injector);
+    // the writes after the fsync overwrite each other, and extend the file
+    write(&injector, &path, 6, b"WORLD");
+    write(&injector, &path, 8, b"rld and more");
+    assert_eq!(std::fs::read(&path).unwrap(), b"HELLO WOrld and more");
+
+    injector.crash().unwrap();
+    assert_eq!(std::fs::read(&path).unwrap(), b"HELLO world");
+
+    // nothing is lost by a crash after the fsync
+    write(&injector, &path, 0, b"hello");
+    fsync(&injector);
+    injector.crash().unwrap();
+    assert_eq!(std::fs::read(&path).unwrap(), b"hello world");
+    std::fs::remove_file(&path).ok();
+}
@@ -0,0 +1,59 @@
+mod common;
+
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::TcpListener;
+use std::path::Path;
+
+use futures::executor::block_on;
+use toda::injector::{Injector, Method};
+use toda::webhook;
+
+// receive reads the body of a request, and replies 200
+fn receive(listener: &TcpListener) -> serde_json::Value {
+    let (stream, _) = listener.accept().unwrap();
+    let mut reader = BufReader::new(stream.try_clone().unwrap());
+    let mut length = 0;
+    loop {
+        let mut line = String::new();
+        reader.read_line(&mut line).unwrap();
+        if line == "\r\n" {
+            break;
+        }
+        if let Some(value) = line.strip_prefix("Content-Length: ") {
+            length = value.trim().parse().unwrap();
+        }
+    }
+    let mut body = vec![0; length];
+    reader.read_exact(&mut body).unwrap();
+
+    let mut stream = stream;
+    stream
+        .write_all(b"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+        .unwrap();
+    serde_json::from_slice(&body).unwrap()
+}
+
+#[test]
+fn triggered_and_exhausted() {
+    let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+    let url = format!("http://{}/events", listener.local_addr().unwrap());
+    webhook::start(&url).unwrap();
+
+    let injector = common::build(
+        r#"{"type": "fault", "name": "eio", "percent": 100, "maxInjections": 2, "faults": [{"errno": 5, "weight": 1}]}"#,
+    );
+    for _ in 0..3 {
+        let _ = block_on(injector.inject(&Method::READ, Path::new("/file")));
+    }
+
+    // the events are sent once, in order
+    let event = receive(&listener);
+    assert_eq!(event["injector"], "eio");
+    assert_eq!(event["event"], "triggered");
+    assert_eq!(event["method"], "read");
+    assert!(event["timestamp"].is_string());
+    assert_eq!(receive(&listener)["event"], "budgetExhausted");
+    listener.set_nonblocking(true).unwrap();
+    std::thread::sleep(std::time::Duration::from_millis(100));
+    assert!(listener.accept().is_err());
+}